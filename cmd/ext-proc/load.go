@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/cainelli/ext-proc/pkg/capture"
+	"github.com/cainelli/ext-proc/pkg/loadgen"
+	"github.com/cainelli/ext-proc/pkg/service/processortest"
+	extproc "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+)
+
+// load generates load on a running ext-proc server and prints the latency percentiles of every phase.
+func load(args []string) error {
+	flags := flag.NewFlagSet("load", flag.ExitOnError)
+	addr := flags.String("addr", "127.0.0.1:9000", "address of the ext-proc gRPC server")
+	streams := flags.Int("streams", 10, "number of concurrent streams")
+	rate := flags.Float64("rate", 0, "target streams per second, 0 means as fast as possible")
+	duration := flags.Duration("duration", 10*time.Second, "duration of the run")
+	bodySize := flags.Int("body-size", 0, "size in bytes of the request and response bodies, 0 sends no body messages")
+	captureFile := flags.String("capture", "", "replay the requests of this capture instead of the built-in sequence")
+	_ = flags.Parse(args)
+
+	sequences, err := loadSequences(*captureFile, *bodySize)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	report, err := loadgen.Run(ctx, loadgen.Config{
+		Addr:      *addr,
+		Streams:   *streams,
+		Rate:      *rate,
+		Duration:  *duration,
+		Sequences: sequences,
+		Token:     os.Getenv("EXT_PROC_GRPC_TOKEN"),
+	})
+	if err != nil {
+		return err
+	}
+	report.Print(os.Stdout)
+	return nil
+}
+
+func loadSequences(captureFile string, bodySize int) ([][]*extproc.ProcessingRequest, error) {
+	if captureFile == "" {
+		return [][]*extproc.ProcessingRequest{defaultSequence(bodySize)}, nil
+	}
+	f, err := os.Open(captureFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed opening capture: %w", err)
+	}
+	defer f.Close()
+	streams, err := capture.Read(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading capture: %w", err)
+	}
+
+	var sequences [][]*extproc.ProcessingRequest
+	for _, stream := range streams {
+		var sequence []*extproc.ProcessingRequest
+		for i := range stream.Records {
+			if stream.Records[i].Direction != capture.DirectionRequest {
+				continue
+			}
+			procreq, err := stream.Records[i].Request()
+			if err != nil {
+				return nil, err
+			}
+			sequence = append(sequence, procreq)
+		}
+		sequences = append(sequences, sequence)
+	}
+	return sequences, nil
+}
+
+// defaultSequence is a typical browser request and its response.
+func defaultSequence(bodySize int) []*extproc.ProcessingRequest {
+	req := httptest.NewRequest(http.MethodGet, "http://127.0.0.1:10000/headers?show_env=1", nil)
+	req.Header.Set("user-agent", "ext-proc-load")
+	req.Header.Set("accept", "*/*")
+	req.Header.Set("cookie", "session=3b2f1c; theme=dark")
+	req.Header.Set("x-request-id", "ec55e255-f363-9706-95b6-16ba7d08df10")
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header: http.Header{
+			"Content-Type": {"application/json"},
+			"Set-Cookie":   {"session=3b2f1c; Path=/", "theme=dark; Path=/"},
+		},
+	}
+
+	body := bytes.Repeat([]byte("x"), bodySize)
+	sequence := []*extproc.ProcessingRequest{processortest.RequestHeaders(req, bodySize == 0)}
+	if bodySize > 0 {
+		sequence = append(sequence, processortest.RequestBody(body, true))
+	}
+	sequence = append(sequence, processortest.ResponseHeaders(resp, bodySize == 0))
+	if bodySize > 0 {
+		sequence = append(sequence, processortest.ResponseBody(body, true))
+	}
+	return sequence
+}
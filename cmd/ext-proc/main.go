@@ -1,48 +1,76 @@
 package main
 
 import (
-	"context"
-	"log"
+	"fmt"
 	"log/slog"
 	"net/http"
-	"os/signal"
-	"syscall"
+	"os"
+	"strings"
 
 	"github.com/cainelli/ext-proc/pkg/echo"
+	"github.com/cainelli/ext-proc/pkg/processors/rewrite"
 	setcookie "github.com/cainelli/ext-proc/pkg/processors/set-cookie"
-	"github.com/cainelli/ext-proc/pkg/server"
 	"github.com/cainelli/ext-proc/pkg/service"
 	"github.com/cainelli/ext-proc/pkg/service/processor"
 )
 
+const usage = `usage: ext-proc [command] [flags]
+
+commands:
+  serve   run the ext-proc server (default)
+  load    generate load on a running server and report the latency of every phase
+  proxy   run the processors in a local reverse proxy, without Envoy
+  replay  replay a capture through the processor chain and report the responses that differ
+`
+
 func main() {
-	extProc := &service.ExtProcessor{
+	command, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+
+	var err error
+	switch command {
+	case "serve":
+		err = serve(args)
+	case "load":
+		err = load(args)
+	case "proxy":
+		err = runProxy(args)
+	case "replay":
+		err = replay(args)
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		slog.Error("command failed", "command", command, "error", err)
+		os.Exit(1)
+	}
+}
+
+// registerEcho registers the echo handlers used as upstream in the development setup.
+func registerEcho(mux *http.ServeMux) {
+	mux.HandleFunc("/headers", echo.RequestHeadersHandler)
+	mux.HandleFunc("/response-headers", echo.ResponseHeadersHandler)
+}
+
+// newExtProcessor returns the processor chain shared by every command.
+func newExtProcessor() (*service.ExtProcessor, error) {
+	// Every request except /response-headers is sent to the echo handler showing the request headers.
+	rewriter, err := rewrite.New(rewrite.Config{
+		Rules: []rewrite.Rule{
+			{Path: "^/response-headers"},
+			{RewritePath: "/headers?show_env=1", Method: http.MethodGet},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid rewrite configuration: %w", err)
+	}
+	return &service.ExtProcessor{
 		Processors: []processor.Processor{
 			&setcookie.SetCookieProcessor{},
+			rewriter,
 		},
-	}
-	grpcSrv := server.NewExtProcServer(extProc)
-
-	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
-	defer cancel()
-	go func() {
-		<-ctx.Done()
-		log.Print("shutting down...")
-		grpcSrv.Stop()
-	}()
-
-	http.HandleFunc("/headers", echo.RequestHeadersHandler)
-	http.HandleFunc("/response-headers", echo.ResponseHeadersHandler)
-	go func() {
-		slog.Info("starting HTTP server", "port", ":8000")
-		if err := http.ListenAndServe(":8000", nil); err != nil {
-			slog.Error("could not listen http", "error", err)
-			cancel()
-		}
-	}()
-
-	if err := grpcSrv.Run(":9000"); err != nil {
-		slog.Error("could not listen grpc", "error", err)
-		cancel()
-	}
+	}, nil
 }
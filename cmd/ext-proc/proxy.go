@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/cainelli/ext-proc/pkg/mutation"
+	"github.com/cainelli/ext-proc/pkg/proxy"
+)
+
+// runProxy runs the processor chain in a reverse proxy in front of the upstream, optionally serving the echo
+// handlers as upstream, so processors can be tried with curl and without Envoy.
+func runProxy(args []string) error {
+	flags := flag.NewFlagSet("proxy", flag.ExitOnError)
+	listen := flags.String("listen", ":10000", "address the proxy listens on")
+	upstream := flags.String("upstream", "http://127.0.0.1:8000", "upstream the requests are forwarded to")
+	echoAddr := flags.String("echo", ":8000", "address to serve the echo handlers on, empty to disable")
+	maxBodySize := flags.Int("max-body-size", 8<<20, "maximum size in bytes of a body, larger bodies are rejected with 413")
+	allowAllRouting := flags.Bool("allow-all-routing", true, "allow processors to modify host, :authority, :scheme and :method, like mutation_rules.allow_all_routing")
+	allowEnvoy := flags.Bool("allow-envoy", true, "allow processors to modify x-envoy-* headers, like mutation_rules.allow_envoy")
+	_ = flags.Parse(args)
+
+	upstreamURL, err := url.Parse(*upstream)
+	if err != nil {
+		return fmt.Errorf("invalid upstream: %w", err)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	extProc, err := newExtProcessor()
+	if err != nil {
+		return err
+	}
+	extProc.MaxBodySize = *maxBodySize
+	if err := extProc.Init(ctx); err != nil {
+		return err
+	}
+
+	servers := []*http.Server{{
+		Addr: *listen,
+		Handler: proxy.New(extProc, upstreamURL, mutation.Rules{
+			AllowAllRouting: *allowAllRouting,
+			AllowEnvoy:      *allowEnvoy,
+		}),
+	}}
+	if *echoAddr != "" {
+		mux := http.NewServeMux()
+		registerEcho(mux)
+		servers = append(servers, &http.Server{Addr: *echoAddr, Handler: mux})
+	}
+	for _, srv := range servers {
+		go func() {
+			slog.Info("starting HTTP server", "port", srv.Addr)
+			if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				slog.Error("could not listen http", "error", err)
+				cancel()
+			}
+		}()
+	}
+	slog.Info("proxying", "listen", *listen, "upstream", upstreamURL.String())
+
+	<-ctx.Done()
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer shutdownCancel()
+	for _, srv := range servers {
+		_ = srv.Shutdown(shutdownCtx)
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/cainelli/ext-proc/pkg/capture"
+)
+
+// errDiffs is returned by replay when some responses differ from the capture.
+var errDiffs = errors.New("responses differ from the capture")
+
+// replay feeds a capture through the current processor chain and prints the responses that differ.
+func replay(args []string) error {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	file := flags.String("file", "capture.jsonl", "capture file written by serve -capture-file")
+	maxBodySize := flags.Int("max-body-size", 8<<20, "maximum size in bytes of a body, larger bodies are rejected with 413")
+	_ = flags.Parse(args)
+
+	f, err := os.Open(*file)
+	if err != nil {
+		return fmt.Errorf("failed opening capture: %w", err)
+	}
+	defer f.Close()
+	streams, err := capture.Read(f)
+	if err != nil {
+		return fmt.Errorf("failed reading capture: %w", err)
+	}
+
+	ctx := context.Background()
+	extProc, err := newExtProcessor()
+	if err != nil {
+		return err
+	}
+	extProc.MaxBodySize = *maxBodySize
+	if err := extProc.Init(ctx); err != nil {
+		return err
+	}
+
+	diffs := 0
+	for _, stream := range streams {
+		streamDiffs, err := capture.Replay(ctx, extProc, stream)
+		if err != nil {
+			return fmt.Errorf("failed replaying stream %s: %w", stream.ID, err)
+		}
+		for _, diff := range streamDiffs {
+			fmt.Print(diff)
+		}
+		diffs += len(streamDiffs)
+	}
+	fmt.Printf("replayed %d streams, %d responses differ\n", len(streams), diffs)
+	if diffs > 0 {
+		return errDiffs
+	}
+	return nil
+}
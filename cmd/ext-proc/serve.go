@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/cainelli/ext-proc/pkg/admin"
+	"github.com/cainelli/ext-proc/pkg/capture"
+	"github.com/cainelli/ext-proc/pkg/health"
+	"github.com/cainelli/ext-proc/pkg/server"
+	"github.com/cainelli/ext-proc/pkg/service"
+
+	"google.golang.org/grpc"
+)
+
+// serve runs the ext-proc gRPC server and the HTTP server until SIGINT or SIGTERM is received. It shuts the servers
+// down and returns the error when the processors cannot be initialized or a server cannot listen.
+func serve(args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	drainPeriod := flags.Duration("drain-period", 5*time.Second, "time to keep serving after being marked unhealthy, so Envoy stops sending new streams")
+	shutdownTimeout := flags.Duration("shutdown-timeout", 15*time.Second, "maximum time to wait for in-flight streams and requests before forcing the servers to close")
+	maxBodySize := flags.Int("max-body-size", 8<<20, "maximum size in bytes of a body, larger bodies are rejected with 413")
+	maxRecvMsgSize := flags.Int("grpc-max-recv-msg-size", server.DefaultMaxRecvMsgSize, "maximum size in bytes of a message received from Envoy, it must be larger than max-body-size")
+	maxConcurrentStreams := flags.Uint("grpc-max-concurrent-streams", 0, "maximum number of concurrent streams per connection, 0 means unlimited")
+	maxConnectionAge := flags.Duration("grpc-max-connection-age", 0, "close connections after this age so Envoy rebalances, 0 means unlimited")
+	keepaliveTime := flags.Duration("grpc-keepalive-time", time.Minute, "ping connections from Envoy after this idle time")
+	keepaliveTimeout := flags.Duration("grpc-keepalive-timeout", 20*time.Second, "close connections whose keepalive ping is not acknowledged within this time")
+	keepaliveMinTime := flags.Duration("grpc-keepalive-min-time", 10*time.Second, "minimum interval allowed between keepalive pings from Envoy")
+	maxStreams := flags.Int("grpc-max-streams", 0, "maximum number of streams served at the same time across all connections, 0 means unlimited")
+	logStreams := flags.Bool("grpc-log-streams", false, "log every gRPC stream and call once it finishes")
+	observerWorkers := flags.Int("observer-workers", 0, "number of workers running the processors on messages Envoy sends in observability mode, 0 runs them inline on the stream")
+	observerQueueSize := flags.Int("observer-queue-size", service.DefaultObserverQueueSize, "number of observability mode messages queued per worker, streams are dropped when it is full")
+	shadowProcessors := flags.String("shadow-processors", "", "comma separated names or indexes of processors to run in shadow mode, their results are only logged and counted")
+	captureFile := flags.String("capture-file", "", "append every ext_proc message received and sent to this JSONL file, it contains sensitive data such as cookies")
+	_ = flags.Parse(args)
+
+	extProc, err := newExtProcessor()
+	if err != nil {
+		return err
+	}
+	extProc.MaxBodySize = *maxBodySize
+	extProc.ObserverWorkers = *observerWorkers
+	extProc.ObserverQueueSize = *observerQueueSize
+	for _, id := range strings.FieldsFunc(*shadowProcessors, func(r rune) bool { return r == ',' }) {
+		index, ok := extProc.ProcessorIndex(strings.TrimSpace(id))
+		if !ok {
+			return fmt.Errorf("unknown processor in -shadow-processors: %q", id)
+		}
+		_ = extProc.SetProcessorShadow(index, true)
+		slog.Warn("processor runs in shadow mode", "processor", extProc.ProcessorsInfo()[index].Name, "index", index)
+	}
+	checker := health.NewChecker(extProc.Ready)
+	streamInterceptors := []grpc.StreamServerInterceptor{server.RecoveryStreamInterceptor()}
+	unaryInterceptors := []grpc.UnaryServerInterceptor{server.RecoveryUnaryInterceptor()}
+	if *logStreams {
+		streamInterceptors = append(streamInterceptors, server.LoggingStreamInterceptor())
+		unaryInterceptors = append(unaryInterceptors, server.LoggingUnaryInterceptor())
+	}
+	if token := os.Getenv("EXT_PROC_GRPC_TOKEN"); token != "" {
+		streamInterceptors = append(streamInterceptors, server.TokenAuthStreamInterceptor(token))
+	}
+	if *maxStreams > 0 {
+		streamInterceptors = append(streamInterceptors, server.ConcurrencyLimitStreamInterceptor(*maxStreams))
+	}
+	if *captureFile != "" {
+		file, err := os.OpenFile(*captureFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+		if err != nil {
+			return fmt.Errorf("failed opening capture file: %w", err)
+		}
+		defer file.Close()
+		slog.Warn("capturing ext_proc streams", "file", *captureFile)
+		streamInterceptors = append(streamInterceptors, capture.NewRecorder(file).StreamInterceptor())
+	}
+	grpcSrv := server.NewExtProcServer(extProc,
+		server.WithStreamInterceptors(streamInterceptors...),
+		server.WithUnaryInterceptors(unaryInterceptors...),
+		server.WithHealthChecker(checker),
+		server.WithMaxRecvMsgSize(*maxRecvMsgSize),
+		server.WithMaxConcurrentStreams(uint32(*maxConcurrentStreams)),
+		server.WithMaxConnectionAge(*maxConnectionAge, *shutdownTimeout),
+		server.WithKeepalive(*keepaliveTime, *keepaliveTimeout),
+		server.WithKeepaliveEnforcement(*keepaliveMinTime, true),
+	)
+
+	signalCtx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	ctx, fail := context.WithCancelCause(signalCtx)
+	defer fail(nil)
+	go func() {
+		if err := extProc.Init(ctx); err != nil {
+			fail(fmt.Errorf("could not initialize processors: %w", err))
+			return
+		}
+		checker.Refresh()
+		slog.Info("processors initialized")
+	}()
+
+	mux := http.NewServeMux()
+	registerEcho(mux)
+	mux.HandleFunc("/healthz", checker.LivenessHandler)
+	mux.HandleFunc("/readyz", checker.ReadinessHandler)
+	if token := os.Getenv("EXT_PROC_ADMIN_TOKEN"); token != "" {
+		mux.Handle("/admin/", admin.NewHandler(extProc, grpcSrv, token))
+	}
+	httpSrv := &http.Server{Addr: ":8000", Handler: mux}
+	go func() {
+		slog.Info("starting HTTP server", "port", httpSrv.Addr)
+		if err := httpSrv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fail(fmt.Errorf("could not listen http: %w", err))
+		}
+	}()
+
+	go func() {
+		if err := grpcSrv.Run(":9000"); err != nil {
+			fail(fmt.Errorf("could not listen grpc: %w", err))
+		}
+	}()
+
+	<-ctx.Done()
+	shutdown(checker, extProc, grpcSrv, httpSrv, *drainPeriod, *shutdownTimeout)
+	// The cause is context.Canceled when a signal stopped the server.
+	if err := context.Cause(ctx); !errors.Is(err, context.Canceled) {
+		return err
+	}
+	return nil
+}
+
+// shutdown marks the server as unhealthy, waits for the drain period so Envoy moves new streams elsewhere and then
+// gracefully stops the gRPC and HTTP servers, forcing them to close once the timeout is reached. The messages queued
+// for the observer workers are processed before returning, within the same timeout.
+func shutdown(checker *health.Checker, extProc *service.ExtProcessor, grpcSrv *server.ExtProcServer, httpSrv *http.Server, drainPeriod, timeout time.Duration) {
+	slog.Info("shutting down...", "drain-period", drainPeriod, "timeout", timeout, "active-streams", grpcSrv.ActiveStreams())
+	checker.Shutdown()
+	time.Sleep(drainPeriod)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		if err := grpcSrv.Shutdown(ctx); err != nil {
+			slog.Error("could not stop gRPC server gracefully", "error", err)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		if err := httpSrv.Shutdown(ctx); err != nil {
+			slog.Error("could not stop HTTP server gracefully", "error", err)
+			_ = httpSrv.Close()
+		}
+	}()
+	wg.Wait()
+	if err := extProc.Shutdown(ctx); err != nil {
+		slog.Error("could not process the queued observations", "error", err, "observer", extProc.ObserverCounters())
+	}
+	slog.Info("shutdown complete")
+}
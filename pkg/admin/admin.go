@@ -0,0 +1,154 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/cainelli/ext-proc/pkg/service"
+	"github.com/cainelli/ext-proc/pkg/service/processor"
+)
+
+// StreamCounter reports the number of streams currently served, it is implemented by server.ExtProcServer.
+type StreamCounter interface {
+	ActiveStreams() int64
+}
+
+// Handler serves the admin API used to inspect and operate the live processor chain.
+// Every endpoint requires the configured bearer token.
+//
+//	GET  /admin/processors                  lists the processors, their options and counters
+//	POST /admin/processors/{id}/enable      enables a processor
+//	POST /admin/processors/{id}/disable     disables a processor, e.g. in an emergency
+//	POST /admin/processors/{id}/shadow      runs a processor in shadow mode, its results are only logged and counted
+//	POST /admin/processors/{id}/enforce     sends the results of a processor in shadow mode to Envoy again
+//	POST /admin/processors/{id}/actions/{action}
+//	                                        runs an action of a processor, e.g. turning maintenance mode on
+//
+// The {id} is either the index of the processor in the chain or its name.
+type Handler struct {
+	extProc *service.ExtProcessor
+	streams StreamCounter
+	token   string
+	mux     *http.ServeMux
+}
+
+var _ http.Handler = &Handler{}
+
+func NewHandler(extProc *service.ExtProcessor, streams StreamCounter, token string) *Handler {
+	h := &Handler{
+		extProc: extProc,
+		streams: streams,
+		token:   token,
+		mux:     http.NewServeMux(),
+	}
+	h.mux.HandleFunc("GET /admin/processors", h.listProcessors)
+	h.mux.HandleFunc("POST /admin/processors/{id}/enable", h.toggleProcessor(true))
+	h.mux.HandleFunc("POST /admin/processors/{id}/disable", h.toggleProcessor(false))
+	h.mux.HandleFunc("POST /admin/processors/{id}/shadow", h.shadowProcessor(true))
+	h.mux.HandleFunc("POST /admin/processors/{id}/enforce", h.shadowProcessor(false))
+	h.mux.HandleFunc("POST /admin/processors/{id}/actions/{action}", h.processorAction)
+	return h
+}
+
+func (h *Handler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	if !h.authorized(request) {
+		writeJSON(writer, http.StatusUnauthorized, errorResponse{Error: "missing or invalid bearer token"})
+		return
+	}
+	h.mux.ServeHTTP(writer, request)
+}
+
+type processorsResponse struct {
+	ActiveStreams int64                     `json:"active_streams"`
+	Observer      *service.ObserverCounters `json:"observer,omitempty"`
+	Processors    []service.ProcessorInfo   `json:"processors"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func (h *Handler) listProcessors(writer http.ResponseWriter, _ *http.Request) {
+	resp := processorsResponse{
+		Processors: h.extProc.ProcessorsInfo(),
+	}
+	if h.extProc.ObserverWorkers > 0 {
+		counters := h.extProc.ObserverCounters()
+		resp.Observer = &counters
+	}
+	if h.streams != nil {
+		resp.ActiveStreams = h.streams.ActiveStreams()
+	}
+	writeJSON(writer, http.StatusOK, resp)
+}
+
+func (h *Handler) toggleProcessor(enabled bool) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		id := request.PathValue("id")
+		index, ok := h.extProc.ProcessorIndex(id)
+		if !ok {
+			writeJSON(writer, http.StatusNotFound, errorResponse{Error: "processor not found: " + id})
+			return
+		}
+		if err := h.extProc.SetProcessorEnabled(index, enabled); err != nil {
+			writeJSON(writer, http.StatusBadRequest, errorResponse{Error: err.Error()})
+			return
+		}
+		info := h.extProc.ProcessorsInfo()[index]
+		slog.Warn("processor toggled through the admin API", "processor", info.Name, "index", index, "enabled", enabled, "remote-addr", request.RemoteAddr)
+		writeJSON(writer, http.StatusOK, info)
+	}
+}
+
+func (h *Handler) shadowProcessor(shadow bool) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		id := request.PathValue("id")
+		index, ok := h.extProc.ProcessorIndex(id)
+		if !ok {
+			writeJSON(writer, http.StatusNotFound, errorResponse{Error: "processor not found: " + id})
+			return
+		}
+		if err := h.extProc.SetProcessorShadow(index, shadow); err != nil {
+			writeJSON(writer, http.StatusBadRequest, errorResponse{Error: err.Error()})
+			return
+		}
+		info := h.extProc.ProcessorsInfo()[index]
+		slog.Warn("processor shadow mode changed through the admin API", "processor", info.Name, "index", index, "shadow", shadow, "remote-addr", request.RemoteAddr)
+		writeJSON(writer, http.StatusOK, info)
+	}
+}
+
+func (h *Handler) processorAction(writer http.ResponseWriter, request *http.Request) {
+	id, action := request.PathValue("id"), request.PathValue("action")
+	index, ok := h.extProc.ProcessorIndex(id)
+	if !ok {
+		writeJSON(writer, http.StatusNotFound, errorResponse{Error: "processor not found: " + id})
+		return
+	}
+	state, err := h.extProc.ProcessorAction(request.Context(), index, action)
+	if err != nil {
+		writeJSON(writer, http.StatusBadRequest, errorResponse{Error: err.Error()})
+		return
+	}
+	slog.Warn("processor action run through the admin API", "processor", processor.Name(h.extProc.Processors[index]), "index", index, "action", action, "remote-addr", request.RemoteAddr)
+	writeJSON(writer, http.StatusOK, state)
+}
+
+func (h *Handler) authorized(request *http.Request) bool {
+	bearer, found := strings.CutPrefix(request.Header.Get("authorization"), "Bearer ")
+	return found && h.token != "" && subtle.ConstantTimeCompare([]byte(bearer), []byte(h.token)) == 1
+}
+
+func writeJSON(writer http.ResponseWriter, status int, v any) {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("content-type", "application/json")
+	writer.WriteHeader(status)
+	_, _ = writer.Write(raw)
+}
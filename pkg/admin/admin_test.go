@@ -0,0 +1,129 @@
+package admin_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cainelli/ext-proc/pkg/admin"
+	"github.com/cainelli/ext-proc/pkg/service"
+	"github.com/cainelli/ext-proc/pkg/service/processor"
+)
+
+type streamCounter int64
+
+func (c streamCounter) ActiveStreams() int64 { return int64(c) }
+
+type namedProcessor struct {
+	processor.NoOpProcessor
+	name string
+}
+
+func (p *namedProcessor) Name() string { return p.name }
+
+func newHandler() (*admin.Handler, *service.ExtProcessor) {
+	extProc := &service.ExtProcessor{Processors: []processor.Processor{
+		&namedProcessor{name: "first"},
+		&namedProcessor{name: "second"},
+	}}
+	return admin.NewHandler(extProc, streamCounter(3), "s3cr3t"), extProc
+}
+
+func serve(h http.Handler, method, target, authorization string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, nil)
+	if authorization != "" {
+		req.Header.Set("authorization", authorization)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAuthorization(t *testing.T) {
+	h, _ := newHandler()
+	tests := map[string]string{
+		"missing token": "",
+		"wrong token":   "Bearer guess",
+		"wrong scheme":  "Basic s3cr3t",
+	}
+	for name, authorization := range tests {
+		for _, target := range []string{"/admin/processors", "/admin/processors/0/disable"} {
+			method := http.MethodGet
+			if target != "/admin/processors" {
+				method = http.MethodPost
+			}
+			if rec := serve(h, method, target, authorization); rec.Code != http.StatusUnauthorized {
+				t.Errorf("%s: %s %s = %d, want 401", name, method, target, rec.Code)
+			}
+		}
+	}
+
+	// An empty token disables the API instead of accepting an empty bearer.
+	empty := admin.NewHandler(&service.ExtProcessor{}, nil, "")
+	if rec := serve(empty, http.MethodGet, "/admin/processors", "Bearer "); rec.Code != http.StatusUnauthorized {
+		t.Errorf("empty token: status = %d, want 401", rec.Code)
+	}
+}
+
+func TestProcessors(t *testing.T) {
+	h, extProc := newHandler()
+	const authorization = "Bearer s3cr3t"
+
+	rec := serve(h, http.MethodGet, "/admin/processors", authorization)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", rec.Code)
+	}
+	var list struct {
+		ActiveStreams int64                   `json:"active_streams"`
+		Processors    []service.ProcessorInfo `json:"processors"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	if list.ActiveStreams != 3 || len(list.Processors) != 2 || list.Processors[1].Name != "second" {
+		t.Errorf("processors = %+v", list)
+	}
+
+	tests := []struct {
+		target      string
+		wantStatus  int
+		wantEnabled bool
+		wantShadow  bool
+	}{
+		{"/admin/processors/second/disable", http.StatusOK, false, false},
+		{"/admin/processors/1/enable", http.StatusOK, true, false},
+		{"/admin/processors/second/shadow", http.StatusOK, true, true},
+		{"/admin/processors/1/enforce", http.StatusOK, true, false},
+		{"/admin/processors/third/disable", http.StatusNotFound, true, false},
+		{"/admin/processors/5/shadow", http.StatusNotFound, true, false},
+	}
+	for _, test := range tests {
+		rec := serve(h, http.MethodPost, test.target, authorization)
+		if rec.Code != test.wantStatus {
+			t.Errorf("POST %s = %d, want %d", test.target, rec.Code, test.wantStatus)
+			continue
+		}
+		info := extProc.ProcessorsInfo()[1]
+		if info.Enabled != test.wantEnabled || info.Shadow != test.wantShadow {
+			t.Errorf("after POST %s: enabled = %v, shadow = %v, want %v, %v", test.target, info.Enabled, info.Shadow, test.wantEnabled, test.wantShadow)
+		}
+		if test.wantStatus != http.StatusOK {
+			continue
+		}
+		var got service.ProcessorInfo
+		if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+			t.Fatal(err)
+		}
+		if got.Name != "second" || got.Enabled != test.wantEnabled || got.Shadow != test.wantShadow {
+			t.Errorf("POST %s returned %+v", test.target, got)
+		}
+	}
+	if info := extProc.ProcessorsInfo()[0]; !info.Enabled || info.Shadow {
+		t.Errorf("first processor changed: %+v", info)
+	}
+
+	if rec := serve(h, http.MethodPost, "/admin/processors/0/actions/reboot", authorization); rec.Code != http.StatusBadRequest {
+		t.Errorf("action on a processor without actions = %d, want 400", rec.Code)
+	}
+}
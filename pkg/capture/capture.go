@@ -0,0 +1,179 @@
+// Package capture records ext_proc streams as JSON lines and replays them through a processor chain.
+//
+// Every line is a Record holding one ProcessingRequest received from Envoy or one ProcessingResponse sent back,
+// encoded with protojson. Records of concurrent streams are interleaved and grouped back by their stream ID.
+package capture
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	extproc "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// Direction tells whether a record was received from or sent to Envoy.
+type Direction string
+
+const (
+	DirectionRequest  Direction = "request"
+	DirectionResponse Direction = "response"
+)
+
+// processMethod is the full gRPC method name of the ext_proc stream, other streams are not recorded.
+const processMethod = "/envoy.service.ext_proc.v3.ExternalProcessor/Process"
+
+// Record is a single line of a capture.
+type Record struct {
+	Stream    string          `json:"stream"`
+	Seq       int             `json:"seq"`
+	Time      time.Time       `json:"time"`
+	Direction Direction       `json:"direction"`
+	Message   json.RawMessage `json:"message"`
+}
+
+// Request decodes the message of a request record.
+func (r *Record) Request() (*extproc.ProcessingRequest, error) {
+	msg := &extproc.ProcessingRequest{}
+	if err := protojson.Unmarshal(r.Message, msg); err != nil {
+		return nil, fmt.Errorf("failed decoding request %s/%d: %w", r.Stream, r.Seq, err)
+	}
+	return msg, nil
+}
+
+// Response decodes the message of a response record.
+func (r *Record) Response() (*extproc.ProcessingResponse, error) {
+	msg := &extproc.ProcessingResponse{}
+	if err := protojson.Unmarshal(r.Message, msg); err != nil {
+		return nil, fmt.Errorf("failed decoding response %s/%d: %w", r.Stream, r.Seq, err)
+	}
+	return msg, nil
+}
+
+// Recorder writes the records of every ext_proc stream to a writer. It is safe for concurrent use.
+type Recorder struct {
+	mu      sync.Mutex
+	writer  io.Writer
+	streams atomic.Uint64
+	prefix  string
+}
+
+func NewRecorder(writer io.Writer) *Recorder {
+	return &Recorder{
+		writer: writer,
+		// The prefix keeps stream IDs unique when several runs append to the same file.
+		prefix: strconv.FormatInt(time.Now().UnixNano(), 36),
+	}
+}
+
+// StreamInterceptor records the messages of the ext_proc streams going through the server.
+func (rec *Recorder) StreamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if info.FullMethod != processMethod {
+			return handler(srv, ss)
+		}
+		return handler(srv, &recordingStream{
+			ServerStream: ss,
+			recorder:     rec,
+			id:           fmt.Sprintf("%s-%d", rec.prefix, rec.streams.Add(1)),
+		})
+	}
+}
+
+func (rec *Recorder) write(record Record) error {
+	raw, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	_, err = rec.writer.Write(append(raw, '\n'))
+	return err
+}
+
+// recordingStream wraps the server stream to record every message received and sent.
+type recordingStream struct {
+	grpc.ServerStream
+	recorder *Recorder
+	id       string
+	seq      atomic.Int64
+}
+
+func (s *recordingStream) RecvMsg(m any) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	s.record(DirectionRequest, m)
+	return nil
+}
+
+func (s *recordingStream) SendMsg(m any) error {
+	if err := s.ServerStream.SendMsg(m); err != nil {
+		return err
+	}
+	s.record(DirectionResponse, m)
+	return nil
+}
+
+// record writes the message, failures are not propagated so capturing never breaks the traffic.
+func (s *recordingStream) record(direction Direction, m any) {
+	msg, ok := m.(proto.Message)
+	if !ok {
+		return
+	}
+	raw, err := protojson.Marshal(msg)
+	if err != nil {
+		return
+	}
+	_ = s.recorder.write(Record{
+		Stream:    s.id,
+		Seq:       int(s.seq.Add(1) - 1),
+		Time:      time.Now(),
+		Direction: direction,
+		Message:   raw,
+	})
+}
+
+// Stream holds the records of a single ext_proc stream in order.
+type Stream struct {
+	ID      string
+	Records []Record
+}
+
+// Read reads a capture and groups the records by stream, in the order the streams started.
+func Read(reader io.Reader) ([]*Stream, error) {
+	var streams []*Stream
+	byID := make(map[string]*Stream)
+
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var record Record
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		stream, ok := byID[record.Stream]
+		if !ok {
+			stream = &Stream{ID: record.Stream}
+			byID[record.Stream] = stream
+			streams = append(streams, stream)
+		}
+		stream.Records = append(stream.Records, record)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return streams, nil
+}
@@ -0,0 +1,150 @@
+package capture_test
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cainelli/ext-proc/pkg/capture"
+	"github.com/cainelli/ext-proc/pkg/service"
+	"github.com/cainelli/ext-proc/pkg/service/processor"
+	"github.com/cainelli/ext-proc/pkg/service/processortest"
+	extproc "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+	"google.golang.org/grpc"
+)
+
+// versionProcessor tags the requests with its version.
+type versionProcessor struct {
+	processor.NoOpProcessor
+	version string
+}
+
+func (p *versionProcessor) RequestHeaders(ctx context.Context, crw *processor.CommonResponseWriter, req *processor.RequestContext) (*extproc.ProcessingResponse_ImmediateResponse, error) {
+	crw.HeaderSet("x-version", p.version)
+	return nil, nil
+}
+
+func chain(version string) *service.ExtProcessor {
+	return &service.ExtProcessor{Processors: []processor.Processor{&versionProcessor{version: version}}}
+}
+
+// interceptedServer runs the server behind a stream interceptor, like the gRPC server does.
+type interceptedServer struct {
+	extproc.UnimplementedExternalProcessorServer
+	srv         extproc.ExternalProcessorServer
+	interceptor grpc.StreamServerInterceptor
+}
+
+func (s *interceptedServer) Process(stream extproc.ExternalProcessor_ProcessServer) error {
+	info := &grpc.StreamServerInfo{FullMethod: "/envoy.service.ext_proc.v3.ExternalProcessor/Process", IsClientStream: true, IsServerStream: true}
+	return s.interceptor(s.srv, stream, info, func(srv any, ss grpc.ServerStream) error {
+		return srv.(extproc.ExternalProcessorServer).Process(&processStream{ss})
+	})
+}
+
+// processStream adapts a grpc.ServerStream to the ext_proc stream, like the generated code.
+type processStream struct {
+	grpc.ServerStream
+}
+
+func (s *processStream) Send(resp *extproc.ProcessingResponse) error {
+	return s.ServerStream.SendMsg(resp)
+}
+
+func (s *processStream) Recv() (*extproc.ProcessingRequest, error) {
+	req := &extproc.ProcessingRequest{}
+	if err := s.ServerStream.RecvMsg(req); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var buf bytes.Buffer
+	recorder := capture.NewRecorder(&buf)
+	srv := &interceptedServer{srv: chain("v1"), interceptor: recorder.StreamInterceptor()}
+	for _, target := range []string{"http://www.example.com/a", "http://www.example.com/b"} {
+		if _, err := processortest.Run(ctx, srv, httptest.NewRequest(http.MethodGet, target, nil), nil); err != nil {
+			t.Fatalf("Run() = %v", err)
+		}
+	}
+
+	streams, err := capture.Read(&buf)
+	if err != nil {
+		t.Fatalf("Read() = %v", err)
+	}
+	if len(streams) != 2 {
+		t.Fatalf("read %d streams, want 2", len(streams))
+	}
+	for _, stream := range streams {
+		if len(stream.Records) != 2 || stream.Records[0].Direction != capture.DirectionRequest || stream.Records[1].Direction != capture.DirectionResponse {
+			t.Fatalf("stream %s records = %+v, want a request and its response", stream.ID, stream.Records)
+		}
+	}
+
+	diffs, err := capture.Replay(ctx, chain("v1"), streams[0])
+	if err != nil {
+		t.Fatalf("Replay() = %v", err)
+	}
+	if len(diffs) != 0 {
+		t.Errorf("replay through the same chain differs: %v", diffs)
+	}
+
+	diffs, err = capture.Replay(ctx, chain("v2"), streams[1])
+	if err != nil {
+		t.Fatalf("Replay() = %v", err)
+	}
+	if len(diffs) != 1 {
+		t.Fatalf("got %d diffs, want 1", len(diffs))
+	}
+	diff := diffs[0]
+	if diff.Stream != streams[1].ID || diff.Request.GetRequestHeaders() == nil {
+		t.Errorf("diff of stream %s for %v", diff.Stream, diff.Request)
+	}
+	version := func(resp *extproc.ProcessingResponse) string {
+		return string(resp.GetRequestHeaders().GetResponse().GetHeaderMutation().GetSetHeaders()[0].GetHeader().GetRawValue())
+	}
+	if expected, actual := version(diff.Expected), version(diff.Actual); expected != "v1" || actual != "v2" {
+		t.Errorf("diff versions = %s, %s, want v1, v2", expected, actual)
+	}
+	lines := strings.Split(diff.String(), "\n")
+	if len(lines) != 4 || lines[0] != "stream "+diff.Stream+": response to RequestHeaders differs" ||
+		!strings.HasPrefix(lines[1], "- {") || !strings.HasPrefix(lines[2], "+ {") || lines[3] != "" {
+		t.Errorf("String() = %q", diff.String())
+	}
+}
+
+func TestReplayMissingResponse(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// A stream recorded without the response, e.g. because the server failed.
+	var buf bytes.Buffer
+	recorder := capture.NewRecorder(&buf)
+	srv := &interceptedServer{srv: chain("v1"), interceptor: recorder.StreamInterceptor()}
+	if _, err := processortest.Run(ctx, srv, httptest.NewRequest(http.MethodGet, "http://www.example.com/", nil), nil); err != nil {
+		t.Fatalf("Run() = %v", err)
+	}
+	streams, err := capture.Read(strings.NewReader(strings.SplitAfter(buf.String(), "\n")[0]))
+	if err != nil {
+		t.Fatalf("Read() = %v", err)
+	}
+
+	diffs, err := capture.Replay(ctx, chain("v1"), streams[0])
+	if err != nil {
+		t.Fatalf("Replay() = %v", err)
+	}
+	if len(diffs) != 1 || diffs[0].Expected != nil || diffs[0].Actual == nil {
+		t.Fatalf("diffs = %v, want the unexpected response", diffs)
+	}
+	if !strings.Contains(diffs[0].String(), "- <none>\n") {
+		t.Errorf("String() = %q, want the missing response", diffs[0].String())
+	}
+}
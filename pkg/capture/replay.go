@@ -0,0 +1,123 @@
+package capture
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/cainelli/ext-proc/pkg/proxy"
+	extproc "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// Diff is a response of the replay which differs from the recorded one.
+type Diff struct {
+	Stream  string
+	Request *extproc.ProcessingRequest
+	// Expected is the recorded response, nil when none was recorded.
+	Expected *extproc.ProcessingResponse
+	// Actual is the response sent by the server during the replay, nil when none was sent.
+	Actual *extproc.ProcessingResponse
+}
+
+func (d Diff) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "stream %s: response to %s differs\n", d.Stream, messageName(d.Request))
+	fmt.Fprintf(&b, "- %s\n", marshal(d.Expected))
+	fmt.Fprintf(&b, "+ %s\n", marshal(d.Actual))
+	return b.String()
+}
+
+// exchange is a request of a stream and the responses recorded for it.
+type exchange struct {
+	request  *extproc.ProcessingRequest
+	expected []*extproc.ProcessingResponse
+}
+
+// Replay feeds the recorded requests of the stream to srv, in order, and compares every response with the recorded
+// one. Requests in async mode are not expected to get a response. It returns the responses that differ.
+func Replay(ctx context.Context, srv extproc.ExternalProcessorServer, stream *Stream) ([]Diff, error) {
+	exchanges, err := exchanges(stream)
+	if err != nil {
+		return nil, err
+	}
+
+	sess := proxy.NewSession(ctx, srv)
+	defer sess.Close()
+
+	var diffs []Diff
+	for _, ex := range exchanges {
+		var actual *extproc.ProcessingResponse
+		if err := sess.Send(ex.request); err != nil && !errors.Is(err, proxy.ErrStreamClosed) {
+			return nil, err
+		}
+		if !ex.request.GetAsyncMode() {
+			actual, err = sess.Recv()
+			if err != nil && !errors.Is(err, io.EOF) {
+				actual = nil
+			}
+		}
+
+		var expected *extproc.ProcessingResponse
+		if len(ex.expected) > 0 {
+			expected = ex.expected[0]
+		}
+		if !proto.Equal(expected, actual) {
+			diffs = append(diffs, Diff{Stream: stream.ID, Request: ex.request, Expected: expected, Actual: actual})
+		}
+		for _, extra := range ex.expected[min(1, len(ex.expected)):] {
+			diffs = append(diffs, Diff{Stream: stream.ID, Request: ex.request, Expected: extra})
+		}
+	}
+	return diffs, nil
+}
+
+func exchanges(stream *Stream) ([]*exchange, error) {
+	var exchanges []*exchange
+	for i := range stream.Records {
+		record := &stream.Records[i]
+		switch record.Direction {
+		case DirectionRequest:
+			req, err := record.Request()
+			if err != nil {
+				return nil, err
+			}
+			exchanges = append(exchanges, &exchange{request: req})
+		case DirectionResponse:
+			resp, err := record.Response()
+			if err != nil {
+				return nil, err
+			}
+			if len(exchanges) == 0 {
+				return nil, fmt.Errorf("stream %s: response %d recorded before any request", stream.ID, record.Seq)
+			}
+			last := exchanges[len(exchanges)-1]
+			last.expected = append(last.expected, resp)
+		default:
+			return nil, fmt.Errorf("stream %s: unknown direction %q in record %d", stream.ID, record.Direction, record.Seq)
+		}
+	}
+	return exchanges, nil
+}
+
+func messageName(req *extproc.ProcessingRequest) string {
+	if req == nil || req.Request == nil {
+		return "unknown message"
+	}
+	return strings.TrimPrefix(fmt.Sprintf("%T", req.Request), "*ext_procv3.ProcessingRequest_")
+}
+
+func marshal(msg proto.Message) string {
+	if msg == nil || !msg.ProtoReflect().IsValid() {
+		return "<none>"
+	}
+	raw, err := protojson.Marshal(msg)
+	if err != nil {
+		return err.Error()
+	}
+	return string(raw)
+}
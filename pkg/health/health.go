@@ -0,0 +1,80 @@
+package health
+
+import (
+	"net/http"
+	"sync/atomic"
+
+	"google.golang.org/grpc"
+	grpchealth "google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// ExtProcServiceName is the service name reported in the gRPC health service for the ExternalProcessor.
+// Envoy can use it in the grpc_health_check of the ext-proc cluster.
+const ExtProcServiceName = "envoy.service.ext_proc.v3.ExternalProcessor"
+
+// Checker tracks the health of the ext-proc server and exposes it through the standard grpc.health.v1 service
+// and through the HTTP /healthz and /readyz endpoints.
+// Liveness only reports whether the process is up, readiness reflects whether the processors are initialized
+// and flips to not ready as soon as a graceful shutdown starts so Envoy drains the server first.
+type Checker struct {
+	grpcHealth   *grpchealth.Server
+	ready        func() bool
+	shuttingDown atomic.Bool
+}
+
+// NewChecker returns a Checker which uses the given function to know whether the processors are ready.
+// The gRPC health status starts as NOT_SERVING until Refresh is called and ready returns true.
+func NewChecker(ready func() bool) *Checker {
+	c := &Checker{
+		grpcHealth: grpchealth.NewServer(),
+		ready:      ready,
+	}
+	c.Refresh()
+	return c
+}
+
+// Register registers the grpc.health.v1 service on the given gRPC server.
+func (c *Checker) Register(srv *grpc.Server) {
+	healthpb.RegisterHealthServer(srv, c.grpcHealth)
+}
+
+// Ready reports whether the server is ready to receive traffic.
+func (c *Checker) Ready() bool {
+	return !c.shuttingDown.Load() && c.ready()
+}
+
+// Refresh updates the gRPC serving status according to the current readiness.
+// It should be called whenever the readiness of the processors changes.
+func (c *Checker) Refresh() {
+	status := healthpb.HealthCheckResponse_NOT_SERVING
+	if c.Ready() {
+		status = healthpb.HealthCheckResponse_SERVING
+	}
+	c.grpcHealth.SetServingStatus("", status)
+	c.grpcHealth.SetServingStatus(ExtProcServiceName, status)
+}
+
+// Shutdown marks the server as not ready. It is irreversible and should be called when a graceful shutdown starts.
+func (c *Checker) Shutdown() {
+	c.shuttingDown.Store(true)
+	c.grpcHealth.Shutdown()
+}
+
+// LivenessHandler answers the /healthz endpoint. It returns 200 as long as the process is able to serve HTTP.
+func (c *Checker) LivenessHandler(writer http.ResponseWriter, _ *http.Request) {
+	writer.Header().Set("content-type", "text/plain")
+	_, _ = writer.Write([]byte("ok\n"))
+}
+
+// ReadinessHandler answers the /readyz endpoint. It returns 200 once the processors are initialized and 503 before that
+// or during shutdown.
+func (c *Checker) ReadinessHandler(writer http.ResponseWriter, _ *http.Request) {
+	writer.Header().Set("content-type", "text/plain")
+	if !c.Ready() {
+		writer.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = writer.Write([]byte("not ready\n"))
+		return
+	}
+	_, _ = writer.Write([]byte("ok\n"))
+}
@@ -0,0 +1,57 @@
+package health
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// check asserts the readiness endpoint and the gRPC status of both services.
+func check(t *testing.T, c *Checker, wantCode int, wantStatus healthpb.HealthCheckResponse_ServingStatus) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	c.ReadinessHandler(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rec.Code != wantCode {
+		t.Errorf("/readyz = %d, want %d", rec.Code, wantCode)
+	}
+	for _, service := range []string{"", ExtProcServiceName} {
+		resp, err := c.grpcHealth.Check(context.Background(), &healthpb.HealthCheckRequest{Service: service})
+		if err != nil {
+			t.Fatalf("Check(%q) = %v", service, err)
+		}
+		if resp.GetStatus() != wantStatus {
+			t.Errorf("Check(%q) = %v, want %v", service, resp.GetStatus(), wantStatus)
+		}
+	}
+}
+
+func TestChecker(t *testing.T) {
+	var ready atomic.Bool
+	c := NewChecker(ready.Load)
+	check(t, c, http.StatusServiceUnavailable, healthpb.HealthCheckResponse_NOT_SERVING)
+
+	// The gRPC status only changes on Refresh.
+	ready.Store(true)
+	check(t, c, http.StatusOK, healthpb.HealthCheckResponse_NOT_SERVING)
+	c.Refresh()
+	check(t, c, http.StatusOK, healthpb.HealthCheckResponse_SERVING)
+
+	c.Shutdown()
+	check(t, c, http.StatusServiceUnavailable, healthpb.HealthCheckResponse_NOT_SERVING)
+	c.Refresh()
+	check(t, c, http.StatusServiceUnavailable, healthpb.HealthCheckResponse_NOT_SERVING)
+}
+
+func TestLiveness(t *testing.T) {
+	c := NewChecker(func() bool { return false })
+	c.Shutdown()
+	rec := httptest.NewRecorder()
+	c.LivenessHandler(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("/healthz = %d, want 200 while the process is up", rec.Code)
+	}
+}
@@ -0,0 +1,243 @@
+// Package loadgen generates load on a running ext_proc server the way Envoy would, with one bidirectional stream
+// per HTTP request, and measures the latency of every phase.
+package loadgen
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	extproc "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Config configures a load run.
+type Config struct {
+	// Addr is the address of the ext_proc gRPC server.
+	Addr string
+	// Streams is the number of streams open at the same time, at least one.
+	Streams int
+	// Rate is the target number of streams per second across all workers, zero means as fast as possible.
+	Rate float64
+	// Duration of the run.
+	Duration time.Duration
+	// Sequences are the messages sent on each stream, the workers go through them in a round robin.
+	Sequences [][]*extproc.ProcessingRequest
+	// Token is sent as bearer token in the authorization metadata when set.
+	Token string
+}
+
+// Run opens the streams and replays the sequences until the duration elapses or ctx is done.
+func Run(ctx context.Context, cfg Config) (*Report, error) {
+	if len(cfg.Sequences) == 0 {
+		return nil, errors.New("no sequences to send")
+	}
+	if cfg.Streams <= 0 {
+		return nil, fmt.Errorf("invalid number of streams %d, at least one is required", cfg.Streams)
+	}
+	conn, err := grpc.Dial(cfg.Addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, fmt.Errorf("failed dialing %s: %w", cfg.Addr, err)
+	}
+	defer conn.Close()
+	client := extproc.NewExternalProcessorClient(conn)
+
+	ctx, cancel := context.WithTimeout(ctx, cfg.Duration)
+	defer cancel()
+	if cfg.Token != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+cfg.Token)
+	}
+
+	report := newReport()
+	tokens := pace(ctx, cfg.Rate)
+	var wg sync.WaitGroup
+	for worker := range cfg.Streams {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := worker; ; i += cfg.Streams {
+				select {
+				case <-ctx.Done():
+					return
+				case _, ok := <-tokens:
+					if !ok {
+						return
+					}
+				}
+				report.record(runStream(ctx, client, cfg.Sequences[i%len(cfg.Sequences)]))
+			}
+		}()
+	}
+	wg.Wait()
+	report.Duration = time.Since(report.start)
+	return report, nil
+}
+
+// pace returns a channel delivering rate tokens per second, or an unlimited amount when rate is zero.
+func pace(ctx context.Context, rate float64) <-chan struct{} {
+	tokens := make(chan struct{})
+	go func() {
+		defer close(tokens)
+		var ticker *time.Ticker
+		if rate > 0 {
+			ticker = time.NewTicker(time.Duration(float64(time.Second) / rate))
+			defer ticker.Stop()
+		}
+		for {
+			if ticker != nil {
+				select {
+				case <-ticker.C:
+				case <-ctx.Done():
+					return
+				}
+			}
+			select {
+			case tokens <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return tokens
+}
+
+// streamResult is the outcome of a single stream.
+type streamResult struct {
+	phases []phaseLatency
+	total  time.Duration
+	err    error
+}
+
+type phaseLatency struct {
+	phase   string
+	latency time.Duration
+}
+
+func runStream(ctx context.Context, client extproc.ExternalProcessorClient, sequence []*extproc.ProcessingRequest) streamResult {
+	start := time.Now()
+	result := streamResult{}
+	stream, err := client.Process(ctx)
+	if err != nil {
+		result.err = err
+		return result
+	}
+	defer func() { _ = stream.CloseSend() }()
+
+	for _, procreq := range sequence {
+		sent := time.Now()
+		if err := stream.Send(procreq); err != nil {
+			result.err = err
+			return result
+		}
+		if procreq.GetAsyncMode() {
+			continue
+		}
+		procresp, err := stream.Recv()
+		if err != nil {
+			result.err = err
+			return result
+		}
+		result.phases = append(result.phases, phaseLatency{phase: phaseName(procreq), latency: time.Since(sent)})
+		if procresp.GetImmediateResponse() != nil {
+			break
+		}
+	}
+	result.total = time.Since(start)
+	return result
+}
+
+func phaseName(procreq *extproc.ProcessingRequest) string {
+	return strings.TrimPrefix(fmt.Sprintf("%T", procreq.GetRequest()), "*ext_procv3.ProcessingRequest_")
+}
+
+// Report holds the latencies measured during a run.
+type Report struct {
+	Streams  int
+	Errors   int
+	Duration time.Duration
+
+	mu        sync.Mutex
+	start     time.Time
+	phases    map[string][]time.Duration
+	order     []string
+	lastError error
+}
+
+func newReport() *Report {
+	return &Report{
+		start:  time.Now(),
+		phases: make(map[string][]time.Duration),
+	}
+}
+
+func (r *Report) record(result streamResult) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if result.err != nil {
+		// Streams cut by the end of the run are not errors.
+		if !endOfRun(result.err) {
+			r.Errors++
+			r.lastError = result.err
+		}
+		return
+	}
+	r.Streams++
+	for _, p := range result.phases {
+		r.add(p.phase, p.latency)
+	}
+	r.add("Stream", result.total)
+}
+
+// endOfRun reports whether the error comes from the end of the run cancelling the in-flight streams.
+func endOfRun(err error) bool {
+	switch status.Code(err) {
+	case codes.DeadlineExceeded, codes.Canceled:
+		return true
+	}
+	return errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) || errors.Is(err, io.EOF)
+}
+
+func (r *Report) add(phase string, latency time.Duration) {
+	if _, ok := r.phases[phase]; !ok {
+		r.order = append(r.order, phase)
+	}
+	r.phases[phase] = append(r.phases[phase], latency)
+}
+
+// Percentile returns the latency percentile (0-100) of the phase.
+func (r *Report) Percentile(phase string, percentile float64) time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	latencies := slices.Clone(r.phases[phase])
+	if len(latencies) == 0 {
+		return 0
+	}
+	slices.Sort(latencies)
+	index := int(float64(len(latencies)-1) * percentile / 100)
+	return latencies[index]
+}
+
+// Print writes the summary of the run.
+func (r *Report) Print(w io.Writer) {
+	rate := float64(r.Streams) / r.Duration.Seconds()
+	fmt.Fprintf(w, "streams: %d, errors: %d, duration: %s, rate: %.1f/s\n", r.Streams, r.Errors, r.Duration.Round(time.Millisecond), rate)
+	if r.lastError != nil {
+		fmt.Fprintf(w, "last error: %v\n", r.lastError)
+	}
+	fmt.Fprintf(w, "%-18s %8s %10s %10s %10s %10s\n", "phase", "count", "p50", "p90", "p99", "max")
+	for _, phase := range r.order {
+		fmt.Fprintf(w, "%-18s %8d %10s %10s %10s %10s\n", phase, len(r.phases[phase]),
+			r.Percentile(phase, 50).Round(time.Microsecond), r.Percentile(phase, 90).Round(time.Microsecond),
+			r.Percentile(phase, 99).Round(time.Microsecond), r.Percentile(phase, 100).Round(time.Microsecond))
+	}
+}
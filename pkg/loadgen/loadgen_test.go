@@ -0,0 +1,141 @@
+package loadgen
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cainelli/ext-proc/pkg/service/processor"
+	"github.com/cainelli/ext-proc/pkg/service/processortest"
+	extproc "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"google.golang.org/grpc"
+)
+
+// gateProcessor answers the requests to /blocked, holds the requests to /slow until their stream ends and fails the
+// requests to /fail.
+type gateProcessor struct {
+	processor.NoOpProcessor
+}
+
+func (p *gateProcessor) RequestHeaders(ctx context.Context, crw *processor.CommonResponseWriter, req *processor.RequestContext) (*extproc.ProcessingResponse_ImmediateResponse, error) {
+	switch req.URL().Path {
+	case "/blocked":
+		return &extproc.ProcessingResponse_ImmediateResponse{
+			ImmediateResponse: &extproc.ImmediateResponse{Status: &typev3.HttpStatus{Code: typev3.StatusCode_Forbidden}},
+		}, nil
+	case "/slow":
+		<-ctx.Done()
+	case "/fail":
+		return nil, errors.New("failure")
+	}
+	return nil, nil
+}
+
+// serve serves the processor on a local port and returns its address.
+func serve(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := grpc.NewServer()
+	extproc.RegisterExternalProcessorServer(srv, processortest.Chain(&gateProcessor{}))
+	go func() { _ = srv.Serve(listener) }()
+	t.Cleanup(srv.Stop)
+	return listener.Addr().String()
+}
+
+// sequence returns the messages of a request to path and its response.
+func sequence(path string) []*extproc.ProcessingRequest {
+	return []*extproc.ProcessingRequest{
+		processortest.RequestHeaders(httptest.NewRequest(http.MethodGet, "http://www.example.com"+path, nil), true),
+		processortest.ResponseHeaders(&http.Response{StatusCode: http.StatusOK, Header: http.Header{}}, true),
+	}
+}
+
+func TestRun(t *testing.T) {
+	report, err := Run(context.Background(), Config{
+		Addr:     serve(t),
+		Streams:  1,
+		Duration: 200 * time.Millisecond,
+		// A single worker alternates between both sequences.
+		Sequences: [][]*extproc.ProcessingRequest{sequence("/"), sequence("/blocked")},
+	})
+	if err != nil {
+		t.Fatalf("Run() = %v", err)
+	}
+	if report.Errors != 0 || report.Streams < 2 {
+		t.Fatalf("report = %d streams, %d errors, want several streams without errors", report.Streams, report.Errors)
+	}
+	requests, responses := len(report.phases["RequestHeaders"]), len(report.phases["ResponseHeaders"])
+	if requests != report.Streams || len(report.phases["Stream"]) != report.Streams {
+		t.Errorf("got %d request phases for %d streams", requests, report.Streams)
+	}
+	// The immediate responses end the blocked streams before their response phase.
+	if want := (report.Streams + 1) / 2; responses != want {
+		t.Errorf("got %d response phases, want %d", responses, want)
+	}
+	for _, phase := range []string{"RequestHeaders", "ResponseHeaders", "Stream"} {
+		if p50, max := report.Percentile(phase, 50), report.Percentile(phase, 100); p50 <= 0 || p50 > max {
+			t.Errorf("%s p50 = %s, max = %s", phase, p50, max)
+		}
+	}
+
+	var out bytes.Buffer
+	report.Print(&out)
+	if !strings.Contains(out.String(), "errors: 0") || !strings.Contains(out.String(), "ResponseHeaders") {
+		t.Errorf("Print() = %q", out.String())
+	}
+}
+
+func TestRunErrors(t *testing.T) {
+	addr := serve(t)
+	config := Config{Addr: addr, Streams: 2, Duration: 100 * time.Millisecond}
+
+	// The streams cut by the end of the run are not errors.
+	config.Sequences = [][]*extproc.ProcessingRequest{sequence("/slow")}
+	report, err := Run(context.Background(), config)
+	if err != nil {
+		t.Fatalf("Run() = %v", err)
+	}
+	if report.Errors != 0 || report.Streams != 0 {
+		t.Errorf("report = %d streams, %d errors, want none", report.Streams, report.Errors)
+	}
+
+	config.Sequences = [][]*extproc.ProcessingRequest{sequence("/fail")}
+	report, err = Run(context.Background(), config)
+	if err != nil {
+		t.Fatalf("Run() = %v", err)
+	}
+	if report.Errors == 0 || report.lastError == nil {
+		t.Errorf("report = %d errors, want the failed streams counted", report.Errors)
+	}
+
+	config.Streams = 0
+	if _, err := Run(context.Background(), config); err == nil {
+		t.Errorf("Run() without streams succeeded")
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	r := newReport()
+	for i := range 100 {
+		r.add("RequestHeaders", time.Duration(100-i)*time.Millisecond)
+	}
+	tests := map[float64]time.Duration{0: time.Millisecond, 50: 50 * time.Millisecond, 99: 99 * time.Millisecond, 100: 100 * time.Millisecond}
+	for percentile, want := range tests {
+		if got := r.Percentile("RequestHeaders", percentile); got != want {
+			t.Errorf("Percentile(%v) = %s, want %s", percentile, got, want)
+		}
+	}
+	if got := r.Percentile("ResponseHeaders", 50); got != 0 {
+		t.Errorf("Percentile() of a phase without latencies = %s, want 0", got)
+	}
+}
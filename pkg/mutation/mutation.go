@@ -0,0 +1,275 @@
+// Package mutation applies the mutations of ext_proc responses to net/http values with the same semantics as Envoy.
+// It is used to verify the end result of processors in tests and to run processors without Envoy.
+package mutation
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	extproc "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+)
+
+// ValueMode selects which field of a header mutation holds the value.
+// In Envoy it depends on the envoy.reloadable_features.send_header_raw_value runtime guard.
+type ValueMode int
+
+const (
+	// ValueModeAuto reads raw_value when it is set and value otherwise.
+	ValueModeAuto ValueMode = iota
+	// ValueModeRaw only reads raw_value, as Envoy does when send_header_raw_value is enabled.
+	ValueModeRaw
+	// ValueModeString only reads value, as Envoy does when send_header_raw_value is disabled.
+	ValueModeString
+)
+
+// Mutator applies ext_proc mutations to net/http values. The zero value applies Envoy's default rules.
+type Mutator struct {
+	Rules     Rules
+	ValueMode ValueMode
+}
+
+// RequestHeaders applies the response to a request headers message. The body mutation and trailers are only
+// applied when the status is CONTINUE_AND_REPLACE.
+func (m *Mutator) RequestHeaders(req *http.Request, common *extproc.CommonResponse) error {
+	if err := m.request(req, common.GetHeaderMutation()); err != nil {
+		return err
+	}
+	if common.GetStatus() != extproc.CommonResponse_CONTINUE_AND_REPLACE {
+		return nil
+	}
+	req.Body, req.ContentLength = body(req.Body, req.ContentLength, req.Header, common.GetBodyMutation())
+	return m.trailers(&req.Trailer, common.GetTrailers())
+}
+
+// RequestBody applies the response to a request body message.
+func (m *Mutator) RequestBody(req *http.Request, common *extproc.CommonResponse) error {
+	if err := m.request(req, common.GetHeaderMutation()); err != nil {
+		return err
+	}
+	req.Body, req.ContentLength = body(req.Body, req.ContentLength, req.Header, common.GetBodyMutation())
+	return nil
+}
+
+// ResponseHeaders applies the response to a response headers message. The body mutation and trailers are only
+// applied when the status is CONTINUE_AND_REPLACE.
+func (m *Mutator) ResponseHeaders(resp *http.Response, common *extproc.CommonResponse) error {
+	if err := m.response(resp, common.GetHeaderMutation()); err != nil {
+		return err
+	}
+	if common.GetStatus() != extproc.CommonResponse_CONTINUE_AND_REPLACE {
+		return nil
+	}
+	resp.Body, resp.ContentLength = body(resp.Body, resp.ContentLength, resp.Header, common.GetBodyMutation())
+	return m.trailers(&resp.Trailer, common.GetTrailers())
+}
+
+// ResponseBody applies the response to a response body message.
+func (m *Mutator) ResponseBody(resp *http.Response, common *extproc.CommonResponse) error {
+	if err := m.response(resp, common.GetHeaderMutation()); err != nil {
+		return err
+	}
+	resp.Body, resp.ContentLength = body(resp.Body, resp.ContentLength, resp.Header, common.GetBodyMutation())
+	return nil
+}
+
+// Trailers applies the header mutation of a trailers response.
+func (m *Mutator) Trailers(trailers http.Header, mutation *extproc.HeaderMutation) error {
+	return m.Headers(trailers, mutation)
+}
+
+// Headers applies the header mutation to the header. Pseudo headers are subject to the rules but are not stored
+// in the header, use the request and response methods to apply them.
+func (m *Mutator) Headers(header http.Header, mutation *extproc.HeaderMutation) error {
+	return m.headers(header, mutation, func(key, _ string) bool { return strings.HasPrefix(key, ":") })
+}
+
+// ImmediateResponse builds the response Envoy sends to the client for the immediate response.
+func (m *Mutator) ImmediateResponse(immediate *extproc.ImmediateResponse, req *http.Request) (*http.Response, error) {
+	status := int(immediate.GetStatus().GetCode())
+	if status == 0 {
+		status = http.StatusOK
+	}
+	resp := &http.Response{
+		Status:        statusText(status),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        make(http.Header),
+		Body:          io.NopCloser(strings.NewReader(immediate.GetBody())),
+		ContentLength: int64(len(immediate.GetBody())),
+		Request:       req,
+	}
+	if err := m.Headers(resp.Header, immediate.GetHeaders()); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (m *Mutator) request(req *http.Request, mutation *extproc.HeaderMutation) error {
+	if req.Header == nil {
+		req.Header = make(http.Header)
+	}
+	return m.headers(req.Header, mutation, func(key, value string) bool {
+		switch key {
+		case ":path":
+			if u, err := url.ParseRequestURI(value); err == nil {
+				req.URL.Path, req.URL.RawPath, req.URL.RawQuery = u.Path, u.RawPath, u.RawQuery
+				req.RequestURI = ""
+			}
+		case ":method":
+			req.Method = value
+		case ":authority", "host":
+			req.Host = value
+			req.URL.Host = value
+		case ":scheme":
+			req.URL.Scheme = value
+		}
+		return strings.HasPrefix(key, ":") || key == "host"
+	})
+}
+
+func (m *Mutator) response(resp *http.Response, mutation *extproc.HeaderMutation) error {
+	if resp.Header == nil {
+		resp.Header = make(http.Header)
+	}
+	var statusErr error
+	err := m.headers(resp.Header, mutation, func(key, value string) bool {
+		if key == ":status" {
+			status, err := strconv.Atoi(value)
+			if err != nil || status < 200 || status > 599 {
+				statusErr = fmt.Errorf("%w: invalid :status %q", ErrInvalidValue, value)
+				return true
+			}
+			resp.StatusCode = status
+			resp.Status = statusText(status)
+		}
+		return strings.HasPrefix(key, ":")
+	})
+	return errors.Join(err, statusErr)
+}
+
+// headers applies the mutation, removals first and then the set headers in order like Envoy.
+// The pseudo function is called for every allowed set mutation and returns true when the header was handled and must
+// not be stored in the header map.
+func (m *Mutator) headers(header http.Header, mutation *extproc.HeaderMutation, pseudo func(key, value string) bool) error {
+	for _, key := range mutation.GetRemoveHeaders() {
+		key = strings.ToLower(key)
+		ok, err := m.Rules.check(operationRemove, key, "")
+		if err != nil {
+			return err
+		}
+		if ok {
+			header.Del(key)
+		}
+	}
+	for _, option := range mutation.GetSetHeaders() {
+		key := strings.ToLower(option.GetHeader().GetKey())
+		value := m.value(option.GetHeader())
+		ok, err := m.Rules.check(operationSet, key, value)
+		if err != nil {
+			return err
+		}
+		if !ok || pseudo(key, value) {
+			continue
+		}
+		setHeader(header, key, value, appendAction(option))
+	}
+	return nil
+}
+
+func (m *Mutator) trailers(trailer *http.Header, trailers *corev3.HeaderMap) error {
+	for _, h := range trailers.GetHeaders() {
+		key := strings.ToLower(h.GetKey())
+		value := m.value(h)
+		ok, err := m.Rules.check(operationSet, key, value)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if *trailer == nil {
+			*trailer = make(http.Header)
+		}
+		trailer.Add(key, value)
+	}
+	return nil
+}
+
+func (m *Mutator) value(header *corev3.HeaderValue) string {
+	switch m.ValueMode {
+	case ValueModeRaw:
+		return string(header.GetRawValue())
+	case ValueModeString:
+		return header.GetValue()
+	}
+	if len(header.GetRawValue()) > 0 {
+		return string(header.GetRawValue())
+	}
+	return header.GetValue()
+}
+
+// appendAction resolves how the header is applied. The deprecated append field takes precedence when it is set,
+// which is how Envoy versions without append_action support behave.
+func appendAction(option *corev3.HeaderValueOption) corev3.HeaderValueOption_HeaderAppendAction {
+	if option.GetAppend() != nil {
+		if option.GetAppend().GetValue() {
+			return corev3.HeaderValueOption_APPEND_IF_EXISTS_OR_ADD
+		}
+		return corev3.HeaderValueOption_OVERWRITE_IF_EXISTS_OR_ADD
+	}
+	return option.GetAppendAction()
+}
+
+func setHeader(header http.Header, key, value string, action corev3.HeaderValueOption_HeaderAppendAction) {
+	_, exists := header[http.CanonicalHeaderKey(key)]
+	switch action {
+	case corev3.HeaderValueOption_APPEND_IF_EXISTS_OR_ADD:
+		header.Add(key, value)
+	case corev3.HeaderValueOption_ADD_IF_ABSENT:
+		if !exists {
+			header.Set(key, value)
+		}
+	case corev3.HeaderValueOption_OVERWRITE_IF_EXISTS_OR_ADD:
+		header.Set(key, value)
+	case corev3.HeaderValueOption_OVERWRITE_IF_EXISTS:
+		if exists {
+			header.Set(key, value)
+		}
+	}
+}
+
+// body returns the body and content length after the mutation. The content-length header is updated when present,
+// as Envoy does for buffered bodies.
+func body(current io.ReadCloser, length int64, header http.Header, mutation *extproc.BodyMutation) (io.ReadCloser, int64) {
+	var replacement []byte
+	switch m := mutation.GetMutation().(type) {
+	case *extproc.BodyMutation_Body:
+		replacement = m.Body
+	case *extproc.BodyMutation_ClearBody:
+		if !m.ClearBody {
+			return current, length
+		}
+	default:
+		return current, length
+	}
+	if header.Get("content-length") != "" {
+		header.Set("content-length", strconv.Itoa(len(replacement)))
+	}
+	if len(replacement) == 0 {
+		return http.NoBody, 0
+	}
+	return io.NopCloser(bytes.NewReader(replacement)), int64(len(replacement))
+}
+
+func statusText(status int) string {
+	return strconv.Itoa(status) + " " + http.StatusText(status)
+}
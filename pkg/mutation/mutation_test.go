@@ -0,0 +1,307 @@
+package mutation_test
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/cainelli/ext-proc/pkg/mutation"
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	extproc "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func set(key, value string, action corev3.HeaderValueOption_HeaderAppendAction) *corev3.HeaderValueOption {
+	return &corev3.HeaderValueOption{
+		Header:       &corev3.HeaderValue{Key: key, RawValue: []byte(value)},
+		AppendAction: action,
+	}
+}
+
+func TestAppendAction(t *testing.T) {
+	tests := []struct {
+		name   string
+		option *corev3.HeaderValueOption
+		want   []string
+	}{
+		{"append", set("x-a", "new", corev3.HeaderValueOption_APPEND_IF_EXISTS_OR_ADD), []string{"old", "new"}},
+		{"append absent", set("x-b", "new", corev3.HeaderValueOption_APPEND_IF_EXISTS_OR_ADD), []string{"new"}},
+		{"add if absent", set("x-a", "new", corev3.HeaderValueOption_ADD_IF_ABSENT), []string{"old"}},
+		{"add if absent absent", set("x-b", "new", corev3.HeaderValueOption_ADD_IF_ABSENT), []string{"new"}},
+		{"overwrite", set("x-a", "new", corev3.HeaderValueOption_OVERWRITE_IF_EXISTS_OR_ADD), []string{"new"}},
+		{"overwrite absent", set("x-b", "new", corev3.HeaderValueOption_OVERWRITE_IF_EXISTS_OR_ADD), []string{"new"}},
+		{"overwrite if exists", set("x-a", "new", corev3.HeaderValueOption_OVERWRITE_IF_EXISTS), []string{"new"}},
+		{"overwrite if exists absent", set("x-b", "new", corev3.HeaderValueOption_OVERWRITE_IF_EXISTS), nil},
+		{"pseudo header", set(":path", "/b", corev3.HeaderValueOption_OVERWRITE_IF_EXISTS_OR_ADD), nil},
+		{"pseudo response header", set(":status", "404", corev3.HeaderValueOption_APPEND_IF_EXISTS_OR_ADD), nil},
+		{
+			"deprecated append true wins",
+			&corev3.HeaderValueOption{
+				Header:       &corev3.HeaderValue{Key: "x-a", RawValue: []byte("new")},
+				Append:       wrapperspb.Bool(true),
+				AppendAction: corev3.HeaderValueOption_OVERWRITE_IF_EXISTS,
+			},
+			[]string{"old", "new"},
+		},
+		{
+			"deprecated append false wins",
+			&corev3.HeaderValueOption{
+				Header:       &corev3.HeaderValue{Key: "x-a", RawValue: []byte("new")},
+				Append:       wrapperspb.Bool(false),
+				AppendAction: corev3.HeaderValueOption_APPEND_IF_EXISTS_OR_ADD,
+			},
+			[]string{"new"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			header := http.Header{"X-A": {"old"}}
+			m := &mutation.Mutator{}
+			if err := m.Headers(header, &extproc.HeaderMutation{SetHeaders: []*corev3.HeaderValueOption{test.option}}); err != nil {
+				t.Fatalf("Headers() = %v", err)
+			}
+			if got := header.Values(test.option.GetHeader().GetKey()); !slices.Equal(got, test.want) {
+				t.Errorf("values = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestValueMode(t *testing.T) {
+	both := &corev3.HeaderValue{Key: "x-a", Value: "string", RawValue: []byte("raw")}
+	onlyValue := &corev3.HeaderValue{Key: "x-a", Value: "string"}
+	tests := []struct {
+		name   string
+		mode   mutation.ValueMode
+		header *corev3.HeaderValue
+		want   string
+	}{
+		{"auto prefers raw_value", mutation.ValueModeAuto, both, "raw"},
+		{"auto falls back to value", mutation.ValueModeAuto, onlyValue, "string"},
+		{"raw", mutation.ValueModeRaw, both, "raw"},
+		{"raw ignores value", mutation.ValueModeRaw, onlyValue, ""},
+		{"string", mutation.ValueModeString, both, "string"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			header := make(http.Header)
+			m := &mutation.Mutator{ValueMode: test.mode}
+			err := m.Headers(header, &extproc.HeaderMutation{SetHeaders: []*corev3.HeaderValueOption{{Header: test.header}}})
+			if err != nil {
+				t.Fatalf("Headers() = %v", err)
+			}
+			if got := header.Get("x-a"); got != test.want {
+				t.Errorf("x-a = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRules(t *testing.T) {
+	tests := []struct {
+		name     string
+		rules    mutation.Rules
+		mutation *extproc.HeaderMutation
+		wantErr  error
+		check    func(req *http.Request) bool
+	}{
+		{
+			name:     "pseudo headers are never removed",
+			rules:    mutation.Rules{AllowAllRouting: true},
+			mutation: &extproc.HeaderMutation{RemoveHeaders: []string{":path", "host"}},
+			check:    func(req *http.Request) bool { return req.URL.Path == "/a" && req.Host == "www.example.com" },
+		},
+		{
+			name:     "removing pseudo headers is an error",
+			rules:    mutation.Rules{AllowAllRouting: true, DisallowIsError: true},
+			mutation: &extproc.HeaderMutation{RemoveHeaders: []string{":path"}},
+			wantErr:  mutation.ErrNotAllowed,
+		},
+		{
+			name:     "routing headers are ignored by default",
+			mutation: &extproc.HeaderMutation{SetHeaders: []*corev3.HeaderValueOption{set(":authority", "evil.example.com", 0), set("host", "evil.example.com", 0)}},
+			check:    func(req *http.Request) bool { return req.Host == "www.example.com" },
+		},
+		{
+			name:     "routing headers are allowed",
+			rules:    mutation.Rules{AllowAllRouting: true},
+			mutation: &extproc.HeaderMutation{SetHeaders: []*corev3.HeaderValueOption{set(":authority", "api.example.com", 0), set(":method", "POST", 0)}},
+			check: func(req *http.Request) bool {
+				return req.Host == "api.example.com" && req.Method == http.MethodPost && req.Header.Get(":authority") == ""
+			},
+		},
+		{
+			name:     "path",
+			mutation: &extproc.HeaderMutation{SetHeaders: []*corev3.HeaderValueOption{set(":path", "/b?c=d", 0)}},
+			check:    func(req *http.Request) bool { return req.URL.RequestURI() == "/b?c=d" },
+		},
+		{
+			name:     "system headers are disallowed",
+			rules:    mutation.Rules{DisallowSystem: true, DisallowIsError: true},
+			mutation: &extproc.HeaderMutation{SetHeaders: []*corev3.HeaderValueOption{set(":path", "/b", 0)}},
+			wantErr:  mutation.ErrNotAllowed,
+		},
+		{
+			name:     "envoy headers are ignored by default",
+			mutation: &extproc.HeaderMutation{SetHeaders: []*corev3.HeaderValueOption{set("x-envoy-retry-on", "5xx", 0)}},
+			check:    func(req *http.Request) bool { return req.Header.Get("x-envoy-retry-on") == "" },
+		},
+		{
+			name:     "envoy headers are allowed",
+			rules:    mutation.Rules{AllowEnvoy: true},
+			mutation: &extproc.HeaderMutation{SetHeaders: []*corev3.HeaderValueOption{set("x-envoy-retry-on", "5xx", 0)}},
+			check:    func(req *http.Request) bool { return req.Header.Get("x-envoy-retry-on") == "5xx" },
+		},
+		{
+			name:     "disallow all",
+			rules:    mutation.Rules{DisallowAll: true},
+			mutation: &extproc.HeaderMutation{SetHeaders: []*corev3.HeaderValueOption{set("x-a", "1", 0)}, RemoveHeaders: []string{"x-b"}},
+			check:    func(req *http.Request) bool { return req.Header.Get("x-a") == "" && req.Header.Get("x-b") == "1" },
+		},
+		{
+			name:     "invalid value",
+			mutation: &extproc.HeaderMutation{SetHeaders: []*corev3.HeaderValueOption{set("x-a", "1\r\nx-injected: 1", 0)}},
+			wantErr:  mutation.ErrInvalidValue,
+		},
+		{
+			name: "removes are applied before sets",
+			mutation: &extproc.HeaderMutation{
+				SetHeaders:    []*corev3.HeaderValueOption{set("x-b", "2", corev3.HeaderValueOption_APPEND_IF_EXISTS_OR_ADD)},
+				RemoveHeaders: []string{"X-B"},
+			},
+			check: func(req *http.Request) bool { return slices.Equal(req.Header.Values("x-b"), []string{"2"}) },
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://www.example.com/a", nil)
+			req.Header.Set("x-b", "1")
+			m := &mutation.Mutator{Rules: test.rules}
+			err := m.RequestHeaders(req, &extproc.CommonResponse{HeaderMutation: test.mutation})
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("RequestHeaders() = %v, want %v", err, test.wantErr)
+			}
+			if test.check != nil && !test.check(req) {
+				t.Errorf("unexpected request %s %s%s %v", req.Method, req.Host, req.URL.RequestURI(), req.Header)
+			}
+		})
+	}
+}
+
+func TestStatus(t *testing.T) {
+	tests := []struct {
+		status     string
+		wantStatus int
+		wantErr    error
+	}{
+		{"404", http.StatusNotFound, nil},
+		{"599", 599, nil},
+		{"100", http.StatusOK, mutation.ErrInvalidValue},
+		{"600", http.StatusOK, mutation.ErrInvalidValue},
+		{"ok", http.StatusOK, mutation.ErrInvalidValue},
+	}
+	for _, test := range tests {
+		resp := &http.Response{StatusCode: http.StatusOK, Header: make(http.Header)}
+		m := &mutation.Mutator{}
+		err := m.ResponseHeaders(resp, &extproc.CommonResponse{HeaderMutation: &extproc.HeaderMutation{
+			SetHeaders: []*corev3.HeaderValueOption{set(":status", test.status, 0)},
+		}})
+		if !errors.Is(err, test.wantErr) {
+			t.Errorf(":status %s: err = %v, want %v", test.status, err, test.wantErr)
+		}
+		if resp.StatusCode != test.wantStatus {
+			t.Errorf(":status %s: status = %d, want %d", test.status, resp.StatusCode, test.wantStatus)
+		}
+		if resp.Header.Get(":status") != "" {
+			t.Errorf(":status %s: pseudo header stored in the header map", test.status)
+		}
+	}
+}
+
+func TestHeadersBodyAndTrailers(t *testing.T) {
+	tests := []struct {
+		name         string
+		status       extproc.CommonResponse_ResponseStatus
+		mutation     *extproc.BodyMutation
+		wantBody     string
+		wantLength   string
+		wantTrailers bool
+	}{
+		{"continue ignores the body", extproc.CommonResponse_CONTINUE, &extproc.BodyMutation{Mutation: &extproc.BodyMutation_Body{Body: []byte("replaced")}}, "original", "8", false},
+		{"replace", extproc.CommonResponse_CONTINUE_AND_REPLACE, &extproc.BodyMutation{Mutation: &extproc.BodyMutation_Body{Body: []byte("new")}}, "new", "3", true},
+		{"clear", extproc.CommonResponse_CONTINUE_AND_REPLACE, &extproc.BodyMutation{Mutation: &extproc.BodyMutation_ClearBody{ClearBody: true}}, "", "0", true},
+		{"clear false", extproc.CommonResponse_CONTINUE_AND_REPLACE, &extproc.BodyMutation{Mutation: &extproc.BodyMutation_ClearBody{}}, "original", "8", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			common := &extproc.CommonResponse{
+				Status:       test.status,
+				BodyMutation: test.mutation,
+				Trailers:     &corev3.HeaderMap{Headers: []*corev3.HeaderValue{{Key: "x-checksum", RawValue: []byte("abc")}}},
+			}
+			m := &mutation.Mutator{}
+
+			req := httptest.NewRequest(http.MethodPost, "http://www.example.com/", strings.NewReader("original"))
+			req.Header.Set("content-length", "8")
+			if err := m.RequestHeaders(req, common); err != nil {
+				t.Fatalf("RequestHeaders() = %v", err)
+			}
+			resp := &http.Response{Header: http.Header{"Content-Length": {"8"}}, Body: io.NopCloser(strings.NewReader("original"))}
+			if err := m.ResponseHeaders(resp, common); err != nil {
+				t.Fatalf("ResponseHeaders() = %v", err)
+			}
+
+			for phase, got := range map[string]struct {
+				body     io.Reader
+				header   http.Header
+				trailers http.Header
+			}{
+				"request":  {req.Body, req.Header, req.Trailer},
+				"response": {resp.Body, resp.Header, resp.Trailer},
+			} {
+				if body, _ := io.ReadAll(got.body); string(body) != test.wantBody {
+					t.Errorf("%s body = %q, want %q", phase, body, test.wantBody)
+				}
+				if length := got.header.Get("content-length"); length != test.wantLength {
+					t.Errorf("%s content-length = %q, want %q", phase, length, test.wantLength)
+				}
+				if applied := got.trailers.Get("x-checksum") == "abc"; applied != test.wantTrailers {
+					t.Errorf("%s trailers applied = %v, want %v", phase, applied, test.wantTrailers)
+				}
+			}
+		})
+	}
+}
+
+func TestBodyPhases(t *testing.T) {
+	// Body phases apply the body mutation whatever the status.
+	req := httptest.NewRequest(http.MethodPost, "http://www.example.com/", strings.NewReader("original"))
+	m := &mutation.Mutator{}
+	if err := m.RequestBody(req, &extproc.CommonResponse{BodyMutation: &extproc.BodyMutation{Mutation: &extproc.BodyMutation_Body{Body: []byte("new")}}}); err != nil {
+		t.Fatalf("RequestBody() = %v", err)
+	}
+	if body, _ := io.ReadAll(req.Body); string(body) != "new" || req.ContentLength != 3 {
+		t.Errorf("body = %q with length %d, want new", body, req.ContentLength)
+	}
+}
+
+func TestImmediateResponse(t *testing.T) {
+	m := &mutation.Mutator{}
+	resp, err := m.ImmediateResponse(&extproc.ImmediateResponse{
+		Body:    "moved",
+		Headers: &extproc.HeaderMutation{SetHeaders: []*corev3.HeaderValueOption{set("location", "/new", 0)}},
+	}, nil)
+	if err != nil {
+		t.Fatalf("ImmediateResponse() = %v", err)
+	}
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("location") != "/new" {
+		t.Errorf("response = %d %v, want 200 with the location", resp.StatusCode, resp.Header)
+	}
+	if body, _ := io.ReadAll(resp.Body); string(body) != "moved" {
+		t.Errorf("body = %q, want moved", body)
+	}
+}
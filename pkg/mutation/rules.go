@@ -0,0 +1,74 @@
+package mutation
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrNotAllowed is returned when a mutation is rejected by the Rules and DisallowIsError is set.
+var ErrNotAllowed = errors.New("header mutation not allowed")
+
+// ErrInvalidValue is returned when a header mutation contains a value Envoy would reject.
+var ErrInvalidValue = errors.New("invalid header value")
+
+// Rules mirrors the mutation_rules of the ext_proc filter configuration.
+// https://www.envoyproxy.io/docs/envoy/latest/api-v3/config/common/mutation_rules/v3/mutation_rules.proto
+// The zero value applies the same defaults as Envoy.
+type Rules struct {
+	// AllowAllRouting allows modifying the host, :authority, :scheme and :method headers, which affect routing.
+	AllowAllRouting bool
+	// AllowEnvoy allows modifying the x-envoy-* headers.
+	AllowEnvoy bool
+	// DisallowSystem rejects the modification of any pseudo header, those starting with ":".
+	DisallowSystem bool
+	// DisallowAll rejects the modification of any header not covered by the other rules.
+	DisallowAll bool
+	// DisallowIsError makes a rejected mutation fail with an error instead of being silently ignored.
+	DisallowIsError bool
+}
+
+// operation is the kind of mutation checked by the Rules.
+type operation int
+
+const (
+	operationSet operation = iota
+	operationRemove
+)
+
+// check returns whether the mutation should be applied. It returns false and no error when the mutation must be ignored.
+func (rules Rules) check(op operation, key, value string) (bool, error) {
+	if strings.ContainsAny(value, "\r\n\x00") {
+		return false, fmt.Errorf("%w for %q", ErrInvalidValue, key)
+	}
+	if rules.allowed(op, key) {
+		return true, nil
+	}
+	if rules.DisallowIsError {
+		return false, fmt.Errorf("%w: %q", ErrNotAllowed, key)
+	}
+	return false, nil
+}
+
+func (rules Rules) allowed(op operation, key string) bool {
+	// Envoy never removes system headers.
+	if op == operationRemove && isSystemHeader(key) {
+		return false
+	}
+	switch key {
+	case "host", ":authority", ":scheme", ":method":
+		return rules.AllowAllRouting
+	}
+	if strings.HasPrefix(key, ":") {
+		return !rules.DisallowSystem
+	}
+	if strings.HasPrefix(key, "x-envoy") {
+		return rules.AllowEnvoy
+	}
+	return !rules.DisallowAll
+}
+
+// isSystemHeader reports whether the header is a pseudo header or host, which Envoy protects from removal.
+func isSystemHeader(key string) bool {
+	return strings.HasPrefix(key, ":") || key == "host"
+}
@@ -0,0 +1,224 @@
+// Package cors answers CORS preflight requests and adds the CORS headers to responses, based on per-authority policies.
+package cors
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cainelli/ext-proc/pkg/service/processor"
+	extproc "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+)
+
+// DefaultAuthority is the key of the policy applied to authorities without their own policy.
+const DefaultAuthority = "*"
+
+// Policy is the CORS policy of an authority.
+type Policy struct {
+	// AllowOrigins are the origins allowed to make cross-origin requests. An origin is either exact
+	// (https://app.example.com), a wildcard subdomain (https://*.example.com) or * to allow any origin.
+	AllowOrigins []string `json:"allow_origins,omitempty"`
+	// AllowOriginRegexps are regular expressions matched against the whole origin, they are anchored when compiled,
+	// e.g. https://pr-[0-9]+\.example\.com.
+	AllowOriginRegexps []string `json:"allow_origin_regexps,omitempty"`
+	// AllowMethods are the methods allowed in preflights, the requested method is allowed when empty.
+	AllowMethods []string `json:"allow_methods,omitempty"`
+	// AllowHeaders are the request headers allowed in preflights, * allows the requested headers.
+	AllowHeaders []string `json:"allow_headers,omitempty"`
+	// ExposeHeaders are the response headers scripts are allowed to read.
+	ExposeHeaders []string `json:"expose_headers,omitempty"`
+	// AllowCredentials allows requests with cookies and authorization headers. The allowed origin is then always
+	// returned as is since browsers reject * with credentials.
+	AllowCredentials bool `json:"allow_credentials,omitempty"`
+	// MaxAge is how long browsers may cache the preflight result, zero leaves it to the browser default.
+	MaxAge time.Duration `json:"max_age,omitempty"`
+}
+
+// CORSProcessor handles CORS for the authorities it has a policy for:
+//   - preflights (OPTIONS with access-control-request-method) from allowed origins are answered with an immediate
+//     204 response in RequestHeaders, the upstream never sees them.
+//   - responses to allowed origins get the access-control-* headers in ResponseHeaders, overwriting the upstream ones.
+//   - responses to other origins have the access-control-allow-* headers of the upstream removed.
+//
+// Requests without an origin header and authorities without a policy are left untouched.
+type CORSProcessor struct {
+	policies map[string]*policy
+}
+
+var _ processor.Processor = &CORSProcessor{}
+
+type policy struct {
+	Policy
+	anyOrigin bool
+	exact     []string
+	wildcards []wildcard
+	regexps   []*regexp.Regexp
+}
+
+// wildcard matches the subdomains of a domain for a scheme, from an origin like https://*.example.com.
+type wildcard struct {
+	scheme string
+	suffix string
+}
+
+// New returns a CORSProcessor applying the policies by authority. The authorities are matched case insensitively
+// with and without port, DefaultAuthority applies to the authorities without a policy.
+func New(policies map[string]Policy) (*CORSProcessor, error) {
+	p := &CORSProcessor{policies: make(map[string]*policy, len(policies))}
+	for authority, config := range policies {
+		compiled, err := compile(config)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CORS policy for %s: %w", authority, err)
+		}
+		p.policies[strings.ToLower(authority)] = compiled
+	}
+	return p, nil
+}
+
+func compile(config Policy) (*policy, error) {
+	compiled := &policy{Policy: config}
+	for _, origin := range config.AllowOrigins {
+		origin = strings.ToLower(origin)
+		switch scheme, host, found := strings.Cut(origin, "://*."); {
+		case origin == "*":
+			compiled.anyOrigin = true
+		case found:
+			compiled.wildcards = append(compiled.wildcards, wildcard{scheme: scheme + "://", suffix: "." + host})
+		case strings.Contains(origin, "*"):
+			return nil, fmt.Errorf("unsupported wildcard in origin %q, only https://*.example.com is supported", origin)
+		default:
+			compiled.exact = append(compiled.exact, origin)
+		}
+	}
+	for _, expr := range config.AllowOriginRegexps {
+		re, err := regexp.Compile(`^(?:` + expr + `)$`)
+		if err != nil {
+			return nil, fmt.Errorf("invalid origin regexp %q: %w", expr, err)
+		}
+		compiled.regexps = append(compiled.regexps, re)
+	}
+	return compiled, nil
+}
+
+// Describe returns the policies by authority.
+func (p *CORSProcessor) Describe() any {
+	policies := make(map[string]Policy, len(p.policies))
+	for authority, compiled := range p.policies {
+		policies[authority] = compiled.Policy
+	}
+	return policies
+}
+
+func (p *CORSProcessor) RequestHeaders(_ context.Context, _ *processor.CommonResponseWriter, req *processor.RequestContext) (*extproc.ProcessingResponse_ImmediateResponse, error) {
+	origin := req.GetRequestHeader("origin")
+	requestedMethod := req.GetRequestHeader("access-control-request-method")
+	if origin == "" || req.Method() != http.MethodOptions || requestedMethod == "" {
+		return nil, nil
+	}
+	pol := p.policy(req.Authority())
+	if pol == nil || !pol.allows(origin) {
+		return nil, nil
+	}
+
+	crw := processor.NewCommonResponseWriter()
+	pol.setOriginHeaders(crw, origin)
+	methods := pol.AllowMethods
+	if len(methods) == 0 {
+		methods = []string{requestedMethod}
+	}
+	crw.HeaderSet("access-control-allow-methods", strings.Join(methods, ", "))
+	if slices.Contains(pol.AllowHeaders, "*") {
+		if requested := req.GetRequestHeader("access-control-request-headers"); requested != "" {
+			crw.HeaderSet("access-control-allow-headers", requested)
+		}
+	} else if len(pol.AllowHeaders) > 0 {
+		crw.HeaderSet("access-control-allow-headers", strings.Join(pol.AllowHeaders, ", "))
+	}
+	if pol.MaxAge > 0 {
+		crw.HeaderSet("access-control-max-age", strconv.Itoa(int(pol.MaxAge.Seconds())))
+	}
+	return &extproc.ProcessingResponse_ImmediateResponse{
+		ImmediateResponse: &extproc.ImmediateResponse{
+			Status:  &typev3.HttpStatus{Code: typev3.StatusCode_NoContent},
+			Headers: crw.CommonResponse().GetHeaderMutation(),
+			Details: "cors_preflight",
+		},
+	}, nil
+}
+
+func (p *CORSProcessor) ResponseHeaders(_ context.Context, crw *processor.CommonResponseWriter, req *processor.RequestContext) (*extproc.ProcessingResponse_ImmediateResponse, error) {
+	origin := req.GetRequestHeader("origin")
+	if origin == "" {
+		return nil, nil
+	}
+	pol := p.policy(req.Authority())
+	if pol == nil {
+		return nil, nil
+	}
+	if !pol.allows(origin) {
+		crw.RemoveHeaders("access-control-allow-origin", "access-control-allow-credentials")
+		return nil, nil
+	}
+	pol.setOriginHeaders(crw, origin)
+	if len(pol.ExposeHeaders) > 0 {
+		crw.HeaderSet("access-control-expose-headers", strings.Join(pol.ExposeHeaders, ", "))
+	}
+	return nil, nil
+}
+
+// policy returns the policy of the authority, with or without port, or the default policy.
+func (p *CORSProcessor) policy(authority string) *policy {
+	authority = strings.ToLower(authority)
+	if pol, ok := p.policies[authority]; ok {
+		return pol
+	}
+	if host, _, err := net.SplitHostPort(authority); err == nil {
+		if pol, ok := p.policies[host]; ok {
+			return pol
+		}
+	}
+	return p.policies[DefaultAuthority]
+}
+
+func (pol *policy) allows(origin string) bool {
+	if pol.anyOrigin {
+		return true
+	}
+	lower := strings.ToLower(origin)
+	if slices.Contains(pol.exact, lower) {
+		return true
+	}
+	for _, w := range pol.wildcards {
+		host, found := strings.CutPrefix(lower, w.scheme)
+		if found && len(host) > len(w.suffix) && strings.HasSuffix(host, w.suffix) {
+			return true
+		}
+	}
+	for _, re := range pol.regexps {
+		if re.MatchString(origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// setOriginHeaders sets the headers telling the browser the origin is allowed.
+func (pol *policy) setOriginHeaders(crw *processor.CommonResponseWriter, origin string) {
+	if pol.anyOrigin && !pol.AllowCredentials {
+		crw.HeaderSet("access-control-allow-origin", "*")
+	} else {
+		crw.HeaderSet("access-control-allow-origin", origin)
+		// The response depends on the origin, caches must not serve it to other origins.
+		crw.HeaderAppend("vary", "origin")
+	}
+	if pol.AllowCredentials {
+		crw.HeaderSet("access-control-allow-credentials", "true")
+	}
+}
@@ -0,0 +1,187 @@
+package cors_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/cainelli/ext-proc/pkg/processors/cors"
+	"github.com/cainelli/ext-proc/pkg/service/processortest"
+)
+
+func TestCORSProcessor(t *testing.T) {
+	p, err := cors.New(map[string]cors.Policy{
+		"api.example.com": {
+			AllowOrigins:       []string{"https://app.example.com", "https://*.example.org"},
+			AllowOriginRegexps: []string{`^https://pr-[0-9]+\.example\.net$`, `https://preview-[a-z]+\.example\.io`},
+			AllowMethods:       []string{"GET", "POST"},
+			AllowHeaders:       []string{"*"},
+			ExposeHeaders:      []string{"x-request-id"},
+			AllowCredentials:   true,
+			MaxAge:             10 * time.Minute,
+		},
+		cors.DefaultAuthority: {
+			AllowOrigins: []string{"*"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("New() = %v", err)
+	}
+	svc := processortest.Chain(p)
+
+	tests := []struct {
+		name      string
+		method    string
+		authority string
+		header    http.Header
+		// want are the response headers expected, an empty value means the header must be absent.
+		want       map[string]string
+		wantStatus int
+	}{
+		{
+			name:      "preflight from an exact origin",
+			method:    http.MethodOptions,
+			authority: "api.example.com",
+			header:    http.Header{"Origin": {"https://app.example.com"}, "Access-Control-Request-Method": {"POST"}, "Access-Control-Request-Headers": {"content-type, x-token"}},
+			want: map[string]string{
+				"access-control-allow-origin":      "https://app.example.com",
+				"access-control-allow-credentials": "true",
+				"access-control-allow-methods":     "GET, POST",
+				"access-control-allow-headers":     "content-type, x-token",
+				"access-control-max-age":           "600",
+				"vary":                             "origin",
+			},
+			wantStatus: http.StatusNoContent,
+		},
+		{
+			name:      "preflight from a wildcard subdomain with port in the authority",
+			method:    http.MethodOptions,
+			authority: "api.example.com:8443",
+			header:    http.Header{"Origin": {"https://a.b.example.org"}, "Access-Control-Request-Method": {"GET"}},
+			want: map[string]string{
+				"access-control-allow-origin": "https://a.b.example.org",
+			},
+			wantStatus: http.StatusNoContent,
+		},
+		{
+			name:      "preflight from a disallowed origin goes upstream",
+			method:    http.MethodOptions,
+			authority: "api.example.com",
+			header:    http.Header{"Origin": {"https://example.org"}, "Access-Control-Request-Method": {"GET"}},
+			want: map[string]string{
+				"access-control-allow-origin":  "",
+				"access-control-allow-methods": "",
+			},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:      "request from a regexp origin",
+			method:    http.MethodGet,
+			authority: "api.example.com",
+			header:    http.Header{"Origin": {"https://pr-42.example.net"}},
+			want: map[string]string{
+				"access-control-allow-origin":      "https://pr-42.example.net",
+				"access-control-allow-credentials": "true",
+				"access-control-expose-headers":    "x-request-id",
+			},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:      "request from a disallowed origin loses the upstream headers",
+			method:    http.MethodGet,
+			authority: "api.example.com",
+			header:    http.Header{"Origin": {"https://pr-42.example.net.evil.com"}},
+			want: map[string]string{
+				"access-control-allow-origin":      "",
+				"access-control-allow-credentials": "",
+			},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:      "unanchored regexps match the whole origin",
+			method:    http.MethodGet,
+			authority: "api.example.com",
+			header:    http.Header{"Origin": {"https://preview-abc.example.io.evil.com"}},
+			want: map[string]string{
+				"access-control-allow-origin": "",
+			},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:      "unanchored regexps do not match a suffix",
+			method:    http.MethodGet,
+			authority: "api.example.com",
+			header:    http.Header{"Origin": {"https://evil.com#https://preview-abc.example.io"}},
+			want: map[string]string{
+				"access-control-allow-origin": "",
+			},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:      "request from an unanchored regexp origin",
+			method:    http.MethodGet,
+			authority: "api.example.com",
+			header:    http.Header{"Origin": {"https://preview-abc.example.io"}},
+			want: map[string]string{
+				"access-control-allow-origin": "https://preview-abc.example.io",
+			},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:      "default policy allows any origin",
+			method:    http.MethodGet,
+			authority: "other.example.com",
+			header:    http.Header{"Origin": {"https://anything.example"}},
+			want: map[string]string{
+				"access-control-allow-origin": "*",
+				"vary":                        "",
+			},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:      "request without origin is untouched",
+			method:    http.MethodGet,
+			authority: "api.example.com",
+			want: map[string]string{
+				"access-control-allow-origin": "*",
+			},
+			wantStatus: http.StatusOK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "https://"+tt.authority+"/path", nil)
+			req.Header = tt.header.Clone()
+			if req.Header == nil {
+				req.Header = make(http.Header)
+			}
+			// The upstream allows everything, as the echo handlers used to.
+			resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{
+				"Access-Control-Allow-Origin":      {"*"},
+				"Access-Control-Allow-Credentials": {"true"},
+			}}
+
+			result := processortest.MustRun(t, svc, req, resp)
+			if result.Response.StatusCode != tt.wantStatus {
+				t.Errorf("status = %d, want %d", result.Response.StatusCode, tt.wantStatus)
+			}
+			for key, want := range tt.want {
+				if got := result.Response.Header.Get(key); got != want {
+					t.Errorf("%s = %q, want %q", key, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestNewInvalidPolicy(t *testing.T) {
+	for _, policy := range []cors.Policy{
+		{AllowOrigins: []string{"https://app.*.example.com"}},
+		{AllowOriginRegexps: []string{"("}},
+	} {
+		if _, err := cors.New(map[string]cors.Policy{"example.com": policy}); err == nil {
+			t.Errorf("New(%+v) succeeded, want an error", policy)
+		}
+	}
+}
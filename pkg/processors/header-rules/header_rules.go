@@ -0,0 +1,279 @@
+// Package headerrules modifies request and response headers with ordered rules, so header tweaks do not need a
+// processor of their own.
+package headerrules
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"slices"
+	"strings"
+	"text/template"
+
+	"github.com/cainelli/ext-proc/pkg/service/processor"
+	extproc "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+	"golang.org/x/net/http/httpguts"
+)
+
+// Phase is the phase a rule runs in.
+type Phase string
+
+const (
+	// PhaseRequest rules modify the request headers before they are sent upstream.
+	PhaseRequest Phase = "request"
+	// PhaseResponse rules modify the response headers before they are sent to the client.
+	PhaseResponse Phase = "response"
+)
+
+// Operation is what a rule does to its header.
+type Operation string
+
+const (
+	// OperationSet replaces the values of the header with Value.
+	OperationSet Operation = "set"
+	// OperationAdd sets the header to Value when it is absent.
+	OperationAdd Operation = "add"
+	// OperationAppend adds Value to the values of the header.
+	OperationAppend Operation = "append"
+	// OperationRemove removes the header.
+	OperationRemove Operation = "remove"
+	// OperationCopy replaces the values of the header with the values of From, when From is present.
+	OperationCopy Operation = "copy"
+)
+
+// Condition matches the headers of the phase of the rule, as modified by the previous rules. The header must be
+// present and, when set, one of its values must be equal to Equals and match Matches. In the response phase, the
+// :status pseudo header holds the status code.
+type Condition struct {
+	Header  string `json:"header"`
+	Equals  string `json:"equals,omitempty"`
+	Matches string `json:"matches,omitempty"`
+	// Absent inverts the condition: the header must be absent.
+	Absent bool `json:"absent,omitempty"`
+}
+
+// Rule modifies a header of the requests or responses matching all its conditions.
+type Rule struct {
+	Phase     Phase     `json:"phase"`
+	Operation Operation `json:"operation"`
+	Header    string    `json:"header"`
+	// Value is a text/template executed with TemplateData, like "{{.Method}} {{.Path}}". Set, add and append are
+	// skipped when it renders an empty string.
+	Value string `json:"value,omitempty"`
+	// From is the header copied by OperationCopy, from the headers of the phase.
+	From string      `json:"from,omitempty"`
+	When []Condition `json:"when,omitempty"`
+}
+
+// Config configures a HeaderRulesProcessor.
+type Config struct {
+	// Rules run in order, each rule sees the headers modified by the previous ones.
+	Rules []Rule `json:"rules"`
+}
+
+// HeaderRulesProcessor applies the rules of each phase to the headers. A rule failing to render its value is skipped.
+type HeaderRulesProcessor struct {
+	processor.NoOpProcessor
+	config   Config
+	request  []rule
+	response []rule
+}
+
+var _ processor.Processor = &HeaderRulesProcessor{}
+
+type rule struct {
+	Rule
+	value *template.Template
+	when  []condition
+}
+
+type condition struct {
+	Condition
+	matches *regexp.Regexp
+}
+
+// New validates the rules and parses their templates.
+func New(config Config) (*HeaderRulesProcessor, error) {
+	p := &HeaderRulesProcessor{config: config}
+	for i, r := range config.Rules {
+		compiled, err := newRule(r)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rule %d: %w", i, err)
+		}
+		switch r.Phase {
+		case PhaseRequest:
+			p.request = append(p.request, compiled)
+		case PhaseResponse:
+			p.response = append(p.response, compiled)
+		default:
+			return nil, fmt.Errorf("invalid rule %d: unknown phase %q", i, r.Phase)
+		}
+	}
+	return p, nil
+}
+
+func newRule(r Rule) (rule, error) {
+	r.Header, r.From = strings.ToLower(r.Header), strings.ToLower(r.From)
+	if r.Header == "" {
+		return rule{}, fmt.Errorf("no header")
+	}
+	compiled := rule{Rule: r}
+	switch r.Operation {
+	case OperationSet, OperationAdd, OperationAppend:
+		if r.Value == "" {
+			return rule{}, fmt.Errorf("%s without value", r.Operation)
+		}
+		t, err := template.New(r.Header).Option("missingkey=zero").Parse(r.Value)
+		if err != nil {
+			return rule{}, err
+		}
+		compiled.value = t
+	case OperationRemove:
+	case OperationCopy:
+		if r.From == "" {
+			return rule{}, fmt.Errorf("copy without from")
+		}
+	default:
+		return rule{}, fmt.Errorf("unknown operation %q", r.Operation)
+	}
+	for _, c := range r.When {
+		c.Header = strings.ToLower(c.Header)
+		if c.Header == "" {
+			return rule{}, fmt.Errorf("condition without header")
+		}
+		cond := condition{Condition: c}
+		if c.Matches != "" {
+			re, err := regexp.Compile(c.Matches)
+			if err != nil {
+				return rule{}, err
+			}
+			cond.matches = re
+		}
+		compiled.when = append(compiled.when, cond)
+	}
+	return compiled, nil
+}
+
+// Describe returns the rules.
+func (p *HeaderRulesProcessor) Describe() any {
+	return p.config
+}
+
+func (p *HeaderRulesProcessor) RequestHeaders(ctx context.Context, crw *processor.CommonResponseWriter, req *processor.RequestContext) (*extproc.ProcessingResponse_ImmediateResponse, error) {
+	apply(crw, req, req.RequestHeaders(), p.request)
+	return nil, nil
+}
+
+func (p *HeaderRulesProcessor) ResponseHeaders(ctx context.Context, crw *processor.CommonResponseWriter, req *processor.RequestContext) (*extproc.ProcessingResponse_ImmediateResponse, error) {
+	apply(crw, req, req.ResponseHeaders(), p.response)
+	return nil, nil
+}
+
+// apply runs the rules on a view of the headers, then writes the headers whose values changed.
+func apply(crw *processor.CommonResponseWriter, req *processor.RequestContext, headers processor.Headers, rules []rule) {
+	if len(rules) == 0 {
+		return
+	}
+	v := &view{headers: headers, changed: make(map[string][]string)}
+	data := &TemplateData{req: req, view: v}
+	for i := range rules {
+		r := &rules[i]
+		if !r.matches(v) {
+			continue
+		}
+		switch r.Operation {
+		case OperationSet, OperationAdd, OperationAppend:
+			if r.Operation == OperationAdd && len(v.values(r.Header)) > 0 {
+				continue
+			}
+			var value strings.Builder
+			if err := r.value.Execute(&value, data); err != nil {
+				slog.Warn("failed rendering header rule value, skipping the rule", "request-id", req.RequestID(), "header", r.Header, "error", err)
+				continue
+			}
+			if value.Len() == 0 {
+				continue
+			}
+			// The templates render request values such as the decoded query, which may hold CR or LF.
+			if !httpguts.ValidHeaderFieldValue(value.String()) {
+				slog.Warn("header rule rendered an invalid value, skipping the rule", "request-id", req.RequestID(), "header", r.Header)
+				continue
+			}
+			if r.Operation == OperationAppend {
+				v.set(r.Header, append(slices.Clone(v.values(r.Header)), value.String()))
+			} else {
+				v.set(r.Header, []string{value.String()})
+			}
+		case OperationRemove:
+			v.set(r.Header, nil)
+		case OperationCopy:
+			if values := v.values(r.From); len(values) > 0 {
+				v.set(r.Header, values)
+			}
+		}
+	}
+	v.write(crw)
+}
+
+func (r *rule) matches(v *view) bool {
+	for _, c := range r.when {
+		if c.match(v.values(c.Header)) == c.Absent {
+			return false
+		}
+	}
+	return true
+}
+
+// match reports whether one of the values satisfies the condition, ignoring Absent.
+func (c *condition) match(values []string) bool {
+	for _, value := range values {
+		if c.Equals != "" && value != c.Equals {
+			continue
+		}
+		if c.matches != nil && !c.matches.MatchString(value) {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// view is the headers of a phase with the changes of the rules applied so far.
+type view struct {
+	headers processor.Headers
+	changed map[string][]string
+	order   []string
+}
+
+func (v *view) values(key string) []string {
+	if values, ok := v.changed[key]; ok {
+		return values
+	}
+	return v.headers.Values(key)
+}
+
+func (v *view) set(key string, values []string) {
+	if _, ok := v.changed[key]; !ok {
+		v.order = append(v.order, key)
+	}
+	v.changed[key] = values
+}
+
+// write writes the mutations turning the original headers into the view.
+func (v *view) write(crw *processor.CommonResponseWriter) {
+	for _, key := range v.order {
+		values := v.changed[key]
+		if slices.Equal(values, v.headers.Values(key)) {
+			continue
+		}
+		if len(values) == 0 {
+			crw.RemoveHeaders(key)
+			continue
+		}
+		crw.HeaderSet(key, values[0])
+		for _, value := range values[1:] {
+			crw.HeaderAppend(key, value)
+		}
+	}
+}
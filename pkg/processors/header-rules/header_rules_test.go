@@ -0,0 +1,157 @@
+package headerrules_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	headerrules "github.com/cainelli/ext-proc/pkg/processors/header-rules"
+	"github.com/cainelli/ext-proc/pkg/service/processor"
+	"github.com/cainelli/ext-proc/pkg/service/processortest"
+)
+
+func run(t *testing.T, rules []headerrules.Rule, req *http.Request, resp *http.Response) *processortest.Result {
+	t.Helper()
+	p, err := headerrules.New(headerrules.Config{Rules: rules})
+	if err != nil {
+		t.Fatalf("New() = %v", err)
+	}
+	claims := &processortest.ClaimsSetter{Key: "jwt.claims", Claims: func(*processor.RequestContext) processor.Claims {
+		return processor.Claims{"sub": "alice", "roles": []any{"admin"}}
+	}}
+	return processortest.MustRun(t, processortest.Chain(claims, p), req, resp)
+}
+
+func TestRequestRules(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "http://www.example.com/orders?page=2", nil)
+	req.Header.Set("x-tenant", "acme")
+	req.Header.Set("x-debug", "1")
+	req.Header.Add("x-forwarded-tags", "a")
+	req.AddCookie(&http.Cookie{Name: "session", Value: "s3cr3t"})
+	req.AddCookie(&http.Cookie{Name: "experiment", Value: "b"})
+
+	result := run(t, []headerrules.Rule{
+		{Phase: headerrules.PhaseRequest, Operation: headerrules.OperationSet, Header: "x-route", Value: "{{.Method}} {{.Path}} page={{.Query \"page\"}}"},
+		{Phase: headerrules.PhaseRequest, Operation: headerrules.OperationSet, Header: "x-user", Value: `{{.Metadata "jwt.claims" "sub"}}`},
+		{Phase: headerrules.PhaseRequest, Operation: headerrules.OperationSet, Header: "x-roles", Value: `{{.Metadata "jwt.claims" "roles"}}`},
+		{Phase: headerrules.PhaseRequest, Operation: headerrules.OperationSet, Header: "x-missing", Value: `{{.Metadata "jwt.claims" "email"}}`},
+		{Phase: headerrules.PhaseRequest, Operation: headerrules.OperationSet, Header: "x-experiment", Value: `{{.Cookie "experiment"}}`},
+		{Phase: headerrules.PhaseRequest, Operation: headerrules.OperationAdd, Header: "x-tenant", Value: "default"},
+		{Phase: headerrules.PhaseRequest, Operation: headerrules.OperationAdd, Header: "x-region", Value: "eu"},
+		{Phase: headerrules.PhaseRequest, Operation: headerrules.OperationAppend, Header: "x-forwarded-tags", Value: "{{.Header \"x-region\"}}"},
+		{Phase: headerrules.PhaseRequest, Operation: headerrules.OperationCopy, Header: "x-original-tenant", From: "X-Tenant"},
+		{
+			Phase: headerrules.PhaseRequest, Operation: headerrules.OperationSet, Header: "x-tenant", Value: "acme-eu",
+			When: []headerrules.Condition{{Header: "x-tenant", Equals: "acme"}, {Header: "x-region", Matches: "^eu"}},
+		},
+		{
+			Phase: headerrules.PhaseRequest, Operation: headerrules.OperationSet, Header: "x-beta", Value: "1",
+			When: []headerrules.Condition{{Header: "x-beta-opt-out", Absent: true}},
+		},
+		{
+			Phase: headerrules.PhaseRequest, Operation: headerrules.OperationSet, Header: "x-never", Value: "1",
+			When: []headerrules.Condition{{Header: "x-tenant", Equals: "acme"}},
+		},
+		{Phase: headerrules.PhaseRequest, Operation: headerrules.OperationRemove, Header: "x-debug"},
+		{Phase: headerrules.PhaseRequest, Operation: headerrules.OperationRemove, Header: "x-absent"},
+	}, req, nil)
+
+	want := map[string][]string{
+		"x-route":           {"POST /orders page=2"},
+		"x-user":            {"alice"},
+		"x-roles":           {`["admin"]`},
+		"x-missing":         nil,
+		"x-experiment":      {"b"},
+		"x-tenant":          {"acme-eu"},
+		"x-region":          {"eu"},
+		"x-forwarded-tags":  {"a", "eu"},
+		"x-original-tenant": {"acme"},
+		"x-beta":            {"1"},
+		"x-never":           nil,
+		"x-debug":           nil,
+	}
+	for key, values := range want {
+		if got := result.Request.Header.Values(key); !slices.Equal(got, values) {
+			t.Errorf("%s = %q, want %q", key, got, values)
+		}
+	}
+	mutation := result.Responses[0].GetRequestHeaders().GetResponse().GetHeaderMutation()
+	if removed := mutation.GetRemoveHeaders(); !slices.Equal(removed, []string{"x-debug"}) {
+		t.Errorf("removed headers = %q, want only the present ones", removed)
+	}
+}
+
+func TestResponseRules(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "http://www.example.com/", nil)
+	req.Header.Set("x-request-id", "abc")
+	tests := []struct {
+		status int
+		want   string
+	}{
+		{http.StatusOK, ""},
+		{http.StatusBadGateway, "502 abc"},
+	}
+	for _, test := range tests {
+		resp := &http.Response{StatusCode: test.status, Header: http.Header{"Server": {"nginx"}, "Cache-Control": {"max-age=60"}}}
+		result := run(t, []headerrules.Rule{
+			{Phase: headerrules.PhaseResponse, Operation: headerrules.OperationRemove, Header: "server"},
+			{
+				Phase: headerrules.PhaseResponse, Operation: headerrules.OperationSet, Header: "x-error", Value: "{{.Status}} {{.RequestHeader \"x-request-id\"}}",
+				When: []headerrules.Condition{{Header: ":status", Matches: "^5"}},
+			},
+			{
+				Phase: headerrules.PhaseResponse, Operation: headerrules.OperationSet, Header: "cache-control", Value: "no-store",
+				When: []headerrules.Condition{{Header: "x-error"}},
+			},
+		}, req, resp)
+		if got := result.Response.Header.Get("server"); got != "" {
+			t.Errorf("server = %q, want it removed", got)
+		}
+		if got := result.Response.Header.Get("x-error"); got != test.want {
+			t.Errorf("x-error = %q, want %q", got, test.want)
+		}
+		wantCache := "max-age=60"
+		if test.want != "" {
+			wantCache = "no-store"
+		}
+		if got := result.Response.Header.Get("cache-control"); got != wantCache {
+			t.Errorf("cache-control = %q, want %q", got, wantCache)
+		}
+	}
+}
+
+func TestNewInvalid(t *testing.T) {
+	invalid := map[string]headerrules.Rule{
+		"phase":           {Phase: "trailers", Operation: headerrules.OperationRemove, Header: "x"},
+		"operation":       {Phase: headerrules.PhaseRequest, Operation: "rename", Header: "x"},
+		"no header":       {Phase: headerrules.PhaseRequest, Operation: headerrules.OperationRemove},
+		"no value":        {Phase: headerrules.PhaseRequest, Operation: headerrules.OperationSet, Header: "x"},
+		"template":        {Phase: headerrules.PhaseRequest, Operation: headerrules.OperationSet, Header: "x", Value: "{{.Method"},
+		"copy":            {Phase: headerrules.PhaseRequest, Operation: headerrules.OperationCopy, Header: "x"},
+		"condition":       {Phase: headerrules.PhaseRequest, Operation: headerrules.OperationRemove, Header: "x", When: []headerrules.Condition{{Equals: "1"}}},
+		"condition regex": {Phase: headerrules.PhaseRequest, Operation: headerrules.OperationRemove, Header: "x", When: []headerrules.Condition{{Header: "y", Matches: "("}}},
+	}
+	for name, rule := range invalid {
+		if _, err := headerrules.New(headerrules.Config{Rules: []headerrules.Rule{rule}}); err == nil {
+			t.Errorf("New() with invalid %s succeeded", name)
+		}
+	}
+}
+
+func TestInvalidValue(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "http://www.example.com/search?q=a%0d%0ax-injected:1&page=2", nil)
+	result := run(t, []headerrules.Rule{
+		{Phase: headerrules.PhaseRequest, Operation: headerrules.OperationSet, Header: "x-search", Value: `{{.Query "q"}}`},
+		{Phase: headerrules.PhaseRequest, Operation: headerrules.OperationSet, Header: "x-page", Value: `{{.Query "page"}}`},
+	}, req, nil)
+	if got := result.Request.Header.Values("x-search"); got != nil {
+		t.Errorf("x-search = %q, want the rule skipped", got)
+	}
+	if got := result.Request.Header.Get("x-injected"); got != "" {
+		t.Errorf("x-injected = %q, want it absent", got)
+	}
+	if got := result.Request.Header.Get("x-page"); got != "2" {
+		t.Errorf("x-page = %q, want 2", got)
+	}
+}
@@ -0,0 +1,99 @@
+package headerrules
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/cainelli/ext-proc/pkg/service/processor"
+)
+
+// TemplateData is the data of the Value templates of the rules.
+type TemplateData struct {
+	req  *processor.RequestContext
+	view *view
+}
+
+// Method returns the method of the request.
+func (d *TemplateData) Method() string {
+	return d.req.Method()
+}
+
+// Path returns the path of the request, without the query.
+func (d *TemplateData) Path() string {
+	return d.req.URL().Path
+}
+
+// Query returns the value of a query parameter of the request.
+func (d *TemplateData) Query(name string) string {
+	return d.req.URL().Query().Get(name)
+}
+
+// Authority returns the authority of the request.
+func (d *TemplateData) Authority() string {
+	return d.req.Authority()
+}
+
+// Scheme returns the scheme of the request.
+func (d *TemplateData) Scheme() string {
+	return d.req.Scheme()
+}
+
+// RequestID returns the x-request-id of the request.
+func (d *TemplateData) RequestID() string {
+	return d.req.RequestID()
+}
+
+// Status returns the status code of the response, 0 in the request phase.
+func (d *TemplateData) Status() int {
+	return d.req.Status()
+}
+
+// Cookie returns the value of a cookie of the request.
+func (d *TemplateData) Cookie(name string) string {
+	for _, cookie := range d.req.Cookies() {
+		if cookie.Name == name {
+			return cookie.Value
+		}
+	}
+	return ""
+}
+
+// Header returns the first value of a header of the phase, as modified by the previous rules.
+func (d *TemplateData) Header(name string) string {
+	if values := d.view.values(strings.ToLower(name)); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// RequestHeader returns the first value of a header of the request as received, also in the response phase.
+func (d *TemplateData) RequestHeader(name string) string {
+	return d.req.GetRequestHeader(name)
+}
+
+// Metadata returns a value of the RequestContext metadata set by the previous processors. The fields are the keys
+// of nested maps, like {{.Metadata "jwt.claims" "sub"}} for a claim of the jwt processor. Strings are returned as
+// they are, other values as JSON, and missing values as an empty string.
+func (d *TemplateData) Metadata(key string, fields ...string) string {
+	value := d.req.Metadata()[key]
+	for _, field := range fields {
+		switch m := value.(type) {
+		case map[string]any:
+			value = m[field]
+		default:
+			return ""
+		}
+	}
+	switch value := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return value
+	default:
+		raw, err := json.Marshal(value)
+		if err != nil {
+			return ""
+		}
+		return string(raw)
+	}
+}
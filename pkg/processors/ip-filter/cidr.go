@@ -0,0 +1,143 @@
+package ipfilter
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math/bits"
+	"net/netip"
+	"strings"
+
+	"github.com/cainelli/ext-proc/pkg/service/processor"
+)
+
+// cidrSet is a set of IPv4 and IPv6 prefixes stored in path compressed binary radix trees, so a lookup visits at
+// most one node per distinct prefix length on the path of the address, whatever the size of the set.
+type cidrSet struct {
+	v4, v6 *node
+	size   int
+}
+
+// node is a prefix of the tree. Nodes created to split a path are not in the set.
+type node struct {
+	prefix netip.Prefix
+	inSet  bool
+	child  [2]*node
+}
+
+func newCIDRSet() *cidrSet {
+	return &cidrSet{
+		v4: &node{prefix: netip.PrefixFrom(netip.IPv4Unspecified(), 0)},
+		v6: &node{prefix: netip.PrefixFrom(netip.IPv6Unspecified(), 0)},
+	}
+}
+
+// add adds the prefix to the set, IPv4-mapped IPv6 prefixes are added as IPv4 prefixes.
+func (set *cidrSet) add(prefix netip.Prefix) {
+	if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+		prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+	}
+	prefix = prefix.Masked()
+	cur := set.v6
+	if prefix.Addr().Is4() {
+		cur = set.v4
+	}
+	for {
+		if cur.prefix.Bits() == prefix.Bits() {
+			if !cur.inSet {
+				cur.inSet = true
+				set.size++
+			}
+			return
+		}
+		b := bit(prefix.Addr(), cur.prefix.Bits())
+		child := cur.child[b]
+		if child == nil {
+			cur.child[b] = &node{prefix: prefix, inSet: true}
+			set.size++
+			return
+		}
+		common := min(commonBits(child.prefix.Addr(), prefix.Addr()), child.prefix.Bits(), prefix.Bits())
+		if common == child.prefix.Bits() {
+			cur = child
+			continue
+		}
+		// The prefix and the child diverge below cur, a node for their common prefix becomes the parent of both.
+		split := &node{prefix: netip.PrefixFrom(prefix.Addr(), common).Masked()}
+		cur.child[b] = split
+		split.child[bit(child.prefix.Addr(), common)] = child
+		if common == prefix.Bits() {
+			split.inSet = true
+		} else {
+			split.child[bit(prefix.Addr(), common)] = &node{prefix: prefix, inSet: true}
+		}
+		set.size++
+		return
+	}
+}
+
+// contains reports whether a prefix of the set contains the address.
+func (set *cidrSet) contains(addr netip.Addr) bool {
+	if !addr.IsValid() {
+		return false
+	}
+	addr = addr.Unmap().WithZone("")
+	cur := set.v6
+	if addr.Is4() {
+		cur = set.v4
+	}
+	for {
+		if cur.inSet {
+			return true
+		}
+		if cur.prefix.Bits() == addr.BitLen() {
+			return false
+		}
+		cur = cur.child[bit(addr, cur.prefix.Bits())]
+		if cur == nil || !cur.prefix.Contains(addr) {
+			return false
+		}
+	}
+}
+
+// bit returns the bit of the address at the index, from the most significant one.
+func bit(addr netip.Addr, i int) int {
+	if addr.Is4() {
+		i += 96
+	}
+	raw := addr.As16()
+	return int(raw[i/8]>>(7-i%8)) & 1
+}
+
+// commonBits returns the length of the common prefix of two addresses of the same family.
+func commonBits(a, b netip.Addr) int {
+	offset := 0
+	if a.Is4() {
+		offset = 96
+	}
+	rawA, rawB := a.As16(), b.As16()
+	for i := range rawA {
+		if x := rawA[i] ^ rawB[i]; x != 0 {
+			return i*8 + bits.LeadingZeros8(x) - offset
+		}
+	}
+	return 128 - offset
+}
+
+// readCIDRs reads a list with a CIDR or address per line. Empty lines and text after # are ignored.
+func readCIDRs(set *cidrSet, r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text, _, _ := strings.Cut(scanner.Text(), "#")
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+		prefix, err := processor.ParsePrefix(text)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		set.add(prefix)
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,106 @@
+package ipfilter
+
+import (
+	"math/rand/v2"
+	"net/netip"
+	"testing"
+
+	"github.com/cainelli/ext-proc/pkg/service/processor"
+)
+
+func TestCIDRSet(t *testing.T) {
+	set := newCIDRSet()
+	for _, s := range []string{"10.0.0.0/8", "192.168.1.0/24", "192.168.1.128/25", "203.0.113.7", "2001:db8::/32", "::ffff:198.51.100.0/120"} {
+		prefix, err := processor.ParsePrefix(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		set.add(prefix)
+	}
+	tests := map[string]bool{
+		"10.1.2.3":          true,
+		"11.0.0.1":          false,
+		"192.168.1.1":       true,
+		"192.168.1.200":     true,
+		"192.168.2.1":       false,
+		"203.0.113.7":       true,
+		"203.0.113.8":       false,
+		"198.51.100.42":     true,
+		"::ffff:10.0.0.1":   true,
+		"2001:db8:1::1":     true,
+		"2001:db9::1":       false,
+		"fe80::1%eth0":      false,
+		"2001:db8::1%eth0":  true,
+		"::":                false,
+		"0.0.0.0":           false,
+		"255.255.255.255":   false,
+		"192.168.1.127":     true,
+		"192.168.0.255":     false,
+		"10.255.255.255":    true,
+		"2001:db8:ffff::ff": true,
+	}
+	for s, want := range tests {
+		if got := set.contains(netip.MustParseAddr(s)); got != want {
+			t.Errorf("contains(%s) = %v, want %v", s, got, want)
+		}
+	}
+	if set.contains(netip.Addr{}) {
+		t.Errorf("set contains the zero address")
+	}
+	if set.size != 6 {
+		t.Errorf("size = %d, want 6", set.size)
+	}
+}
+
+// The tree agrees with a linear scan of the prefixes for random prefixes and addresses.
+func TestCIDRSetRandom(t *testing.T) {
+	rng := rand.New(rand.NewPCG(1, 2))
+	randomAddr := func() netip.Addr {
+		if rng.IntN(2) == 0 {
+			return netip.AddrFrom4([4]byte{byte(rng.IntN(4)), byte(rng.Uint32()), byte(rng.Uint32()), byte(rng.Uint32())})
+		}
+		var raw [16]byte
+		raw[0] = byte(rng.IntN(4))
+		for i := 1; i < 16; i++ {
+			raw[i] = byte(rng.Uint32())
+		}
+		return netip.AddrFrom16(raw)
+	}
+
+	set := newCIDRSet()
+	var prefixes []netip.Prefix
+	for range 2000 {
+		addr := randomAddr()
+		prefix := netip.PrefixFrom(addr, rng.IntN(addr.BitLen()+1)).Masked()
+		prefixes = append(prefixes, prefix)
+		set.add(prefix)
+	}
+	for range 20000 {
+		addr := randomAddr()
+		want := false
+		for _, prefix := range prefixes {
+			if prefix.Contains(addr) {
+				want = true
+				break
+			}
+		}
+		if got := set.contains(addr); got != want {
+			t.Fatalf("contains(%s) = %v, want %v", addr, got, want)
+		}
+	}
+}
+
+func BenchmarkCIDRSetContains(b *testing.B) {
+	rng := rand.New(rand.NewPCG(1, 2))
+	set := newCIDRSet()
+	for range 100_000 {
+		addr := netip.AddrFrom4([4]byte{byte(rng.Uint32()), byte(rng.Uint32()), byte(rng.Uint32()), 0})
+		set.add(netip.PrefixFrom(addr, 16+rng.IntN(9)).Masked())
+	}
+	addr := netip.MustParseAddr("203.0.113.7")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		set.contains(addr)
+	}
+}
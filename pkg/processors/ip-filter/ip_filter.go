@@ -0,0 +1,225 @@
+// Package ipfilter blocks or tags requests by client IP with allow and deny lists of CIDRs.
+package ipfilter
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/cainelli/ext-proc/pkg/service/processor"
+	extproc "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+)
+
+const (
+	// MatchMetadataKey is the key of the tag of a request in the RequestContext metadata, see Route.Action.
+	MatchMetadataKey = "ipfilter.match"
+	// DefaultTagHeader is the request header carrying the tag when Config.TagHeader is empty.
+	DefaultTagHeader = "x-ip-filter"
+	// DefaultReloadInterval is the interval between checks of the list files when Config.ReloadInterval is zero.
+	DefaultReloadInterval = 10 * time.Second
+	// NotAllowed is the tag of requests from addresses in none of the allow lists of the route.
+	NotAllowed = "not-allowed"
+)
+
+// Action is what happens to the requests rejected by a route.
+type Action string
+
+const (
+	// ActionBlock answers the request with a 403.
+	ActionBlock Action = "block"
+	// ActionTag lets the request through with the tag header set to the name of the deny list containing the address
+	// or NotAllowed, so the upstream decides.
+	ActionTag Action = "tag"
+)
+
+// List is a set of CIDRs or addresses, from the configuration and from a file.
+type List struct {
+	CIDRs []string `json:"cidrs,omitempty"`
+	// File has a CIDR or address per line, lines can have comments after #. It is reloaded when it changes.
+	File string `json:"file,omitempty"`
+}
+
+// Route applies allow and deny lists to the matching requests.
+// A request is rejected when its address is in a deny list, unless it is in an allow list. When the route has allow
+// lists, the addresses in none of them are rejected too, including requests whose address is unknown.
+type Route struct {
+	// Authorities are the authorities the route applies to, all when empty, see processor.MatchAuthority.
+	Authorities []string `json:"authorities,omitempty"`
+	// PathPrefix is the prefix of the paths the route applies to, all when empty.
+	PathPrefix string `json:"path_prefix,omitempty"`
+	// Allow and Deny are names of Config.Lists.
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+	// Action is what happens to the rejected requests, ActionBlock when empty.
+	Action Action `json:"action,omitempty"`
+}
+
+// Config configures an IPFilterProcessor.
+type Config struct {
+	// Lists are the CIDR lists by name.
+	Lists map[string]List `json:"lists"`
+	// Routes are matched in order, the first matching route applies.
+	Routes []Route `json:"routes"`
+	// TrustedHops is the number of proxies in front of Envoy appending to x-forwarded-for, see
+	// processor.RequestContext.ClientIP.
+	TrustedHops int `json:"trusted_hops,omitempty"`
+	// TagHeader is the request header carrying the tag of ActionTag routes, DefaultTagHeader when empty. It is
+	// always removed from the incoming request so clients cannot set it.
+	TagHeader string `json:"tag_header,omitempty"`
+	// ReloadInterval is the interval between checks of the list files, DefaultReloadInterval when zero.
+	ReloadInterval time.Duration `json:"reload_interval,omitempty"`
+}
+
+// IPFilterProcessor blocks or tags the requests whose client address is rejected by the lists of their route.
+type IPFilterProcessor struct {
+	processor.NoOpProcessor
+	config Config
+	lists  map[string]*list
+	routes []route
+}
+
+var _ processor.Processor = &IPFilterProcessor{}
+var _ processor.Initializer = &IPFilterProcessor{}
+
+type route struct {
+	Route
+	allow, deny []*list
+}
+
+// New loads the lists, the files are only reloaded once Init is called.
+func New(config Config) (*IPFilterProcessor, error) {
+	if config.TagHeader == "" {
+		config.TagHeader = DefaultTagHeader
+	}
+	if config.ReloadInterval <= 0 {
+		config.ReloadInterval = DefaultReloadInterval
+	}
+	p := &IPFilterProcessor{config: config, lists: make(map[string]*list, len(config.Lists))}
+	for name, c := range config.Lists {
+		l, err := newList(name, c)
+		if err != nil {
+			return nil, err
+		}
+		p.lists[name] = l
+	}
+	for i, r := range config.Routes {
+		if r.Action == "" {
+			r.Action = ActionBlock
+		}
+		if r.Action != ActionBlock && r.Action != ActionTag {
+			return nil, fmt.Errorf("invalid route %d: unknown action %q", i, r.Action)
+		}
+		if len(r.Allow) == 0 && len(r.Deny) == 0 {
+			return nil, fmt.Errorf("invalid route %d: no allow or deny list", i)
+		}
+		rt := route{Route: r}
+		for _, name := range r.Allow {
+			l, ok := p.lists[name]
+			if !ok {
+				return nil, fmt.Errorf("invalid route %d: unknown list %q", i, name)
+			}
+			rt.allow = append(rt.allow, l)
+		}
+		for _, name := range r.Deny {
+			l, ok := p.lists[name]
+			if !ok {
+				return nil, fmt.Errorf("invalid route %d: unknown list %q", i, name)
+			}
+			rt.deny = append(rt.deny, l)
+		}
+		p.routes = append(p.routes, rt)
+	}
+	return p, nil
+}
+
+// Init reloads the list files when they change until the context is done.
+func (p *IPFilterProcessor) Init(ctx context.Context) error {
+	var files []*list
+	for _, l := range p.lists {
+		if l.config.File != "" {
+			files = append(files, l)
+		}
+	}
+	if len(files) > 0 {
+		go watch(ctx, files, p.config.ReloadInterval)
+	}
+	return nil
+}
+
+// Describe returns the configuration with the number of prefixes of each list.
+func (p *IPFilterProcessor) Describe() any {
+	sizes := make(map[string]int, len(p.lists))
+	for name, l := range p.lists {
+		sizes[name] = l.set.Load().size
+	}
+	return map[string]any{"config": p.config, "prefixes": sizes}
+}
+
+func (p *IPFilterProcessor) RequestHeaders(ctx context.Context, crw *processor.CommonResponseWriter, req *processor.RequestContext) (*extproc.ProcessingResponse_ImmediateResponse, error) {
+	crw.RemoveHeaders(p.config.TagHeader)
+	r := p.route(req)
+	if r == nil {
+		return nil, nil
+	}
+	addr, _ := req.ClientIP(p.config.TrustedHops)
+	tag, rejected := r.check(addr)
+	if !rejected {
+		return nil, nil
+	}
+	if r.Action == ActionTag {
+		crw.HeaderSet(p.config.TagHeader, tag)
+		req.Metadata()[MatchMetadataKey] = tag
+		return nil, nil
+	}
+	slog.Debug("blocking request by client IP", "request-id", req.RequestID(), "client-ip", addr, "match", tag)
+	return forbidden(), nil
+}
+
+func (p *IPFilterProcessor) route(req *processor.RequestContext) *route {
+	for i := range p.routes {
+		r := &p.routes[i]
+		if !processor.MatchAuthority(r.Authorities, req.Authority()) {
+			continue
+		}
+		if !strings.HasPrefix(req.URL().Path, r.PathPrefix) {
+			continue
+		}
+		return r
+	}
+	return nil
+}
+
+// check returns whether the address is rejected by the route and why.
+func (r *route) check(addr netip.Addr) (string, bool) {
+	for _, l := range r.allow {
+		if l.contains(addr) {
+			return "", false
+		}
+	}
+	for _, l := range r.deny {
+		if l.contains(addr) {
+			return l.name, true
+		}
+	}
+	if len(r.allow) > 0 {
+		return NotAllowed, true
+	}
+	return "", false
+}
+
+func forbidden() *extproc.ProcessingResponse_ImmediateResponse {
+	crw := processor.NewCommonResponseWriter()
+	crw.HeaderSet("content-type", "text/plain; charset=utf-8")
+	return &extproc.ProcessingResponse_ImmediateResponse{
+		ImmediateResponse: &extproc.ImmediateResponse{
+			Status:  &typev3.HttpStatus{Code: typev3.StatusCode_Forbidden},
+			Headers: crw.CommonResponse().GetHeaderMutation(),
+			Body:    "Forbidden\n",
+			Details: "ip_filter_blocked",
+		},
+	}
+}
@@ -0,0 +1,153 @@
+package ipfilter_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	ipfilter "github.com/cainelli/ext-proc/pkg/processors/ip-filter"
+	"github.com/cainelli/ext-proc/pkg/service/processortest"
+)
+
+func send(t *testing.T, p *ipfilter.IPFilterProcessor, target, clientIP string, headers map[string]string) *processortest.Result {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	if clientIP != "" {
+		// The address of the load balancer in front of Envoy is the last one.
+		req.Header.Set("x-forwarded-for", clientIP+", 10.0.0.1")
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	return processortest.MustRun(t, processortest.Chain(p), req, nil)
+}
+
+func TestIPFilter(t *testing.T) {
+	dir := t.TempDir()
+	blocklist := filepath.Join(dir, "blocklist.txt")
+	if err := os.WriteFile(blocklist, []byte("# Abusive networks\n198.51.100.0/24\n2001:db8:bad::/48 # scanner\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	p, err := ipfilter.New(ipfilter.Config{
+		TrustedHops: 1,
+		Lists: map[string]ipfilter.List{
+			"office":    {CIDRs: []string{"203.0.113.0/24", "2001:db8:1::/48"}},
+			"blocklist": {File: blocklist},
+			"partners":  {CIDRs: []string{"192.0.2.10"}},
+		},
+		Routes: []ipfilter.Route{
+			{Authorities: []string{"admin.example.com"}, Allow: []string{"office"}},
+			{PathPrefix: "/api/", Allow: []string{"partners"}, Deny: []string{"blocklist"}, Action: ipfilter.ActionTag},
+			{Deny: []string{"blocklist"}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("New() = %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		target  string
+		ip      string
+		blocked bool
+		tag     string
+	}{
+		{"admin from office", "http://admin.example.com/", "203.0.113.5", false, ""},
+		{"admin from office over IPv6", "http://admin.example.com/", "2001:db8:1::7", false, ""},
+		{"admin from elsewhere", "http://admin.example.com/", "192.0.2.1", true, ""},
+		{"admin without address", "http://admin.example.com/", "", true, ""},
+		{"admin in uppercase from elsewhere", "http://ADMIN.example.com/", "192.0.2.1", true, ""},
+		{"admin with port from elsewhere", "http://admin.example.com:443/", "192.0.2.1", true, ""},
+		{"admin with port from office", "http://admin.example.com:443/", "203.0.113.5", false, ""},
+		{"site from blocklist", "http://www.example.com/", "198.51.100.9", true, ""},
+		{"site from blocklisted IPv6", "http://www.example.com/", "2001:db8:bad::1", true, ""},
+		{"site from elsewhere", "http://www.example.com/", "192.0.2.1", false, ""},
+		{"api from blocklist is tagged", "http://www.example.com/api/items", "198.51.100.9", false, "blocklist"},
+		{"api from partner", "http://www.example.com/api/items", "192.0.2.10", false, ""},
+		{"api from elsewhere is tagged", "http://www.example.com/api/items", "192.0.2.1", false, ipfilter.NotAllowed},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result := send(t, p, test.target, test.ip, map[string]string{ipfilter.DefaultTagHeader: "spoofed"})
+			if blocked := result.ImmediateResponse != nil; blocked != test.blocked {
+				t.Fatalf("blocked = %v, want %v", blocked, test.blocked)
+			}
+			if test.blocked {
+				if result.Response.StatusCode != http.StatusForbidden {
+					t.Errorf("status = %d, want 403", result.Response.StatusCode)
+				}
+				return
+			}
+			if got := result.Request.Header.Get(ipfilter.DefaultTagHeader); got != test.tag {
+				t.Errorf("tag = %q, want %q", got, test.tag)
+			}
+		})
+	}
+}
+
+func TestReload(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "blocklist.txt")
+	if err := os.WriteFile(file, []byte("198.51.100.0/24\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	p, err := ipfilter.New(ipfilter.Config{
+		Lists:          map[string]ipfilter.List{"blocklist": {File: file}},
+		Routes:         []ipfilter.Route{{Deny: []string{"blocklist"}}},
+		TrustedHops:    1,
+		ReloadInterval: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("New() = %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := p.Init(ctx); err != nil {
+		t.Fatalf("Init() = %v", err)
+	}
+	if result := send(t, p, "http://www.example.com/", "192.0.2.1", nil); result.ImmediateResponse != nil {
+		t.Fatalf("address outside the list was blocked")
+	}
+
+	replaceFile(t, file, "198.51.100.0/24\n192.0.2.0/24\n")
+	processortest.WaitFor(t, func() bool {
+		return send(t, p, "http://www.example.com/", "192.0.2.1", nil).ImmediateResponse != nil
+	})
+
+	// An invalid file keeps the current list.
+	replaceFile(t, file, "not a cidr\n")
+	time.Sleep(50 * time.Millisecond)
+	if result := send(t, p, "http://www.example.com/", "192.0.2.1", nil); result.ImmediateResponse == nil {
+		t.Errorf("invalid file replaced the list")
+	}
+}
+
+func TestNewInvalid(t *testing.T) {
+	invalid := map[string]ipfilter.Config{
+		"invalid CIDR": {Lists: map[string]ipfilter.List{"l": {CIDRs: []string{"10.0.0.0/33"}}}},
+		"missing file": {Lists: map[string]ipfilter.List{"l": {File: "/does/not/exist"}}},
+		"unknown list": {Routes: []ipfilter.Route{{Deny: []string{"l"}}}},
+		"no lists":     {Routes: []ipfilter.Route{{PathPrefix: "/"}}},
+		"bad action":   {Lists: map[string]ipfilter.List{"l": {}}, Routes: []ipfilter.Route{{Deny: []string{"l"}, Action: "drop"}}},
+	}
+	for name, config := range invalid {
+		if _, err := ipfilter.New(config); err == nil {
+			t.Errorf("New() with %s succeeded", name)
+		}
+	}
+}
+
+// replaceFile replaces the file atomically, so the reloader never reads it half written.
+func replaceFile(t *testing.T, file, content string) {
+	t.Helper()
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,101 @@
+package ipfilter
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/cainelli/ext-proc/pkg/service/processor"
+)
+
+// list is a named CIDR set. The set is replaced as a whole when the file changes, so lookups never see a partially
+// loaded list.
+type list struct {
+	name   string
+	config List
+	set    atomic.Pointer[cidrSet]
+
+	// modTime and size identify the loaded version of the file, they are only used by the reload loop.
+	modTime time.Time
+	size    int64
+}
+
+func newList(name string, config List) (*list, error) {
+	l := &list{name: name, config: config}
+	if err := l.load(); err != nil {
+		return nil, fmt.Errorf("invalid list %q: %w", name, err)
+	}
+	return l, nil
+}
+
+// load builds the set from the CIDRs and the file.
+func (l *list) load() error {
+	set := newCIDRSet()
+	for _, cidr := range l.config.CIDRs {
+		prefix, err := processor.ParsePrefix(cidr)
+		if err != nil {
+			return err
+		}
+		set.add(prefix)
+	}
+	if l.config.File != "" {
+		f, err := os.Open(l.config.File)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		// An invalid version of the file is not retried until it changes again.
+		l.modTime, l.size = info.ModTime(), info.Size()
+		if err := readCIDRs(set, f); err != nil {
+			return fmt.Errorf("%s: %w", l.config.File, err)
+		}
+	}
+	l.set.Store(set)
+	return nil
+}
+
+// changed reports whether the file changed since it was loaded.
+func (l *list) changed() bool {
+	info, err := os.Stat(l.config.File)
+	if err != nil {
+		slog.Warn("failed checking IP list file", "list", l.name, "file", l.config.File, "error", err)
+		return false
+	}
+	return !info.ModTime().Equal(l.modTime) || info.Size() != l.size
+}
+
+func (l *list) contains(addr netip.Addr) bool {
+	return l.set.Load().contains(addr)
+}
+
+// watch reloads the lists whose file changed at every interval until the context is done. The current set is kept
+// when the new file is invalid.
+func watch(ctx context.Context, lists []*list, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, l := range lists {
+				if l.config.File == "" || !l.changed() {
+					continue
+				}
+				if err := l.load(); err != nil {
+					slog.Warn("failed reloading IP list, keeping the current one", "list", l.name, "error", err)
+					continue
+				}
+				slog.Info("reloaded IP list", "list", l.name, "file", l.config.File, "prefixes", l.set.Load().size)
+			}
+		}
+	}
+}
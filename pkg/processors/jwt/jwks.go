@@ -0,0 +1,245 @@
+package jwt
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// minRefreshInterval limits the refreshes triggered by tokens signed with unknown keys, so forged key ids do not
+// flood the JWKS endpoint.
+const minRefreshInterval = 30 * time.Second
+
+// maxJWKSSize is the maximum size of a JWKS document.
+const maxJWKSSize = 1 << 20
+
+// key is a verification key of the key set.
+type key struct {
+	id  string
+	alg string
+	// public is a *rsa.PublicKey, *ecdsa.PublicKey, ed25519.PublicKey or the []byte secret of HS256.
+	public any
+}
+
+// jwk is the JSON representation of a key, RFC 7517.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	K   string `json:"k"`
+}
+
+// parseJWKS parses a JWKS document. Keys which are not for signatures or of unsupported types are skipped.
+func parseJWKS(raw []byte) ([]*key, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(raw, &set); err != nil {
+		return nil, fmt.Errorf("invalid JWKS: %w", err)
+	}
+	keys := make([]*key, 0, len(set.Keys))
+	for _, j := range set.Keys {
+		if j.Use != "" && j.Use != "sig" {
+			continue
+		}
+		public, err := j.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %q in JWKS: %w", j.Kid, err)
+		}
+		if public == nil {
+			continue
+		}
+		keys = append(keys, &key{id: j.Kid, alg: j.Alg, public: public})
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("JWKS has no supported signing key")
+	}
+	return keys, nil
+}
+
+func (j *jwk) publicKey() (any, error) {
+	switch j.Kty {
+	case "RSA":
+		n, err := decodeBigInt(j.N)
+		if err != nil {
+			return nil, fmt.Errorf("n: %w", err)
+		}
+		e, err := decodeBigInt(j.E)
+		if err != nil || !e.IsInt64() {
+			return nil, fmt.Errorf("e: %w", errors.Join(err, errors.New("invalid exponent")))
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if j.Crv != "P-256" {
+			return nil, nil
+		}
+		x, errX := decodeBigInt(j.X)
+		y, errY := decodeBigInt(j.Y)
+		if err := errors.Join(errX, errY); err != nil {
+			return nil, err
+		}
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+		if !pub.Curve.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on the P-256 curve")
+		}
+		return pub, nil
+	case "OKP":
+		if j.Crv != "Ed25519" {
+			return nil, nil
+		}
+		x, err := base64.RawURLEncoding.DecodeString(j.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("x: %w", errors.Join(err, errors.New("invalid Ed25519 public key")))
+		}
+		return ed25519.PublicKey(x), nil
+	case "oct":
+		k, err := base64.RawURLEncoding.DecodeString(j.K)
+		if err != nil || len(k) == 0 {
+			return nil, fmt.Errorf("k: %w", errors.Join(err, errors.New("empty secret")))
+		}
+		return k, nil
+	}
+	return nil, nil
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) == 0 {
+		return nil, errors.New("empty value")
+	}
+	return new(big.Int).SetBytes(raw), nil
+}
+
+// keySet caches the keys of a JWKS file or URL. It is refreshed periodically and when a token is signed with an
+// unknown key, so keys can be rotated by publishing the new key before using it.
+type keySet struct {
+	file   string
+	url    string
+	client *http.Client
+
+	mu   sync.RWMutex
+	keys []*key
+	// refreshMu serializes the refreshes so concurrent requests with an unknown key trigger a single one, it guards
+	// lastUnknownRefresh.
+	refreshMu          sync.Mutex
+	lastUnknownRefresh time.Time
+}
+
+// lookup returns the candidate keys for the key id, every key when the token has no key id.
+func (ks *keySet) lookup(kid string) []*key {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	if kid == "" {
+		return ks.keys
+	}
+	for _, k := range ks.keys {
+		if k.id == kid {
+			return []*key{k}
+		}
+	}
+	return nil
+}
+
+// refreshUnknown refreshes the keys for a key id not in the set, unless an unknown key triggered a refresh less than
+// minRefreshInterval ago.
+func (ks *keySet) refreshUnknown(ctx context.Context, kid string) []*key {
+	ks.refreshMu.Lock()
+	defer ks.refreshMu.Unlock()
+	// Another request may have refreshed the keys while this one was waiting.
+	if keys := ks.lookup(kid); len(keys) > 0 {
+		return keys
+	}
+	if time.Since(ks.lastUnknownRefresh) < minRefreshInterval {
+		return nil
+	}
+	ks.lastUnknownRefresh = time.Now()
+	if err := ks.refresh(ctx); err != nil {
+		slog.Warn("failed refreshing JWKS for unknown key", "kid", kid, "error", err)
+		return nil
+	}
+	return ks.lookup(kid)
+}
+
+// refresh loads the keys, the current keys are kept when it fails.
+func (ks *keySet) refresh(ctx context.Context) error {
+	raw, err := ks.load(ctx)
+	if err != nil {
+		return err
+	}
+	keys, err := parseJWKS(raw)
+	if err != nil {
+		return err
+	}
+	ks.mu.Lock()
+	ks.keys = keys
+	ks.mu.Unlock()
+	return nil
+}
+
+func (ks *keySet) load(ctx context.Context) ([]byte, error) {
+	if ks.file != "" {
+		raw, err := os.ReadFile(ks.file)
+		if err != nil {
+			return nil, fmt.Errorf("failed reading JWKS file: %w", err)
+		}
+		return raw, nil
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, ks.url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid JWKS URL: %w", err)
+	}
+	request.Header.Set("accept", "application/json")
+	resp, err := ks.client.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("failed fetching JWKS: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed fetching JWKS: %s", resp.Status)
+	}
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, maxJWKSSize))
+	if err != nil {
+		return nil, fmt.Errorf("failed reading JWKS: %w", err)
+	}
+	return raw, nil
+}
+
+// run refreshes the keys at every interval until the context is done.
+func (ks *keySet) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			ks.refreshMu.Lock()
+			if err := ks.refresh(ctx); err != nil {
+				slog.Warn("failed refreshing JWKS, keeping the current keys", "error", err)
+			}
+			ks.refreshMu.Unlock()
+		}
+	}
+}
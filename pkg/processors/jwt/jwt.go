@@ -0,0 +1,175 @@
+// Package jwt validates the bearer tokens of requests with the keys of a JWKS file or URL.
+package jwt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cainelli/ext-proc/pkg/service/processor"
+	extproc "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+)
+
+const (
+	// ClaimsMetadataKey is the key of the claims of a validated token in the RequestContext metadata, stored as
+	// processor.Claims.
+	ClaimsMetadataKey = "jwt.claims"
+	// DefaultRefreshInterval is the interval between JWKS refreshes when Config.RefreshInterval is zero.
+	DefaultRefreshInterval = 10 * time.Minute
+)
+
+// Config configures a JWTProcessor. Exactly one of JWKSFile and JWKSURL must be set.
+type Config struct {
+	// JWKSFile is the path of a JWKS document, e.g. a mounted Kubernetes secret.
+	JWKSFile string `json:"jwks_file,omitempty"`
+	// JWKSURL is the URL of a JWKS document, e.g. https://issuer.example.com/.well-known/jwks.json.
+	JWKSURL string `json:"jwks_url,omitempty"`
+	// RefreshInterval is the interval between JWKS refreshes, DefaultRefreshInterval when zero. Tokens signed with an
+	// unknown key also trigger a refresh.
+	RefreshInterval time.Duration `json:"refresh_interval,omitempty"`
+	// Issuer is the required iss claim, any issuer is accepted when empty.
+	Issuer string `json:"issuer,omitempty"`
+	// Audiences are the accepted aud claims, any audience is accepted when empty.
+	Audiences []string `json:"audiences,omitempty"`
+	// ClockSkew is the leeway allowed when checking the exp, nbf and iat claims.
+	ClockSkew time.Duration `json:"clock_skew,omitempty"`
+	// ClaimHeaders maps claims to the request headers forwarded to the upstream, e.g. "sub": "x-jwt-sub".
+	// The headers are always removed from the incoming request so clients cannot set them.
+	ClaimHeaders map[string]string `json:"claim_headers,omitempty"`
+	// Optional lets requests without token through. Requests with an invalid token are still rejected.
+	Optional bool `json:"optional,omitempty"`
+	// HTTPClient fetches JWKSURL, a client with a 10s timeout is used when nil.
+	HTTPClient *http.Client `json:"-"`
+}
+
+// JWTProcessor rejects requests without a valid bearer token with a 401 immediate response. The claims of valid
+// tokens are forwarded as headers and stored in the RequestContext metadata under ClaimsMetadataKey.
+type JWTProcessor struct {
+	config Config
+	keys   *keySet
+	now    func() time.Time
+}
+
+var _ processor.Processor = &JWTProcessor{}
+var _ processor.Initializer = &JWTProcessor{}
+
+func New(config Config) (*JWTProcessor, error) {
+	if (config.JWKSFile == "") == (config.JWKSURL == "") {
+		return nil, errors.New("exactly one of JWKSFile and JWKSURL must be set")
+	}
+	if config.RefreshInterval <= 0 {
+		config.RefreshInterval = DefaultRefreshInterval
+	}
+	client := config.HTTPClient
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	return &JWTProcessor{
+		config: config,
+		keys:   &keySet{file: config.JWKSFile, url: config.JWKSURL, client: client},
+		now:    time.Now,
+	}, nil
+}
+
+// Init loads the keys and refreshes them in the background until the context is done.
+func (p *JWTProcessor) Init(ctx context.Context) error {
+	if err := p.keys.refresh(ctx); err != nil {
+		return fmt.Errorf("failed loading JWKS: %w", err)
+	}
+	go p.keys.run(ctx, p.config.RefreshInterval)
+	return nil
+}
+
+// Describe returns the configuration.
+func (p *JWTProcessor) Describe() any {
+	return p.config
+}
+
+func (p *JWTProcessor) RequestHeaders(ctx context.Context, crw *processor.CommonResponseWriter, req *processor.RequestContext) (*extproc.ProcessingResponse_ImmediateResponse, error) {
+	for _, h := range p.config.ClaimHeaders {
+		crw.RemoveHeaders(h)
+	}
+
+	raw, found := bearerToken(req.GetRequestHeader("authorization"))
+	if !found {
+		if p.config.Optional {
+			return nil, nil
+		}
+		return unauthorized("missing bearer token"), nil
+	}
+	claims, err := p.validate(ctx, raw)
+	if err != nil {
+		slog.Info("rejecting request with invalid token", "request-id", req.RequestID(), "error", err)
+		return unauthorized("invalid token"), nil
+	}
+
+	req.Metadata()[ClaimsMetadataKey] = processor.Claims(claims)
+	for claim, h := range p.config.ClaimHeaders {
+		if value, ok := processor.ClaimValue(claims[claim]); ok {
+			crw.HeaderSet(h, value)
+		}
+	}
+	return nil, nil
+}
+
+func (*JWTProcessor) ResponseHeaders(ctx context.Context, crw *processor.CommonResponseWriter, req *processor.RequestContext) (*extproc.ProcessingResponse_ImmediateResponse, error) {
+	return nil, nil
+}
+
+// validate verifies the token with the key set and checks its claims.
+func (p *JWTProcessor) validate(ctx context.Context, raw string) (Claims, error) {
+	t, err := parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	keys := p.keys.lookup(t.header.Kid)
+	if len(keys) == 0 {
+		keys = p.keys.refreshUnknown(ctx, t.header.Kid)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%w: kid %q", ErrUnknownKey, t.header.Kid)
+	}
+	err = ErrInvalidSignature
+	for _, k := range keys {
+		if err = t.verify(k); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := t.validate(p.now(), p.config.Issuer, p.config.Audiences, p.config.ClockSkew); err != nil {
+		return nil, err
+	}
+	return t.claims, nil
+}
+
+func bearerToken(authorization string) (string, bool) {
+	scheme, token, found := strings.Cut(authorization, " ")
+	if !found || !strings.EqualFold(scheme, "bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
+
+func unauthorized(description string) *extproc.ProcessingResponse_ImmediateResponse {
+	crw := processor.NewCommonResponseWriter()
+	crw.HeaderSet("www-authenticate", fmt.Sprintf(`Bearer error="invalid_token", error_description=%q`, description))
+	crw.HeaderSet("content-type", "application/json")
+	body, _ := json.Marshal(map[string]string{"error": "unauthorized", "error_description": description})
+	return &extproc.ProcessingResponse_ImmediateResponse{
+		ImmediateResponse: &extproc.ImmediateResponse{
+			Status:  &typev3.HttpStatus{Code: typev3.StatusCode_Unauthorized},
+			Headers: crw.CommonResponse().GetHeaderMutation(),
+			Body:    string(body),
+			Details: "jwt_unauthorized",
+		},
+	}
+}
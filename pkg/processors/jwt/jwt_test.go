@@ -0,0 +1,290 @@
+package jwt_test
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cainelli/ext-proc/pkg/processors/jwt"
+	"github.com/cainelli/ext-proc/pkg/service/processortest"
+)
+
+// signer signs test tokens and describes its public key as a JWK.
+type signer struct {
+	kid  string
+	alg  string
+	sign func(input []byte) []byte
+	jwk  map[string]string
+}
+
+func b64(raw []byte) string {
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func newSigners(t *testing.T) []*signer {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPub, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := []byte("0123456789abcdef0123456789abcdef")
+
+	return []*signer{
+		{
+			kid: "rsa", alg: jwt.RS256,
+			sign: func(input []byte) []byte {
+				digest := sha256.Sum256(input)
+				sig, _ := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, digest[:])
+				return sig
+			},
+			jwk: map[string]string{"kty": "RSA", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+		},
+		{
+			kid: "ec", alg: jwt.ES256,
+			sign: func(input []byte) []byte {
+				digest := sha256.Sum256(input)
+				r, s, _ := ecdsa.Sign(rand.Reader, ecKey, digest[:])
+				sig := make([]byte, 64)
+				r.FillBytes(sig[:32])
+				s.FillBytes(sig[32:])
+				return sig
+			},
+			jwk: map[string]string{"kty": "EC", "crv": "P-256", "x": b64(ecKey.X.FillBytes(make([]byte, 32))), "y": b64(ecKey.Y.FillBytes(make([]byte, 32)))},
+		},
+		{
+			kid: "ed", alg: jwt.EdDSA,
+			sign: func(input []byte) []byte { return ed25519.Sign(edKey, input) },
+			jwk:  map[string]string{"kty": "OKP", "crv": "Ed25519", "x": b64(edPub)},
+		},
+		{
+			kid: "hs", alg: jwt.HS256,
+			sign: func(input []byte) []byte {
+				mac := hmac.New(sha256.New, secret)
+				mac.Write(input)
+				return mac.Sum(nil)
+			},
+			jwk: map[string]string{"kty": "oct", "k": b64(secret)},
+		},
+	}
+}
+
+func (s *signer) token(t *testing.T, claims map[string]any) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": s.alg, "kid": s.kid, "typ": "JWT"})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := b64(header) + "." + b64(payload)
+	return input + "." + b64(s.sign([]byte(input)))
+}
+
+func jwks(signers ...*signer) []byte {
+	keys := make([]map[string]string, 0, len(signers))
+	for _, s := range signers {
+		k := map[string]string{"kid": s.kid, "alg": s.alg, "use": "sig"}
+		for name, value := range s.jwk {
+			k[name] = value
+		}
+		keys = append(keys, k)
+	}
+	raw, _ := json.Marshal(map[string]any{"keys": keys})
+	return raw
+}
+
+func validClaims() map[string]any {
+	return map[string]any{
+		"iss":   "https://issuer.example.com",
+		"aud":   []string{"other", "api"},
+		"sub":   "user-1",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"iat":   time.Now().Unix(),
+		"roles": []string{"admin", "dev"},
+	}
+}
+
+func send(t *testing.T, p *jwt.JWTProcessor, authorization string) (*processortest.Result, *processortest.ClaimsRecorder) {
+	t.Helper()
+	recorder := &processortest.ClaimsRecorder{Key: jwt.ClaimsMetadataKey}
+	req := httptest.NewRequest(http.MethodGet, "http://api.example.com/", nil)
+	req.Header.Set("x-jwt-sub", "spoofed")
+	if authorization != "" {
+		req.Header.Set("authorization", authorization)
+	}
+	return processortest.MustRun(t, processortest.Chain(p, recorder), req, nil), recorder
+}
+
+func TestJWTProcessor(t *testing.T) {
+	signers := newSigners(t)
+	file := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(file, jwks(signers...), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	p, err := jwt.New(jwt.Config{
+		JWKSFile:     file,
+		Issuer:       "https://issuer.example.com",
+		Audiences:    []string{"api"},
+		ClockSkew:    time.Minute,
+		ClaimHeaders: map[string]string{"sub": "x-jwt-sub", "roles": "x-jwt-roles"},
+	})
+	if err != nil {
+		t.Fatalf("New() = %v", err)
+	}
+	if err := p.Init(context.Background()); err != nil {
+		t.Fatalf("Init() = %v", err)
+	}
+
+	for _, s := range signers {
+		t.Run(s.alg, func(t *testing.T) {
+			result, recorder := send(t, p, "Bearer "+s.token(t, validClaims()))
+			if result.ImmediateResponse != nil {
+				t.Fatalf("valid token rejected: %s", result.ImmediateResponse.GetBody())
+			}
+			if got := result.Request.Header.Get("x-jwt-sub"); got != "user-1" {
+				t.Errorf("x-jwt-sub = %q, want user-1", got)
+			}
+			if got := result.Request.Header.Get("x-jwt-roles"); got != "admin,dev" {
+				t.Errorf("x-jwt-roles = %q, want admin,dev", got)
+			}
+			if recorder.Claims["sub"] != "user-1" {
+				t.Errorf("claims in metadata = %v", recorder.Claims)
+			}
+		})
+	}
+
+	rs := signers[0]
+	claims := func(change func(map[string]any)) map[string]any {
+		c := validClaims()
+		change(c)
+		return c
+	}
+	tests := map[string]string{
+		"missing token":   "",
+		"not a bearer":    "Basic dXNlcjpwYXNz",
+		"malformed":       "Bearer abc.def",
+		"expired":         "Bearer " + rs.token(t, claims(func(c map[string]any) { c["exp"] = time.Now().Add(-2 * time.Minute).Unix() })),
+		"without exp":     "Bearer " + rs.token(t, claims(func(c map[string]any) { delete(c, "exp") })),
+		"not yet valid":   "Bearer " + rs.token(t, claims(func(c map[string]any) { c["nbf"] = time.Now().Add(2 * time.Minute).Unix() })),
+		"wrong issuer":    "Bearer " + rs.token(t, claims(func(c map[string]any) { c["iss"] = "https://evil.example.com" })),
+		"wrong audience":  "Bearer " + rs.token(t, claims(func(c map[string]any) { c["aud"] = "other" })),
+		"unknown key":     "Bearer " + (&signer{kid: "unknown", alg: rs.alg, sign: rs.sign}).token(t, validClaims()),
+		"alg mismatch":    "Bearer " + (&signer{kid: "hs", alg: jwt.RS256, sign: rs.sign}).token(t, validClaims()),
+		"alg none":        "Bearer " + (&signer{kid: "rsa", alg: "none", sign: func([]byte) []byte { return nil }}).token(t, validClaims()),
+		"tampered claims": "Bearer " + tamper(rs.token(t, validClaims())),
+	}
+	for name, authorization := range tests {
+		t.Run(name, func(t *testing.T) {
+			result, _ := send(t, p, authorization)
+			if result.ImmediateResponse == nil || result.Response.StatusCode != http.StatusUnauthorized {
+				t.Fatalf("request was not rejected with 401")
+			}
+			if result.Response.Header.Get("www-authenticate") == "" {
+				t.Errorf("www-authenticate is missing")
+			}
+		})
+	}
+
+	// Within the clock skew the token is still valid.
+	result, _ := send(t, p, "Bearer "+rs.token(t, claims(func(c map[string]any) { c["exp"] = time.Now().Add(-30 * time.Second).Unix() })))
+	if result.ImmediateResponse != nil {
+		t.Errorf("token expired within the clock skew was rejected")
+	}
+}
+
+func TestOptional(t *testing.T) {
+	signers := newSigners(t)
+	file := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(file, jwks(signers...), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	p, err := jwt.New(jwt.Config{JWKSFile: file, Optional: true, ClaimHeaders: map[string]string{"sub": "x-jwt-sub"}})
+	if err != nil {
+		t.Fatalf("New() = %v", err)
+	}
+	result, _ := send(t, p, "")
+	if result.ImmediateResponse != nil {
+		t.Fatalf("request without token was rejected")
+	}
+	if got := result.Request.Header.Get("x-jwt-sub"); got != "" {
+		t.Errorf("x-jwt-sub = %q, want the spoofed header removed", got)
+	}
+	if result, _ := send(t, p, "Bearer invalid"); result.ImmediateResponse == nil {
+		t.Errorf("invalid token was accepted")
+	}
+}
+
+// Tokens signed with a new key are accepted once the key is published, without waiting for the refresh interval.
+func TestKeyRotation(t *testing.T) {
+	signers := newSigners(t)
+	oldKey, newKey := signers[0], signers[1]
+	var document atomic.Value
+	document.Store(jwks(oldKey))
+	var fetches atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		fetches.Add(1)
+		_, _ = w.Write(document.Load().([]byte))
+	}))
+	defer srv.Close()
+
+	p, err := jwt.New(jwt.Config{JWKSURL: srv.URL})
+	if err != nil {
+		t.Fatalf("New() = %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := p.Init(ctx); err != nil {
+		t.Fatalf("Init() = %v", err)
+	}
+
+	if result, _ := send(t, p, "Bearer "+oldKey.token(t, validClaims())); result.ImmediateResponse != nil {
+		t.Fatalf("token signed with the current key was rejected")
+	}
+	document.Store(jwks(oldKey, newKey))
+	if result, _ := send(t, p, "Bearer "+newKey.token(t, validClaims())); result.ImmediateResponse != nil {
+		t.Fatalf("token signed with the rotated key was rejected")
+	}
+	// Unknown keys do not trigger a fetch on every request.
+	unknown := &signer{kid: "unknown", alg: oldKey.alg, sign: oldKey.sign}
+	for range 3 {
+		send(t, p, "Bearer "+unknown.token(t, validClaims()))
+	}
+	if got := fetches.Load(); got != 2 {
+		t.Errorf("JWKS fetched %d times, want 2", got)
+	}
+}
+
+func tamper(token string) string {
+	raw := []byte(token)
+	// Flip a character of the claims, between the two dots.
+	for i := range raw {
+		if raw[i] == '.' {
+			raw[i+2] ^= 1
+			break
+		}
+	}
+	return string(raw)
+}
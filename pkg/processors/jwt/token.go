@@ -0,0 +1,193 @@
+package jwt
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Supported signing algorithms.
+const (
+	RS256 = "RS256"
+	ES256 = "ES256"
+	EdDSA = "EdDSA"
+	HS256 = "HS256"
+)
+
+var (
+	ErrMalformed        = errors.New("malformed token")
+	ErrUnsupportedAlg   = errors.New("unsupported signing algorithm")
+	ErrUnknownKey       = errors.New("no key to verify the token")
+	ErrInvalidSignature = errors.New("invalid signature")
+	ErrExpired          = errors.New("token is expired")
+	ErrNotYetValid      = errors.New("token is not valid yet")
+	ErrInvalidIssuer    = errors.New("invalid issuer")
+	ErrInvalidAudience  = errors.New("invalid audience")
+)
+
+// Claims are the claims of a validated token.
+type Claims map[string]any
+
+// Subject returns the sub claim.
+func (c Claims) Subject() string {
+	sub, _ := c["sub"].(string)
+	return sub
+}
+
+// header is the JOSE header of a token.
+type header struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// token is a parsed but not yet verified token.
+type token struct {
+	header       header
+	claims       Claims
+	signingInput []byte
+	signature    []byte
+}
+
+func parse(raw string) (*token, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: expected 3 parts, got %d", ErrMalformed, len(parts))
+	}
+	t := &token{signingInput: []byte(parts[0] + "." + parts[1])}
+	if err := decodeSegment(parts[0], &t.header); err != nil {
+		return nil, fmt.Errorf("%w: header: %w", ErrMalformed, err)
+	}
+	if err := decodeSegment(parts[1], &t.claims); err != nil {
+		return nil, fmt.Errorf("%w: claims: %w", ErrMalformed, err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: signature: %w", ErrMalformed, err)
+	}
+	t.signature = signature
+	return t, nil
+}
+
+func decodeSegment(segment string, v any) error {
+	raw, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	// Numbers are kept as json.Number so large integer claims are not rounded.
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
+
+// verify checks the signature of the token with the key.
+func (t *token) verify(k *key) error {
+	if k.alg != "" && k.alg != t.header.Alg {
+		return fmt.Errorf("%w: key %q is for %s, token is signed with %s", ErrInvalidSignature, k.id, k.alg, t.header.Alg)
+	}
+	digest := sha256.Sum256(t.signingInput)
+	switch t.header.Alg {
+	case RS256:
+		pub, ok := k.public.(*rsa.PublicKey)
+		if !ok || rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], t.signature) != nil {
+			return ErrInvalidSignature
+		}
+	case ES256:
+		pub, ok := k.public.(*ecdsa.PublicKey)
+		if !ok || len(t.signature) != 64 {
+			return ErrInvalidSignature
+		}
+		r := new(big.Int).SetBytes(t.signature[:32])
+		s := new(big.Int).SetBytes(t.signature[32:])
+		if !ecdsa.Verify(pub, digest[:], r, s) {
+			return ErrInvalidSignature
+		}
+	case EdDSA:
+		pub, ok := k.public.(ed25519.PublicKey)
+		if !ok || !ed25519.Verify(pub, t.signingInput, t.signature) {
+			return ErrInvalidSignature
+		}
+	case HS256:
+		secret, ok := k.public.([]byte)
+		if !ok {
+			return ErrInvalidSignature
+		}
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(t.signingInput)
+		if !hmac.Equal(mac.Sum(nil), t.signature) {
+			return ErrInvalidSignature
+		}
+	default:
+		return fmt.Errorf("%w: %q", ErrUnsupportedAlg, t.header.Alg)
+	}
+	return nil
+}
+
+// validate checks the registered claims of the token at the given time.
+func (t *token) validate(now time.Time, issuer string, audiences []string, skew time.Duration) error {
+	exp, ok := numericDate(t.claims["exp"])
+	if !ok {
+		return fmt.Errorf("%w: missing exp claim", ErrExpired)
+	}
+	if now.After(exp.Add(skew)) {
+		return ErrExpired
+	}
+	if nbf, ok := numericDate(t.claims["nbf"]); ok && now.Add(skew).Before(nbf) {
+		return ErrNotYetValid
+	}
+	if iat, ok := numericDate(t.claims["iat"]); ok && now.Add(skew).Before(iat) {
+		return fmt.Errorf("%w: issued in the future", ErrNotYetValid)
+	}
+	if issuer != "" {
+		if iss, _ := t.claims["iss"].(string); iss != issuer {
+			return fmt.Errorf("%w: %q", ErrInvalidIssuer, iss)
+		}
+	}
+	if len(audiences) > 0 && !slices.ContainsFunc(audienceClaim(t.claims["aud"]), func(aud string) bool {
+		return slices.Contains(audiences, aud)
+	}) {
+		return ErrInvalidAudience
+	}
+	return nil
+}
+
+func numericDate(v any) (time.Time, bool) {
+	n, ok := v.(json.Number)
+	if !ok {
+		return time.Time{}, false
+	}
+	f, err := n.Float64()
+	if err != nil {
+		return time.Time{}, false
+	}
+	sec, frac := int64(f), f-float64(int64(f))
+	return time.Unix(sec, int64(frac*float64(time.Second))), true
+}
+
+// audienceClaim returns the aud claim, which is either a string or an array of strings.
+func audienceClaim(v any) []string {
+	switch aud := v.(type) {
+	case string:
+		return []string{aud}
+	case []any:
+		audiences := make([]string, 0, len(aud))
+		for _, a := range aud {
+			if s, ok := a.(string); ok {
+				audiences = append(audiences, s)
+			}
+		}
+		return audiences
+	}
+	return nil
+}
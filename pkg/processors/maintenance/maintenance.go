@@ -0,0 +1,304 @@
+// Package maintenance answers requests with a maintenance page while maintenance mode is on and replaces the bodies
+// of upstream error responses with custom error pages.
+package maintenance
+
+import (
+	"cmp"
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/cainelli/ext-proc/pkg/service/processor"
+	extproc "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+)
+
+const (
+	// DefaultFlagInterval is the interval between checks of the flag file when Config.FlagInterval is zero.
+	DefaultFlagInterval = 5 * time.Second
+
+	// ActionEnable turns maintenance mode on through the admin API.
+	ActionEnable = "enable"
+	// ActionDisable turns off the maintenance mode turned on through the admin API, the flag file still applies.
+	ActionDisable = "disable"
+	// ActionStatus returns the State without changing it.
+	ActionStatus = "status"
+
+	// errorPageKey is the key of the rendered error page in the RequestContext metadata, between the response phases.
+	errorPageKey = "maintenance.error-page"
+	// errorPageSentKey marks in the RequestContext metadata that the error page replaced a body chunk already.
+	errorPageSentKey = "maintenance.error-page-sent"
+)
+
+// Config configures a MaintenanceProcessor.
+type Config struct {
+	// Authorities are the authorities put in maintenance and served error pages, all when empty, see
+	// processor.MatchAuthority.
+	Authorities []string `json:"authorities,omitempty"`
+	// Enabled turns maintenance mode on at startup, like ActionEnable.
+	Enabled bool `json:"enabled,omitempty"`
+	// FlagFile turns maintenance mode on while the file exists, it is checked every FlagInterval once Init is called.
+	FlagFile string `json:"flag_file,omitempty"`
+	// FlagInterval is the interval between checks of FlagFile, DefaultFlagInterval when zero.
+	FlagInterval time.Duration `json:"flag_interval,omitempty"`
+	// AllowCIDRs are the client addresses or CIDRs passing through during maintenance, e.g. the office to test the
+	// release.
+	AllowCIDRs []string `json:"allow_cidrs,omitempty"`
+	// TrustedHops is the number of proxies in front of Envoy appending to x-forwarded-for, see
+	// processor.RequestContext.ClientIP.
+	TrustedHops int `json:"trusted_hops,omitempty"`
+	// AllowHeaders are headers and values letting requests pass through during maintenance, e.g. a bypass token.
+	AllowHeaders map[string]string `json:"-"`
+	// Page is the html/template of the maintenance page executed with PageData, DefaultPage when empty.
+	Page string `json:"-"`
+	// RetryAfter is sent in the retry-after header of the maintenance page when set.
+	RetryAfter time.Duration `json:"retry_after,omitempty"`
+	// ErrorPages are html/templates executed with PageData by status code, like "404", or by class, "4xx" or "5xx".
+	// They replace the body of the upstream responses with these statuses for the requests accepting text/html, so
+	// API clients still get the upstream errors. The status code is kept.
+	ErrorPages map[string]string `json:"-"`
+}
+
+// State is the maintenance mode state returned by the admin actions.
+type State struct {
+	// Maintenance is whether maintenance mode is on, either through the admin API or the flag file.
+	Maintenance bool `json:"maintenance"`
+	Admin       bool `json:"admin"`
+	FlagFile    bool `json:"flag_file"`
+}
+
+// MaintenanceProcessor answers the requests with a 503 maintenance page while maintenance mode is on, except for the
+// allowed addresses and headers, and serves the error pages. Error pages require the BUFFERED or STREAMED
+// response_body_mode.
+type MaintenanceProcessor struct {
+	config     Config
+	allow      []netip.Prefix
+	page       *page
+	errorPages map[string]*page
+
+	admin atomic.Bool
+	flag  atomic.Bool
+}
+
+var _ processor.Processor = &MaintenanceProcessor{}
+var _ processor.ResponseBodyProcessor = &MaintenanceProcessor{}
+var _ processor.Initializer = &MaintenanceProcessor{}
+var _ processor.Actioner = &MaintenanceProcessor{}
+
+// New parses the pages. The flag file is only checked once Init is called.
+func New(config Config) (*MaintenanceProcessor, error) {
+	if config.FlagInterval <= 0 {
+		config.FlagInterval = DefaultFlagInterval
+	}
+	p := &MaintenanceProcessor{config: config, errorPages: make(map[string]*page, len(config.ErrorPages))}
+	p.admin.Store(config.Enabled)
+	for _, s := range config.AllowCIDRs {
+		prefix, err := processor.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowed CIDR %q: %w", s, err)
+		}
+		p.allow = append(p.allow, prefix.Masked())
+	}
+	var err error
+	if p.page, err = newPage("maintenance", cmp.Or(config.Page, DefaultPage)); err != nil {
+		return nil, err
+	}
+	for key, text := range config.ErrorPages {
+		if !validStatusKey(key) {
+			return nil, fmt.Errorf("invalid error page %q: not a 4xx or 5xx status or class", key)
+		}
+		if p.errorPages[key], err = newPage(key, text); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// Init checks the flag file and keeps checking it until the context is done.
+func (p *MaintenanceProcessor) Init(ctx context.Context) error {
+	if p.config.FlagFile == "" {
+		return nil
+	}
+	p.checkFlag()
+	go func() {
+		ticker := time.NewTicker(p.config.FlagInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				p.checkFlag()
+			}
+		}
+	}()
+	return nil
+}
+
+func (p *MaintenanceProcessor) checkFlag() {
+	_, err := os.Stat(p.config.FlagFile)
+	if err != nil && !os.IsNotExist(err) {
+		slog.Warn("failed checking maintenance flag file, keeping the current mode", "file", p.config.FlagFile, "error", err)
+		return
+	}
+	if on := err == nil; p.flag.Swap(on) != on {
+		slog.Warn("maintenance mode changed by the flag file", "file", p.config.FlagFile, "maintenance", on)
+	}
+}
+
+// Action runs ActionEnable, ActionDisable or ActionStatus and returns the State.
+func (p *MaintenanceProcessor) Action(ctx context.Context, name string) (any, error) {
+	switch name {
+	case ActionEnable:
+		p.admin.Store(true)
+	case ActionDisable:
+		p.admin.Store(false)
+	case ActionStatus:
+	default:
+		return nil, fmt.Errorf("unknown action %q, want %s, %s or %s", name, ActionEnable, ActionDisable, ActionStatus)
+	}
+	return p.State(), nil
+}
+
+// State returns the current maintenance mode state.
+func (p *MaintenanceProcessor) State() State {
+	admin, flag := p.admin.Load(), p.flag.Load()
+	return State{Maintenance: admin || flag, Admin: admin, FlagFile: flag}
+}
+
+// Describe returns the configuration with the current state and the configured error pages.
+func (p *MaintenanceProcessor) Describe() any {
+	pages := make([]string, 0, len(p.errorPages))
+	for key := range p.errorPages {
+		pages = append(pages, key)
+	}
+	slices.Sort(pages)
+	return map[string]any{"config": p.config, "state": p.State(), "error_pages": pages}
+}
+
+func (p *MaintenanceProcessor) RequestHeaders(ctx context.Context, crw *processor.CommonResponseWriter, req *processor.RequestContext) (*extproc.ProcessingResponse_ImmediateResponse, error) {
+	if !p.State().Maintenance || !p.applies(req) || p.allowed(req) {
+		return nil, nil
+	}
+	body, err := p.page.render(newPageData(req, http.StatusServiceUnavailable, p.config.RetryAfter))
+	if err != nil {
+		return nil, err
+	}
+	headers := processor.NewCommonResponseWriter()
+	headers.HeaderSet("content-type", "text/html; charset=utf-8")
+	headers.HeaderSet("cache-control", "no-store")
+	if p.config.RetryAfter > 0 {
+		headers.HeaderSet("retry-after", strconv.Itoa(int(p.config.RetryAfter.Seconds())))
+	}
+	return &extproc.ProcessingResponse_ImmediateResponse{
+		ImmediateResponse: &extproc.ImmediateResponse{
+			Status:  &typev3.HttpStatus{Code: typev3.StatusCode_ServiceUnavailable},
+			Headers: headers.CommonResponse().GetHeaderMutation(),
+			Body:    string(body),
+			Details: "maintenance",
+		},
+	}, nil
+}
+
+// ResponseHeaders renders the error page of the status and replaces the headers describing the upstream body. The
+// body is replaced in ResponseBody, or right away when the response has none.
+func (p *MaintenanceProcessor) ResponseHeaders(ctx context.Context, crw *processor.CommonResponseWriter, req *processor.RequestContext) (*extproc.ProcessingResponse_ImmediateResponse, error) {
+	status := req.Status()
+	page := p.errorPage(status)
+	if page == nil || !p.applies(req) || !acceptsHTML(req) {
+		return nil, nil
+	}
+	body, err := page.render(newPageData(req, status, 0))
+	if err != nil {
+		slog.Warn("failed rendering error page, keeping the upstream body", "request-id", req.RequestID(), "status", status, "error", err)
+		return nil, nil
+	}
+	crw.HeaderSet("content-type", "text/html; charset=utf-8")
+	crw.RemoveHeaders("content-length", "content-encoding", "etag", "last-modified")
+	if req.ResponseEndOfStream() {
+		crw.SetStatus(extproc.CommonResponse_CONTINUE_AND_REPLACE)
+		crw.BodyMutation(&extproc.BodyMutation{Mutation: &extproc.BodyMutation_Body{Body: body}})
+		return nil, nil
+	}
+	req.Metadata()[errorPageKey] = body
+	return nil, nil
+}
+
+// ResponseBody replaces the body with the error page rendered in ResponseHeaders. In the STREAMED
+// response_body_mode the first chunk is replaced with the page and the next ones are cleared.
+func (p *MaintenanceProcessor) ResponseBody(ctx context.Context, crw *processor.CommonResponseWriter, req *processor.RequestContext, body *extproc.HttpBody) (*extproc.ProcessingResponse_ImmediateResponse, error) {
+	page, ok := req.Metadata()[errorPageKey].([]byte)
+	if !ok {
+		return nil, nil
+	}
+	if req.Metadata()[errorPageSentKey] == true {
+		crw.BodyMutation(&extproc.BodyMutation{Mutation: &extproc.BodyMutation_ClearBody{ClearBody: true}})
+		return nil, nil
+	}
+	req.Metadata()[errorPageSentKey] = true
+	crw.BodyMutation(&extproc.BodyMutation{Mutation: &extproc.BodyMutation_Body{Body: page}})
+	return nil, nil
+}
+
+func (p *MaintenanceProcessor) applies(req *processor.RequestContext) bool {
+	return len(p.config.Authorities) == 0 || processor.MatchAuthority(p.config.Authorities, req.Authority())
+}
+
+// allowed reports whether the request passes through maintenance mode.
+func (p *MaintenanceProcessor) allowed(req *processor.RequestContext) bool {
+	for key, value := range p.config.AllowHeaders {
+		if got := req.GetRequestHeader(key); got != "" && subtle.ConstantTimeCompare([]byte(got), []byte(value)) == 1 {
+			return true
+		}
+	}
+	if len(p.allow) == 0 {
+		return false
+	}
+	addr, ok := req.ClientIP(p.config.TrustedHops)
+	if !ok {
+		return false
+	}
+	for _, prefix := range p.allow {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// errorPage returns the page of the status code, or of its class.
+func (p *MaintenanceProcessor) errorPage(status int) *page {
+	if len(p.errorPages) == 0 || status < 400 || status > 599 {
+		return nil
+	}
+	if page, ok := p.errorPages[strconv.Itoa(status)]; ok {
+		return page
+	}
+	return p.errorPages[strconv.Itoa(status/100)+"xx"]
+}
+
+func validStatusKey(key string) bool {
+	if key == "4xx" || key == "5xx" {
+		return true
+	}
+	status, err := strconv.Atoi(key)
+	return err == nil && len(key) == 3 && status >= 400 && status <= 599
+}
+
+func acceptsHTML(req *processor.RequestContext) bool {
+	for _, value := range req.RequestHeaders().Values("accept") {
+		if strings.Contains(value, "text/html") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,258 @@
+package maintenance_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cainelli/ext-proc/pkg/processors/maintenance"
+	"github.com/cainelli/ext-proc/pkg/service"
+	"github.com/cainelli/ext-proc/pkg/service/processor"
+	"github.com/cainelli/ext-proc/pkg/service/processortest"
+	extproc "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+)
+
+func run(t *testing.T, svc *service.ExtProcessor, req *http.Request, resp *http.Response) (*processortest.Result, string) {
+	t.Helper()
+	result := processortest.MustRun(t, svc, req, resp)
+	if result.Response == nil {
+		return result, ""
+	}
+	body, err := io.ReadAll(result.Response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result, string(body)
+}
+
+func TestMaintenance(t *testing.T) {
+	p, err := maintenance.New(maintenance.Config{
+		Authorities:  []string{"www.example.com"},
+		AllowCIDRs:   []string{"203.0.113.0/24"},
+		TrustedHops:  1,
+		AllowHeaders: map[string]string{"x-maintenance-bypass": "s3cr3t"},
+		RetryAfter:   10 * time.Minute,
+	})
+	if err != nil {
+		t.Fatalf("New() = %v", err)
+	}
+	svc := &service.ExtProcessor{Processors: []processor.Processor{p}}
+	index, _ := svc.ProcessorIndex("MaintenanceProcessor")
+
+	request := func(target, clientIP string, headers map[string]string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.Header.Set("x-forwarded-for", clientIP+", 10.0.0.1")
+		req.Header.Set("x-request-id", "abc")
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		return req
+	}
+
+	if result, _ := run(t, svc, request("http://www.example.com/", "192.0.2.1", nil), nil); result.ImmediateResponse != nil {
+		t.Fatalf("request answered while maintenance mode is off")
+	}
+
+	state, err := svc.ProcessorAction(context.Background(), index, maintenance.ActionEnable)
+	if err != nil {
+		t.Fatalf("ProcessorAction(enable) = %v", err)
+	}
+	if !state.(maintenance.State).Maintenance {
+		t.Fatalf("state = %+v, want maintenance", state)
+	}
+
+	result, body := run(t, svc, request("http://www.example.com/", "192.0.2.1", nil), nil)
+	if result.ImmediateResponse == nil {
+		t.Fatalf("request passed during maintenance")
+	}
+	if result.Response.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want 503", result.Response.StatusCode)
+	}
+	if got := result.Response.Header.Get("retry-after"); got != "600" {
+		t.Errorf("retry-after = %q, want 600", got)
+	}
+	if got := result.Response.Header.Get("content-type"); got != "text/html; charset=utf-8" {
+		t.Errorf("content-type = %q", got)
+	}
+	if !strings.Contains(body, "www.example.com is being updated") || !strings.Contains(body, "Request ID: abc") {
+		t.Errorf("body = %q, want the default page", body)
+	}
+
+	for _, target := range []string{"http://WWW.Example.com/", "http://www.example.com:8080/"} {
+		if result, _ := run(t, svc, request(target, "192.0.2.1", nil), nil); result.ImmediateResponse == nil {
+			t.Errorf("request to %s passed during maintenance", target)
+		}
+	}
+
+	passing := map[string]*http.Request{
+		"other authority": request("http://api.example.com/", "192.0.2.1", nil),
+		"allowed address": request("http://www.example.com/", "203.0.113.9", nil),
+		"bypass header":   request("http://www.example.com/", "192.0.2.1", map[string]string{"x-maintenance-bypass": "s3cr3t"}),
+	}
+	for name, req := range passing {
+		if result, _ := run(t, svc, req, nil); result.ImmediateResponse != nil {
+			t.Errorf("request with %s was answered during maintenance", name)
+		}
+	}
+	if result, _ := run(t, svc, request("http://www.example.com/", "192.0.2.1", map[string]string{"x-maintenance-bypass": "guess"}), nil); result.ImmediateResponse == nil {
+		t.Errorf("request with a wrong bypass header passed")
+	}
+
+	if _, err := svc.ProcessorAction(context.Background(), index, maintenance.ActionDisable); err != nil {
+		t.Fatalf("ProcessorAction(disable) = %v", err)
+	}
+	if result, _ := run(t, svc, request("http://www.example.com/", "192.0.2.1", nil), nil); result.ImmediateResponse != nil {
+		t.Errorf("request answered after maintenance mode was disabled")
+	}
+	if _, err := svc.ProcessorAction(context.Background(), index, "reboot"); err == nil {
+		t.Errorf("ProcessorAction(reboot) succeeded")
+	}
+}
+
+func TestFlagFile(t *testing.T) {
+	flag := filepath.Join(t.TempDir(), "maintenance")
+	p, err := maintenance.New(maintenance.Config{FlagFile: flag, FlagInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("New() = %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := p.Init(ctx); err != nil {
+		t.Fatalf("Init() = %v", err)
+	}
+	if p.State().Maintenance {
+		t.Fatalf("maintenance mode on without the flag file")
+	}
+	if err := os.WriteFile(flag, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	processortest.WaitFor(t, func() bool { return p.State().Maintenance })
+
+	// Disabling through the admin API does not override the flag file.
+	if _, err := p.Action(ctx, maintenance.ActionDisable); err != nil {
+		t.Fatal(err)
+	}
+	if !p.State().Maintenance {
+		t.Errorf("maintenance mode off while the flag file exists")
+	}
+	if err := os.Remove(flag); err != nil {
+		t.Fatal(err)
+	}
+	processortest.WaitFor(t, func() bool { return !p.State().Maintenance })
+}
+
+func TestErrorPages(t *testing.T) {
+	p, err := maintenance.New(maintenance.Config{
+		ErrorPages: map[string]string{
+			"404": "<h1>{{.Path}} not found</h1>",
+			"5xx": "<h1>{{.Status}} {{.StatusText}}</h1><p>{{.RequestID}}</p>",
+		},
+	})
+	if err != nil {
+		t.Fatalf("New() = %v", err)
+	}
+	svc := &service.ExtProcessor{Processors: []processor.Processor{p}}
+
+	tests := []struct {
+		name     string
+		accept   string
+		status   int
+		body     string
+		wantBody string
+	}{
+		{"5xx class", "text/html", http.StatusBadGateway, "upstream connect error", "<h1>502 Bad Gateway</h1><p>&lt;script&gt;</p>"},
+		{"exact status", "text/html,*/*", http.StatusNotFound, "404 page not found", "<h1>/missing not found</h1>"},
+		{"without body", "text/html", http.StatusNotFound, "", "<h1>/missing not found</h1>"},
+		{"no page", "text/html", http.StatusForbidden, "forbidden", "forbidden"},
+		{"success", "text/html", http.StatusOK, "ok", "ok"},
+		{"API client", "application/json", http.StatusBadGateway, `{"error":"bad gateway"}`, `{"error":"bad gateway"}`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://www.example.com/missing", nil)
+			req.Header.Set("accept", test.accept)
+			req.Header.Set("x-request-id", "<script>")
+			resp := &http.Response{StatusCode: test.status, Header: http.Header{"Content-Type": {"text/plain"}}}
+			if test.body != "" {
+				resp.Body = io.NopCloser(strings.NewReader(test.body))
+				resp.Header.Set("content-length", "12")
+			}
+			result, body := run(t, svc, req, resp)
+			if result.Response.StatusCode != test.status {
+				t.Errorf("status = %d, want %d", result.Response.StatusCode, test.status)
+			}
+			if body != test.wantBody {
+				t.Errorf("body = %q, want %q", body, test.wantBody)
+			}
+			replaced := test.body != test.wantBody
+			if got := result.Response.Header.Get("content-type") == "text/html; charset=utf-8"; got != replaced {
+				t.Errorf("content-type = %q", result.Response.Header.Get("content-type"))
+			}
+			if replaced && result.Response.Header.Get("content-length") != "" {
+				t.Errorf("content-length of the upstream body was kept")
+			}
+		})
+	}
+}
+
+func TestErrorPageStreamed(t *testing.T) {
+	p, err := maintenance.New(maintenance.Config{ErrorPages: map[string]string{"5xx": "<h1>{{.Status}}</h1>"}})
+	if err != nil {
+		t.Fatalf("New() = %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), processortest.Timeout)
+	defer cancel()
+	sess := processortest.NewSession(ctx, processortest.Chain(p))
+	defer sess.Close()
+
+	req := httptest.NewRequest(http.MethodGet, "http://www.example.com/", nil)
+	req.Header.Set("accept", "text/html")
+	resp := &http.Response{StatusCode: http.StatusBadGateway, Header: http.Header{"Content-Type": {"text/plain"}}}
+	for _, msg := range []*extproc.ProcessingRequest{processortest.RequestHeaders(req, true), processortest.ResponseHeaders(resp, false)} {
+		if _, err := sess.Exchange(msg); err != nil {
+			t.Fatalf("Exchange() = %v", err)
+		}
+	}
+
+	// Each chunk of the upstream body is mutated, only the first one into the page.
+	chunks := []string{"upstream ", "connect ", "error"}
+	var body []byte
+	for i, chunk := range chunks {
+		msg, err := sess.Exchange(processortest.ResponseBody([]byte(chunk), i == len(chunks)-1))
+		if err != nil {
+			t.Fatalf("Exchange() = %v", err)
+		}
+		mutation := msg.GetResponseBody().GetResponse().GetBodyMutation()
+		if mutation == nil {
+			t.Fatalf("chunk %d was not mutated", i)
+		}
+		if i > 0 && !mutation.GetClearBody() {
+			t.Errorf("chunk %d = %v, want it cleared", i, mutation)
+		}
+		body = append(body, mutation.GetBody()...)
+	}
+	if string(body) != "<h1>502</h1>" {
+		t.Errorf("body = %q, want the page once", body)
+	}
+}
+
+func TestNewInvalid(t *testing.T) {
+	invalid := map[string]maintenance.Config{
+		"CIDR":             {AllowCIDRs: []string{"10.0.0.0/33"}},
+		"page":             {Page: "{{.Authority"},
+		"error page":       {ErrorPages: map[string]string{"500": "{{"}},
+		"error page class": {ErrorPages: map[string]string{"3xx": "moved"}},
+		"error page code":  {ErrorPages: map[string]string{"200": "ok"}},
+	}
+	for name, config := range invalid {
+		if _, err := maintenance.New(config); err == nil {
+			t.Errorf("New() with invalid %s succeeded", name)
+		}
+	}
+}
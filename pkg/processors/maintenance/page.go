@@ -0,0 +1,70 @@
+package maintenance
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"net/http"
+	"time"
+
+	"github.com/cainelli/ext-proc/pkg/service/processor"
+)
+
+// DefaultPage is the maintenance page used when Config.Page is empty.
+const DefaultPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Down for maintenance</title>
+<style>body{font-family:system-ui,sans-serif;margin:15vh auto;max-width:36rem;padding:0 1rem;color:#222}small{color:#777}</style>
+</head>
+<body>
+<h1>Down for maintenance</h1>
+<p>{{.Authority}} is being updated and will be back shortly{{if .RetryAfter}}, in about {{.RetryAfter}}{{end}}.</p>
+<p><small>Request ID: {{.RequestID}}</small></p>
+</body>
+</html>
+`
+
+// PageData is the data of the maintenance and error page templates.
+type PageData struct {
+	Status     int
+	StatusText string
+	Authority  string
+	Path       string
+	RequestID  string
+	// RetryAfter is Config.RetryAfter on the maintenance page, zero on error pages.
+	RetryAfter time.Duration
+}
+
+func newPageData(req *processor.RequestContext, status int, retryAfter time.Duration) PageData {
+	return PageData{
+		Status:     status,
+		StatusText: http.StatusText(status),
+		Authority:  req.Authority(),
+		Path:       req.URL().Path,
+		RequestID:  req.RequestID(),
+		RetryAfter: retryAfter,
+	}
+}
+
+type page struct {
+	template *template.Template
+}
+
+func newPage(name, text string) (*page, error) {
+	t, err := template.New(name).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s page: %w", name, err)
+	}
+	return &page{template: t}, nil
+}
+
+func (p *page) render(data PageData) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := p.template.Execute(&buf, data); err != nil {
+		return nil, fmt.Errorf("failed rendering %s page: %w", p.template.Name(), err)
+	}
+	return buf.Bytes(), nil
+}
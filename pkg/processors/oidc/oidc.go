@@ -0,0 +1,515 @@
+// Package oidc authenticates browser requests with an OpenID Connect provider and keeps the session in an encrypted
+// cookie, so internal tools get SSO at the edge without handling it themselves.
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cainelli/ext-proc/pkg/service/processor"
+	extproc "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+)
+
+const (
+	// ClaimsMetadataKey is the key of the ID token claims of the session in the RequestContext metadata, stored as
+	// processor.Claims.
+	ClaimsMetadataKey = "oidc.claims"
+	// DefaultCookieName is the name of the session cookie when Config.CookieName is empty.
+	DefaultCookieName = "_ext_proc_session"
+	// DefaultSessionTTL is the lifetime of a session when Config.SessionTTL is zero.
+	DefaultSessionTTL = 12 * time.Hour
+	// DefaultLogoutPath is the logout path when Config.LogoutPath is empty.
+	DefaultLogoutPath = "/oauth2/logout"
+
+	// loginStateTTL is the time a user has to log in at the provider.
+	loginStateTTL = 10 * time.Minute
+	// discoveryMinBackoff and discoveryMaxBackoff bound the time failed discoveries are returned without fetching the
+	// document again, the backoff doubles with every failure.
+	discoveryMinBackoff = time.Second
+	discoveryMaxBackoff = time.Minute
+	// setCookieMetadataKey holds the session cookie to set on the response after a token refresh.
+	setCookieMetadataKey = "oidc.set-cookie"
+)
+
+// Config configures an OIDCProcessor.
+type Config struct {
+	// Issuer is the issuer URL of the provider, its endpoints are read from the discovery document. The issuer and
+	// its token endpoint must use https, plain http is only accepted on loopback addresses for local development.
+	Issuer string `json:"issuer"`
+	// ClientID and ClientSecret are the credentials of the client registered at the provider.
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"-"`
+	// RedirectURL is the callback URL registered at the provider, e.g. https://tools.example.com/oauth2/callback.
+	// Requests to its path are handled by the processor.
+	RedirectURL string `json:"redirect_url"`
+	// Scopes are the requested scopes, openid is always requested.
+	Scopes []string `json:"scopes,omitempty"`
+	// CookieName is the name of the session cookie, DefaultCookieName when empty.
+	CookieName string `json:"cookie_name,omitempty"`
+	// CookieSecret is the 16, 24 or 32 bytes AES key encrypting the cookies. Changing it logs everybody out.
+	CookieSecret []byte `json:"-"`
+	// InsecureCookies drops the Secure attribute of the cookies, for local development over plain HTTP.
+	InsecureCookies bool `json:"insecure_cookies,omitempty"`
+	// SessionTTL is the lifetime of a session, DefaultSessionTTL when zero. Users log in again once it ends.
+	SessionTTL time.Duration `json:"session_ttl,omitempty"`
+	// LogoutPath ends the session and redirects to the end session endpoint of the provider, DefaultLogoutPath when empty.
+	LogoutPath string `json:"logout_path,omitempty"`
+	// PostLogoutRedirectURL is where users land after logging out.
+	PostLogoutRedirectURL string `json:"post_logout_redirect_url,omitempty"`
+	// ClaimHeaders forwards ID token claims of the session to the upstream, e.g. "email": "x-forwarded-email". These
+	// claims and sub are the only ones kept in the session cookie. Incoming values of the headers are dropped.
+	ClaimHeaders map[string]string `json:"claim_headers,omitempty"`
+	// ForwardAccessToken sends the access token to the upstream in the authorization header.
+	ForwardAccessToken bool `json:"forward_access_token,omitempty"`
+	// HTTPClient calls the provider, a client with a 10s timeout is used when nil.
+	HTTPClient *http.Client `json:"-"`
+}
+
+// OIDCProcessor requires a session for every request:
+//   - requests with a valid session cookie go upstream with the claim headers, the access token is refreshed with
+//     the refresh token once expired.
+//   - browser navigations without session are redirected to the provider, other requests get a 401.
+//   - the callback path exchanges the authorization code, sets the session cookie and redirects to the initial URL.
+//   - the logout path clears the session cookie and redirects to the end session endpoint of the provider.
+//
+// The session cookie is removed from the request sent upstream.
+type OIDCProcessor struct {
+	config       Config
+	cipher       *cookieCipher
+	client       *http.Client
+	callbackPath string
+	now          func() time.Time
+
+	mu       sync.Mutex
+	provider *provider
+	// fetching is closed once the discovery in flight ends.
+	fetching     chan struct{}
+	discoveryErr error
+	failures     int
+	retryAt      time.Time
+}
+
+var _ processor.Processor = &OIDCProcessor{}
+var _ processor.Initializer = &OIDCProcessor{}
+
+func New(config Config) (*OIDCProcessor, error) {
+	if config.Issuer == "" || config.ClientID == "" || config.RedirectURL == "" {
+		return nil, errors.New("Issuer, ClientID and RedirectURL are required")
+	}
+	if !secureURL(config.Issuer) {
+		return nil, fmt.Errorf("invalid Issuer %q: https is required", config.Issuer)
+	}
+	redirectURL, err := url.Parse(config.RedirectURL)
+	if err != nil || !redirectURL.IsAbs() {
+		return nil, fmt.Errorf("invalid RedirectURL %q", config.RedirectURL)
+	}
+	cipher, err := newCookieCipher(config.CookieSecret)
+	if err != nil {
+		return nil, err
+	}
+	if config.CookieName == "" {
+		config.CookieName = DefaultCookieName
+	}
+	if config.SessionTTL <= 0 {
+		config.SessionTTL = DefaultSessionTTL
+	}
+	if config.LogoutPath == "" {
+		config.LogoutPath = DefaultLogoutPath
+	}
+	client := config.HTTPClient
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	return &OIDCProcessor{
+		config:       config,
+		cipher:       cipher,
+		client:       client,
+		callbackPath: redirectURL.Path,
+		now:          time.Now,
+	}, nil
+}
+
+// Init fetches the discovery document of the provider.
+func (p *OIDCProcessor) Init(ctx context.Context) error {
+	_, err := p.discover(ctx)
+	return err
+}
+
+// Describe returns the configuration, without the secrets.
+func (p *OIDCProcessor) Describe() any {
+	return p.config
+}
+
+func (p *OIDCProcessor) RequestHeaders(ctx context.Context, crw *processor.CommonResponseWriter, req *processor.RequestContext) (*extproc.ProcessingResponse_ImmediateResponse, error) {
+	for _, h := range p.config.ClaimHeaders {
+		crw.RemoveHeaders(h)
+	}
+	// Requests are denied while the provider is unknown, whatever the failure mode of Envoy.
+	prov, err := p.discover(ctx)
+	if err != nil {
+		slog.Warn("OIDC provider discovery failed", "request-id", req.RequestID(), "error", err)
+		return immediate(typev3.StatusCode_ServiceUnavailable, "oidc_provider_unavailable", nil, "retry-after", strconv.Itoa(p.retryAfter())), nil
+	}
+
+	switch req.URL().Path {
+	case p.callbackPath:
+		return p.callback(ctx, prov, req), nil
+	case p.config.LogoutPath:
+		return p.logout(prov), nil
+	}
+
+	sess, ok := p.session(req)
+	if ok && sess.tokenExpired(p.now()) {
+		ok = p.refresh(ctx, prov, req, sess)
+	}
+	if !ok {
+		return p.login(prov, req)
+	}
+
+	req.Metadata()[ClaimsMetadataKey] = sess.Claims
+	for claim, h := range p.config.ClaimHeaders {
+		if value, ok := processor.ClaimValue(sess.Claims[claim]); ok {
+			crw.HeaderSet(h, value)
+		}
+	}
+	if p.config.ForwardAccessToken {
+		crw.HeaderSet("authorization", "Bearer "+sess.AccessToken)
+	}
+	p.stripSessionCookie(crw, req)
+	return nil, nil
+}
+
+func (p *OIDCProcessor) ResponseHeaders(_ context.Context, crw *processor.CommonResponseWriter, req *processor.RequestContext) (*extproc.ProcessingResponse_ImmediateResponse, error) {
+	if cookie, ok := req.Metadata()[setCookieMetadataKey].(string); ok {
+		crw.HeaderAppend("set-cookie", cookie)
+	}
+	return nil, nil
+}
+
+// discover returns the provider endpoints, fetching the discovery document until it succeeds once. A single request
+// fetches it at a time, the others wait for its result. After a failure, the error is returned without fetching again
+// until the backoff elapses.
+func (p *OIDCProcessor) discover(ctx context.Context) (*provider, error) {
+	p.mu.Lock()
+	for p.provider == nil && p.fetching != nil {
+		fetching := p.fetching
+		p.mu.Unlock()
+		select {
+		case <-fetching:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		p.mu.Lock()
+	}
+	if p.provider != nil || p.now().Before(p.retryAt) {
+		prov, err := p.provider, p.discoveryErr
+		p.mu.Unlock()
+		return prov, err
+	}
+	fetching := make(chan struct{})
+	p.fetching = fetching
+	p.mu.Unlock()
+
+	prov, err := discover(ctx, p.client, p.config.Issuer)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.fetching = nil
+	close(fetching)
+	if err != nil {
+		// The request giving up is not a failure of the provider.
+		if ctx.Err() == nil {
+			p.discoveryErr = err
+			p.retryAt = p.now().Add(min(discoveryMinBackoff<<p.failures, discoveryMaxBackoff))
+			p.failures = min(p.failures+1, 16)
+		}
+		return nil, err
+	}
+	p.provider, p.discoveryErr = prov, nil
+	return prov, nil
+}
+
+// retryAfter returns the seconds until the discovery document is fetched again after a failure, at least one.
+func (p *OIDCProcessor) retryAfter() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return max(int(math.Ceil(p.retryAt.Sub(p.now()).Seconds())), 1)
+}
+
+// session returns the session of the request cookie, if it is valid.
+func (p *OIDCProcessor) session(req *processor.RequestContext) (*session, bool) {
+	for _, cookie := range req.Cookies() {
+		if cookie.Name != p.config.CookieName {
+			continue
+		}
+		sess := &session{}
+		if err := p.cipher.open(cookie.Name, cookie.Value, sess); err != nil || sess.expired(p.now()) {
+			return nil, false
+		}
+		return sess, true
+	}
+	return nil, false
+}
+
+// refresh renews the access token of the session, the new session cookie is set on the response.
+func (p *OIDCProcessor) refresh(ctx context.Context, prov *provider, req *processor.RequestContext, sess *session) bool {
+	if sess.RefreshToken == "" {
+		return false
+	}
+	tokens, err := p.token(ctx, prov, url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {sess.RefreshToken},
+	})
+	if err != nil {
+		slog.Info("failed refreshing OIDC session", "request-id", req.RequestID(), "error", err)
+		return false
+	}
+	if tokens.IDToken != "" {
+		claims, err := p.idTokenClaims(tokens.IDToken, prov.Issuer, "", p.now())
+		if err != nil {
+			slog.Info("failed refreshing OIDC session", "request-id", req.RequestID(), "error", err)
+			return false
+		}
+		sess.Claims = p.keptClaims(claims)
+	}
+	p.updateTokens(sess, tokens)
+	cookie, err := p.sessionCookie(sess)
+	if err != nil {
+		slog.Warn("failed encoding OIDC session", "request-id", req.RequestID(), "error", err)
+		return false
+	}
+	req.Metadata()[setCookieMetadataKey] = cookie
+	return true
+}
+
+// login redirects browser navigations to the provider and rejects other requests, which cannot follow the login flow.
+func (p *OIDCProcessor) login(prov *provider, req *processor.RequestContext) (*extproc.ProcessingResponse_ImmediateResponse, error) {
+	if !isNavigation(req) {
+		return immediate(typev3.StatusCode_Unauthorized, "oidc_unauthenticated", nil), nil
+	}
+	state := &loginState{
+		State:    randomString(),
+		Nonce:    randomString(),
+		Verifier: randomString(),
+		ReturnTo: req.URL().RequestURI(),
+		Expiry:   p.now().Add(loginStateTTL).Unix(),
+	}
+	value, err := p.cipher.seal(p.stateCookieName(), state)
+	if err != nil {
+		return nil, fmt.Errorf("failed encoding OIDC login state: %w", err)
+	}
+	challenge := sha256.Sum256([]byte(state.Verifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.config.ClientID},
+		"redirect_uri":          {p.config.RedirectURL},
+		"scope":                 {p.scope()},
+		"state":                 {state.State},
+		"nonce":                 {state.Nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	return redirect(prov.AuthorizationEndpoint+"?"+query.Encode(), p.cookie(p.stateCookieName(), value, loginStateTTL)), nil
+}
+
+// callback exchanges the authorization code for tokens, starts the session and redirects to the initial URL.
+func (p *OIDCProcessor) callback(ctx context.Context, prov *provider, req *processor.RequestContext) *extproc.ProcessingResponse_ImmediateResponse {
+	clearState := p.cookie(p.stateCookieName(), "", -1)
+	query := req.URL().Query()
+	if providerErr := query.Get("error"); providerErr != "" {
+		slog.Info("OIDC provider returned an error", "request-id", req.RequestID(), "error", providerErr, "description", query.Get("error_description"))
+		return immediate(typev3.StatusCode_Forbidden, "oidc_provider_error", []string{clearState})
+	}
+
+	state := &loginState{}
+	found := false
+	for _, cookie := range req.Cookies() {
+		if cookie.Name == p.stateCookieName() {
+			found = p.cipher.open(cookie.Name, cookie.Value, state) == nil
+		}
+	}
+	if !found || state.State != query.Get("state") || p.now().Unix() >= state.Expiry {
+		slog.Info("invalid OIDC callback state", "request-id", req.RequestID())
+		return immediate(typev3.StatusCode_BadRequest, "oidc_invalid_state", []string{clearState})
+	}
+
+	tokens, err := p.token(ctx, prov, url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {query.Get("code")},
+		"redirect_uri":  {p.config.RedirectURL},
+		"code_verifier": {state.Verifier},
+	})
+	if err == nil && tokens.IDToken == "" {
+		err = fmt.Errorf("%w: missing from the token response", errInvalidIDToken)
+	}
+	var claims map[string]any
+	if err == nil {
+		claims, err = p.idTokenClaims(tokens.IDToken, prov.Issuer, state.Nonce, p.now())
+	}
+	if err != nil {
+		slog.Warn("failed exchanging OIDC authorization code", "request-id", req.RequestID(), "error", err)
+		return immediate(typev3.StatusCode_BadGateway, "oidc_code_exchange_failed", []string{clearState})
+	}
+
+	sess := &session{
+		Claims: p.keptClaims(claims),
+		Expiry: p.now().Add(p.config.SessionTTL).Unix(),
+	}
+	p.updateTokens(sess, tokens)
+	cookie, err := p.sessionCookie(sess)
+	if err != nil {
+		slog.Warn("failed encoding OIDC session", "request-id", req.RequestID(), "error", err)
+		return immediate(typev3.StatusCode_InternalServerError, "oidc_session_too_large", []string{clearState})
+	}
+	slog.Info("OIDC login", "request-id", req.RequestID(), "sub", claims["sub"])
+	// ReturnTo was encrypted by the processor, it is always a path of this host.
+	return redirect(state.ReturnTo, clearState, cookie)
+}
+
+// logout clears the session and redirects to the end session endpoint of the provider when it has one.
+func (p *OIDCProcessor) logout(prov *provider) *extproc.ProcessingResponse_ImmediateResponse {
+	location := p.config.PostLogoutRedirectURL
+	if prov.EndSessionEndpoint != "" {
+		query := url.Values{"client_id": {p.config.ClientID}}
+		if location != "" {
+			query.Set("post_logout_redirect_uri", location)
+		}
+		location = prov.EndSessionEndpoint + "?" + query.Encode()
+	}
+	if location == "" {
+		location = "/"
+	}
+	return redirect(location, p.cookie(p.config.CookieName, "", -1))
+}
+
+func (p *OIDCProcessor) updateTokens(sess *session, tokens *tokenResponse) {
+	sess.AccessToken = tokens.AccessToken
+	if tokens.RefreshToken != "" {
+		sess.RefreshToken = tokens.RefreshToken
+	}
+	sess.TokenExpiry = 0
+	if tokens.ExpiresIn > 0 {
+		sess.TokenExpiry = p.now().Unix() + tokens.ExpiresIn
+	}
+}
+
+// keptClaims returns the claims stored in the session: sub and the claims forwarded as headers, the cookie would
+// otherwise grow too large.
+func (p *OIDCProcessor) keptClaims(claims map[string]any) map[string]any {
+	kept := map[string]any{"sub": claims["sub"]}
+	for claim := range p.config.ClaimHeaders {
+		if v, ok := claims[claim]; ok {
+			kept[claim] = v
+		}
+	}
+	return kept
+}
+
+func (p *OIDCProcessor) sessionCookie(sess *session) (string, error) {
+	value, err := p.cipher.seal(p.config.CookieName, sess)
+	if err != nil {
+		return "", err
+	}
+	return p.cookie(p.config.CookieName, value, time.Until(time.Unix(sess.Expiry, 0))), nil
+}
+
+// cookie returns a set-cookie value, a negative maxAge deletes the cookie.
+func (p *OIDCProcessor) cookie(name, value string, maxAge time.Duration) string {
+	cookie := &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   !p.config.InsecureCookies,
+		// Lax so the cookies are sent on the redirect back from the provider.
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   int(maxAge.Seconds()),
+	}
+	if maxAge < 0 {
+		cookie.MaxAge = -1
+	}
+	return cookie.String()
+}
+
+// stripSessionCookie removes the session cookie from the request sent upstream, it carries the tokens.
+func (p *OIDCProcessor) stripSessionCookie(crw *processor.CommonResponseWriter, req *processor.RequestContext) {
+	var kept []string
+	for _, cookie := range req.Cookies() {
+		if cookie.Name != p.config.CookieName {
+			kept = append(kept, cookie.Name+"="+cookie.Value)
+		}
+	}
+	if len(kept) == 0 {
+		crw.RemoveHeaders("cookie")
+		return
+	}
+	crw.HeaderSet("cookie", strings.Join(kept, "; "))
+}
+
+func (p *OIDCProcessor) stateCookieName() string {
+	return p.config.CookieName + "_state"
+}
+
+func (p *OIDCProcessor) scope() string {
+	scopes := []string{"openid"}
+	for _, scope := range p.config.Scopes {
+		if scope != "openid" {
+			scopes = append(scopes, scope)
+		}
+	}
+	return strings.Join(scopes, " ")
+}
+
+// isNavigation reports whether the request is a browser navigation which can follow redirects to the provider.
+func isNavigation(req *processor.RequestContext) bool {
+	if req.Method() != http.MethodGet && req.Method() != http.MethodHead {
+		return false
+	}
+	if mode := req.GetRequestHeader("sec-fetch-mode"); mode != "" {
+		return mode == "navigate"
+	}
+	return strings.Contains(req.GetRequestHeader("accept"), "text/html")
+}
+
+func redirect(location string, cookies ...string) *extproc.ProcessingResponse_ImmediateResponse {
+	return immediate(typev3.StatusCode_Found, "oidc_redirect", cookies, "location", location)
+}
+
+// immediate returns an immediate response setting the cookies and the given header key value pairs. Immediate
+// responses are never cached, they depend on the session.
+func immediate(code typev3.StatusCode, details string, cookies []string, headers ...string) *extproc.ProcessingResponse_ImmediateResponse {
+	crw := processor.NewCommonResponseWriter()
+	crw.HeaderSet("cache-control", "no-store")
+	for i := 0; i+1 < len(headers); i += 2 {
+		crw.HeaderSet(headers[i], headers[i+1])
+	}
+	for _, cookie := range cookies {
+		crw.HeaderAppend("set-cookie", cookie)
+	}
+	return &extproc.ProcessingResponse_ImmediateResponse{
+		ImmediateResponse: &extproc.ImmediateResponse{
+			Status:  &typev3.HttpStatus{Code: code},
+			Headers: crw.CommonResponse().GetHeaderMutation(),
+			Details: details,
+		},
+	}
+}
+
+func randomString() string {
+	raw := make([]byte, 32)
+	_, _ = rand.Read(raw)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
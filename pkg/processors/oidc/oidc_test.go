@@ -0,0 +1,342 @@
+package oidc_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cainelli/ext-proc/pkg/processors/oidc"
+	"github.com/cainelli/ext-proc/pkg/processors/oidc/oidctest"
+	"github.com/cainelli/ext-proc/pkg/service"
+	"github.com/cainelli/ext-proc/pkg/service/processortest"
+)
+
+const redirectURL = "https://tools.example.com/oauth2/callback"
+
+type harness struct {
+	t        *testing.T
+	provider *oidctest.Provider
+	svc      *service.ExtProcessor
+	recorder *processortest.ClaimsRecorder
+}
+
+func newHarness(t *testing.T, provider *oidctest.Provider) *harness {
+	t.Helper()
+	p, err := oidc.New(oidc.Config{
+		Issuer:                provider.Issuer(),
+		ClientID:              provider.ClientID,
+		ClientSecret:          provider.ClientSecret,
+		RedirectURL:           redirectURL,
+		Scopes:                []string{"email"},
+		CookieSecret:          []byte("0123456789abcdef0123456789abcdef"),
+		PostLogoutRedirectURL: "https://tools.example.com/",
+		ClaimHeaders:          map[string]string{"email": "x-forwarded-email"},
+		ForwardAccessToken:    true,
+	})
+	if err != nil {
+		t.Fatalf("New() = %v", err)
+	}
+	if err := p.Init(context.Background()); err != nil {
+		t.Fatalf("Init() = %v", err)
+	}
+	recorder := &processortest.ClaimsRecorder{Key: oidc.ClaimsMetadataKey}
+	return &harness{
+		t:        t,
+		provider: provider,
+		svc:      processortest.Chain(p, recorder),
+		recorder: recorder,
+	}
+}
+
+// send runs a request through the processor, with a response from the upstream when it reaches it.
+func (h *harness) send(req *http.Request) *processortest.Result {
+	h.t.Helper()
+	resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}}
+	return processortest.MustRun(h.t, h.svc, req, resp)
+}
+
+// login runs the login flow starting at target and returns the session cookie.
+func (h *harness) login(target string) *http.Cookie {
+	h.t.Helper()
+	req := browserRequest(target)
+	result := h.send(req)
+	if result.Response.StatusCode != http.StatusFound {
+		h.t.Fatalf("unauthenticated navigation got %d, want a redirect to the provider", result.Response.StatusCode)
+	}
+	location := result.Response.Header.Get("location")
+	if !strings.HasPrefix(location, h.provider.URL+"/authorize?") {
+		h.t.Fatalf("redirected to %q, want the authorization endpoint", location)
+	}
+	stateCookie := cookie(result.Response, oidc.DefaultCookieName+"_state")
+	if stateCookie == nil || !stateCookie.HttpOnly || !stateCookie.Secure {
+		h.t.Fatalf("state cookie = %v, want a secure HttpOnly cookie", stateCookie)
+	}
+
+	// The fake provider logs the user in right away and redirects back to the callback.
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	authorized, err := client.Get(location)
+	if err != nil {
+		h.t.Fatalf("authorize: %v", err)
+	}
+	authorized.Body.Close()
+	callback := authorized.Header.Get("location")
+	if !strings.HasPrefix(callback, redirectURL+"?") {
+		h.t.Fatalf("provider redirected to %q, want the callback", callback)
+	}
+
+	req = browserRequest(callback)
+	req.AddCookie(stateCookie)
+	result = h.send(req)
+	if result.Response.StatusCode != http.StatusFound {
+		h.t.Fatalf("callback got %d, want a redirect", result.Response.StatusCode)
+	}
+	if got, want := result.Response.Header.Get("location"), strings.TrimPrefix(target, "https://tools.example.com"); got != want {
+		h.t.Errorf("callback redirected to %q, want %q", got, want)
+	}
+	if c := cookie(result.Response, oidc.DefaultCookieName+"_state"); c == nil || c.MaxAge >= 0 {
+		h.t.Errorf("state cookie was not cleared")
+	}
+	sessionCookie := cookie(result.Response, oidc.DefaultCookieName)
+	if sessionCookie == nil || sessionCookie.Value == "" {
+		h.t.Fatalf("callback did not set the session cookie")
+	}
+	return sessionCookie
+}
+
+func TestLogin(t *testing.T) {
+	provider := oidctest.NewProvider("tools", "secret")
+	defer provider.Close()
+	h := newHarness(t, provider)
+
+	sessionCookie := h.login("https://tools.example.com/dashboard?tab=1")
+
+	req := browserRequest("https://tools.example.com/dashboard?tab=1")
+	req.AddCookie(sessionCookie)
+	req.AddCookie(&http.Cookie{Name: "theme", Value: "dark"})
+	req.Header.Set("x-forwarded-email", "spoofed@example.com")
+	result := h.send(req)
+	if result.ImmediateResponse != nil {
+		t.Fatalf("request with session got an immediate response %d", result.Response.StatusCode)
+	}
+	if got := result.Request.Header.Get("x-forwarded-email"); got != "user@example.com" {
+		t.Errorf("x-forwarded-email = %q, want user@example.com", got)
+	}
+	if got := result.Request.Header.Get("authorization"); !strings.HasPrefix(got, "Bearer ") {
+		t.Errorf("authorization = %q, want the access token", got)
+	}
+	if got := result.Request.Header.Get("cookie"); got != "theme=dark" {
+		t.Errorf("upstream cookie = %q, want the session cookie removed", got)
+	}
+	if h.recorder.Claims["sub"] != "user-1" {
+		t.Errorf("claims in metadata = %v", h.recorder.Claims)
+	}
+
+	// A session cookie sealed with another name or tampered with is not accepted.
+	for name, c := range map[string]*http.Cookie{
+		"tampered":    {Name: oidc.DefaultCookieName, Value: sessionCookie.Value[:len(sessionCookie.Value)-2] + "AA"},
+		"state value": {Name: oidc.DefaultCookieName + "_state", Value: sessionCookie.Value},
+	} {
+		t.Run(name, func(t *testing.T) {
+			req := browserRequest("https://tools.example.com/")
+			req.AddCookie(c)
+			if result := h.send(req); result.Response.StatusCode != http.StatusFound {
+				t.Errorf("got %d, want a redirect to the provider", result.Response.StatusCode)
+			}
+		})
+	}
+}
+
+func TestUnauthenticated(t *testing.T) {
+	provider := oidctest.NewProvider("tools", "secret")
+	defer provider.Close()
+	h := newHarness(t, provider)
+
+	req := httptest.NewRequest(http.MethodPost, "https://tools.example.com/api/items", nil)
+	req.Header.Set("accept", "application/json")
+	result := h.send(req)
+	if result.Response.StatusCode != http.StatusUnauthorized {
+		t.Errorf("API request got %d, want 401", result.Response.StatusCode)
+	}
+
+	// A callback without the state cookie of the login is rejected.
+	result = h.send(browserRequest(redirectURL + "?code=abc&state=forged"))
+	if result.Response.StatusCode != http.StatusBadRequest {
+		t.Errorf("forged callback got %d, want 400", result.Response.StatusCode)
+	}
+	if got := provider.AuthorizationCodeGrants.Load(); got != 0 {
+		t.Errorf("forged callback exchanged %d codes", got)
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	provider := oidctest.NewProvider("tools", "secret")
+	defer provider.Close()
+	// Tokens expiring within 30s are refreshed right away.
+	provider.TokenTTL = 10 * time.Second
+	h := newHarness(t, provider)
+	sessionCookie := h.login("https://tools.example.com/")
+
+	req := browserRequest("https://tools.example.com/")
+	req.AddCookie(sessionCookie)
+	result := h.send(req)
+	if result.ImmediateResponse != nil {
+		t.Fatalf("request with expired access token got an immediate response %d", result.Response.StatusCode)
+	}
+	if got := provider.RefreshTokenGrants.Load(); got != 1 {
+		t.Errorf("refresh token grants = %d, want 1", got)
+	}
+	refreshed := cookie(result.Response, oidc.DefaultCookieName)
+	if refreshed == nil || refreshed.Value == sessionCookie.Value {
+		t.Fatalf("response did not update the session cookie")
+	}
+
+	// The rotated refresh token of the new cookie is used next, the old one was revoked.
+	req = browserRequest("https://tools.example.com/")
+	req.AddCookie(refreshed)
+	if result := h.send(req); result.ImmediateResponse != nil {
+		t.Errorf("request with refreshed session got an immediate response %d", result.Response.StatusCode)
+	}
+	req = browserRequest("https://tools.example.com/")
+	req.AddCookie(sessionCookie)
+	if result := h.send(req); result.Response.StatusCode != http.StatusFound {
+		t.Errorf("request with revoked refresh token got %d, want a redirect to the provider", result.Response.StatusCode)
+	}
+}
+
+func TestLogout(t *testing.T) {
+	provider := oidctest.NewProvider("tools", "secret")
+	defer provider.Close()
+	h := newHarness(t, provider)
+	sessionCookie := h.login("https://tools.example.com/")
+
+	req := browserRequest("https://tools.example.com" + oidc.DefaultLogoutPath)
+	req.AddCookie(sessionCookie)
+	result := h.send(req)
+	if result.Response.StatusCode != http.StatusFound {
+		t.Fatalf("logout got %d, want a redirect", result.Response.StatusCode)
+	}
+	location, err := url.Parse(result.Response.Header.Get("location"))
+	if err != nil || location.Host != strings.TrimPrefix(provider.URL, "http://") || location.Path != "/logout" {
+		t.Errorf("logout redirected to %q, want the end session endpoint", location)
+	}
+	if got := location.Query().Get("post_logout_redirect_uri"); got != "https://tools.example.com/" {
+		t.Errorf("post_logout_redirect_uri = %q", got)
+	}
+	if c := cookie(result.Response, oidc.DefaultCookieName); c == nil || c.MaxAge >= 0 {
+		t.Errorf("session cookie was not cleared")
+	}
+}
+
+func TestNew(t *testing.T) {
+	valid := oidc.Config{Issuer: "https://issuer.example.com", ClientID: "tools", RedirectURL: redirectURL, CookieSecret: make([]byte, 32)}
+	if _, err := oidc.New(valid); err != nil {
+		t.Errorf("New() = %v", err)
+	}
+	invalid := map[string]func(*oidc.Config){
+		"missing issuer":        func(c *oidc.Config) { c.Issuer = "" },
+		"relative redirect":     func(c *oidc.Config) { c.RedirectURL = "/oauth2/callback" },
+		"short cookie secret":   func(c *oidc.Config) { c.CookieSecret = []byte("short") },
+		"missing cookie secret": func(c *oidc.Config) { c.CookieSecret = nil },
+		"plain http issuer":     func(c *oidc.Config) { c.Issuer = "http://issuer.example.com" },
+	}
+	for name, change := range invalid {
+		config := valid
+		change(&config)
+		if _, err := oidc.New(config); err == nil {
+			t.Errorf("New() with %s succeeded", name)
+		}
+	}
+}
+
+func TestDiscovery(t *testing.T) {
+	var fetches atomic.Int64
+	var tokenEndpoint string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		time.Sleep(50 * time.Millisecond)
+		if tokenEndpoint == "" {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("content-type", "application/json")
+		fmt.Fprintf(w, `{"issuer": %q, "authorization_endpoint": "https://issuer.example.com/authorize", "token_endpoint": %q}`,
+			"http://"+r.Host, tokenEndpoint)
+	}))
+	defer srv.Close()
+
+	p, err := oidc.New(oidc.Config{Issuer: srv.URL, ClientID: "tools", RedirectURL: redirectURL, CookieSecret: make([]byte, 32)})
+	if err != nil {
+		t.Fatalf("New() = %v", err)
+	}
+	// Concurrent requests share a single fetch, and the failure is returned until the backoff elapses.
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := p.Init(context.Background()); err == nil {
+				t.Errorf("Init() succeeded with an unavailable provider")
+			}
+		}()
+	}
+	wg.Wait()
+	if err := p.Init(context.Background()); err == nil {
+		t.Errorf("Init() succeeded with an unavailable provider")
+	}
+	if got := fetches.Load(); got != 1 {
+		t.Errorf("discovery fetched %d times, want 1", got)
+	}
+
+	// The ID tokens are only trusted from a token endpoint over TLS.
+	tokenEndpoint = "http://issuer.example.com/token"
+	p, err = oidc.New(oidc.Config{Issuer: srv.URL, ClientID: "tools", RedirectURL: redirectURL, CookieSecret: make([]byte, 32)})
+	if err != nil {
+		t.Fatalf("New() = %v", err)
+	}
+	if err := p.Init(context.Background()); err == nil || !strings.Contains(err.Error(), "https") {
+		t.Errorf("Init() = %v, want the plain http token endpoint rejected", err)
+	}
+}
+
+func TestProviderUnavailable(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+	p, err := oidc.New(oidc.Config{Issuer: srv.URL, ClientID: "tools", RedirectURL: redirectURL, CookieSecret: make([]byte, 32)})
+	if err != nil {
+		t.Fatalf("New() = %v", err)
+	}
+
+	// The requests are denied rather than failing the stream, which Envoy may let through.
+	for range 2 {
+		resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}}
+		result := processortest.MustRun(t, processortest.Chain(p), browserRequest("https://tools.example.com/dashboard"), resp)
+		if result.ImmediateResponse == nil || result.Response.StatusCode != http.StatusServiceUnavailable {
+			t.Fatalf("got %d, want 503", result.Response.StatusCode)
+		}
+		if got := result.Response.Header.Get("retry-after"); got != "1" {
+			t.Errorf("retry-after = %q, want the discovery backoff", got)
+		}
+	}
+}
+
+func browserRequest(target string) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	req.Header.Set("accept", "text/html,application/xhtml+xml")
+	return req
+}
+
+func cookie(resp *http.Response, name string) *http.Cookie {
+	for _, c := range resp.Cookies() {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
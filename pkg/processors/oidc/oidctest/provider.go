@@ -0,0 +1,194 @@
+// Package oidctest provides a fake OpenID Connect provider to test the OIDC processor and its configuration without
+// a real identity provider.
+package oidctest
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Provider is a fake OIDC provider which logs in every user as Claims without asking for credentials. It supports
+// the authorization code flow with PKCE, the refresh token grant and the end session endpoint.
+type Provider struct {
+	*httptest.Server
+
+	ClientID     string
+	ClientSecret string
+	// Claims are the claims of the issued ID tokens, besides iss, aud, exp, iat and nonce.
+	Claims map[string]any
+	// TokenTTL is the lifetime of the issued access and ID tokens.
+	TokenTTL time.Duration
+
+	// AuthorizationCodeGrants and RefreshTokenGrants count the calls to the token endpoint by grant type.
+	AuthorizationCodeGrants atomic.Int32
+	RefreshTokenGrants      atomic.Int32
+
+	mu            sync.Mutex
+	codes         map[string]authorization
+	refreshTokens map[string]bool
+}
+
+// authorization is an authorization code waiting to be exchanged.
+type authorization struct {
+	redirectURI string
+	nonce       string
+	challenge   string
+}
+
+// NewProvider starts a provider for the client, it is stopped with Close.
+func NewProvider(clientID, clientSecret string) *Provider {
+	p := &Provider{
+		ClientID:      clientID,
+		ClientSecret:  clientSecret,
+		Claims:        map[string]any{"sub": "user-1", "email": "user@example.com"},
+		TokenTTL:      time.Hour,
+		codes:         map[string]authorization{},
+		refreshTokens: map[string]bool{},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", p.discovery)
+	mux.HandleFunc("/authorize", p.authorize)
+	mux.HandleFunc("/token", p.token)
+	mux.HandleFunc("/logout", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	p.Server = httptest.NewServer(mux)
+	return p
+}
+
+// Issuer returns the issuer URL of the provider.
+func (p *Provider) Issuer() string {
+	return p.URL
+}
+
+func (p *Provider) discovery(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{
+		"issuer":                 p.URL,
+		"authorization_endpoint": p.URL + "/authorize",
+		"token_endpoint":         p.URL + "/token",
+		"end_session_endpoint":   p.URL + "/logout",
+	})
+}
+
+// authorize logs the user in right away and redirects back to the client with a code.
+func (p *Provider) authorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("client_id") != p.ClientID || query.Get("response_type") != "code" || query.Get("code_challenge_method") != "S256" {
+		http.Error(w, "invalid authorization request", http.StatusBadRequest)
+		return
+	}
+	code := random()
+	p.mu.Lock()
+	p.codes[code] = authorization{
+		redirectURI: query.Get("redirect_uri"),
+		nonce:       query.Get("nonce"),
+		challenge:   query.Get("code_challenge"),
+	}
+	p.mu.Unlock()
+
+	redirect, err := url.Parse(query.Get("redirect_uri"))
+	if err != nil {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+	redirect.RawQuery = url.Values{"code": {code}, "state": {query.Get("state")}}.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+func (p *Provider) token(w http.ResponseWriter, r *http.Request) {
+	id, secret, _ := r.BasicAuth()
+	if id != p.ClientID || secret != p.ClientSecret {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_request"})
+		return
+	}
+
+	var nonce string
+	switch r.PostForm.Get("grant_type") {
+	case "authorization_code":
+		p.AuthorizationCodeGrants.Add(1)
+		p.mu.Lock()
+		auth, ok := p.codes[r.PostForm.Get("code")]
+		delete(p.codes, r.PostForm.Get("code"))
+		p.mu.Unlock()
+		challenge := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if !ok || auth.redirectURI != r.PostForm.Get("redirect_uri") || auth.challenge != base64.RawURLEncoding.EncodeToString(challenge[:]) {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+			return
+		}
+		nonce = auth.nonce
+	case "refresh_token":
+		p.RefreshTokenGrants.Add(1)
+		p.mu.Lock()
+		ok := p.refreshTokens[r.PostForm.Get("refresh_token")]
+		delete(p.refreshTokens, r.PostForm.Get("refresh_token"))
+		p.mu.Unlock()
+		if !ok {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+			return
+		}
+	default:
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "unsupported_grant_type"})
+		return
+	}
+
+	// Refresh tokens are rotated, like most providers do.
+	refreshToken := random()
+	p.mu.Lock()
+	p.refreshTokens[refreshToken] = true
+	p.mu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]any{
+		"access_token":  random(),
+		"token_type":    "Bearer",
+		"refresh_token": refreshToken,
+		"expires_in":    int64(p.TokenTTL.Seconds()),
+		"id_token":      p.idToken(nonce),
+	})
+}
+
+// idToken returns an ID token signed with the client secret (HS256).
+func (p *Provider) idToken(nonce string) string {
+	now := time.Now()
+	claims := map[string]any{
+		"iss": p.URL,
+		"aud": p.ClientID,
+		"iat": now.Unix(),
+		"exp": now.Add(p.TokenTTL).Unix(),
+	}
+	for name, value := range p.Claims {
+		claims[name] = value
+	}
+	if nonce != "" {
+		claims["nonce"] = nonce
+	}
+	header, _ := json.Marshal(map[string]string{"alg": "HS256", "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, []byte(p.ClientSecret))
+	mac.Write([]byte(input))
+	return input + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func random() string {
+	raw := make([]byte, 16)
+	_, _ = rand.Read(raw)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
@@ -0,0 +1,101 @@
+package oidc
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// maxCookieSize is the size above which browsers may drop a cookie.
+const maxCookieSize = 4000
+
+var errInvalidCookie = errors.New("invalid cookie")
+
+// session is the content of the session cookie.
+type session struct {
+	// Claims are the claims of the ID token kept for the claim headers.
+	Claims map[string]any `json:"claims"`
+	// AccessToken and RefreshToken are the tokens returned by the provider.
+	AccessToken  string `json:"access_token,omitempty"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	// TokenExpiry is the unix time at which the access token expires, zero when unknown.
+	TokenExpiry int64 `json:"token_expiry,omitempty"`
+	// Expiry is the unix time at which the session ends, whatever the tokens.
+	Expiry int64 `json:"expiry"`
+}
+
+// loginState is the content of the cookie set when redirecting to the provider and checked on the callback.
+type loginState struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	// ReturnTo is the path and query of the request which started the login.
+	ReturnTo string `json:"return_to"`
+	Expiry   int64  `json:"expiry"`
+}
+
+func (s *session) expired(now time.Time) bool {
+	return now.Unix() >= s.Expiry
+}
+
+// tokenExpired reports whether the access token must be refreshed, a little before its actual expiry so it does not
+// expire while the upstream uses it.
+func (s *session) tokenExpired(now time.Time) bool {
+	return s.TokenExpiry != 0 && now.Add(30*time.Second).Unix() >= s.TokenExpiry
+}
+
+// cookieCipher encrypts and authenticates cookie values with AES-GCM. The cookie name is authenticated with the value
+// so the value of a cookie cannot be used in another one.
+type cookieCipher struct {
+	aead cipher.AEAD
+}
+
+func newCookieCipher(secret []byte) (*cookieCipher, error) {
+	block, err := aes.NewCipher(secret)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cookie secret, it must be 16, 24 or 32 bytes long: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &cookieCipher{aead: aead}, nil
+}
+
+func (c *cookieCipher) seal(name string, v any) (string, error) {
+	plaintext, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, c.aead.NonceSize(), c.aead.NonceSize()+len(plaintext)+c.aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	value := base64.RawURLEncoding.EncodeToString(c.aead.Seal(nonce, nonce, plaintext, []byte(name)))
+	if len(name)+len(value) > maxCookieSize {
+		return "", fmt.Errorf("cookie %s is %d bytes long, browsers may drop it", name, len(name)+len(value))
+	}
+	return value, nil
+}
+
+func (c *cookieCipher) open(name, value string, v any) error {
+	raw, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || len(raw) < c.aead.NonceSize() {
+		return errInvalidCookie
+	}
+	nonce, ciphertext := raw[:c.aead.NonceSize()], raw[c.aead.NonceSize():]
+	plaintext, err := c.aead.Open(nil, nonce, ciphertext, []byte(name))
+	if err != nil {
+		return errInvalidCookie
+	}
+	if err := json.Unmarshal(plaintext, v); err != nil {
+		return errInvalidCookie
+	}
+	return nil
+}
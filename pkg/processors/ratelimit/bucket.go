@@ -0,0 +1,120 @@
+package ratelimit
+
+import (
+	"container/list"
+	"hash/maphash"
+	"math"
+	"sync"
+	"time"
+)
+
+// shards is the number of independently locked parts of a bucket set, so concurrent requests rarely wait for each
+// other.
+const shards = 16
+
+// Decision is the outcome of counting a request against a limit.
+type Decision struct {
+	Allowed bool
+	// Limit is the number of requests allowed at once, the burst of a token bucket.
+	Limit int
+	// Remaining is the number of requests left before the limit is exceeded.
+	Remaining int
+	// RetryAfter is the time until a request is allowed again, zero when allowed.
+	RetryAfter time.Duration
+	// Reset is the time until the full limit is available again.
+	Reset time.Duration
+}
+
+// bucket is a token bucket.
+type bucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+}
+
+// bucketSet holds the token buckets of a rule by key. The least recently used buckets are evicted once it holds
+// maxKeys buckets: they are the idlest ones, most likely full again, which is the state of a new bucket anyway.
+type bucketSet struct {
+	// rate is the number of tokens added per second.
+	rate float64
+	// burst is the capacity of the buckets.
+	burst  float64
+	seed   maphash.Seed
+	shards [shards]bucketShard
+}
+
+type bucketShard struct {
+	mu      sync.Mutex
+	maxKeys int
+	lru     *list.List
+	buckets map[string]*list.Element
+}
+
+func newBucketSet(requests int, period time.Duration, burst, maxKeys int) *bucketSet {
+	set := &bucketSet{
+		rate:  float64(requests) / period.Seconds(),
+		burst: float64(burst),
+		seed:  maphash.MakeSeed(),
+	}
+	for i := range set.shards {
+		set.shards[i] = bucketShard{
+			maxKeys: max(1, maxKeys/shards),
+			lru:     list.New(),
+			buckets: make(map[string]*list.Element),
+		}
+	}
+	return set
+}
+
+// take takes a token from the bucket of the key.
+func (set *bucketSet) take(key string, now time.Time) Decision {
+	shard := &set.shards[maphash.String(set.seed, key)%shards]
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	var b *bucket
+	if elem, ok := shard.buckets[key]; ok {
+		shard.lru.MoveToFront(elem)
+		b = elem.Value.(*bucket)
+		if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+			b.tokens = math.Min(set.burst, b.tokens+elapsed*set.rate)
+		}
+	} else {
+		if shard.lru.Len() >= shard.maxKeys {
+			oldest := shard.lru.Back()
+			shard.lru.Remove(oldest)
+			delete(shard.buckets, oldest.Value.(*bucket).key)
+		}
+		b = &bucket{key: key, tokens: set.burst}
+		shard.buckets[key] = shard.lru.PushFront(b)
+	}
+	b.last = now
+
+	d := Decision{Limit: int(set.burst)}
+	if b.tokens >= 1 {
+		b.tokens--
+		d.Allowed = true
+	} else {
+		d.RetryAfter = set.duration(1 - b.tokens)
+	}
+	d.Remaining = int(b.tokens)
+	d.Reset = set.duration(set.burst - b.tokens)
+	return d
+}
+
+// len returns the number of buckets.
+func (set *bucketSet) len() int {
+	n := 0
+	for i := range set.shards {
+		shard := &set.shards[i]
+		shard.mu.Lock()
+		n += shard.lru.Len()
+		shard.mu.Unlock()
+	}
+	return n
+}
+
+// duration returns the time to refill the tokens.
+func (set *bucketSet) duration(tokens float64) time.Duration {
+	return time.Duration(tokens / set.rate * float64(time.Second))
+}
@@ -0,0 +1,347 @@
+// Package ratelimit limits the rate of requests with token buckets keyed by request attributes, e.g. the client IP or
+// a claim of the JWT. The counters are local to the replica, or shared by all the replicas with a Store.
+package ratelimit
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/cainelli/ext-proc/pkg/service/processor"
+	extproc "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+)
+
+const (
+	// DefaultMaxKeys is the number of keys tracked per rule when Config.MaxKeys is zero.
+	DefaultMaxKeys = 100_000
+	// DefaultClaimsMetadataKey is the metadata key of the claims of the jwt processor, read when KeyPart.MetadataKey
+	// is empty.
+	DefaultClaimsMetadataKey = "jwt.claims"
+)
+
+// Source is where a part of the key of a rule is read from.
+type Source string
+
+const (
+	// SourceClientIP is the client address, see Config.TrustedHops.
+	SourceClientIP Source = "client_ip"
+	// SourceAuthority is the :authority of the request.
+	SourceAuthority Source = "authority"
+	// SourcePath is the path of the request, without the query.
+	SourcePath Source = "path"
+	// SourceHeader is the request header KeyPart.Name.
+	SourceHeader Source = "header"
+	// SourceCookie is the cookie KeyPart.Name.
+	SourceCookie Source = "cookie"
+	// SourceClaim is the claim KeyPart.Name stored in the metadata by the JWT or OIDC processors, which must run before.
+	SourceClaim Source = "claim"
+)
+
+// KeyPart is a part of the key of a rule.
+type KeyPart struct {
+	Source Source `json:"source"`
+	// Name is the header, cookie or claim name.
+	Name string `json:"name,omitempty"`
+	// MetadataKey is the metadata key of the claims for SourceClaim, DefaultClaimsMetadataKey when empty.
+	MetadataKey string `json:"metadata_key,omitempty"`
+}
+
+// Rule limits the matching requests to Requests per Period for every key. Requests without one of the key parts,
+// e.g. without the header, are not limited by the rule.
+type Rule struct {
+	// Name identifies the rule in the logs.
+	Name string `json:"name"`
+	// Authorities are the authorities the rule applies to, all when empty, see processor.MatchAuthority.
+	Authorities []string `json:"authorities,omitempty"`
+	// Methods are the methods the rule applies to, all when empty.
+	Methods []string `json:"methods,omitempty"`
+	// PathPattern is the path.Match pattern of the paths the rule applies to, e.g. /api/*/search, all when empty.
+	PathPattern string `json:"path_pattern,omitempty"`
+	// Key are the parts of the bucket key, a single bucket is shared by all the requests when empty.
+	Key []KeyPart `json:"key,omitempty"`
+	// Requests are the requests allowed per Period.
+	Requests int           `json:"requests"`
+	Period   time.Duration `json:"period"`
+	// Burst is the capacity of the local buckets, Requests when zero. It does not apply to the Store, which allows
+	// Requests per sliding Period.
+	Burst int `json:"burst,omitempty"`
+	// FallbackRequests are the requests allowed per Period by each replica while the Store is unreachable, Requests
+	// when zero.
+	FallbackRequests int `json:"fallback_requests,omitempty"`
+	// Shadow only logs and counts the requests exceeding the limit, so a rule can be tried without rejecting requests.
+	Shadow bool `json:"shadow,omitempty"`
+}
+
+// Config configures a RateLimitProcessor.
+type Config struct {
+	// Rules are all checked in order, the first rule whose limit is exceeded rejects the request.
+	Rules []Rule `json:"rules"`
+	// MaxKeys is the number of keys tracked per rule, DefaultMaxKeys when zero. The least recently used keys are
+	// evicted, which resets their limit.
+	MaxKeys int `json:"max_keys,omitempty"`
+	// TrustedHops is the number of proxies in front of Envoy appending to x-forwarded-for, see
+	// processor.RequestContext.ClientIP. Rules keyed by SourceClientIP skip the requests without a client IP, e.g.
+	// when TrustedHops is zero and Envoy does not send the source.address attribute. They are counted in
+	// RuleStats.NoClientIP and the first one is logged.
+	TrustedHops int `json:"trusted_hops,omitempty"`
+	// Store shares the counters between the replicas, the limits are local to the replica when nil. The rules must
+	// then have unique names, they are part of the store keys.
+	Store Store `json:"-"`
+	// StoreRetryInterval is the time the local buckets are used after the Store failed, before trying it again,
+	// DefaultStoreRetryInterval when zero.
+	StoreRetryInterval time.Duration `json:"store_retry_interval,omitempty"`
+}
+
+// RateLimitProcessor rejects the requests exceeding the limit of a rule with a 429 immediate response carrying the
+// Retry-After and RateLimit-* headers.
+// With a Store, requests are counted by the Store and by the local buckets only while the Store is unreachable.
+type RateLimitProcessor struct {
+	processor.NoOpProcessor
+	config Config
+	rules  []*rule
+	now    func() time.Time
+	// storeDownUntil is the unix nano time until which the Store is not called after a failure.
+	storeDownUntil atomic.Int64
+}
+
+var _ processor.Processor = &RateLimitProcessor{}
+
+// rule is a Rule with its buckets and counters.
+type rule struct {
+	Rule
+	buckets *bucketSet
+
+	allowed       atomic.Uint64
+	limited       atomic.Uint64
+	shadowLimited atomic.Uint64
+	fallback      atomic.Uint64
+	noClientIP    atomic.Uint64
+}
+
+// RuleStats are the counters of a rule.
+type RuleStats struct {
+	Rule
+	Keys          int    `json:"keys"`
+	Allowed       uint64 `json:"allowed"`
+	Limited       uint64 `json:"limited"`
+	ShadowLimited uint64 `json:"shadow_limited"`
+	// Fallback counts the requests counted by the local buckets because the Store was unreachable.
+	Fallback uint64 `json:"fallback"`
+	// NoClientIP counts the requests skipped because the rule is keyed by the client IP and they had none.
+	NoClientIP uint64 `json:"no_client_ip"`
+}
+
+func New(config Config) (*RateLimitProcessor, error) {
+	if config.MaxKeys <= 0 {
+		config.MaxKeys = DefaultMaxKeys
+	}
+	if config.StoreRetryInterval <= 0 {
+		config.StoreRetryInterval = DefaultStoreRetryInterval
+	}
+	p := &RateLimitProcessor{config: config, now: time.Now}
+	names := map[string]bool{}
+	for i, r := range config.Rules {
+		if err := r.validate(); err != nil {
+			return nil, fmt.Errorf("invalid rule %d %q: %w", i, r.Name, err)
+		}
+		if config.Store != nil && (r.Name == "" || names[r.Name]) {
+			return nil, fmt.Errorf("invalid rule %d %q: rules need unique names with a Store", i, r.Name)
+		}
+		names[r.Name] = true
+		if r.Burst <= 0 {
+			r.Burst = r.Requests
+		}
+		if r.FallbackRequests <= 0 {
+			r.FallbackRequests = r.Requests
+		}
+		requests, burst := r.Requests, r.Burst
+		if config.Store != nil {
+			requests, burst = r.FallbackRequests, min(r.Burst, r.FallbackRequests)
+		}
+		p.rules = append(p.rules, &rule{Rule: r, buckets: newBucketSet(requests, r.Period, burst, config.MaxKeys)})
+	}
+	return p, nil
+}
+
+func (r *Rule) validate() error {
+	if r.Requests <= 0 || r.Period <= 0 {
+		return errors.New("Requests and Period must be positive")
+	}
+	if _, err := path.Match(r.PathPattern, ""); err != nil {
+		return fmt.Errorf("invalid PathPattern: %w", err)
+	}
+	for _, part := range r.Key {
+		switch part.Source {
+		case SourceClientIP, SourceAuthority, SourcePath:
+		case SourceHeader, SourceCookie, SourceClaim:
+			if part.Name == "" {
+				return fmt.Errorf("%s key part without name", part.Source)
+			}
+		default:
+			return fmt.Errorf("unknown key source %q", part.Source)
+		}
+	}
+	return nil
+}
+
+// Describe returns the rules with their counters.
+func (p *RateLimitProcessor) Describe() any {
+	stats := make([]RuleStats, 0, len(p.rules))
+	for _, r := range p.rules {
+		stats = append(stats, RuleStats{
+			Rule:          r.Rule,
+			Keys:          r.buckets.len(),
+			Allowed:       r.allowed.Load(),
+			Limited:       r.limited.Load(),
+			ShadowLimited: r.shadowLimited.Load(),
+			Fallback:      r.fallback.Load(),
+			NoClientIP:    r.noClientIP.Load(),
+		})
+	}
+	return map[string]any{
+		"rules":        stats,
+		"max_keys":     p.config.MaxKeys,
+		"trusted_hops": p.config.TrustedHops,
+		"store":        p.config.Store != nil,
+	}
+}
+
+func (p *RateLimitProcessor) RequestHeaders(ctx context.Context, crw *processor.CommonResponseWriter, req *processor.RequestContext) (*extproc.ProcessingResponse_ImmediateResponse, error) {
+	now := p.now()
+	for _, r := range p.rules {
+		if !r.matches(req) {
+			continue
+		}
+		key, ok := p.key(r, req)
+		if !ok {
+			continue
+		}
+		d := p.take(ctx, r, key, now)
+		if d.Allowed {
+			r.allowed.Add(1)
+			continue
+		}
+		if r.Shadow {
+			r.shadowLimited.Add(1)
+			slog.Info("rate limit exceeded in shadow mode", "rule", r.Name, "key", key, "request-id", req.RequestID())
+			continue
+		}
+		r.limited.Add(1)
+		slog.Debug("rate limit exceeded", "rule", r.Name, "key", key, "request-id", req.RequestID())
+		return tooManyRequests(&r.Rule, d), nil
+	}
+	return nil, nil
+}
+
+// take counts the request with the Store, or with the local buckets without Store or when it fails.
+func (p *RateLimitProcessor) take(ctx context.Context, r *rule, key string, now time.Time) Decision {
+	if p.config.Store != nil {
+		if now.UnixNano() >= p.storeDownUntil.Load() {
+			d, err := p.config.Store.Take(ctx, r.Name+"|"+key, r.Requests, r.Period, now)
+			if err == nil {
+				return d
+			}
+			// Only the first failure of an outage is logged, the next requests do not call the Store.
+			slog.Warn("rate limit store failed, using local limits", "retry-in", p.config.StoreRetryInterval, "error", err)
+			p.storeDownUntil.Store(now.Add(p.config.StoreRetryInterval).UnixNano())
+		}
+		r.fallback.Add(1)
+	}
+	return r.buckets.take(key, now)
+}
+
+func (r *rule) matches(req *processor.RequestContext) bool {
+	if !processor.MatchAuthority(r.Authorities, req.Authority()) {
+		return false
+	}
+	if len(r.Methods) > 0 && !slices.Contains(r.Methods, req.Method()) {
+		return false
+	}
+	if r.PathPattern != "" {
+		if matched, _ := path.Match(r.PathPattern, req.URL().Path); !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// key returns the bucket key of the request, false when a part is missing.
+func (p *RateLimitProcessor) key(r *rule, req *processor.RequestContext) (string, bool) {
+	var key strings.Builder
+	for i, part := range r.Key {
+		value, ok := p.keyPart(part, req)
+		if !ok {
+			// A rule which never applies is a configuration error, unlike a missing header, cookie or claim.
+			if part.Source == SourceClientIP && r.noClientIP.Add(1) == 1 {
+				slog.Warn("rate limit rule skipped, the request has no client IP", "rule", r.Name, "trusted-hops", p.config.TrustedHops, "request-id", req.RequestID())
+			}
+			return "", false
+		}
+		if i > 0 {
+			// Values are quoted so parts cannot collide, e.g. "a|b" + "c" and "a" + "b|c".
+			key.WriteByte('|')
+		}
+		key.WriteString(strconv.Quote(value))
+	}
+	return key.String(), true
+}
+
+func (p *RateLimitProcessor) keyPart(part KeyPart, req *processor.RequestContext) (string, bool) {
+	switch part.Source {
+	case SourceClientIP:
+		addr, ok := req.ClientIP(p.config.TrustedHops)
+		return addr.String(), ok
+	case SourceAuthority:
+		return req.Authority(), true
+	case SourcePath:
+		return req.URL().Path, true
+	case SourceHeader:
+		value := req.GetRequestHeader(part.Name)
+		return value, req.RequestHeaders().Has(part.Name)
+	case SourceCookie:
+		for _, cookie := range req.Cookies() {
+			if cookie.Name == part.Name {
+				return cookie.Value, true
+			}
+		}
+	case SourceClaim:
+		return req.Claim(cmp.Or(part.MetadataKey, DefaultClaimsMetadataKey), part.Name)
+	}
+	return "", false
+}
+
+// tooManyRequests returns the 429 response with the headers of draft-ietf-httpapi-ratelimit-headers.
+func tooManyRequests(r *Rule, d Decision) *extproc.ProcessingResponse_ImmediateResponse {
+	crw := processor.NewCommonResponseWriter()
+	crw.HeaderSet("retry-after", seconds(d.RetryAfter))
+	crw.HeaderSet("ratelimit-limit", strconv.Itoa(d.Limit))
+	crw.HeaderSet("ratelimit-remaining", strconv.Itoa(d.Remaining))
+	crw.HeaderSet("ratelimit-reset", seconds(d.Reset))
+	crw.HeaderSet("ratelimit-policy", fmt.Sprintf("%d;w=%s", r.Requests, seconds(r.Period)))
+	crw.HeaderSet("content-type", "application/json")
+	body, _ := json.Marshal(map[string]string{"error": "too_many_requests", "rule": r.Name})
+	return &extproc.ProcessingResponse_ImmediateResponse{
+		ImmediateResponse: &extproc.ImmediateResponse{
+			Status:  &typev3.HttpStatus{Code: typev3.StatusCode_TooManyRequests},
+			Headers: crw.CommonResponse().GetHeaderMutation(),
+			Body:    string(body),
+			Details: "rate_limited",
+		},
+	}
+}
+
+// seconds formats the duration in whole seconds, rounded up so clients do not retry too early.
+func seconds(d time.Duration) string {
+	return strconv.FormatInt(int64(math.Ceil(d.Seconds())), 10)
+}
@@ -0,0 +1,207 @@
+package ratelimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/cainelli/ext-proc/pkg/service"
+	"github.com/cainelli/ext-proc/pkg/service/processor"
+	"github.com/cainelli/ext-proc/pkg/service/processortest"
+)
+
+type clock struct {
+	now time.Time
+}
+
+func (c *clock) Now() time.Time { return c.now }
+
+func newProcessor(t *testing.T, config Config) (*RateLimitProcessor, *service.ExtProcessor, *clock) {
+	t.Helper()
+	p, err := New(config)
+	if err != nil {
+		t.Fatalf("New() = %v", err)
+	}
+	c := &clock{now: time.Unix(1_700_000_000, 0)}
+	p.now = c.Now
+	// The claims of the requests have the sub of their x-test-sub header.
+	claims := &processortest.ClaimsSetter{Key: DefaultClaimsMetadataKey, Claims: func(req *processor.RequestContext) processor.Claims {
+		if sub := req.GetRequestHeader("x-test-sub"); sub != "" {
+			return processor.Claims{"sub": sub}
+		}
+		return nil
+	}}
+	return p, processortest.Chain(claims, p), c
+}
+
+func send(t *testing.T, svc *service.ExtProcessor, target string, headers map[string]string) *processortest.Result {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	return processortest.MustRun(t, svc, req, nil)
+}
+
+func TestRateLimit(t *testing.T) {
+	p, svc, c := newProcessor(t, Config{
+		TrustedHops: 1,
+		Rules: []Rule{
+			{Name: "per-ip", PathPattern: "/api/*", Key: []KeyPart{{Source: SourceClientIP}}, Requests: 2, Period: time.Second},
+		},
+	})
+	ip := func(addr string) map[string]string {
+		return map[string]string{"x-forwarded-for": addr + ", 10.0.0.1"}
+	}
+
+	for i := range 2 {
+		if result := send(t, svc, "http://api.example.com/api/items", ip("192.0.2.1")); result.ImmediateResponse != nil {
+			t.Fatalf("request %d was limited", i)
+		}
+	}
+	result := send(t, svc, "http://api.example.com/api/items", ip("192.0.2.1"))
+	if result.ImmediateResponse == nil || result.Response.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("third request was not limited")
+	}
+	for header, want := range map[string]string{"retry-after": "1", "ratelimit-limit": "2", "ratelimit-remaining": "0", "ratelimit-reset": "1", "ratelimit-policy": "2;w=1"} {
+		if got := result.Response.Header.Get(header); got != want {
+			t.Errorf("%s = %q, want %q", header, got, want)
+		}
+	}
+
+	// Other clients and paths outside the rule are not limited.
+	if result := send(t, svc, "http://api.example.com/api/items", ip("192.0.2.2")); result.ImmediateResponse != nil {
+		t.Errorf("other client was limited")
+	}
+	if result := send(t, svc, "http://api.example.com/health", ip("192.0.2.1")); result.ImmediateResponse != nil {
+		t.Errorf("path outside the rule was limited")
+	}
+	// Requests without client address are not limited by the rule.
+	if result := send(t, svc, "http://api.example.com/api/items", nil); result.ImmediateResponse != nil {
+		t.Errorf("request without x-forwarded-for was limited")
+	}
+
+	// Tokens are added back over time.
+	c.now = c.now.Add(500 * time.Millisecond)
+	if result := send(t, svc, "http://api.example.com/api/items", ip("192.0.2.1")); result.ImmediateResponse != nil {
+		t.Errorf("request after refill was limited")
+	}
+	if result := send(t, svc, "http://api.example.com/api/items", ip("192.0.2.1")); result.ImmediateResponse == nil {
+		t.Errorf("request exceeding the refill was not limited")
+	}
+
+	stats := p.Describe().(map[string]any)["rules"].([]RuleStats)
+	if stats[0].Limited != 2 || stats[0].Keys != 2 {
+		t.Errorf("stats = %+v, want 2 limited requests and 2 keys", stats[0])
+	}
+}
+
+func TestKeys(t *testing.T) {
+	_, svc, _ := newProcessor(t, Config{
+		Rules: []Rule{
+			{Name: "per-user", Key: []KeyPart{{Source: SourceClaim, Name: "sub"}, {Source: SourceAuthority}}, Requests: 1, Period: time.Minute},
+			{Name: "per-tenant", Key: []KeyPart{{Source: SourceHeader, Name: "x-tenant"}, {Source: SourceCookie, Name: "region"}}, Requests: 1, Period: time.Minute},
+		},
+	})
+	tests := []struct {
+		name    string
+		target  string
+		headers map[string]string
+		limited bool
+	}{
+		{"first user request", "http://a.example.com/", map[string]string{"x-test-sub": "alice"}, false},
+		{"second user request", "http://a.example.com/", map[string]string{"x-test-sub": "alice"}, true},
+		{"other authority", "http://b.example.com/", map[string]string{"x-test-sub": "alice"}, false},
+		{"other user", "http://a.example.com/", map[string]string{"x-test-sub": "bob"}, false},
+		{"first tenant request", "http://a.example.com/", map[string]string{"x-tenant": "t1", "cookie": "region=eu"}, false},
+		{"second tenant request", "http://a.example.com/", map[string]string{"x-tenant": "t1", "cookie": "region=eu"}, true},
+		{"other region", "http://a.example.com/", map[string]string{"x-tenant": "t1", "cookie": "region=us"}, false},
+		{"missing cookie", "http://a.example.com/", map[string]string{"x-tenant": "t1"}, false},
+		{"missing cookie again", "http://a.example.com/", map[string]string{"x-tenant": "t1"}, false},
+	}
+	for _, test := range tests {
+		result := send(t, svc, test.target, test.headers)
+		if limited := result.ImmediateResponse != nil; limited != test.limited {
+			t.Errorf("%s: limited = %v, want %v", test.name, limited, test.limited)
+		}
+	}
+}
+
+func TestAuthorities(t *testing.T) {
+	_, svc, _ := newProcessor(t, Config{
+		Rules: []Rule{{Name: "admin", Authorities: []string{"admin.example.com"}, Requests: 1, Period: time.Minute}},
+	})
+	if result := send(t, svc, "http://www.example.com/", nil); result.ImmediateResponse != nil {
+		t.Fatalf("request to another authority was limited")
+	}
+	// Changing the form of the host header does not skip the rule.
+	for _, target := range []string{"http://admin.example.com/", "http://ADMIN.example.com/", "http://admin.example.com:443/"} {
+		result := send(t, svc, target, nil)
+		if limited := result.ImmediateResponse != nil; limited != (target != "http://admin.example.com/") {
+			t.Errorf("%s: limited = %v", target, limited)
+		}
+	}
+}
+
+func TestNoClientIP(t *testing.T) {
+	p, svc, _ := newProcessor(t, Config{
+		Rules: []Rule{{Name: "per-ip", Key: []KeyPart{{Source: SourceClientIP}}, Requests: 1, Period: time.Minute}},
+	})
+	// Without trusted hops and source.address attribute, the client IP is unknown.
+	for range 3 {
+		if result := send(t, svc, "http://api.example.com/", map[string]string{"x-forwarded-for": "192.0.2.1"}); result.ImmediateResponse != nil {
+			t.Fatalf("request without client IP was limited")
+		}
+	}
+	stats := p.Describe().(map[string]any)["rules"].([]RuleStats)
+	if stats[0].NoClientIP != 3 || stats[0].Allowed != 0 {
+		t.Errorf("stats = %+v, want 3 requests without client IP", stats[0])
+	}
+}
+
+func TestShadowRule(t *testing.T) {
+	p, svc, _ := newProcessor(t, Config{
+		Rules: []Rule{{Name: "global", Requests: 1, Period: time.Minute, Shadow: true}},
+	})
+	for range 3 {
+		if result := send(t, svc, "http://api.example.com/", nil); result.ImmediateResponse != nil {
+			t.Fatalf("shadow rule limited a request")
+		}
+	}
+	stats := p.Describe().(map[string]any)["rules"].([]RuleStats)
+	if stats[0].ShadowLimited != 2 || stats[0].Limited != 0 {
+		t.Errorf("stats = %+v, want 2 shadow limited requests", stats[0])
+	}
+}
+
+func TestBucketEviction(t *testing.T) {
+	set := newBucketSet(1, time.Minute, 1, 16*shards)
+	now := time.Now()
+	for i := range 10_000 {
+		set.take(strconv.Itoa(i), now)
+	}
+	if n := set.len(); n > 16*shards {
+		t.Errorf("bucket set holds %d keys, want at most %d", n, 16*shards)
+	}
+	// The most recently used key is still limited.
+	if d := set.take("9999", now); d.Allowed {
+		t.Errorf("recently used key was evicted")
+	}
+}
+
+func TestNewInvalid(t *testing.T) {
+	invalid := map[string]Rule{
+		"no requests":    {Period: time.Second},
+		"no period":      {Requests: 1},
+		"bad pattern":    {Requests: 1, Period: time.Second, PathPattern: "["},
+		"unknown source": {Requests: 1, Period: time.Second, Key: []KeyPart{{Source: "query"}}},
+		"unnamed header": {Requests: 1, Period: time.Second, Key: []KeyPart{{Source: SourceHeader}}},
+	}
+	for name, r := range invalid {
+		if _, err := New(Config{Rules: []Rule{r}}); err == nil {
+			t.Errorf("New() with %s succeeded", name)
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package ratelimit
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	// DefaultRedisKeyPrefix prefixes the keys of the counters when RedisConfig.KeyPrefix is empty.
+	DefaultRedisKeyPrefix = "ratelimit:"
+	// DefaultRedisTimeout is the timeout of a call when RedisConfig.Timeout is zero, requests wait for it so it
+	// is short.
+	DefaultRedisTimeout = 100 * time.Millisecond
+	// DefaultRedisMaxIdleConns is the number of idle connections kept when RedisConfig.MaxIdleConns is zero.
+	DefaultRedisMaxIdleConns = 16
+)
+
+// RedisConfig configures a RedisStore.
+type RedisConfig struct {
+	// Addr is the host:port of the server.
+	Addr string `json:"addr"`
+	// Username and Password authenticate the connections when Password is set, Username may be empty.
+	Username string `json:"username,omitempty"`
+	Password string `json:"-"`
+	// DB is the database selected on the connections.
+	DB int `json:"db,omitempty"`
+	// KeyPrefix prefixes the keys of the counters, DefaultRedisKeyPrefix when empty.
+	KeyPrefix string `json:"key_prefix,omitempty"`
+	// Timeout bounds the time to dial and run a call, DefaultRedisTimeout when zero.
+	Timeout time.Duration `json:"timeout,omitempty"`
+	// MaxIdleConns is the number of idle connections kept for reuse, DefaultRedisMaxIdleConns when zero.
+	MaxIdleConns int `json:"max_idle_conns,omitempty"`
+}
+
+// RedisStore is a Store keeping sliding window counters in a server speaking the Redis protocol (RESP), e.g.
+// Redis, Valkey or KeyDB. Each key uses a counter per window, expiring after the next window.
+// Rejected requests are counted too, so clients retrying too early stay limited.
+type RedisStore struct {
+	config RedisConfig
+	idle   chan *redisConn
+}
+
+var _ Store = &RedisStore{}
+
+func NewRedisStore(config RedisConfig) (*RedisStore, error) {
+	if config.Addr == "" {
+		return nil, errors.New("Addr is required")
+	}
+	if config.KeyPrefix == "" {
+		config.KeyPrefix = DefaultRedisKeyPrefix
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultRedisTimeout
+	}
+	if config.MaxIdleConns <= 0 {
+		config.MaxIdleConns = DefaultRedisMaxIdleConns
+	}
+	return &RedisStore{config: config, idle: make(chan *redisConn, config.MaxIdleConns)}, nil
+}
+
+// Take increments the counter of the current window and reads the one of the previous window in a single round
+// trip.
+func (s *RedisStore) Take(ctx context.Context, key string, limit int, window time.Duration, now time.Time) (Decision, error) {
+	start := windowStart(now, window)
+	current := s.config.KeyPrefix + key + ":" + strconv.FormatInt(start.UnixMilli(), 10)
+	previous := s.config.KeyPrefix + key + ":" + strconv.FormatInt(start.Add(-window).UnixMilli(), 10)
+	replies, err := s.do(ctx,
+		[]string{"INCR", current},
+		[]string{"PEXPIRE", current, strconv.FormatInt((2 * window).Milliseconds(), 10)},
+		[]string{"GET", previous},
+	)
+	if err != nil {
+		return Decision{}, err
+	}
+	count, ok := replies[0].(int64)
+	if !ok {
+		return Decision{}, fmt.Errorf("unexpected INCR reply %v", replies[0])
+	}
+	var previousCount int64
+	if reply, ok := replies[2].(string); ok {
+		if previousCount, err = strconv.ParseInt(reply, 10, 64); err != nil {
+			return Decision{}, fmt.Errorf("unexpected GET reply %q", reply)
+		}
+	}
+	return slidingWindow(previousCount, count, limit, window, now), nil
+}
+
+// Close closes the idle connections.
+func (s *RedisStore) Close() error {
+	for {
+		select {
+		case conn := <-s.idle:
+			conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// do pipelines the commands and returns their replies. Error replies are returned as errors.
+func (s *RedisStore) do(ctx context.Context, commands ...[]string) ([]any, error) {
+	deadline := time.Now().Add(s.config.Timeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	conn, err := s.conn(ctx, deadline)
+	if err != nil {
+		return nil, err
+	}
+	replies, err := conn.do(deadline, commands...)
+	if err != nil {
+		// The connection is in an unknown state, e.g. with replies left to read.
+		conn.Close()
+		return nil, err
+	}
+	select {
+	case s.idle <- conn:
+	default:
+		conn.Close()
+	}
+	for _, reply := range replies {
+		if err, ok := reply.(redisError); ok {
+			return nil, err
+		}
+	}
+	return replies, nil
+}
+
+// conn returns an idle connection or dials a new one.
+func (s *RedisStore) conn(ctx context.Context, deadline time.Time) (*redisConn, error) {
+	select {
+	case conn := <-s.idle:
+		return conn, nil
+	default:
+	}
+	dialer := net.Dialer{Deadline: deadline}
+	netConn, err := dialer.DialContext(ctx, "tcp", s.config.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed connecting to redis: %w", err)
+	}
+	conn := &redisConn{Conn: netConn, r: bufio.NewReader(netConn), w: bufio.NewWriter(netConn)}
+
+	var setup [][]string
+	if s.config.Password != "" {
+		if s.config.Username != "" {
+			setup = append(setup, []string{"AUTH", s.config.Username, s.config.Password})
+		} else {
+			setup = append(setup, []string{"AUTH", s.config.Password})
+		}
+	}
+	if s.config.DB != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(s.config.DB)})
+	}
+	if len(setup) > 0 {
+		replies, err := conn.do(deadline, setup...)
+		if err == nil {
+			for _, reply := range replies {
+				if replyErr, ok := reply.(redisError); ok {
+					err = replyErr
+				}
+			}
+		}
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed setting up redis connection: %w", err)
+		}
+	}
+	return conn, nil
+}
+
+// redisError is an error reply.
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// redisConn is a connection speaking RESP2.
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+	w *bufio.Writer
+}
+
+// do writes the commands and reads a reply for each of them. Replies are int64, string, nil, redisError or []any.
+func (c *redisConn) do(deadline time.Time, commands ...[]string) ([]any, error) {
+	if err := c.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+	for _, command := range commands {
+		c.w.WriteString("*" + strconv.Itoa(len(command)) + "\r\n")
+		for _, arg := range command {
+			c.w.WriteString("$" + strconv.Itoa(len(arg)) + "\r\n" + arg + "\r\n")
+		}
+	}
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+	replies := make([]any, len(commands))
+	for i := range replies {
+		reply, err := readReply(c.r)
+		if err != nil {
+			return nil, err
+		}
+		replies[i] = reply
+	}
+	return replies, nil
+}
+
+func readReply(r *bufio.Reader) (any, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("invalid redis reply %q", line)
+	}
+	kind, value := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return value, nil
+	case '-':
+		return redisError(value), nil
+	case ':':
+		return strconv.ParseInt(value, 10, 64)
+	case '$':
+		size, err := strconv.Atoi(value)
+		if err != nil || size < 0 {
+			return nil, err
+		}
+		raw := make([]byte, size+2)
+		if _, err := io.ReadFull(r, raw); err != nil {
+			return nil, err
+		}
+		return string(raw[:size]), nil
+	case '*':
+		size, err := strconv.Atoi(value)
+		if err != nil || size < 0 {
+			return nil, err
+		}
+		items := make([]any, size)
+		for i := range items {
+			if items[i], err = readReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("invalid redis reply %q", line)
+}
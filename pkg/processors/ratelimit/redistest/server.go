@@ -0,0 +1,230 @@
+// Package redistest provides an in-process server speaking the Redis protocol, implementing the few commands used by
+// ratelimit.RedisStore, to test it without a Redis server.
+package redistest
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Server stores string values in memory and implements PING, AUTH, SELECT, GET, SET, INCR, PEXPIRE and DEL.
+type Server struct {
+	// Commands counts the commands received.
+	Commands atomic.Int64
+
+	password string
+	listener net.Listener
+	mu       sync.Mutex
+	values   map[string]string
+	expiries map[string]time.Time
+	conns    map[net.Conn]bool
+	wg       sync.WaitGroup
+}
+
+// NewServer starts a server on a local port, it is stopped with Close. When password is set, it is required with AUTH
+// before any other command.
+func NewServer(password string) (*Server, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		password: password,
+		listener: listener,
+		values:   map[string]string{},
+		expiries: map[string]time.Time{},
+		conns:    map[net.Conn]bool{},
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+// Addr returns the host:port the server listens on.
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Get returns the value of the key, like GET.
+func (s *Server) Get(key string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.get(key)
+}
+
+// Close stops the server and closes the connections.
+func (s *Server) Close() error {
+	err := s.listener.Close()
+	s.mu.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns[conn] = true
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go s.handle(conn)
+	}
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	authenticated := s.password == ""
+	for {
+		command, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		s.Commands.Add(1)
+		name := strings.ToUpper(command[0])
+		switch {
+		case name == "AUTH":
+			// AUTH password or AUTH username password.
+			authenticated = command[len(command)-1] == s.password
+			if !authenticated {
+				w.WriteString("-WRONGPASS invalid username-password pair\r\n")
+				break
+			}
+			w.WriteString("+OK\r\n")
+		case !authenticated:
+			w.WriteString("-NOAUTH Authentication required.\r\n")
+		default:
+			w.WriteString(s.run(name, command[1:]))
+		}
+		// Pipelined commands are answered together.
+		if r.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// run runs the command and returns its RESP reply.
+func (s *Server) run(name string, args []string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case name == "PING":
+		return "+PONG\r\n"
+	case name == "SELECT" && len(args) == 1:
+		return "+OK\r\n"
+	case name == "GET" && len(args) == 1:
+		value, ok := s.get(args[0])
+		if !ok {
+			return "$-1\r\n"
+		}
+		return "$" + strconv.Itoa(len(value)) + "\r\n" + value + "\r\n"
+	case name == "SET" && len(args) == 2:
+		s.values[args[0]] = args[1]
+		delete(s.expiries, args[0])
+		return "+OK\r\n"
+	case name == "INCR" && len(args) == 1:
+		value, _ := s.get(args[0])
+		n, err := strconv.ParseInt(value, 10, 64)
+		if value != "" && err != nil {
+			return "-ERR value is not an integer or out of range\r\n"
+		}
+		n++
+		s.values[args[0]] = strconv.FormatInt(n, 10)
+		return ":" + strconv.FormatInt(n, 10) + "\r\n"
+	case name == "PEXPIRE" && len(args) == 2:
+		ms, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return "-ERR value is not an integer or out of range\r\n"
+		}
+		if _, ok := s.get(args[0]); !ok {
+			return ":0\r\n"
+		}
+		s.expiries[args[0]] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		return ":1\r\n"
+	case name == "DEL":
+		deleted := 0
+		for _, key := range args {
+			if _, ok := s.get(key); ok {
+				delete(s.values, key)
+				delete(s.expiries, key)
+				deleted++
+			}
+		}
+		return ":" + strconv.Itoa(deleted) + "\r\n"
+	}
+	return fmt.Sprintf("-ERR unknown command or wrong number of arguments for '%s'\r\n", name)
+}
+
+// get returns the value of the key, deleting it once expired. s.mu must be held.
+func (s *Server) get(key string) (string, bool) {
+	if expiry, ok := s.expiries[key]; ok && !time.Now().Before(expiry) {
+		delete(s.values, key)
+		delete(s.expiries, key)
+	}
+	value, ok := s.values[key]
+	return value, ok
+}
+
+// readCommand reads a command sent as an array of bulk strings.
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return nil, fmt.Errorf("unexpected command %q", line)
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("invalid command size %q", line)
+	}
+	command := make([]string, n)
+	for i := range command {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimPrefix(line, "$"))
+		if !strings.HasPrefix(line, "$") || err != nil || size < 0 {
+			return nil, fmt.Errorf("invalid bulk string %q", line)
+		}
+		raw := make([]byte, size+2)
+		if _, err := io.ReadFull(r, raw); err != nil {
+			return nil, err
+		}
+		command[i] = string(raw[:size])
+	}
+	return command, nil
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(line, "\r\n"), nil
+}
@@ -0,0 +1,47 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"time"
+)
+
+// DefaultStoreRetryInterval is the time the local buckets are used after the store failed, when
+// Config.StoreRetryInterval is zero.
+const DefaultStoreRetryInterval = 5 * time.Second
+
+// Store counts the requests of all the replicas, so the limits hold across the fleet.
+type Store interface {
+	// Take counts a request for the key and returns whether it is within limit requests per window.
+	Take(ctx context.Context, key string, limit int, window time.Duration, now time.Time) (Decision, error)
+}
+
+// windowStart returns the start of the fixed window containing now. Windows are aligned on the unix epoch so every
+// replica uses the same windows, given their clocks are synchronized.
+func windowStart(now time.Time, window time.Duration) time.Time {
+	return time.Unix(0, now.UnixNano()-now.UnixNano()%int64(window))
+}
+
+// slidingWindow decides with the sliding window counter approximation: the requests of the previous window are
+// weighted by the part of it still covered by a window ending now, and added to the requests of the current window.
+// current includes the request being decided.
+func slidingWindow(previous, current int64, limit int, window time.Duration, now time.Time) Decision {
+	elapsed := now.Sub(windowStart(now, window))
+	weight := 1 - float64(elapsed)/float64(window)
+	count := float64(previous)*weight + float64(current)
+	d := Decision{
+		Allowed:   count <= float64(limit),
+		Limit:     limit,
+		Remaining: max(0, limit-int(math.Ceil(count))),
+		Reset:     window - elapsed,
+	}
+	if !d.Allowed {
+		d.RetryAfter = window - elapsed
+		if current < int64(limit) && previous > 0 {
+			// The weight of the previous window decreases until the next request is within limit.
+			below := 1 - (float64(limit)-float64(current+1))/float64(previous)
+			d.RetryAfter = time.Duration(math.Ceil((below-(1-weight))*float64(window.Milliseconds()))) * time.Millisecond
+		}
+	}
+	return d
+}
@@ -0,0 +1,149 @@
+package ratelimit
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/cainelli/ext-proc/pkg/processors/ratelimit/redistest"
+	"github.com/cainelli/ext-proc/pkg/service"
+)
+
+func TestSlidingWindow(t *testing.T) {
+	window := time.Minute
+	start := time.Unix(1_700_000_040, 0) // A minute boundary.
+	tests := []struct {
+		name              string
+		previous, current int64
+		elapsed           time.Duration
+		allowed           bool
+		remaining         int
+		retryAfter        time.Duration
+	}{
+		{"empty", 0, 1, 0, true, 9, 0},
+		{"at limit", 0, 10, 30 * time.Second, true, 0, 0},
+		{"over limit", 0, 11, 30 * time.Second, false, 0, 30 * time.Second},
+		{"previous window weighs", 10, 6, 30 * time.Second, false, 0, 12 * time.Second},
+		{"previous window faded", 10, 6, 45 * time.Second, true, 1, 0},
+	}
+	for _, test := range tests {
+		d := slidingWindow(test.previous, test.current, 10, window, start.Add(test.elapsed))
+		if d.Allowed != test.allowed || d.Remaining != test.remaining || d.RetryAfter != test.retryAfter {
+			t.Errorf("%s: got %+v, want allowed %v, remaining %d, retry after %s", test.name, d, test.allowed, test.remaining, test.retryAfter)
+		}
+		if d.Reset != window-test.elapsed {
+			t.Errorf("%s: reset = %s, want %s", test.name, d.Reset, window-test.elapsed)
+		}
+	}
+}
+
+func newRedis(t *testing.T) (*redistest.Server, *RedisStore) {
+	t.Helper()
+	srv, err := redistest.NewServer("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { srv.Close() })
+	store, err := NewRedisStore(RedisConfig{Addr: srv.Addr(), Password: "secret", DB: 1, Timeout: time.Second})
+	if err != nil {
+		t.Fatalf("NewRedisStore() = %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return srv, store
+}
+
+// Replicas sharing a store enforce a single limit.
+func TestRedisStore(t *testing.T) {
+	srv, store := newRedis(t)
+	config := Config{
+		Store: store,
+		Rules: []Rule{{Name: "per-tenant", Key: []KeyPart{{Source: SourceHeader, Name: "x-tenant"}}, Requests: 3, Period: time.Minute}},
+	}
+	_, replica1, c := newProcessor(t, config)
+	p2, replica2, _ := newProcessor(t, config)
+	p2.now = c.Now
+
+	tenant := map[string]string{"x-tenant": "t1"}
+	for i, replica := range []*service.ExtProcessor{replica1, replica2, replica1} {
+		if result := send(t, replica, "http://api.example.com/", tenant); result.ImmediateResponse != nil {
+			t.Fatalf("request %d was limited", i)
+		}
+	}
+	result := send(t, replica2, "http://api.example.com/", tenant)
+	if result.ImmediateResponse == nil || result.Response.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("fourth request across replicas was not limited")
+	}
+	if got := result.Response.Header.Get("ratelimit-limit"); got != "3" {
+		t.Errorf("ratelimit-limit = %q, want 3", got)
+	}
+
+	start := windowStart(c.now, time.Minute)
+	key := DefaultRedisKeyPrefix + `per-tenant|"t1":` + strconv.FormatInt(start.UnixMilli(), 10)
+	if value, ok := srv.Get(key); !ok || value != "4" {
+		t.Errorf("counter %s = %q, want 4", key, value)
+	}
+}
+
+// countingStore counts the calls to the store.
+type countingStore struct {
+	Store
+	calls int
+}
+
+func (s *countingStore) Take(ctx context.Context, key string, limit int, window time.Duration, now time.Time) (Decision, error) {
+	s.calls++
+	return s.Store.Take(ctx, key, limit, window, now)
+}
+
+func TestStoreFallback(t *testing.T) {
+	srv, redis := newRedis(t)
+	store := &countingStore{Store: redis}
+	p, svc, c := newProcessor(t, Config{
+		Store: store,
+		Rules: []Rule{{Name: "global", Requests: 100, FallbackRequests: 1, Period: time.Minute}},
+	})
+	if result := send(t, svc, "http://api.example.com/", nil); result.ImmediateResponse != nil {
+		t.Fatalf("request was limited")
+	}
+	srv.Close()
+	redis.Close()
+
+	// The local buckets allow FallbackRequests while the store is down, without calling it.
+	if result := send(t, svc, "http://api.example.com/", nil); result.ImmediateResponse != nil {
+		t.Fatalf("first request while the store is down was limited")
+	}
+	if result := send(t, svc, "http://api.example.com/", nil); result.ImmediateResponse == nil {
+		t.Fatalf("request over the fallback limit was not limited")
+	}
+	if store.calls != 2 {
+		t.Errorf("store called %d times, want 2", store.calls)
+	}
+	stats := p.Describe().(map[string]any)["rules"].([]RuleStats)
+	if stats[0].Fallback != 2 {
+		t.Errorf("fallback = %d, want 2", stats[0].Fallback)
+	}
+
+	// The store is tried again after the retry interval.
+	c.now = c.now.Add(DefaultStoreRetryInterval)
+	send(t, svc, "http://api.example.com/", nil)
+	if store.calls != 3 {
+		t.Errorf("store called %d times, want 3", store.calls)
+	}
+}
+
+func TestRedisStoreErrors(t *testing.T) {
+	srv, err := redistest.NewServer("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	store, err := NewRedisStore(RedisConfig{Addr: srv.Addr(), Password: "wrong"})
+	if err != nil {
+		t.Fatalf("NewRedisStore() = %v", err)
+	}
+	if _, err := store.Take(context.Background(), "key", 1, time.Second, time.Now()); err == nil {
+		t.Errorf("Take() with a wrong password succeeded")
+	}
+}
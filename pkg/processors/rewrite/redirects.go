@@ -0,0 +1,81 @@
+package rewrite
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Redirect redirects the requests for a path.
+// In files, a redirect is a CSV record "from,to[,status]", lines starting with # are comments.
+type Redirect struct {
+	// From is the escaped path, without the query, or the authority followed by the path like example.com/old.
+	// Redirects with an authority take precedence.
+	From string `json:"from"`
+	// To is the location of the redirect. The query of the request is kept unless To has one.
+	To string `json:"to"`
+	// Status is the status of the redirect, 301 when zero.
+	Status int `json:"status,omitempty"`
+}
+
+func (r Redirect) validate() error {
+	if r.From == "" || r.To == "" {
+		return fmt.Errorf("invalid redirect %q to %q: from and to are required", r.From, r.To)
+	}
+	if !strings.Contains(r.From, "/") {
+		return fmt.Errorf("invalid redirect %q: no path", r.From)
+	}
+	if !isRedirect(r.Status) {
+		return fmt.Errorf("invalid redirect %q: %d is not a redirect status", r.From, r.Status)
+	}
+	return nil
+}
+
+func readRedirectFile(name string) ([]Redirect, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	redirects, err := readRedirects(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return redirects, nil
+}
+
+func readRedirects(r io.Reader) ([]Redirect, error) {
+	reader := csv.NewReader(r)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	var redirects []Redirect
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return redirects, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		line, _ := reader.FieldPos(0)
+		if len(record) < 2 || len(record) > 3 {
+			return nil, fmt.Errorf("line %d: %d fields, want from,to[,status]", line, len(record))
+		}
+		redirect := Redirect{From: strings.TrimSpace(record[0]), To: strings.TrimSpace(record[1]), Status: http.StatusMovedPermanently}
+		if len(record) == 3 {
+			if redirect.Status, err = strconv.Atoi(strings.TrimSpace(record[2])); err != nil {
+				return nil, fmt.Errorf("line %d: invalid status: %w", line, err)
+			}
+		}
+		if err := redirect.validate(); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		redirects = append(redirects, redirect)
+	}
+}
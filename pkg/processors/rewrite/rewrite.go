@@ -0,0 +1,273 @@
+// Package rewrite rewrites the path, authority and method of requests and answers redirects: HTTP to HTTPS, trailing
+// slash normalization, redirect maps and regex rules.
+package rewrite
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/cainelli/ext-proc/pkg/service/processor"
+	extproc "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+)
+
+// TrailingSlash is the normalization of the trailing slash of the paths.
+type TrailingSlash string
+
+const (
+	// TrailingSlashKeep leaves the paths as they are.
+	TrailingSlashKeep TrailingSlash = ""
+	// TrailingSlashAdd redirects the paths without a trailing slash to the path with one, except the paths whose last
+	// segment has an extension, like /app.js.
+	TrailingSlashAdd TrailingSlash = "add"
+	// TrailingSlashRemove redirects the paths with trailing slashes to the path without them.
+	TrailingSlashRemove TrailingSlash = "remove"
+)
+
+// Rule rewrites or redirects the matching requests.
+type Rule struct {
+	// Authorities are the authorities the rule applies to, all when empty, see processor.MatchAuthority.
+	Authorities []string `json:"authorities,omitempty"`
+	// Path is a regular expression matched against the escaped path, without the query. It matches all paths when
+	// empty.
+	Path string `json:"path,omitempty"`
+	// RewritePath replaces the path, $1 or ${name} are replaced by the groups of Path. The query of the request is
+	// kept unless RewritePath has one. The path is unchanged when empty.
+	RewritePath string `json:"rewrite_path,omitempty"`
+	// Host replaces the authority of the request.
+	Host string `json:"host,omitempty"`
+	// Method replaces the method of the request.
+	Method string `json:"method,omitempty"`
+	// RedirectStatus answers with a redirect to the rewritten URL instead of forwarding the rewritten request.
+	RedirectStatus int `json:"redirect_status,omitempty"`
+}
+
+// Config configures a RewriteProcessor. The redirects are checked in the order of the fields, the first one
+// answering the request wins.
+type Config struct {
+	// HTTPSRedirect redirects the requests whose :scheme is http to https.
+	HTTPSRedirect bool `json:"https_redirect,omitempty"`
+	// Redirects are redirects of exact paths.
+	Redirects []Redirect `json:"redirects,omitempty"`
+	// RedirectFiles are CSV files of redirects, see Redirect.
+	RedirectFiles []string `json:"redirect_files,omitempty"`
+	// TrailingSlash normalizes the trailing slash of the paths with a redirect.
+	TrailingSlash TrailingSlash `json:"trailing_slash,omitempty"`
+	// Rules are matched in order, the first matching rule applies. A rule without RewritePath, Host or Method leaves
+	// the matching requests unchanged, so a rule can exclude requests from the following ones.
+	Rules []Rule `json:"rules,omitempty"`
+}
+
+// RewriteProcessor rewrites and redirects requests. The route of rewritten requests is recomputed by Envoy, which
+// must allow routing mutations (mutation_rules.allow_all_routing) for Host and Method.
+type RewriteProcessor struct {
+	processor.NoOpProcessor
+	config    Config
+	redirects map[string]Redirect
+	rules     []rule
+}
+
+var _ processor.Processor = &RewriteProcessor{}
+
+type rule struct {
+	Rule
+	path *regexp.Regexp
+}
+
+// New validates the configuration and loads the redirect files.
+func New(config Config) (*RewriteProcessor, error) {
+	switch config.TrailingSlash {
+	case TrailingSlashKeep, TrailingSlashAdd, TrailingSlashRemove:
+	default:
+		return nil, fmt.Errorf("unknown trailing slash normalization %q", config.TrailingSlash)
+	}
+
+	p := &RewriteProcessor{config: config, redirects: make(map[string]Redirect)}
+	redirects := slices.Clone(config.Redirects)
+	for _, file := range config.RedirectFiles {
+		loaded, err := readRedirectFile(file)
+		if err != nil {
+			return nil, err
+		}
+		redirects = append(redirects, loaded...)
+	}
+	for _, r := range redirects {
+		if r.Status == 0 {
+			r.Status = http.StatusMovedPermanently
+		}
+		if err := r.validate(); err != nil {
+			return nil, err
+		}
+		p.redirects[r.From] = r
+	}
+
+	for i, r := range config.Rules {
+		rt := rule{Rule: r}
+		if r.Path != "" {
+			re, err := regexp.Compile(r.Path)
+			if err != nil {
+				return nil, fmt.Errorf("invalid rule %d: %w", i, err)
+			}
+			rt.path = re
+		}
+		if r.RedirectStatus != 0 {
+			if !isRedirect(r.RedirectStatus) {
+				return nil, fmt.Errorf("invalid rule %d: %d is not a redirect status", i, r.RedirectStatus)
+			}
+			if r.Method != "" {
+				return nil, fmt.Errorf("invalid rule %d: redirects cannot change the method", i)
+			}
+			if r.RewritePath == "" && r.Host == "" {
+				return nil, fmt.Errorf("invalid rule %d: redirect without path or host", i)
+			}
+		}
+		p.rules = append(p.rules, rt)
+	}
+	return p, nil
+}
+
+// Describe returns the configuration with the number of loaded redirects.
+func (p *RewriteProcessor) Describe() any {
+	return map[string]any{"config": p.config, "redirects": len(p.redirects)}
+}
+
+func (p *RewriteProcessor) RequestHeaders(ctx context.Context, crw *processor.CommonResponseWriter, req *processor.RequestContext) (*extproc.ProcessingResponse_ImmediateResponse, error) {
+	u := req.URL()
+	path := u.EscapedPath()
+
+	if p.config.HTTPSRedirect && req.Scheme() == "http" {
+		return redirect(req, preserveMethod(req, http.StatusMovedPermanently), "https://"+req.Authority()+u.RequestURI()), nil
+	}
+	if r, ok := p.lookup(req.Authority(), path); ok {
+		return redirect(req, r.Status, withQuery(r.To, u.RawQuery)), nil
+	}
+	if normalized := p.normalize(path); normalized != path {
+		return redirect(req, preserveMethod(req, http.StatusMovedPermanently), withQuery(normalized, u.RawQuery)), nil
+	}
+
+	r, match := p.rule(req.Authority(), path)
+	if r == nil {
+		return nil, nil
+	}
+	rewritten := ""
+	if r.RewritePath != "" {
+		template := r.RewritePath
+		if r.path != nil {
+			template = string(r.path.ExpandString(nil, r.RewritePath, path, match))
+		}
+		rewritten = withQuery(template, u.RawQuery)
+	}
+
+	if r.RedirectStatus != 0 {
+		location := cmp.Or(rewritten, u.RequestURI())
+		if r.Host != "" {
+			location = cmp.Or(req.Scheme(), "https") + "://" + r.Host + location
+		}
+		return redirect(req, r.RedirectStatus, location), nil
+	}
+
+	if rewritten == "" && r.Host == "" && r.Method == "" {
+		return nil, nil
+	}
+	if rewritten != "" {
+		crw.HeaderSet(":path", rewritten)
+	}
+	if r.Host != "" {
+		crw.HeaderSet(":authority", r.Host)
+	}
+	if r.Method != "" {
+		crw.HeaderSet(":method", r.Method)
+	}
+	crw.ClearRouteCache(true)
+	slog.Debug("rewriting request", "request-id", req.RequestID(), "path", u.RequestURI(), "rewritten-path", rewritten, "host", r.Host, "method", r.Method)
+	return nil, nil
+}
+
+// lookup returns the redirect of the authority and path, then of the path alone.
+func (p *RewriteProcessor) lookup(authority, path string) (Redirect, bool) {
+	if len(p.redirects) == 0 {
+		return Redirect{}, false
+	}
+	if r, ok := p.redirects[authority+path]; ok {
+		return r, true
+	}
+	r, ok := p.redirects[path]
+	return r, ok
+}
+
+// normalize returns the path with the trailing slash normalization applied.
+func (p *RewriteProcessor) normalize(path string) string {
+	switch p.config.TrailingSlash {
+	case TrailingSlashAdd:
+		last := path[strings.LastIndex(path, "/")+1:]
+		if last != "" && !strings.Contains(last, ".") {
+			return path + "/"
+		}
+	case TrailingSlashRemove:
+		if trimmed := strings.TrimRight(path, "/"); trimmed != "" {
+			return trimmed
+		}
+		return "/"
+	}
+	return path
+}
+
+// rule returns the first rule matching the request with the indexes of the groups of its Path.
+func (p *RewriteProcessor) rule(authority, path string) (*rule, []int) {
+	for i := range p.rules {
+		r := &p.rules[i]
+		if !processor.MatchAuthority(r.Authorities, authority) {
+			continue
+		}
+		if r.path == nil {
+			return r, nil
+		}
+		if match := r.path.FindStringSubmatchIndex(path); match != nil {
+			return r, match
+		}
+	}
+	return nil, nil
+}
+
+// withQuery adds the query to the target unless it has one already.
+func withQuery(target, query string) string {
+	if query == "" || strings.Contains(target, "?") {
+		return target
+	}
+	return target + "?" + query
+}
+
+// preserveMethod turns a 301 into a 308 for the methods other than GET and HEAD, so clients do not replay them as GET.
+func preserveMethod(req *processor.RequestContext, status int) int {
+	if method := req.Method(); method != http.MethodGet && method != http.MethodHead {
+		return http.StatusPermanentRedirect
+	}
+	return status
+}
+
+func isRedirect(status int) bool {
+	switch status {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+func redirect(req *processor.RequestContext, status int, location string) *extproc.ProcessingResponse_ImmediateResponse {
+	slog.Debug("redirecting request", "request-id", req.RequestID(), "authority", req.Authority(), "path", req.URL().RequestURI(), "status", status, "location", location)
+	crw := processor.NewCommonResponseWriter()
+	crw.HeaderSet("location", location)
+	return &extproc.ProcessingResponse_ImmediateResponse{
+		ImmediateResponse: &extproc.ImmediateResponse{
+			Status:  &typev3.HttpStatus{Code: typev3.StatusCode(status)},
+			Headers: crw.CommonResponse().GetHeaderMutation(),
+			Details: "redirect",
+		},
+	}
+}
@@ -0,0 +1,171 @@
+package rewrite_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cainelli/ext-proc/pkg/mutation"
+	"github.com/cainelli/ext-proc/pkg/processors/rewrite"
+	"github.com/cainelli/ext-proc/pkg/service/processortest"
+)
+
+func send(t *testing.T, p *rewrite.RewriteProcessor, method, target string) *processortest.Result {
+	t.Helper()
+	runner := &processortest.Runner{Mutator: mutation.Mutator{Rules: mutation.Rules{AllowAllRouting: true, DisallowIsError: true}}}
+	return processortest.MustRunWith(t, runner, processortest.Chain(p), httptest.NewRequest(method, target, nil), nil)
+}
+
+func TestRules(t *testing.T) {
+	p, err := rewrite.New(rewrite.Config{
+		Rules: []rewrite.Rule{
+			{Path: `^/response-headers`},
+			{Path: `^/users/(?P<id>\d+)/posts/(\d+)$`, RewritePath: "/api/posts?user=${id}&post=$2"},
+			{Path: `^/static/(.*)`, RewritePath: "/$1", Host: "cdn.internal"},
+			{Authorities: []string{"old.example.com"}, Path: `^/(.*)`, RewritePath: "/new/$1", Host: "www.example.com", RedirectStatus: http.StatusFound},
+			{Authorities: []string{"www.example.com"}, RewritePath: "/headers?show_env=1", Method: http.MethodGet},
+		},
+	})
+	if err != nil {
+		t.Fatalf("New() = %v", err)
+	}
+
+	tests := []struct {
+		name, method, target string
+		wantURI, wantHost    string
+		wantMethod           string
+		wantLocation         string
+	}{
+		{"excluded", http.MethodPost, "http://www.example.com/response-headers?a=1", "/response-headers?a=1", "www.example.com", http.MethodPost, ""},
+		{"capture groups", http.MethodGet, "http://api.example.com/users/42/posts/7", "/api/posts?user=42&post=7", "api.example.com", http.MethodGet, ""},
+		{"host rewrite keeps the query", http.MethodGet, "http://www.example.com/static/app.js?v=3", "/app.js?v=3", "cdn.internal", http.MethodGet, ""},
+		{"redirect", http.MethodGet, "http://old.example.com/about?ref=x", "", "", "", "http://www.example.com/new/about?ref=x"},
+		{"catch all", http.MethodPost, "http://www.example.com/anything?a=1", "/headers?show_env=1", "www.example.com", http.MethodGet, ""},
+		{"catch all in uppercase with port", http.MethodPost, "http://WWW.example.com:8080/anything", "/headers?show_env=1", "WWW.example.com:8080", http.MethodGet, ""},
+		{"no match", http.MethodGet, "http://other.example.com/anything", "/anything", "other.example.com", http.MethodGet, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result := send(t, p, test.method, test.target)
+			if test.wantLocation != "" {
+				if result.ImmediateResponse == nil {
+					t.Fatalf("request was not redirected")
+				}
+				if result.Response.StatusCode != http.StatusFound {
+					t.Errorf("status = %d, want 302", result.Response.StatusCode)
+				}
+				if got := result.Response.Header.Get("location"); got != test.wantLocation {
+					t.Errorf("location = %q, want %q", got, test.wantLocation)
+				}
+				return
+			}
+			if result.ImmediateResponse != nil {
+				t.Fatalf("unexpected immediate response %v", result.ImmediateResponse)
+			}
+			if got := result.Request.URL.RequestURI(); got != test.wantURI {
+				t.Errorf("path = %q, want %q", got, test.wantURI)
+			}
+			if result.Request.Host != test.wantHost {
+				t.Errorf("host = %q, want %q", result.Request.Host, test.wantHost)
+			}
+			if result.Request.Method != test.wantMethod {
+				t.Errorf("method = %q, want %q", result.Request.Method, test.wantMethod)
+			}
+			rewritten := test.target != "http://"+test.wantHost+test.wantURI || test.method != test.wantMethod
+			if got := result.Responses[0].GetRequestHeaders().GetResponse().GetClearRouteCache(); got != rewritten {
+				t.Errorf("clear route cache = %v, want %v", got, rewritten)
+			}
+		})
+	}
+}
+
+func TestRedirects(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "redirects.csv")
+	csv := "# from,to,status\n/old,/new\n\"/promo\",https://shop.example.com/sale?utm=promo,302\nblog.example.com/old,/blog/new\n"
+	if err := os.WriteFile(file, []byte(csv), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	p, err := rewrite.New(rewrite.Config{
+		HTTPSRedirect: true,
+		RedirectFiles: []string{file},
+		Redirects:     []rewrite.Redirect{{From: "/docs", To: "/documentation/", Status: http.StatusTemporaryRedirect}},
+		TrailingSlash: rewrite.TrailingSlashAdd,
+	})
+	if err != nil {
+		t.Fatalf("New() = %v", err)
+	}
+
+	tests := []struct {
+		name, method, target string
+		wantStatus           int
+		wantLocation         string
+	}{
+		{"https", http.MethodGet, "http://www.example.com/a?b=c", http.StatusMovedPermanently, "https://www.example.com/a?b=c"},
+		{"https keeps the method", http.MethodPost, "http://www.example.com/a", http.StatusPermanentRedirect, "https://www.example.com/a"},
+		{"map keeps the query", http.MethodGet, "https://www.example.com/old?x=1", http.StatusMovedPermanently, "/new?x=1"},
+		{"map with status", http.MethodGet, "https://www.example.com/promo?x=1", http.StatusFound, "https://shop.example.com/sale?utm=promo"},
+		{"map by authority", http.MethodGet, "https://blog.example.com/old", http.StatusMovedPermanently, "/blog/new"},
+		{"configured redirect", http.MethodGet, "https://www.example.com/docs", http.StatusTemporaryRedirect, "/documentation/"},
+		{"trailing slash", http.MethodGet, "https://www.example.com/about?x=1", http.StatusMovedPermanently, "/about/?x=1"},
+		{"file", http.MethodGet, "https://www.example.com/app.js", 0, ""},
+		{"normalized", http.MethodGet, "https://www.example.com/about/", 0, ""},
+		{"root", http.MethodGet, "https://www.example.com/", 0, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result := send(t, p, test.method, test.target)
+			if test.wantStatus == 0 {
+				if result.ImmediateResponse != nil {
+					t.Fatalf("unexpected redirect to %q", result.Response.Header.Get("location"))
+				}
+				return
+			}
+			if result.ImmediateResponse == nil {
+				t.Fatalf("request was not redirected")
+			}
+			if result.Response.StatusCode != test.wantStatus {
+				t.Errorf("status = %d, want %d", result.Response.StatusCode, test.wantStatus)
+			}
+			if got := result.Response.Header.Get("location"); got != test.wantLocation {
+				t.Errorf("location = %q, want %q", got, test.wantLocation)
+			}
+		})
+	}
+}
+
+func TestTrailingSlashRemove(t *testing.T) {
+	p, err := rewrite.New(rewrite.Config{TrailingSlash: rewrite.TrailingSlashRemove})
+	if err != nil {
+		t.Fatalf("New() = %v", err)
+	}
+	if got := send(t, p, http.MethodGet, "http://www.example.com/about//").Response.Header.Get("location"); got != "/about" {
+		t.Errorf("location = %q, want /about", got)
+	}
+	if result := send(t, p, http.MethodGet, "http://www.example.com/"); result.ImmediateResponse != nil {
+		t.Errorf("root was redirected")
+	}
+}
+
+func TestNewInvalid(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "redirects.csv")
+	if err := os.WriteFile(file, []byte("/old,/new,200\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	invalid := map[string]rewrite.Config{
+		"trailing slash":          {TrailingSlash: "both"},
+		"regexp":                  {Rules: []rewrite.Rule{{Path: "("}}},
+		"redirect status":         {Rules: []rewrite.Rule{{RewritePath: "/", RedirectStatus: http.StatusOK}}},
+		"redirect without target": {Rules: []rewrite.Rule{{RedirectStatus: http.StatusFound}}},
+		"redirect with method":    {Rules: []rewrite.Rule{{RewritePath: "/", Method: http.MethodGet, RedirectStatus: http.StatusFound}}},
+		"redirect without to":     {Redirects: []rewrite.Redirect{{From: "/old"}}},
+		"status in file":          {RedirectFiles: []string{file}},
+		"missing file":            {RedirectFiles: []string{"/does/not/exist.csv"}},
+	}
+	for name, config := range invalid {
+		if _, err := rewrite.New(config); err == nil {
+			t.Errorf("New() with invalid %s succeeded", name)
+		}
+	}
+}
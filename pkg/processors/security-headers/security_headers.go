@@ -0,0 +1,192 @@
+// Package securityheaders sets the security headers of responses and fills the per-request CSP nonce in the markers of
+// HTML bodies.
+package securityheaders
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"mime"
+	"strings"
+
+	"github.com/cainelli/ext-proc/pkg/service/processor"
+	extproc "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+)
+
+const (
+	// Disabled is the value of a header in a route override which stops the header from being set on that route.
+	Disabled = "-"
+	// NoncePlaceholder is replaced by the nonce of the request in ContentSecurityPolicy, e.g. script-src 'nonce-{nonce}'.
+	NoncePlaceholder = "{nonce}"
+	// DefaultNonceMarker is the marker replaced by the nonce of the request in HTML bodies when NonceMarker is empty,
+	// the upstream templates emit it in the tags they trust, e.g. <script nonce="{{csp-nonce}}">.
+	DefaultNonceMarker = "{{csp-nonce}}"
+	// NonceMetadataKey is the key of the request nonce in the RequestContext metadata, for processors rendering HTML.
+	NonceMetadataKey = "securityheaders.nonce"
+)
+
+// Headers are the security headers set on responses. Empty headers are not set.
+type Headers struct {
+	StrictTransportSecurity   string `json:"strict_transport_security,omitempty"`
+	ContentTypeOptions        string `json:"content_type_options,omitempty"`
+	ReferrerPolicy            string `json:"referrer_policy,omitempty"`
+	PermissionsPolicy         string `json:"permissions_policy,omitempty"`
+	CrossOriginOpenerPolicy   string `json:"cross_origin_opener_policy,omitempty"`
+	CrossOriginEmbedderPolicy string `json:"cross_origin_embedder_policy,omitempty"`
+	// ContentSecurityPolicy may contain NoncePlaceholder, a new nonce is then generated for every response and
+	// replaces the nonce markers of HTML bodies.
+	ContentSecurityPolicy string `json:"content_security_policy,omitempty"`
+	// ReportOnly sends the ContentSecurityPolicy as content-security-policy-report-only, so violations are reported
+	// without blocking anything. Nil inherits the value of the processor in route overrides.
+	ReportOnly *bool `json:"report_only,omitempty"`
+}
+
+// DefaultHeaders returns a strict set of headers suitable for most HTML applications.
+func DefaultHeaders() Headers {
+	return Headers{
+		StrictTransportSecurity:   "max-age=63072000; includeSubDomains",
+		ContentTypeOptions:        "nosniff",
+		ReferrerPolicy:            "strict-origin-when-cross-origin",
+		PermissionsPolicy:         "camera=(), microphone=(), geolocation=()",
+		CrossOriginOpenerPolicy:   "same-origin",
+		CrossOriginEmbedderPolicy: "require-corp",
+		ContentSecurityPolicy:     "default-src 'self'; script-src 'self' 'nonce-{nonce}'; object-src 'none'; base-uri 'none'; frame-ancestors 'none'",
+	}
+}
+
+// Route overrides the headers for the paths starting with PathPrefix. The headers set in the route replace the
+// headers of the processor, Disabled removes them.
+type Route struct {
+	PathPrefix string  `json:"path_prefix"`
+	Headers    Headers `json:"headers"`
+}
+
+// SecurityHeadersProcessor sets the security headers on responses which do not already have them. The route with the
+// longest matching PathPrefix overrides the headers.
+//
+// The nonce only replaces the markers emitted by the upstream, tags without one never get the nonce, so scripts
+// injected in the page stay blocked. The markers are only replaced in uncompressed HTML bodies, which requires the
+// BUFFERED response_body_mode in Envoy and the decompressor filter before ext_proc when the upstream compresses.
+// Otherwise scripts are blocked, use ReportOnly to evaluate the policy first.
+type SecurityHeadersProcessor struct {
+	Headers Headers
+	Routes  []Route
+	// NonceMarker is replaced by the nonce of the request in HTML bodies, DefaultNonceMarker when empty.
+	NonceMarker string
+}
+
+var _ processor.Processor = &SecurityHeadersProcessor{}
+var _ processor.ResponseBodyProcessor = &SecurityHeadersProcessor{}
+
+// Describe returns the headers and route overrides.
+func (p *SecurityHeadersProcessor) Describe() any {
+	return p
+}
+
+func (*SecurityHeadersProcessor) RequestHeaders(ctx context.Context, crw *processor.CommonResponseWriter, req *processor.RequestContext) (*extproc.ProcessingResponse_ImmediateResponse, error) {
+	return nil, nil
+}
+
+func (p *SecurityHeadersProcessor) ResponseHeaders(_ context.Context, crw *processor.CommonResponseWriter, req *processor.RequestContext) (*extproc.ProcessingResponse_ImmediateResponse, error) {
+	headers := p.headers(req.URL().Path)
+	for _, h := range []struct{ key, value string }{
+		{"strict-transport-security", headers.StrictTransportSecurity},
+		{"x-content-type-options", headers.ContentTypeOptions},
+		{"referrer-policy", headers.ReferrerPolicy},
+		{"permissions-policy", headers.PermissionsPolicy},
+		{"cross-origin-opener-policy", headers.CrossOriginOpenerPolicy},
+		{"cross-origin-embedder-policy", headers.CrossOriginEmbedderPolicy},
+	} {
+		if h.value == "" || h.value == Disabled || req.GetResponseHeader(h.key) != "" {
+			continue
+		}
+		crw.HeaderSet(h.key, h.value)
+	}
+
+	csp := headers.ContentSecurityPolicy
+	key := "content-security-policy"
+	if headers.ReportOnly != nil && *headers.ReportOnly {
+		key = "content-security-policy-report-only"
+	}
+	// The upstream policy wins, a nonce it does not know about would be useless.
+	if csp == "" || csp == Disabled || req.GetResponseHeader(key) != "" {
+		return nil, nil
+	}
+	if strings.Contains(csp, NoncePlaceholder) {
+		nonce, err := newNonce()
+		if err != nil {
+			return nil, err
+		}
+		csp = strings.ReplaceAll(csp, NoncePlaceholder, nonce)
+		req.Metadata()[NonceMetadataKey] = nonce
+		if injectable(req) {
+			// The body length changes with the nonces, Envoy falls back to chunked encoding without content-length.
+			crw.RemoveHeaders("content-length")
+		}
+	}
+	crw.HeaderSet(key, csp)
+	return nil, nil
+}
+
+// ResponseBody replaces the nonce markers of HTML bodies with the nonce of the request.
+func (p *SecurityHeadersProcessor) ResponseBody(_ context.Context, crw *processor.CommonResponseWriter, req *processor.RequestContext, body *extproc.HttpBody) (*extproc.ProcessingResponse_ImmediateResponse, error) {
+	nonce, ok := req.Metadata()[NonceMetadataKey].(string)
+	if !ok || !injectable(req) {
+		return nil, nil
+	}
+	marker := []byte(cmp.Or(p.NonceMarker, DefaultNonceMarker))
+	if bytes.Contains(body.GetBody(), marker) {
+		injected := bytes.ReplaceAll(body.GetBody(), marker, []byte(nonce))
+		crw.BodyMutation(&extproc.BodyMutation{Mutation: &extproc.BodyMutation_Body{Body: injected}})
+	}
+	return nil, nil
+}
+
+// headers returns the headers of the processor with the overrides of the longest matching route applied.
+func (p *SecurityHeadersProcessor) headers(path string) Headers {
+	headers := p.Headers
+	var route *Route
+	for i := range p.Routes {
+		r := &p.Routes[i]
+		if strings.HasPrefix(path, r.PathPrefix) && (route == nil || len(r.PathPrefix) > len(route.PathPrefix)) {
+			route = r
+		}
+	}
+	if route == nil {
+		return headers
+	}
+	override := func(current *string, value string) {
+		if value != "" {
+			*current = value
+		}
+	}
+	override(&headers.StrictTransportSecurity, route.Headers.StrictTransportSecurity)
+	override(&headers.ContentTypeOptions, route.Headers.ContentTypeOptions)
+	override(&headers.ReferrerPolicy, route.Headers.ReferrerPolicy)
+	override(&headers.PermissionsPolicy, route.Headers.PermissionsPolicy)
+	override(&headers.CrossOriginOpenerPolicy, route.Headers.CrossOriginOpenerPolicy)
+	override(&headers.CrossOriginEmbedderPolicy, route.Headers.CrossOriginEmbedderPolicy)
+	override(&headers.ContentSecurityPolicy, route.Headers.ContentSecurityPolicy)
+	if route.Headers.ReportOnly != nil {
+		headers.ReportOnly = route.Headers.ReportOnly
+	}
+	return headers
+}
+
+// injectable reports whether the response body is HTML that can be modified.
+func injectable(req *processor.RequestContext) bool {
+	mediaType, _, _ := mime.ParseMediaType(req.GetResponseHeader("content-type"))
+	encoding := req.GetResponseHeader("content-encoding")
+	return mediaType == "text/html" && (encoding == "" || strings.EqualFold(encoding, "identity"))
+}
+
+func newNonce() (string, error) {
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return "", fmt.Errorf("failed generating CSP nonce: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(raw), nil
+}
@@ -0,0 +1,124 @@
+package securityheaders_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	securityheaders "github.com/cainelli/ext-proc/pkg/processors/security-headers"
+	"github.com/cainelli/ext-proc/pkg/service/processortest"
+)
+
+func run(t *testing.T, p *securityheaders.SecurityHeadersProcessor, path string, header http.Header, body string) (*http.Response, string) {
+	t.Helper()
+	resp := &http.Response{
+		StatusCode:    http.StatusOK,
+		Header:        header,
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+	}
+	result := processortest.MustRun(t, processortest.Chain(p), httptest.NewRequest(http.MethodGet, "https://example.com"+path, nil), resp)
+	raw, err := io.ReadAll(result.Response.Body)
+	if err != nil {
+		t.Fatalf("failed reading body: %v", err)
+	}
+	return result.Response, string(raw)
+}
+
+func TestNonceInjection(t *testing.T) {
+	p := &securityheaders.SecurityHeadersProcessor{Headers: securityheaders.DefaultHeaders()}
+	body := `<html><head><script nonce="{{csp-nonce}}" src="/app.js"></script><script nonce="upstream">1</script>` +
+		`<link rel="stylesheet" nonce="{{csp-nonce}}" href="/app.css"></head>` +
+		`<body><p>Hello <script>alert(document.cookie)</script></p><SCRIPT src="https://evil.example"></SCRIPT></body></html>`
+	resp, got := run(t, p, "/", http.Header{"Content-Type": {"text/html; charset=utf-8"}, "Content-Length": {"1"}}, body)
+
+	match := regexp.MustCompile(`'nonce-([^']+)'`).FindStringSubmatch(resp.Header.Get("content-security-policy"))
+	if match == nil {
+		t.Fatalf("content-security-policy = %q, want a nonce", resp.Header.Get("content-security-policy"))
+	}
+	want := strings.ReplaceAll(body, "{{csp-nonce}}", match[1])
+	if got != want {
+		t.Errorf("body =\n%s\nwant\n%s", got, want)
+	}
+	// Scripts injected in the page, without the marker, must stay blocked.
+	if strings.Count(got, match[1]) != 2 || !strings.Contains(got, "<script>alert(document.cookie)</script>") ||
+		!strings.Contains(got, `<SCRIPT src="https://evil.example">`) {
+		t.Errorf("the nonce was added to tags without the marker: %s", got)
+	}
+	if resp.Header.Get("content-length") != "" {
+		t.Errorf("content-length = %q, want it removed", resp.Header.Get("content-length"))
+	}
+	for _, key := range []string{"strict-transport-security", "x-content-type-options", "referrer-policy", "permissions-policy", "cross-origin-opener-policy", "cross-origin-embedder-policy"} {
+		if resp.Header.Get(key) == "" {
+			t.Errorf("%s is missing", key)
+		}
+	}
+
+	_, second := run(t, p, "/", http.Header{"Content-Type": {"text/html"}}, `<script nonce="{{csp-nonce}}"></script>`)
+	if strings.Contains(second, match[1]) {
+		t.Errorf("the nonce is reused between requests")
+	}
+}
+
+func TestNonceMarker(t *testing.T) {
+	p := &securityheaders.SecurityHeadersProcessor{Headers: securityheaders.DefaultHeaders(), NonceMarker: "__NONCE__"}
+	resp, got := run(t, p, "/", http.Header{"Content-Type": {"text/html"}}, `<script nonce="__NONCE__"></script><script nonce="{{csp-nonce}}"></script>`)
+	match := regexp.MustCompile(`'nonce-([^']+)'`).FindStringSubmatch(resp.Header.Get("content-security-policy"))
+	if match == nil {
+		t.Fatalf("content-security-policy = %q, want a nonce", resp.Header.Get("content-security-policy"))
+	}
+	if want := `<script nonce="` + match[1] + `"></script><script nonce="{{csp-nonce}}"></script>`; got != want {
+		t.Errorf("body = %q, want %q", got, want)
+	}
+}
+
+func TestNoInjection(t *testing.T) {
+	p := &securityheaders.SecurityHeadersProcessor{Headers: securityheaders.DefaultHeaders()}
+	const body = `<script nonce="{{csp-nonce}}"></script>`
+	for name, header := range map[string]http.Header{
+		"json":         {"Content-Type": {"application/json"}},
+		"compressed":   {"Content-Type": {"text/html"}, "Content-Encoding": {"gzip"}},
+		"upstream csp": {"Content-Type": {"text/html"}, "Content-Security-Policy": {"default-src 'none'"}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			resp, got := run(t, p, "/", header, body)
+			if got != body {
+				t.Errorf("body = %q, want it untouched", got)
+			}
+			if name == "upstream csp" && resp.Header.Get("content-security-policy") != "default-src 'none'" {
+				t.Errorf("content-security-policy = %q, want the upstream one", resp.Header.Get("content-security-policy"))
+			}
+		})
+	}
+}
+
+func TestRouteOverrides(t *testing.T) {
+	reportOnly := true
+	p := &securityheaders.SecurityHeadersProcessor{
+		Headers: securityheaders.DefaultHeaders(),
+		Routes: []securityheaders.Route{
+			{PathPrefix: "/embed", Headers: securityheaders.Headers{CrossOriginEmbedderPolicy: securityheaders.Disabled}},
+			{PathPrefix: "/embed/beta", Headers: securityheaders.Headers{ContentSecurityPolicy: "default-src *", ReportOnly: &reportOnly}},
+		},
+	}
+
+	resp, _ := run(t, p, "/embed/widget", http.Header{"Content-Type": {"application/json"}}, "")
+	if got := resp.Header.Get("cross-origin-embedder-policy"); got != "" {
+		t.Errorf("cross-origin-embedder-policy = %q, want it disabled", got)
+	}
+
+	resp, _ = run(t, p, "/embed/beta/widget", http.Header{"Content-Type": {"application/json"}}, "")
+	if got := resp.Header.Get("content-security-policy-report-only"); got != "default-src *" {
+		t.Errorf("content-security-policy-report-only = %q", got)
+	}
+	if got := resp.Header.Get("content-security-policy"); got != "" {
+		t.Errorf("content-security-policy = %q, want only the report-only header", got)
+	}
+	// The longest prefix wins, the /embed override does not apply.
+	if got := resp.Header.Get("cross-origin-embedder-policy"); got != "require-corp" {
+		t.Errorf("cross-origin-embedder-policy = %q", got)
+	}
+}
@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"cmp"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	extproc "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+)
+
+// RequestHeaders builds the request headers message Envoy sends for the given request.
+// Header keys are lowercased and the :method, :path, :scheme and :authority pseudo headers are added.
+func RequestHeaders(req *http.Request, endOfStream bool) *extproc.ProcessingRequest {
+	scheme := req.URL.Scheme
+	if scheme == "" {
+		scheme = "http"
+		if req.TLS != nil {
+			scheme = "https"
+		}
+	}
+	authority := req.Host
+	if authority == "" {
+		authority = req.URL.Host
+	}
+	pseudo := []*corev3.HeaderValue{
+		headerValue(":authority", authority),
+		headerValue(":path", req.URL.RequestURI()),
+		headerValue(":method", cmp.Or(req.Method, http.MethodGet)),
+		headerValue(":scheme", scheme),
+	}
+	return &extproc.ProcessingRequest{
+		Request: &extproc.ProcessingRequest_RequestHeaders{
+			RequestHeaders: &extproc.HttpHeaders{
+				Headers:     &corev3.HeaderMap{Headers: append(pseudo, headerValues(req.Header)...)},
+				EndOfStream: endOfStream,
+			},
+		},
+	}
+}
+
+// RequestBody builds a request body message.
+func RequestBody(body []byte, endOfStream bool) *extproc.ProcessingRequest {
+	return &extproc.ProcessingRequest{
+		Request: &extproc.ProcessingRequest_RequestBody{
+			RequestBody: &extproc.HttpBody{Body: body, EndOfStream: endOfStream},
+		},
+	}
+}
+
+// RequestTrailers builds a request trailers message.
+func RequestTrailers(trailers http.Header) *extproc.ProcessingRequest {
+	return &extproc.ProcessingRequest{
+		Request: &extproc.ProcessingRequest_RequestTrailers{
+			RequestTrailers: &extproc.HttpTrailers{Trailers: &corev3.HeaderMap{Headers: headerValues(trailers)}},
+		},
+	}
+}
+
+// ResponseHeaders builds the response headers message Envoy sends for the given response.
+// Header keys are lowercased and the :status pseudo header is added.
+func ResponseHeaders(resp *http.Response, endOfStream bool) *extproc.ProcessingRequest {
+	pseudo := []*corev3.HeaderValue{
+		headerValue(":status", strconv.Itoa(cmp.Or(resp.StatusCode, http.StatusOK))),
+	}
+	return &extproc.ProcessingRequest{
+		Request: &extproc.ProcessingRequest_ResponseHeaders{
+			ResponseHeaders: &extproc.HttpHeaders{
+				Headers:     &corev3.HeaderMap{Headers: append(pseudo, headerValues(resp.Header)...)},
+				EndOfStream: endOfStream,
+			},
+		},
+	}
+}
+
+// ResponseBody builds a response body message.
+func ResponseBody(body []byte, endOfStream bool) *extproc.ProcessingRequest {
+	return &extproc.ProcessingRequest{
+		Request: &extproc.ProcessingRequest_ResponseBody{
+			ResponseBody: &extproc.HttpBody{Body: body, EndOfStream: endOfStream},
+		},
+	}
+}
+
+// ResponseTrailers builds a response trailers message.
+func ResponseTrailers(trailers http.Header) *extproc.ProcessingRequest {
+	return &extproc.ProcessingRequest{
+		Request: &extproc.ProcessingRequest_ResponseTrailers{
+			ResponseTrailers: &extproc.HttpTrailers{Trailers: &corev3.HeaderMap{Headers: headerValues(trailers)}},
+		},
+	}
+}
+
+// headerValues converts the header in the representation used by Envoy, lowercase keys sorted and values in raw_value.
+func headerValues(header http.Header) []*corev3.HeaderValue {
+	keys := make([]string, 0, len(header))
+	for key := range header {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	values := make([]*corev3.HeaderValue, 0, len(header))
+	for _, key := range keys {
+		for _, value := range header[key] {
+			values = append(values, headerValue(strings.ToLower(key), value))
+		}
+	}
+	return values
+}
+
+func headerValue(key, value string) *corev3.HeaderValue {
+	return &corev3.HeaderValue{Key: key, RawValue: []byte(value)}
+}
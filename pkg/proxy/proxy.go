@@ -0,0 +1,169 @@
+// Package proxy implements an HTTP reverse proxy which runs the ext_proc processors itself, without Envoy.
+// It is meant for local development: every proxied request goes through the same ExternalProcessorServer Envoy
+// would call, with headers and trailers sent and bodies buffered, and the mutations are applied by the proxy.
+//
+// The Runner and Session driving an ExternalProcessorServer through an in-memory stream from plain net/http values
+// are also used to replay captures and, through processortest, to test processors.
+package proxy
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/cainelli/ext-proc/pkg/mutation"
+	extproc "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+)
+
+// hopHeaders are removed before forwarding, as they only apply to a single connection.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// Proxy forwards the requests to the upstream running the processors of srv on every request and response.
+type Proxy struct {
+	srv      extproc.ExternalProcessorServer
+	upstream *url.URL
+	runner   Runner
+	// Transport is used to send the requests upstream, http.DefaultTransport when nil.
+	Transport http.RoundTripper
+}
+
+var _ http.Handler = &Proxy{}
+
+// New returns a Proxy forwarding to upstream. The mutations of the processors are applied with the given rules.
+func New(srv extproc.ExternalProcessorServer, upstream *url.URL, rules mutation.Rules) *Proxy {
+	return &Proxy{
+		srv:      srv,
+		upstream: upstream,
+		runner:   Runner{Mutator: mutation.Mutator{Rules: rules}},
+	}
+}
+
+func (p *Proxy) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	ctx := request.Context()
+	// Envoy generates the request ID before calling the ext_proc filter.
+	if request.Header.Get("x-request-id") == "" {
+		request.Header.Set("x-request-id", requestID())
+	}
+
+	sess := NewSession(ctx, p.srv)
+	defer func() {
+		if err := sess.Close(); err != nil {
+			slog.Error("ext_proc stream failed", "error", err)
+		}
+	}()
+
+	result, err := p.runner.Request(ctx, sess, request)
+	if err != nil {
+		p.fail(writer, "request", err)
+		return
+	}
+	if result.ImmediateResponse != nil {
+		writeResponse(writer, result.Response)
+		return
+	}
+
+	resp, err := p.transport().RoundTrip(p.outgoing(result.Request))
+	if err != nil {
+		slog.Error("upstream request failed", "upstream", p.upstream.String(), "error", err)
+		http.Error(writer, "upstream connect error", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	removeHopHeaders(resp.Header)
+
+	if err := p.runner.Response(sess, result, resp); err != nil {
+		p.fail(writer, "response", err)
+		return
+	}
+	writeResponse(writer, result.Response)
+}
+
+// outgoing turns the processed request into the request sent upstream. The path comes from the processed request
+// and is joined to the upstream path, the host header is preserved like Envoy does.
+func (p *Proxy) outgoing(req *http.Request) *http.Request {
+	out := req.Clone(req.Context())
+	out.RequestURI = ""
+	out.URL.Scheme = p.upstream.Scheme
+	out.URL.Host = p.upstream.Host
+	out.URL.Path = strings.TrimSuffix(p.upstream.Path, "/") + "/" + strings.TrimPrefix(req.URL.Path, "/")
+	out.URL.RawPath = ""
+	removeHopHeaders(out.Header)
+	if ip := clientIP(req); ip != "" {
+		out.Header.Add("x-forwarded-for", ip)
+	}
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+	out.Header.Set("x-forwarded-proto", proto)
+	return out
+}
+
+// fail answers like Envoy when the ext_proc stream fails with failure_mode_allow disabled.
+func (p *Proxy) fail(writer http.ResponseWriter, phase string, err error) {
+	slog.Error("ext_proc processing failed", "phase", phase, "error", err)
+	http.Error(writer, "ext_proc error", http.StatusInternalServerError)
+}
+
+func (p *Proxy) transport() http.RoundTripper {
+	if p.Transport != nil {
+		return p.Transport
+	}
+	return http.DefaultTransport
+}
+
+func writeResponse(writer http.ResponseWriter, resp *http.Response) {
+	defer resp.Body.Close()
+	for key, values := range resp.Header {
+		writer.Header()[key] = values
+	}
+	for key := range resp.Trailer {
+		writer.Header().Add("Trailer", key)
+	}
+	writer.WriteHeader(resp.StatusCode)
+	if _, err := io.Copy(writer, resp.Body); err != nil {
+		slog.Error("failed writing response body", "error", err)
+		return
+	}
+	for key, values := range resp.Trailer {
+		writer.Header()[key] = values
+	}
+}
+
+func removeHopHeaders(header http.Header) {
+	for _, key := range hopHeaders {
+		header.Del(key)
+	}
+}
+
+func clientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return ""
+	}
+	return host
+}
+
+// requestID returns a random UUID v4 like the ones Envoy generates.
+func requestID() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
@@ -0,0 +1,148 @@
+package proxy_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/cainelli/ext-proc/pkg/mutation"
+	"github.com/cainelli/ext-proc/pkg/proxy"
+	"github.com/cainelli/ext-proc/pkg/service"
+	"github.com/cainelli/ext-proc/pkg/service/processor"
+	extproc "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+)
+
+// gateProcessor answers the requests to /blocked, tags the others and their responses.
+type gateProcessor struct {
+	processor.NoOpProcessor
+}
+
+func (p *gateProcessor) RequestHeaders(ctx context.Context, crw *processor.CommonResponseWriter, req *processor.RequestContext) (*extproc.ProcessingResponse_ImmediateResponse, error) {
+	if req.URL().Path == "/blocked" {
+		return &extproc.ProcessingResponse_ImmediateResponse{
+			ImmediateResponse: &extproc.ImmediateResponse{
+				Status: &typev3.HttpStatus{Code: typev3.StatusCode_Forbidden},
+				Body:   "blocked",
+			},
+		}, nil
+	}
+	crw.HeaderSet("x-gate", "passed")
+	crw.RemoveHeaders("x-debug")
+	return nil, nil
+}
+
+func (p *gateProcessor) ResponseHeaders(ctx context.Context, crw *processor.CommonResponseWriter, req *processor.RequestContext) (*extproc.ProcessingResponse_ImmediateResponse, error) {
+	crw.HeaderSet("x-upstream-status", req.GetResponseHeader(":status"))
+	crw.RemoveHeaders("server")
+	return nil, nil
+}
+
+// upstream echoes the request it receives in the response headers and counts the requests.
+func upstream(t *testing.T, calls *atomic.Int64) *url.URL {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		calls.Add(1)
+		body, _ := io.ReadAll(request.Body)
+		writer.Header().Set("server", "upstream")
+		writer.Header().Set("x-echo-path", request.URL.RequestURI())
+		writer.Header().Set("x-echo-host", request.Host)
+		for _, key := range []string{"x-gate", "x-debug", "x-request-id", "x-forwarded-for", "x-forwarded-proto"} {
+			writer.Header().Set("x-echo-"+key, request.Header.Get(key))
+		}
+		writer.WriteHeader(http.StatusAccepted)
+		_, _ = writer.Write(append([]byte("echo: "), body...))
+	}))
+	t.Cleanup(srv.Close)
+	u, err := url.Parse(srv.URL + "/base/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func newProxy(t *testing.T, calls *atomic.Int64) *proxy.Proxy {
+	t.Helper()
+	svc := &service.ExtProcessor{Processors: []processor.Processor{&gateProcessor{}}}
+	return proxy.New(svc, upstream(t, calls), mutation.Rules{})
+}
+
+func TestProxy(t *testing.T) {
+	var calls atomic.Int64
+	p := newProxy(t, &calls)
+
+	req := httptest.NewRequest(http.MethodPost, "http://www.example.com/orders?page=2", strings.NewReader("order"))
+	req.Header.Set("x-debug", "1")
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("status = %d, want 202", rec.Code)
+	}
+	if got := rec.Body.String(); got != "echo: order" {
+		t.Errorf("body = %q, want the upstream body", got)
+	}
+	want := map[string]string{
+		// Request phase.
+		"x-echo-path":              "/base/orders?page=2",
+		"x-echo-host":              "www.example.com",
+		"x-echo-x-gate":            "passed",
+		"x-echo-x-debug":           "",
+		"x-echo-x-forwarded-for":   "192.0.2.1",
+		"x-echo-x-forwarded-proto": "http",
+		// Response phase.
+		"x-upstream-status": "202",
+		"server":            "",
+	}
+	for key, value := range want {
+		if got := rec.Header().Get(key); got != value {
+			t.Errorf("%s = %q, want %q", key, got, value)
+		}
+	}
+	if rec.Header().Get("x-echo-x-request-id") == "" {
+		t.Errorf("no request ID was generated")
+	}
+	if calls.Load() != 1 {
+		t.Errorf("upstream called %d times, want 1", calls.Load())
+	}
+}
+
+func TestProxyTLS(t *testing.T) {
+	var calls atomic.Int64
+	p := newProxy(t, &calls)
+
+	req := httptest.NewRequest(http.MethodGet, "https://www.example.com/", nil)
+	req.Header.Set("x-request-id", "abc")
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, req)
+
+	if got := rec.Header().Get("x-echo-x-forwarded-proto"); got != "https" {
+		t.Errorf("x-forwarded-proto = %q, want https", got)
+	}
+	if got := rec.Header().Get("x-echo-x-request-id"); got != "abc" {
+		t.Errorf("x-request-id = %q, want the one of the client", got)
+	}
+}
+
+func TestProxyImmediateResponse(t *testing.T) {
+	var calls atomic.Int64
+	p := newProxy(t, &calls)
+
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://www.example.com/blocked", nil))
+
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("status = %d, want 403", rec.Code)
+	}
+	if got := rec.Body.String(); got != "blocked" {
+		t.Errorf("body = %q, want blocked", got)
+	}
+	if calls.Load() != 0 {
+		t.Errorf("upstream called %d times, want none", calls.Load())
+	}
+}
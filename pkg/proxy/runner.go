@@ -0,0 +1,212 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/cainelli/ext-proc/pkg/mutation"
+	extproc "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+)
+
+// Result is the outcome of running an HTTP exchange through the server.
+type Result struct {
+	// Request is a copy of the request with the mutations of the request phases applied.
+	Request *http.Request
+	// Response is a copy of the response with the mutations of the response phases applied.
+	// When the server sent an immediate response, it is the immediate response instead.
+	Response *http.Response
+	// ImmediateResponse is the immediate response sent by the server, if any.
+	ImmediateResponse *extproc.ImmediateResponse
+	// Responses are all the messages sent by the server in order.
+	Responses []*extproc.ProcessingResponse
+}
+
+// Runner runs HTTP exchanges through a server, applying the mutations with its Mutator.
+// The zero value applies the mutations with Envoy's default mutation rules.
+type Runner struct {
+	Mutator mutation.Mutator
+}
+
+// Run runs the exchange with the default Runner, see Runner.Run.
+func Run(ctx context.Context, srv extproc.ExternalProcessorServer, req *http.Request, resp *http.Response) (*Result, error) {
+	return (&Runner{}).Run(ctx, srv, req, resp)
+}
+
+// Run drives srv through the phases of an HTTP exchange like Envoy configured to SEND headers and trailers and to
+// send BUFFERED bodies. Body and trailer phases are only sent when the request or response have them.
+// resp may be nil to only run the request phases. The given values are not modified, the mutations are applied to
+// copies returned in the Result.
+// Mutations rejected by the mutation rules make Run fail, as Envoy would fail the request.
+func (runner *Runner) Run(ctx context.Context, srv extproc.ExternalProcessorServer, req *http.Request, resp *http.Response) (*Result, error) {
+	sess := NewSession(ctx, srv)
+	result, err := runner.run(ctx, sess, req, resp)
+	if closeErr := sess.Close(); closeErr != nil && err == nil {
+		err = fmt.Errorf("server returned an error: %w", closeErr)
+	}
+	return result, err
+}
+
+func (runner *Runner) run(ctx context.Context, sess *Session, req *http.Request, resp *http.Response) (*Result, error) {
+	result, err := runner.Request(ctx, sess, req)
+	if err != nil || result.ImmediateResponse != nil || resp == nil {
+		return result, err
+	}
+	return result, runner.Response(sess, result, resp)
+}
+
+// Request runs the request phases on the session. The request body is read and the mutations are applied to a copy
+// of req returned in the Result. When the server sends an immediate response, the Result holds it and the response
+// phases must not be run.
+func (runner *Runner) Request(ctx context.Context, sess *Session, req *http.Request) (*Result, error) {
+	result := &Result{}
+
+	reqBody, err := readBody(req.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading request body: %w", err)
+	}
+	result.Request = req.Clone(ctx)
+	result.Request.Body = bodyReader(reqBody)
+
+	if done, err := runner.exchange(result, sess, RequestHeaders(result.Request, reqBody == nil && len(req.Trailer) == 0)); done || err != nil {
+		return result, err
+	}
+	if reqBody != nil {
+		if done, err := runner.exchange(result, sess, RequestBody(reqBody, len(req.Trailer) == 0)); done || err != nil {
+			return result, err
+		}
+	}
+	if len(req.Trailer) > 0 {
+		if _, err := runner.exchange(result, sess, RequestTrailers(req.Trailer)); err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// Response runs the response phases on the session for the result of Request. The response body is read and the
+// mutations are applied to a copy of resp stored in the Result.
+func (runner *Runner) Response(sess *Session, result *Result, resp *http.Response) error {
+	respBody, err := readBody(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed reading response body: %w", err)
+	}
+	result.Response = cloneResponse(resp, result.Request)
+	result.Response.Body = bodyReader(respBody)
+
+	if done, err := runner.exchange(result, sess, ResponseHeaders(result.Response, respBody == nil && len(resp.Trailer) == 0)); done || err != nil {
+		return err
+	}
+	if respBody != nil {
+		if done, err := runner.exchange(result, sess, ResponseBody(respBody, len(resp.Trailer) == 0)); done || err != nil {
+			return err
+		}
+	}
+	if len(resp.Trailer) > 0 {
+		if _, err := runner.exchange(result, sess, ResponseTrailers(resp.Trailer)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exchange sends the message, waits for the server reply and applies it. It returns true when the processing ended
+// because of an immediate response.
+func (runner *Runner) exchange(result *Result, sess *Session, procreq *extproc.ProcessingRequest) (bool, error) {
+	procresp, err := sess.Exchange(procreq)
+	if errors.Is(err, io.EOF) {
+		return false, fmt.Errorf("server closed the stream without replying to %T", procreq.Request)
+	}
+	if err != nil {
+		return false, err
+	}
+	result.Responses = append(result.Responses, procresp)
+
+	m := &runner.Mutator
+	if immediate := procresp.GetImmediateResponse(); immediate != nil {
+		result.ImmediateResponse = immediate
+		result.Response, err = m.ImmediateResponse(immediate, result.Request)
+		return true, err
+	}
+	if !matchesPhase(procreq, procresp) {
+		return false, fmt.Errorf("server replied %T to %T", procresp.Response, procreq.Request)
+	}
+
+	switch r := procresp.Response.(type) {
+	case *extproc.ProcessingResponse_RequestHeaders:
+		err = m.RequestHeaders(result.Request, r.RequestHeaders.GetResponse())
+	case *extproc.ProcessingResponse_RequestBody:
+		err = m.RequestBody(result.Request, r.RequestBody.GetResponse())
+	case *extproc.ProcessingResponse_RequestTrailers:
+		err = m.Trailers(result.Request.Trailer, r.RequestTrailers.GetHeaderMutation())
+	case *extproc.ProcessingResponse_ResponseHeaders:
+		err = m.ResponseHeaders(result.Response, r.ResponseHeaders.GetResponse())
+	case *extproc.ProcessingResponse_ResponseBody:
+		err = m.ResponseBody(result.Response, r.ResponseBody.GetResponse())
+	case *extproc.ProcessingResponse_ResponseTrailers:
+		err = m.Trailers(result.Response.Trailer, r.ResponseTrailers.GetHeaderMutation())
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed applying %T: %w", procresp.Response, err)
+	}
+	return false, nil
+}
+
+// matchesPhase reports whether the response is the one expected for the request phase.
+func matchesPhase(procreq *extproc.ProcessingRequest, procresp *extproc.ProcessingResponse) bool {
+	switch procresp.Response.(type) {
+	case *extproc.ProcessingResponse_RequestHeaders:
+		return procreq.GetRequestHeaders() != nil
+	case *extproc.ProcessingResponse_RequestBody:
+		return procreq.GetRequestBody() != nil
+	case *extproc.ProcessingResponse_RequestTrailers:
+		return procreq.GetRequestTrailers() != nil
+	case *extproc.ProcessingResponse_ResponseHeaders:
+		return procreq.GetResponseHeaders() != nil
+	case *extproc.ProcessingResponse_ResponseBody:
+		return procreq.GetResponseBody() != nil
+	case *extproc.ProcessingResponse_ResponseTrailers:
+		return procreq.GetResponseTrailers() != nil
+	}
+	return false
+}
+
+func cloneResponse(resp *http.Response, req *http.Request) *http.Response {
+	clone := *resp
+	clone.Header = resp.Header.Clone()
+	if clone.Header == nil {
+		clone.Header = make(http.Header)
+	}
+	clone.Trailer = resp.Trailer.Clone()
+	if clone.Trailer == nil {
+		clone.Trailer = make(http.Header)
+	}
+	clone.Request = req
+	return &clone
+}
+
+// readBody reads the whole body, it returns nil when there is no body.
+func readBody(body io.ReadCloser) ([]byte, error) {
+	if body == nil || body == http.NoBody {
+		return nil, nil
+	}
+	defer body.Close()
+	raw, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	return raw, nil
+}
+
+func bodyReader(body []byte) io.ReadCloser {
+	if body == nil {
+		return http.NoBody
+	}
+	return io.NopCloser(bytes.NewReader(body))
+}
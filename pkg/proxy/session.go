@@ -0,0 +1,157 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+
+	extproc "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// ErrStreamClosed is returned when sending on a session whose server side has already returned.
+var ErrStreamClosed = errors.New("proxy: stream closed by the server")
+
+// stream is an in-memory implementation of extproc.ExternalProcessor_ProcessServer.
+type stream struct {
+	ctx       context.Context
+	requests  chan *extproc.ProcessingRequest
+	responses chan *extproc.ProcessingResponse
+	done      chan struct{}
+}
+
+var _ extproc.ExternalProcessor_ProcessServer = &stream{}
+
+func (s *stream) Send(resp *extproc.ProcessingResponse) error {
+	select {
+	case s.responses <- resp:
+		return nil
+	case <-s.ctx.Done():
+		return s.ctx.Err()
+	}
+}
+
+func (s *stream) Recv() (*extproc.ProcessingRequest, error) {
+	select {
+	case req, ok := <-s.requests:
+		if !ok {
+			return nil, io.EOF
+		}
+		return req, nil
+	case <-s.ctx.Done():
+		// gRPC reports cancellations with a status error.
+		return nil, status.FromContextError(s.ctx.Err()).Err()
+	}
+}
+
+func (s *stream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *stream) SendMsg(m any) error {
+	return s.Send(m.(*extproc.ProcessingResponse))
+}
+
+func (s *stream) RecvMsg(m any) error {
+	req, err := s.Recv()
+	if err != nil {
+		return err
+	}
+	proto.Merge(m.(*extproc.ProcessingRequest), req)
+	return nil
+}
+
+func (s *stream) SetHeader(metadata.MD) error  { return nil }
+func (s *stream) SendHeader(metadata.MD) error { return nil }
+func (s *stream) SetTrailer(metadata.MD)       {}
+
+var _ grpc.ServerStream = &stream{}
+
+// Session is the client side of an in-memory ext_proc stream, it plays the role of Envoy.
+// Messages sent with Send are received by the server and the server replies are read with Recv.
+type Session struct {
+	stream    *stream
+	cancel    context.CancelFunc
+	closeOnce sync.Once
+	err       error
+}
+
+// NewSession starts srv.Process on a new in-memory stream. The stream context is derived from ctx.
+// Close must be called to end the stream and release the resources.
+func NewSession(ctx context.Context, srv extproc.ExternalProcessorServer) *Session {
+	ctx, cancel := context.WithCancel(ctx)
+	sess := &Session{
+		stream: &stream{
+			ctx:       ctx,
+			requests:  make(chan *extproc.ProcessingRequest),
+			responses: make(chan *extproc.ProcessingResponse, 1),
+			done:      make(chan struct{}),
+		},
+		cancel: cancel,
+	}
+	go func() {
+		defer close(sess.stream.done)
+		sess.err = srv.Process(sess.stream)
+	}()
+	return sess
+}
+
+// Send delivers the request to the server. It returns ErrStreamClosed when the server has already returned.
+// Send must not be called after Close.
+func (sess *Session) Send(req *extproc.ProcessingRequest) error {
+	select {
+	case sess.stream.requests <- req:
+		return nil
+	case <-sess.stream.done:
+		return ErrStreamClosed
+	}
+}
+
+// Recv waits for the next response of the server. It returns io.EOF when the server returned without error
+// and the server error otherwise.
+func (sess *Session) Recv() (*extproc.ProcessingResponse, error) {
+	select {
+	case resp := <-sess.stream.responses:
+		return resp, nil
+	case <-sess.stream.done:
+		// The server may have sent a last response right before returning.
+		select {
+		case resp := <-sess.stream.responses:
+			return resp, nil
+		default:
+		}
+		if sess.err != nil {
+			return nil, sess.err
+		}
+		return nil, io.EOF
+	}
+}
+
+// Exchange sends the request and waits for the matching response.
+func (sess *Session) Exchange(req *extproc.ProcessingRequest) (*extproc.ProcessingResponse, error) {
+	if err := sess.Send(req); err != nil {
+		return nil, err
+	}
+	return sess.Recv()
+}
+
+// Done is closed once the server returned from Process.
+func (sess *Session) Done() <-chan struct{} {
+	return sess.stream.done
+}
+
+// Close half-closes the stream like Envoy does when the HTTP stream ends, waits for the server to return and
+// returns its error.
+func (sess *Session) Close() error {
+	sess.closeOnce.Do(func() {
+		close(sess.stream.requests)
+	})
+	<-sess.stream.done
+	sess.cancel()
+	return sess.err
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"log/slog"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// healthMethodPrefix is the prefix of the grpc.health.v1 methods, they are excluded from authentication and limits
+// so Envoy health checks keep working.
+const healthMethodPrefix = "/grpc.health.v1.Health/"
+
+// WithStreamInterceptors appends stream interceptors to the chain. They run in the given order around every stream,
+// including the ext_proc Process stream.
+func WithStreamInterceptors(interceptors ...grpc.StreamServerInterceptor) Option {
+	return func(extProcSrv *ExtProcServer) {
+		extProcSrv.streamInterceptors = append(extProcSrv.streamInterceptors, interceptors...)
+	}
+}
+
+// WithUnaryInterceptors appends unary interceptors to the chain. They run in the given order around every unary call,
+// such as the health checks.
+func WithUnaryInterceptors(interceptors ...grpc.UnaryServerInterceptor) Option {
+	return func(extProcSrv *ExtProcServer) {
+		extProcSrv.unaryInterceptors = append(extProcSrv.unaryInterceptors, interceptors...)
+	}
+}
+
+// RecoveryStreamInterceptor converts panics in stream handlers into an Internal error instead of crashing the server.
+func RecoveryStreamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				slog.Error("recovered from panic", "method", info.FullMethod, "panic", r, "stack", string(debug.Stack()))
+				err = status.Errorf(codes.Internal, "panic while handling stream: %v", r)
+			}
+		}()
+		return handler(srv, ss)
+	}
+}
+
+// RecoveryUnaryInterceptor converts panics in unary handlers into an Internal error instead of crashing the server.
+func RecoveryUnaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp any, err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				slog.Error("recovered from panic", "method", info.FullMethod, "panic", r, "stack", string(debug.Stack()))
+				err = status.Errorf(codes.Internal, "panic while handling call: %v", r)
+			}
+		}()
+		return handler(ctx, req)
+	}
+}
+
+// LoggingStreamInterceptor logs every stream once it ends with its duration and resulting status code.
+func LoggingStreamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		start := time.Now()
+		err := handler(srv, ss)
+		logCall(ss.Context(), info.FullMethod, start, err)
+		return err
+	}
+}
+
+// LoggingUnaryInterceptor logs every unary call with its duration and resulting status code.
+func LoggingUnaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		start := time.Now()
+		resp, err := handler(ctx, req)
+		logCall(ctx, info.FullMethod, start, err)
+		return resp, err
+	}
+}
+
+// TokenAuthStreamInterceptor rejects streams which do not carry the given bearer token in the authorization metadata.
+// Envoy can send it with the initial_metadata field of the ext_proc grpc_service. Health checks are not authenticated.
+func TokenAuthStreamInterceptor(token string) grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if strings.HasPrefix(info.FullMethod, healthMethodPrefix) {
+			return handler(srv, ss)
+		}
+		md, _ := metadata.FromIncomingContext(ss.Context())
+		for _, authorization := range md.Get("authorization") {
+			bearer, found := strings.CutPrefix(authorization, "Bearer ")
+			if found && subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) == 1 {
+				return handler(srv, ss)
+			}
+		}
+		return status.Error(codes.Unauthenticated, "missing or invalid bearer token")
+	}
+}
+
+// ConcurrencyLimitStreamInterceptor limits the number of streams served at the same time across all connections.
+// Streams over the limit are rejected with ResourceExhausted so Envoy applies its failure_mode_allow policy right away
+// instead of piling up work on an overloaded server.
+func ConcurrencyLimitStreamInterceptor(limit int) grpc.StreamServerInterceptor {
+	slots := make(chan struct{}, limit)
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if strings.HasPrefix(info.FullMethod, healthMethodPrefix) {
+			return handler(srv, ss)
+		}
+		select {
+		case slots <- struct{}{}:
+			defer func() { <-slots }()
+			return handler(srv, ss)
+		default:
+			return status.Errorf(codes.ResourceExhausted, "too many concurrent streams, limit is %d", limit)
+		}
+	}
+}
+
+func logCall(ctx context.Context, method string, start time.Time, err error) {
+	attrs := []any{
+		"method", method,
+		"code", status.Code(err).String(),
+		"duration", time.Since(start),
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		attrs = append(attrs, "peer", p.Addr.String())
+	}
+	if err != nil {
+		slog.Warn("gRPC call finished with error", append(attrs, "error", err)...)
+		return
+	}
+	slog.Info("gRPC call finished", attrs...)
+}
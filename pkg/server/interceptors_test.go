@@ -0,0 +1,118 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cainelli/ext-proc/pkg/health"
+	extproc "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// panickingProcessor panics on every stream.
+type panickingProcessor struct {
+	extproc.UnimplementedExternalProcessorServer
+}
+
+func (p *panickingProcessor) Process(srv extproc.ExternalProcessor_ProcessServer) error {
+	panic("boom")
+}
+
+// processCode opens a Process stream and returns the status code it ends with.
+func processCode(ctx context.Context, t *testing.T, client extproc.ExternalProcessorClient) codes.Code {
+	t.Helper()
+	stream, err := client.Process(ctx)
+	if err != nil {
+		t.Fatalf("Process() = %v", err)
+	}
+	_, err = stream.Recv()
+	return status.Code(err)
+}
+
+func TestRecoveryStreamInterceptor(t *testing.T) {
+	srv := NewExtProcServer(&panickingProcessor{}, WithStreamInterceptors(RecoveryStreamInterceptor()))
+	conn := start(t, srv)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if got := processCode(ctx, t, extproc.NewExternalProcessorClient(conn)); got != codes.Internal {
+		t.Errorf("code = %v, want Internal", got)
+	}
+}
+
+func TestTokenAuthStreamInterceptor(t *testing.T) {
+	processor := &blockingProcessor{started: make(chan struct{}, 1)}
+	srv := NewExtProcServer(processor,
+		WithHealthChecker(health.NewChecker(func() bool { return true })),
+		WithStreamInterceptors(TokenAuthStreamInterceptor("s3cr3t")),
+	)
+	conn := start(t, srv)
+	client := extproc.NewExternalProcessorClient(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tests := map[string][]string{
+		"missing token": nil,
+		"wrong token":   {"authorization", "Bearer guess"},
+		"wrong scheme":  {"authorization", "Basic s3cr3t"},
+	}
+	for name, md := range tests {
+		if got := processCode(metadata.AppendToOutgoingContext(ctx, md...), t, client); got != codes.Unauthenticated {
+			t.Errorf("%s: code = %v, want Unauthenticated", name, got)
+		}
+	}
+
+	if _, err := client.Process(metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer s3cr3t")); err != nil {
+		t.Fatalf("Process() = %v", err)
+	}
+	select {
+	case <-processor.started:
+	case <-ctx.Done():
+		t.Fatalf("stream with the token was not served")
+	}
+
+	watch, err := healthpb.NewHealthClient(conn).Watch(ctx, &healthpb.HealthCheckRequest{})
+	if err != nil {
+		t.Fatalf("Watch() = %v", err)
+	}
+	if _, err := watch.Recv(); err != nil {
+		t.Errorf("health watch without token = %v, want it served", err)
+	}
+}
+
+func TestConcurrencyLimitStreamInterceptor(t *testing.T) {
+	processor := &blockingProcessor{started: make(chan struct{}, 1)}
+	srv := NewExtProcServer(processor, WithStreamInterceptors(ConcurrencyLimitStreamInterceptor(1)))
+	conn := start(t, srv)
+	client := extproc.NewExternalProcessorClient(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	first, cancelFirst := context.WithCancel(ctx)
+	if _, err := client.Process(first); err != nil {
+		t.Fatalf("Process() = %v", err)
+	}
+	<-processor.started
+	if got := processCode(ctx, t, client); got != codes.ResourceExhausted {
+		t.Errorf("code = %v, want ResourceExhausted", got)
+	}
+
+	// The slot is released once the first stream ends.
+	cancelFirst()
+	deadline := time.Now().Add(5 * time.Second)
+	for srv.ActiveStreams() != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := client.Process(ctx); err != nil {
+		t.Fatalf("Process() = %v", err)
+	}
+	select {
+	case <-processor.started:
+	case <-ctx.Done():
+		t.Errorf("stream was not served after the first one ended")
+	}
+}
@@ -1,24 +1,122 @@
 package server
 
 import (
+	"context"
 	"fmt"
 	"log/slog"
 	"net"
+	"sync/atomic"
+	"time"
 
+	"github.com/cainelli/ext-proc/pkg/health"
 	extproc "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/keepalive"
 )
 
+// DefaultMaxRecvMsgSize is the maximum message size the server accepts by default. It is larger than gRPC's 4MB default
+// so BUFFERED bodies up to Envoy's default per connection buffer limit fit in a single message.
+const DefaultMaxRecvMsgSize = 16 << 20
+
 type ExtProcServer struct {
-	grpcServer *grpc.Server
-	extProc    extproc.ExternalProcessorServer
+	grpcServer    *grpc.Server
+	extProc       extproc.ExternalProcessorServer
+	health        *health.Checker
+	activeStreams atomic.Int64
+
+	maxRecvMsgSize       int
+	maxSendMsgSize       int
+	maxConcurrentStreams uint32
+	keepaliveParams      keepalive.ServerParameters
+	keepalivePolicy      keepalive.EnforcementPolicy
+	streamInterceptors   []grpc.StreamServerInterceptor
+	unaryInterceptors    []grpc.UnaryServerInterceptor
+}
+
+// Option configures an ExtProcServer.
+type Option func(*ExtProcServer)
+
+// WithHealthChecker registers the grpc.health.v1 service backed by the given checker.
+func WithHealthChecker(checker *health.Checker) Option {
+	return func(extProcSrv *ExtProcServer) {
+		extProcSrv.health = checker
+	}
+}
+
+// WithMaxRecvMsgSize sets the maximum message size in bytes the server can receive, it must be large enough to hold the
+// BUFFERED bodies sent by Envoy. gRPC closes the stream when a larger message is received, so the ExtProcessor MaxBodySize
+// should be set below it to reject large bodies with a 413 immediate response instead. Defaults to DefaultMaxRecvMsgSize.
+func WithMaxRecvMsgSize(size int) Option {
+	return func(extProcSrv *ExtProcServer) {
+		extProcSrv.maxRecvMsgSize = size
+	}
+}
+
+// WithMaxSendMsgSize sets the maximum message size in bytes the server can send. Defaults to gRPC's default.
+func WithMaxSendMsgSize(size int) Option {
+	return func(extProcSrv *ExtProcServer) {
+		extProcSrv.maxSendMsgSize = size
+	}
+}
+
+// WithMaxConcurrentStreams limits the number of concurrent streams on each HTTP/2 connection from Envoy.
+func WithMaxConcurrentStreams(streams uint32) Option {
+	return func(extProcSrv *ExtProcServer) {
+		extProcSrv.maxConcurrentStreams = streams
+	}
+}
+
+// WithKeepalive makes the server ping idle connections after interval and close them when the ping is not acknowledged within timeout.
+func WithKeepalive(interval, timeout time.Duration) Option {
+	return func(extProcSrv *ExtProcServer) {
+		extProcSrv.keepaliveParams.Time = interval
+		extProcSrv.keepaliveParams.Timeout = timeout
+	}
+}
+
+// WithKeepaliveEnforcement sets the minimum time a client should wait between keepalive pings and whether pings are
+// allowed when there are no active streams. Clients violating the policy have their connection closed.
+func WithKeepaliveEnforcement(minTime time.Duration, permitWithoutStream bool) Option {
+	return func(extProcSrv *ExtProcServer) {
+		extProcSrv.keepalivePolicy = keepalive.EnforcementPolicy{
+			MinTime:             minTime,
+			PermitWithoutStream: permitWithoutStream,
+		}
+	}
+}
+
+// WithMaxConnectionAge closes connections once they reach the given age, giving in-flight streams grace to complete.
+// It makes Envoy reconnect periodically which spreads the load when new replicas are added.
+func WithMaxConnectionAge(age, grace time.Duration) Option {
+	return func(extProcSrv *ExtProcServer) {
+		extProcSrv.keepaliveParams.MaxConnectionAge = age
+		extProcSrv.keepaliveParams.MaxConnectionAgeGrace = grace
+	}
+}
+
+// WithMaxConnectionIdle closes connections that had no active streams for the given duration.
+func WithMaxConnectionIdle(idle time.Duration) Option {
+	return func(extProcSrv *ExtProcServer) {
+		extProcSrv.keepaliveParams.MaxConnectionIdle = idle
+	}
 }
 
-func NewExtProcServer(extProcServerv3 extproc.ExternalProcessorServer) *ExtProcServer {
-	return &ExtProcServer{
-		extProc: extProcServerv3,
+func NewExtProcServer(extProcServerv3 extproc.ExternalProcessorServer, opts ...Option) *ExtProcServer {
+	extProcSrv := &ExtProcServer{
+		extProc:        extProcServerv3,
+		maxRecvMsgSize: DefaultMaxRecvMsgSize,
 	}
+	for _, opt := range opts {
+		opt(extProcSrv)
+	}
+
+	extProcSrv.grpcServer = grpc.NewServer(extProcSrv.serverOptions()...)
+	extproc.RegisterExternalProcessorServer(extProcSrv.grpcServer, extProcSrv.extProc)
+	if extProcSrv.health != nil {
+		extProcSrv.health.Register(extProcSrv.grpcServer)
+	}
+	return extProcSrv
 }
 
 func (extProcSrv *ExtProcServer) Run(grpcAddr string) error {
@@ -27,16 +125,74 @@ func (extProcSrv *ExtProcServer) Run(grpcAddr string) error {
 		return fmt.Errorf("failed to listen: %w", err)
 	}
 
-	extProcSrv.grpcServer = grpc.NewServer()
-	extproc.RegisterExternalProcessorServer(extProcSrv.grpcServer, extProcSrv.extProc)
-
 	slog.Info("starting gRPC server", "port", grpcAddr)
+	return extProcSrv.Serve(listener)
+}
+
+// Serve serves gRPC on the listener until the server is shut down.
+func (extProcSrv *ExtProcServer) Serve(listener net.Listener) error {
 	if err := extProcSrv.grpcServer.Serve(listener); err != nil {
 		return fmt.Errorf("failed to serve: %w", err)
 	}
 	return nil
 }
 
-func (extProcSrv *ExtProcServer) Stop() {
-	extProcSrv.grpcServer.GracefulStop()
+// Shutdown gracefully stops the gRPC server: it stops accepting new streams and waits for the in-flight ones to finish.
+// If ctx expires first, the remaining streams are forcefully closed and the context error is returned.
+func (extProcSrv *ExtProcServer) Shutdown(ctx context.Context) error {
+	if extProcSrv.health != nil {
+		extProcSrv.health.Shutdown()
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		extProcSrv.grpcServer.GracefulStop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		slog.Info("gRPC server stopped gracefully")
+		return nil
+	case <-ctx.Done():
+		cut := extProcSrv.ActiveStreams()
+		extProcSrv.grpcServer.Stop()
+		<-stopped
+		slog.Warn("gRPC server shutdown deadline exceeded, streams were forcefully closed", "streams-cut", cut)
+		return fmt.Errorf("failed to stop gracefully: %w", ctx.Err())
+	}
+}
+
+func (extProcSrv *ExtProcServer) serverOptions() []grpc.ServerOption {
+	opts := []grpc.ServerOption{
+		grpc.ChainStreamInterceptor(append([]grpc.StreamServerInterceptor{extProcSrv.trackStreams}, extProcSrv.streamInterceptors...)...),
+		grpc.ChainUnaryInterceptor(extProcSrv.unaryInterceptors...),
+		grpc.MaxRecvMsgSize(extProcSrv.maxRecvMsgSize),
+		grpc.KeepaliveParams(extProcSrv.keepaliveParams),
+		grpc.KeepaliveEnforcementPolicy(extProcSrv.keepalivePolicy),
+	}
+	if extProcSrv.maxSendMsgSize > 0 {
+		opts = append(opts, grpc.MaxSendMsgSize(extProcSrv.maxSendMsgSize))
+	}
+	if extProcSrv.maxConcurrentStreams > 0 {
+		opts = append(opts, grpc.MaxConcurrentStreams(extProcSrv.maxConcurrentStreams))
+	}
+	return opts
+}
+
+// processMethod is the full gRPC method name of the ext_proc stream.
+const processMethod = "/envoy.service.ext_proc.v3.ExternalProcessor/Process"
+
+// ActiveStreams returns the number of ext_proc streams currently being served, health watches are not counted.
+func (extProcSrv *ExtProcServer) ActiveStreams() int64 {
+	return extProcSrv.activeStreams.Load()
+}
+
+func (extProcSrv *ExtProcServer) trackStreams(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if info.FullMethod != processMethod {
+		return handler(srv, ss)
+	}
+	extProcSrv.activeStreams.Add(1)
+	defer extProcSrv.activeStreams.Add(-1)
+	return handler(srv, ss)
 }
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cainelli/ext-proc/pkg/health"
+	extproc "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// blockingProcessor holds every stream open until its context is done.
+type blockingProcessor struct {
+	extproc.UnimplementedExternalProcessorServer
+	started chan struct{}
+}
+
+func (p *blockingProcessor) Process(srv extproc.ExternalProcessor_ProcessServer) error {
+	p.started <- struct{}{}
+	<-srv.Context().Done()
+	return nil
+}
+
+// start serves the ExtProcServer on an in-memory listener and returns a client connection to it.
+func start(t *testing.T, srv *ExtProcServer) *grpc.ClientConn {
+	t.Helper()
+	listener := bufconn.Listen(1 << 20)
+	go func() { _ = srv.Serve(listener) }()
+	t.Cleanup(srv.grpcServer.Stop)
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("Dial() = %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestActiveStreams(t *testing.T) {
+	processor := &blockingProcessor{started: make(chan struct{}, 1)}
+	srv := NewExtProcServer(processor, WithHealthChecker(health.NewChecker(func() bool { return true })))
+	conn := start(t, srv)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	watch, err := healthpb.NewHealthClient(conn).Watch(ctx, &healthpb.HealthCheckRequest{})
+	if err != nil {
+		t.Fatalf("Watch() = %v", err)
+	}
+	if _, err := watch.Recv(); err != nil {
+		t.Fatalf("Watch().Recv() = %v", err)
+	}
+	if _, err := extproc.NewExternalProcessorClient(conn).Process(ctx); err != nil {
+		t.Fatalf("Process() = %v", err)
+	}
+	<-processor.started
+	if got := srv.ActiveStreams(); got != 1 {
+		t.Errorf("ActiveStreams() = %d, want 1, health watches are not counted", got)
+	}
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	var logs bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+
+	processor := &blockingProcessor{started: make(chan struct{}, 1)}
+	srv := NewExtProcServer(processor)
+	client := extproc.NewExternalProcessorClient(start(t, srv))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stream, err := client.Process(ctx)
+	if err != nil {
+		t.Fatalf("Process() = %v", err)
+	}
+	<-processor.started
+
+	// The blocked stream never finishes, so it is cut once the deadline is reached.
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer shutdownCancel()
+	begin := time.Now()
+	if err := srv.Shutdown(shutdownCtx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Shutdown() = %v, want the deadline error", err)
+	}
+	if elapsed := time.Since(begin); elapsed > 2*time.Second {
+		t.Errorf("Shutdown() took %s after its deadline", elapsed)
+	}
+	if !strings.Contains(logs.String(), "streams-cut=1") {
+		t.Errorf("logs = %q, want the cut stream counted", logs.String())
+	}
+	if _, err := stream.Recv(); err == nil {
+		t.Errorf("Recv() on the cut stream succeeded")
+	}
+
+	newCtx, newCancel := context.WithTimeout(context.Background(), time.Second)
+	defer newCancel()
+	stream, err = client.Process(newCtx)
+	if err == nil {
+		_, err = stream.Recv()
+	}
+	if code := status.Code(err); code != codes.Unavailable {
+		t.Errorf("new stream = %v, want Unavailable", err)
+	}
+	select {
+	case <-processor.started:
+		t.Errorf("a stream was served after the shutdown")
+	default:
+	}
+}
@@ -0,0 +1,269 @@
+package service_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cainelli/ext-proc/pkg/service"
+	"github.com/cainelli/ext-proc/pkg/service/processor"
+	"github.com/cainelli/ext-proc/pkg/service/processortest"
+	extproc "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+)
+
+// These tests check ExtProcessor against the rules of the ext_proc protocol, as Envoy expects them:
+// https://www.envoyproxy.io/docs/envoy/latest/api-v3/service/ext_proc/v3/external_processor.proto
+
+// step is a message sent to the server and the response type expected for it, empty when no response is expected.
+type step struct {
+	request *extproc.ProcessingRequest
+	expect  string
+}
+
+// scriptedProcessor is a processor whose behavior is defined by each test.
+type scriptedProcessor struct {
+	requestHeaders  func(crw *processor.CommonResponseWriter, req *processor.RequestContext) (*extproc.ProcessingResponse_ImmediateResponse, error)
+	responseHeaders func(crw *processor.CommonResponseWriter, req *processor.RequestContext) (*extproc.ProcessingResponse_ImmediateResponse, error)
+}
+
+func (p *scriptedProcessor) RequestHeaders(_ context.Context, crw *processor.CommonResponseWriter, req *processor.RequestContext) (*extproc.ProcessingResponse_ImmediateResponse, error) {
+	if p.requestHeaders == nil {
+		return nil, nil
+	}
+	return p.requestHeaders(crw, req)
+}
+
+func (p *scriptedProcessor) ResponseHeaders(_ context.Context, crw *processor.CommonResponseWriter, req *processor.RequestContext) (*extproc.ProcessingResponse_ImmediateResponse, error) {
+	if p.responseHeaders == nil {
+		return nil, nil
+	}
+	return p.responseHeaders(crw, req)
+}
+
+func immediate(code typev3.StatusCode) func(*processor.CommonResponseWriter, *processor.RequestContext) (*extproc.ProcessingResponse_ImmediateResponse, error) {
+	return func(*processor.CommonResponseWriter, *processor.RequestContext) (*extproc.ProcessingResponse_ImmediateResponse, error) {
+		return &extproc.ProcessingResponse_ImmediateResponse{
+			ImmediateResponse: &extproc.ImmediateResponse{Status: &typev3.HttpStatus{Code: code}},
+		}, nil
+	}
+}
+
+func async(procreq *extproc.ProcessingRequest) *extproc.ProcessingRequest {
+	procreq.AsyncMode = true
+	return procreq
+}
+
+var (
+	testRequest  = httptest.NewRequest(http.MethodPost, "http://example.com/path?query=1", nil)
+	testResponse = &http.Response{StatusCode: http.StatusOK, Header: http.Header{"Set-Cookie": {"a=b"}}}
+	testTrailers = http.Header{"Grpc-Status": {"0"}}
+)
+
+func TestConformance(t *testing.T) {
+	tests := []struct {
+		name string
+		// processor defaults to a processor not doing anything.
+		processor   *scriptedProcessor
+		maxBodySize int
+		steps       []step
+		// ended tells whether the server must have closed the stream after the last step.
+		ended bool
+		// wantErr tells whether the stream must end with an error.
+		wantErr bool
+	}{
+		{
+			name: "every phase gets a response of the same phase",
+			steps: []step{
+				{request: processortest.RequestHeaders(testRequest, false), expect: "RequestHeaders"},
+				{request: processortest.RequestBody([]byte("request"), false), expect: "RequestBody"},
+				{request: processortest.RequestTrailers(testTrailers), expect: "RequestTrailers"},
+				{request: processortest.ResponseHeaders(testResponse, false), expect: "ResponseHeaders"},
+				{request: processortest.ResponseBody([]byte("response"), false), expect: "ResponseBody"},
+				{request: processortest.ResponseTrailers(testTrailers), expect: "ResponseTrailers"},
+			},
+		},
+		{
+			name: "streamed body chunks are answered one by one",
+			steps: []step{
+				{request: processortest.RequestHeaders(testRequest, false), expect: "RequestHeaders"},
+				{request: processortest.RequestBody([]byte("chunk 1"), false), expect: "RequestBody"},
+				{request: processortest.RequestBody([]byte("chunk 2"), true), expect: "RequestBody"},
+			},
+		},
+		{
+			name:        "streamed body chunks are limited as a whole",
+			maxBodySize: 10,
+			steps: []step{
+				{request: processortest.RequestHeaders(testRequest, false), expect: "RequestHeaders"},
+				{request: processortest.RequestBody([]byte("chunk 1"), false), expect: "RequestBody"},
+				{request: processortest.RequestBody([]byte("chunk 2"), true), expect: "ImmediateResponse"},
+			},
+			ended: true,
+		},
+		{
+			name: "response headers are answered without the request phases",
+			steps: []step{
+				{request: processortest.ResponseHeaders(testResponse, true), expect: "ResponseHeaders"},
+			},
+		},
+		{
+			name:      "immediate response on request headers ends the stream",
+			processor: &scriptedProcessor{requestHeaders: immediate(typev3.StatusCode_Forbidden)},
+			steps: []step{
+				{request: processortest.RequestHeaders(testRequest, true), expect: "ImmediateResponse"},
+			},
+			ended: true,
+		},
+		{
+			name:      "immediate response on response headers ends the stream",
+			processor: &scriptedProcessor{responseHeaders: immediate(typev3.StatusCode_BadGateway)},
+			steps: []step{
+				{request: processortest.RequestHeaders(testRequest, true), expect: "RequestHeaders"},
+				{request: processortest.ResponseHeaders(testResponse, true), expect: "ImmediateResponse"},
+			},
+			ended: true,
+		},
+		{
+			name: "async mode messages are not answered",
+			steps: []step{
+				{request: async(processortest.RequestHeaders(testRequest, false))},
+				{request: async(processortest.RequestBody([]byte("request"), true))},
+				{request: async(processortest.ResponseHeaders(testResponse, true))},
+			},
+		},
+		{
+			name:      "async mode messages are not answered with immediate responses",
+			processor: &scriptedProcessor{requestHeaders: immediate(typev3.StatusCode_Forbidden)},
+			steps: []step{
+				{request: async(processortest.RequestHeaders(testRequest, true))},
+			},
+			ended: true,
+		},
+		{
+			name: "unknown message types do not end the stream",
+			steps: []step{
+				{request: &extproc.ProcessingRequest{}},
+				{request: processortest.RequestHeaders(testRequest, true), expect: "RequestHeaders"},
+			},
+		},
+		{
+			name: "processor errors end the stream with an error",
+			processor: &scriptedProcessor{requestHeaders: func(*processor.CommonResponseWriter, *processor.RequestContext) (*extproc.ProcessingResponse_ImmediateResponse, error) {
+				return nil, errors.New("boom")
+			}},
+			steps: []step{
+				{request: processortest.RequestHeaders(testRequest, true)},
+			},
+			ended:   true,
+			wantErr: true,
+		},
+		{
+			name: "header mutations are valid responses",
+			processor: &scriptedProcessor{
+				requestHeaders: func(crw *processor.CommonResponseWriter, _ *processor.RequestContext) (*extproc.ProcessingResponse_ImmediateResponse, error) {
+					crw.HeaderSet("x-request", "1").RemoveHeaders("x-remove")
+					return nil, nil
+				},
+				responseHeaders: func(crw *processor.CommonResponseWriter, _ *processor.RequestContext) (*extproc.ProcessingResponse_ImmediateResponse, error) {
+					crw.HeaderAppend("x-response", "1")
+					return nil, nil
+				},
+			},
+			steps: []step{
+				{request: processortest.RequestHeaders(testRequest, true), expect: "RequestHeaders"},
+				{request: processortest.ResponseHeaders(testResponse, true), expect: "ResponseHeaders"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := tt.processor
+			if p == nil {
+				p = &scriptedProcessor{}
+			}
+			svc := &service.ExtProcessor{Processors: []processor.Processor{p}, MaxBodySize: tt.maxBodySize}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			sess := processortest.NewSession(ctx, svc)
+
+			for i, s := range tt.steps {
+				if err := sess.Send(s.request); err != nil {
+					t.Fatalf("step %d: failed sending %s: %v", i, messageName(s.request), err)
+				}
+				if s.expect == "" {
+					continue
+				}
+				procresp, err := sess.Recv()
+				if err != nil {
+					t.Fatalf("step %d: expected %s response to %s, got error: %v", i, s.expect, messageName(s.request), err)
+				}
+				checkResponse(t, i, s, procresp)
+			}
+
+			if tt.ended {
+				select {
+				case <-sess.Done():
+				case <-ctx.Done():
+					t.Fatal("the server did not end the stream")
+				}
+			}
+			err := sess.Close()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("stream error = %v, want error %v", err, tt.wantErr)
+			}
+			// Every response must have been consumed by the steps, anything left was not requested.
+			if procresp, err := sess.Recv(); err == nil {
+				t.Fatalf("unexpected response %s", responseName(procresp))
+			}
+		})
+	}
+}
+
+func checkResponse(t *testing.T, i int, s step, procresp *extproc.ProcessingResponse) {
+	t.Helper()
+	if got := responseName(procresp); got != s.expect {
+		t.Fatalf("step %d: got %s response to %s, want %s", i, got, messageName(s.request), s.expect)
+	}
+	if err := procresp.ValidateAll(); err != nil {
+		t.Fatalf("step %d: invalid response: %v", i, err)
+	}
+	isHeaders := procresp.GetRequestHeaders() != nil || procresp.GetResponseHeaders() != nil
+	if procresp.GetModeOverride() != nil && !isHeaders {
+		t.Fatalf("step %d: mode override is only allowed on headers responses, got it on %s", i, responseName(procresp))
+	}
+}
+
+func messageName(procreq *extproc.ProcessingRequest) string {
+	return oneofName(procreq.GetRequest(), "*ext_procv3.ProcessingRequest_")
+}
+
+func responseName(procresp *extproc.ProcessingResponse) string {
+	return oneofName(procresp.GetResponse(), "*ext_procv3.ProcessingResponse_")
+}
+
+func oneofName(v any, prefix string) string {
+	if v == nil {
+		return "none"
+	}
+	return strings.TrimPrefix(fmt.Sprintf("%T", v), prefix)
+}
+
+// The session must behave like a real stream for the suite to be meaningful: once closed, Recv returns io.EOF.
+func TestSessionEOF(t *testing.T) {
+	sess := processortest.NewSession(context.Background(), &service.ExtProcessor{})
+	if err := sess.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+	if _, err := sess.Recv(); !errors.Is(err, io.EOF) {
+		t.Fatalf("Recv() = %v, want io.EOF", err)
+	}
+}
@@ -0,0 +1,184 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+
+	"github.com/cainelli/ext-proc/pkg/service/processor"
+	extproc "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+)
+
+// DefaultObserverQueueSize is the number of messages buffered per observer worker when ObserverQueueSize is zero.
+const DefaultObserverQueueSize = 1024
+
+// observation is a message sent in async mode waiting to be run through the processors.
+// A nil procreq marks the end of the stream.
+type observation struct {
+	ctx     context.Context
+	stream  *observedStream
+	procreq *extproc.ProcessingRequest
+}
+
+// observedStream is the state of a stream processed by an observer worker. All the observations of a stream go to the
+// same worker, so it is only accessed by that worker and the messages are processed in order.
+type observedStream struct {
+	req   *processor.RequestContext
+	ended bool
+}
+
+// observer runs the processors of async mode messages on a fixed set of workers, each one with a bounded queue.
+type observer struct {
+	queues []chan observation
+	next   atomic.Uint64
+	wg     sync.WaitGroup
+
+	// mu guards closed, enqueuing holds it for reading so the queues are not closed while a message is sent to them.
+	mu     sync.RWMutex
+	closed bool
+
+	queued    atomic.Uint64
+	dropped   atomic.Uint64
+	processed atomic.Uint64
+}
+
+// ObserverCounters counts the async mode messages handled by the observer workers since the server started.
+type ObserverCounters struct {
+	Queued    uint64 `json:"queued"`
+	Dropped   uint64 `json:"dropped"`
+	Processed uint64 `json:"processed"`
+}
+
+// ObserverCounters returns the counters of the observer workers, they are all zero when ObserverWorkers is zero.
+func (svc *ExtProcessor) ObserverCounters() ObserverCounters {
+	obs := svc.observer()
+	if obs == nil {
+		return ObserverCounters{}
+	}
+	return ObserverCounters{
+		Queued:    obs.queued.Load(),
+		Dropped:   obs.dropped.Load(),
+		Processed: obs.processed.Load(),
+	}
+}
+
+// Shutdown stops the observer workers once they processed the queued messages, or when the context is done.
+// Messages sent in async mode after Shutdown are dropped.
+func (svc *ExtProcessor) Shutdown(ctx context.Context) error {
+	obs := svc.observer()
+	if obs == nil {
+		return nil
+	}
+	obs.mu.Lock()
+	if !obs.closed {
+		obs.closed = true
+		for _, queue := range obs.queues {
+			close(queue)
+		}
+	}
+	obs.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		obs.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("observer workers did not finish the queued messages: %w", ctx.Err())
+	}
+}
+
+// observer starts the workers on first use, it returns nil when async mode messages are processed inline.
+func (svc *ExtProcessor) observer() *observer {
+	if svc.ObserverWorkers <= 0 {
+		return nil
+	}
+	svc.observerOnce.Do(func() {
+		size := svc.ObserverQueueSize
+		if size <= 0 {
+			size = DefaultObserverQueueSize
+		}
+		obs := &observer{queues: make([]chan observation, svc.ObserverWorkers)}
+		for i := range obs.queues {
+			obs.queues[i] = make(chan observation, size)
+			obs.wg.Add(1)
+			go func(queue chan observation) {
+				defer obs.wg.Done()
+				for o := range queue {
+					svc.observe(obs, o)
+				}
+			}(obs.queues[i])
+		}
+		svc.obs = obs
+	})
+	return svc.obs
+}
+
+// observeStream returns a function queuing the async mode messages of a stream for the observer workers. It never
+// blocks: when the queue is full the message and the rest of the stream are dropped, since the processors would
+// otherwise see an incomplete exchange. The function must be called with a nil message once the stream ends.
+func (obs *observer) observeStream(ctx context.Context) func(procreq *extproc.ProcessingRequest) {
+	queue := obs.queues[obs.next.Add(1)%uint64(len(obs.queues))]
+	stream := &observedStream{req: processor.NewRequestContext()}
+	// The processors run after the stream may have ended, they must not be cancelled with it.
+	ctx = context.WithoutCancel(ctx)
+	dropping := false
+	return func(procreq *extproc.ProcessingRequest) {
+		if dropping {
+			if procreq != nil {
+				obs.dropped.Add(1)
+			}
+			return
+		}
+		obs.mu.RLock()
+		defer obs.mu.RUnlock()
+		sent := false
+		if !obs.closed {
+			select {
+			case queue <- observation{ctx: ctx, stream: stream, procreq: procreq}:
+				sent = true
+			default:
+			}
+		}
+		if procreq == nil {
+			// The end of the stream only releases the RequestContext, when it is not queued it is left to the GC.
+			return
+		}
+		if !sent {
+			dropping = true
+			obs.dropped.Add(1)
+			slog.Warn("observer queue is full, dropping the stream")
+			return
+		}
+		obs.queued.Add(1)
+	}
+}
+
+// observe runs the processors on a queued message. The responses are discarded and an immediate response or an error
+// ends the processing of the stream, like they end the stream when processed inline.
+func (svc *ExtProcessor) observe(obs *observer, o observation) {
+	stream := o.stream
+	if o.procreq == nil {
+		stream.req.Release()
+		return
+	}
+	obs.processed.Add(1)
+	if stream.ended {
+		return
+	}
+	stream.req.Process(o.procreq.Request)
+	err := svc.handleMessage(o.ctx, stream.req, o.procreq, discardResponses{})
+	switch {
+	case errors.Is(err, errProcessingEnded):
+		stream.ended = true
+	case err != nil:
+		stream.ended = true
+		slog.Error("observer failed processing message", "error", err)
+	}
+}
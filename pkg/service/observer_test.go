@@ -0,0 +1,105 @@
+package service_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cainelli/ext-proc/pkg/service"
+	"github.com/cainelli/ext-proc/pkg/service/processor"
+	"github.com/cainelli/ext-proc/pkg/service/processortest"
+	extproc "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+)
+
+// observeStream sends the messages of an exchange in async mode and closes the stream.
+func observeStream(t *testing.T, svc *service.ExtProcessor) {
+	t.Helper()
+	sess := processortest.NewSession(context.Background(), svc)
+	for _, procreq := range []*extproc.ProcessingRequest{
+		async(processortest.RequestHeaders(testRequest, true)),
+		async(processortest.ResponseHeaders(testResponse, true)),
+	} {
+		if err := sess.Send(procreq); err != nil {
+			t.Fatalf("failed sending %s: %v", messageName(procreq), err)
+		}
+	}
+	if err := sess.Close(); err != nil {
+		t.Fatalf("stream error = %v", err)
+	}
+	if procresp, err := sess.Recv(); err == nil {
+		t.Fatalf("unexpected response %s", responseName(procresp))
+	}
+}
+
+func TestObserver(t *testing.T) {
+	var mu sync.Mutex
+	var phases []string
+	record := func(phase string) func(*processor.CommonResponseWriter, *processor.RequestContext) (*extproc.ProcessingResponse_ImmediateResponse, error) {
+		return func(crw *processor.CommonResponseWriter, req *processor.RequestContext) (*extproc.ProcessingResponse_ImmediateResponse, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			phases = append(phases, phase+" "+req.URL().Path)
+			crw.HeaderSet("x-observed", "1")
+			return nil, nil
+		}
+	}
+	svc := &service.ExtProcessor{
+		Processors: []processor.Processor{&scriptedProcessor{
+			requestHeaders:  record("RequestHeaders"),
+			responseHeaders: record("ResponseHeaders"),
+		}},
+		ObserverWorkers: 2,
+	}
+
+	observeStream(t, svc)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := svc.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown() = %v", err)
+	}
+
+	want := []string{"RequestHeaders /path", "ResponseHeaders /path"}
+	if len(phases) != len(want) || phases[0] != want[0] || phases[1] != want[1] {
+		t.Fatalf("processors observed %q, want %q", phases, want)
+	}
+	if got := svc.ObserverCounters(); got != (service.ObserverCounters{Queued: 2, Processed: 2}) {
+		t.Fatalf("ObserverCounters() = %+v", got)
+	}
+}
+
+func TestObserverDropsWhenFull(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	svc := &service.ExtProcessor{
+		Processors: []processor.Processor{&scriptedProcessor{
+			requestHeaders: func(*processor.CommonResponseWriter, *processor.RequestContext) (*extproc.ProcessingResponse_ImmediateResponse, error) {
+				select {
+				case started <- struct{}{}:
+				default:
+				}
+				<-release
+				return nil, nil
+			},
+		}},
+		ObserverWorkers:   1,
+		ObserverQueueSize: 1,
+	}
+
+	// The worker blocks on the first message, the second one fills the queue and the rest of the streams are dropped.
+	observeStream(t, svc)
+	<-started
+	observeStream(t, svc)
+	observeStream(t, svc)
+	close(release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := svc.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown() = %v", err)
+	}
+	got := svc.ObserverCounters()
+	if got.Dropped == 0 || got.Queued+got.Dropped != 6 || got.Processed != got.Queued {
+		t.Fatalf("ObserverCounters() = %+v, want drops and every message either queued or dropped", got)
+	}
+}
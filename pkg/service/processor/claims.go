@@ -0,0 +1,44 @@
+package processor
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// Claims are the claims of a token. The processors authenticating requests store them in the RequestContext metadata
+// with this type, so the next processors read them with Claim without depending on those processors.
+type Claims = map[string]any
+
+// Claim returns a claim of the Claims stored in the metadata under key, formatted with ClaimValue. It returns false
+// when the claims or the claim are missing.
+func (r *RequestContext) Claim(key, name string) (string, bool) {
+	claims, _ := r.Metadata()[key].(Claims)
+	return ClaimValue(claims[name])
+}
+
+// ClaimValue formats a token claim as a header value: strings as is, arrays of strings joined by commas and other
+// values as JSON. It returns false for missing claims.
+func ClaimValue(v any) (string, bool) {
+	switch claim := v.(type) {
+	case nil:
+		return "", false
+	case string:
+		return claim, true
+	case []any:
+		values := make([]string, 0, len(claim))
+		for _, item := range claim {
+			s, ok := item.(string)
+			if !ok {
+				return jsonValue(claim)
+			}
+			values = append(values, s)
+		}
+		return strings.Join(values, ","), true
+	}
+	return jsonValue(v)
+}
+
+func jsonValue(v any) (string, bool) {
+	raw, err := json.Marshal(v)
+	return string(raw), err == nil
+}
@@ -0,0 +1,47 @@
+package processor
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestClaimValue(t *testing.T) {
+	tests := []struct {
+		name   string
+		claim  any
+		want   string
+		wantOK bool
+	}{
+		{"missing", nil, "", false},
+		{"string", "alice", "alice", true},
+		{"strings", []any{"admin", "dev"}, "admin,dev", true},
+		{"mixed array", []any{"admin", 1.0}, `["admin",1]`, true},
+		{"number", json.Number("42"), "42", true},
+		{"bool", true, "true", true},
+		{"object", map[string]any{"org": "acme"}, `{"org":"acme"}`, true},
+	}
+	for _, test := range tests {
+		got, ok := ClaimValue(test.claim)
+		if got != test.want || ok != test.wantOK {
+			t.Errorf("%s: ClaimValue() = %q, %v, want %q, %v", test.name, got, ok, test.want, test.wantOK)
+		}
+	}
+}
+
+func TestRequestContextClaim(t *testing.T) {
+	r := &RequestContext{}
+	r.Metadata()["auth.claims"] = Claims{"sub": "alice", "roles": []any{"admin"}}
+	r.Metadata()["other"] = map[string]string{"sub": "bob"}
+
+	if got, ok := r.Claim("auth.claims", "sub"); !ok || got != "alice" {
+		t.Errorf("Claim(sub) = %q, %v, want alice", got, ok)
+	}
+	if got, ok := r.Claim("auth.claims", "roles"); !ok || got != "admin" {
+		t.Errorf("Claim(roles) = %q, %v, want admin", got, ok)
+	}
+	for _, key := range []string{"auth.claims", "other", "missing"} {
+		if got, ok := r.Claim(key, "email"); ok {
+			t.Errorf("Claim(%s, email) = %q, want none", key, got)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package processor
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+)
+
+// maxPooledFields is the number of header fields above which the storage is not kept for reuse, so a single request
+// with huge headers does not pin memory in the pool.
+const maxPooledFields = 256
+
+// Headers stores HTTP headers as Envoy sends them: lowercase keys, in order of arrival, with repeated headers kept as
+// separate fields. Lookups are case insensitive and do not allocate.
+// The zero value is empty and ready to use.
+type Headers struct {
+	fields []headerField
+}
+
+type headerField struct {
+	key   string
+	value string
+}
+
+// Get returns the first value associated with the key, or "" when there is none.
+func (h Headers) Get(key string) string {
+	for _, f := range h.fields {
+		if equalLower(f.key, key) {
+			return f.value
+		}
+	}
+	return ""
+}
+
+// Has reports whether the key is present.
+func (h Headers) Has(key string) bool {
+	for _, f := range h.fields {
+		if equalLower(f.key, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// Values returns all the values associated with the key in order, or nil when there is none.
+// Unlike Get, it allocates the returned slice.
+func (h Headers) Values(key string) []string {
+	var values []string
+	for _, f := range h.fields {
+		if equalLower(f.key, key) {
+			values = append(values, f.value)
+		}
+	}
+	return values
+}
+
+// Len returns the number of header fields.
+func (h Headers) Len() int {
+	return len(h.fields)
+}
+
+// Each calls fn for every header field in order until fn returns false.
+func (h Headers) Each(fn func(key, value string) bool) {
+	for _, f := range h.fields {
+		if !fn(f.key, f.value) {
+			return
+		}
+	}
+}
+
+// Header returns a copy of the headers as an http.Header with canonical keys, for code requiring one.
+func (h Headers) Header() http.Header {
+	header := make(http.Header, len(h.fields))
+	for _, f := range h.fields {
+		header.Add(f.key, f.value)
+	}
+	return header
+}
+
+// add appends the headers of a message. The raw values are copied into a single string shared by the fields, so a
+// message costs one allocation whatever its number of headers.
+func (h *Headers) add(headers []*corev3.HeaderValue) {
+	size := 0
+	for _, hv := range headers {
+		size += len(hv.GetRawValue())
+	}
+	var buf strings.Builder
+	buf.Grow(size)
+	for _, hv := range headers {
+		buf.Write(hv.GetRawValue())
+	}
+	values := buf.String()
+
+	h.fields = slices.Grow(h.fields, len(headers))
+	offset := 0
+	for _, hv := range headers {
+		// Envoy sends either raw_value or value depending on its send_header_raw_value runtime guard.
+		value := hv.GetValue()
+		if raw := hv.GetRawValue(); len(raw) > 0 {
+			value = values[offset : offset+len(raw)]
+			offset += len(raw)
+		}
+		// Envoy already lowercases the keys, ToLower only allocates for other clients.
+		h.fields = append(h.fields, headerField{key: strings.ToLower(hv.GetKey()), value: value})
+	}
+}
+
+// reset empties the headers, keeping the storage for reuse unless it grew too large.
+func (h *Headers) reset() {
+	if cap(h.fields) > maxPooledFields {
+		h.fields = nil
+		return
+	}
+	clear(h.fields)
+	h.fields = h.fields[:0]
+}
+
+// equalLower reports whether key matches the lowercase stored key, ignoring the ASCII case of key.
+func equalLower(stored, key string) bool {
+	if len(stored) != len(key) {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		if 'A' <= c && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		if stored[i] != c {
+			return false
+		}
+	}
+	return true
+}
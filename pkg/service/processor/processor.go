@@ -2,6 +2,7 @@ package processor
 
 import (
 	"context"
+	"reflect"
 
 	extproc "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
 )
@@ -11,6 +12,53 @@ type Processor interface {
 	ResponseHeaders(ctx context.Context, crw *CommonResponseWriter, req *RequestContext) (*extproc.ProcessingResponse_ImmediateResponse, error)
 }
 
+// RequestBodyProcessor is implemented by processors that inspect or replace the request body.
+// Envoy only sends the body when the request_body_mode of the filter is not NONE, BUFFERED sends it in one message.
+// The body is the one sent by Envoy with the mutations of the previous processors applied.
+type RequestBodyProcessor interface {
+	RequestBody(ctx context.Context, crw *CommonResponseWriter, req *RequestContext, body *extproc.HttpBody) (*extproc.ProcessingResponse_ImmediateResponse, error)
+}
+
+// ResponseBodyProcessor is implemented by processors that inspect or replace the response body, see RequestBodyProcessor.
+type ResponseBodyProcessor interface {
+	ResponseBody(ctx context.Context, crw *CommonResponseWriter, req *RequestContext, body *extproc.HttpBody) (*extproc.ProcessingResponse_ImmediateResponse, error)
+}
+
+// Initializer is implemented by processors that need to prepare state before serving traffic (load keys, warm caches, etc).
+// Init is called once before the processor chain is reported as ready.
+type Initializer interface {
+	Init(ctx context.Context) error
+}
+
+// Namer is implemented by processors that want to be identified by a custom name, e.g. in logs and in the admin API.
+type Namer interface {
+	Name() string
+}
+
+// Describer is implemented by processors that expose their configuration (matchers, options, etc) for inspection.
+// The returned value must be JSON serializable.
+type Describer interface {
+	Describe() any
+}
+
+// Actioner is implemented by processors with operations triggered at runtime through the admin API, e.g. turning
+// maintenance mode on. Action returns the state of the processor after the action, which must be JSON serializable.
+type Actioner interface {
+	Action(ctx context.Context, name string) (any, error)
+}
+
+// Name returns the name of the processor, which is the one returned by Namer or its type name otherwise.
+func Name(p Processor) string {
+	if namer, ok := p.(Namer); ok {
+		return namer.Name()
+	}
+	t := reflect.TypeOf(p)
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	return t.Name()
+}
+
 type NoOpProcessor struct{}
 
 var _ Processor = &NoOpProcessor{}
@@ -1,183 +1,286 @@
 package processor
 
 import (
-	"cmp"
+	"maps"
+	"net"
 	"net/http"
+	"net/netip"
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
 
 	extproc "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+	"google.golang.org/protobuf/types/known/structpb"
 )
 
+var requestContextPool = sync.Pool{
+	New: func() any { return new(RequestContext) },
+}
+
 // RequestContext stores the context between the different gRPC messages received from Envoy and it is used to store the request headers, response headers, and other information about the request.
 // The Process method should be called on every message received from Envoy in order to update the request object.
+// The URL and cookies are only parsed when they are first accessed.
 // Note that the request object is not thread-safe and should not be shared between goroutines.
 type RequestContext struct {
-	scheme          string
-	authority       string
-	method          string
-	url             *url.URL
-	requestID       string
-	status          int
-	requestHeaders  http.Header
-	responseHeaders http.Header
-	cookies         []http.Cookie
-	setCookies      []http.Cookie
-	metadata        map[string]any
-}
-
-// RequestHeaders returns the key-value pairs in an HTTP header.
-// The keys should be in canonical form, as returned by http.CanonicalHeaderKey.
-func (r *RequestContext) RequestHeaders() map[string][]string {
+	requestHeaders   Headers
+	responseHeaders  Headers
+	url              *url.URL
+	cookies          []http.Cookie
+	cookiesParsed    bool
+	setCookies       []http.Cookie
+	setCookiesParsed bool
+	metadata         map[string]any
+	attributes       map[string]*structpb.Struct
+	responseEnded    bool
+}
+
+// NewRequestContext returns an empty RequestContext taken from a pool. Call Release once the stream ends so the next
+// stream reuses its storage. The zero value is also ready to use.
+func NewRequestContext() *RequestContext {
+	return requestContextPool.Get().(*RequestContext)
+}
+
+// Release resets the RequestContext and puts it back in the pool.
+// Neither the RequestContext nor the values returned by its methods may be used afterwards.
+func (r *RequestContext) Release() {
+	r.requestHeaders.reset()
+	r.responseHeaders.reset()
+	r.url = nil
+	r.cookies, r.cookiesParsed = r.cookies[:0], false
+	r.setCookies, r.setCookiesParsed = r.setCookies[:0], false
+	clear(r.metadata)
+	r.attributes = nil
+	r.responseEnded = false
+	requestContextPool.Put(r)
+}
+
+// RequestHeaders returns the request headers with the lowercase keys sent by Envoy, pseudo headers included.
+func (r *RequestContext) RequestHeaders() Headers {
 	return r.requestHeaders
 }
 
 // GetRequestHeader gets the first value associated with the given key.
-// If there are no values associated with the key, GetRequestHeader returns "". It is case insensitive;
-// [textproto.CanonicalMIMEHeaderKey] is used to canonicalize the provided key. GetRequestHeader assumes that all keys are stored in canonical form.
-// To use non-canonical keys, access the map directly
+// If there are no values associated with the key, GetRequestHeader returns "". It is case insensitive and does not allocate.
 func (r *RequestContext) GetRequestHeader(key string) string {
 	return r.requestHeaders.Get(key)
 }
 
 // RequestHeaderValues returns all values associated with the given key.
-// It is case insensitive; [textproto.CanonicalMIMEHeaderKey] is used to canonicalize the provided key.
-// To use non-canonical keys, access the map directly. The returned slice is not a copy.
+// It is case insensitive. The returned slice is a copy.
 func (r *RequestContext) RequestHeaderValues(key string) []string {
 	return r.requestHeaders.Values(key)
 }
 
-// ResponseHeaders returns the key-value pairs in an HTTP header.
-// The keys should be in canonical form, as returned by http.CanonicalHeaderKey.
-
-func (r *RequestContext) ResponseHeaders() map[string][]string {
+// ResponseHeaders returns the response headers with the lowercase keys sent by Envoy, pseudo headers included.
+func (r *RequestContext) ResponseHeaders() Headers {
 	return r.responseHeaders
 }
 
 // GetResponseHeader gets the first value associated with the given key.
-// If there are no values associated with the key, GetResponseHeader returns "". It is case insensitive;
-// [textproto.CanonicalMIMEHeaderKey] is used to canonicalize the provided key. GetResponseHeader assumes that all keys are stored in canonical form.
-// To use non-canonical keys, access the map directly
+// If there are no values associated with the key, GetResponseHeader returns "". It is case insensitive and does not allocate.
 func (r *RequestContext) GetResponseHeader(key string) string {
 	return r.responseHeaders.Get(key)
 }
 
 // ResponseHeaderValues returns all values associated with the given key.
-// It is case insensitive; [textproto.CanonicalMIMEHeaderKey] is used to canonicalize the provided key.
-// To use non-canonical keys, access the map directly. The returned slice is not a copy.
+// It is case insensitive. The returned slice is a copy.
 func (r *RequestContext) ResponseHeaderValues(key string) []string {
 	return r.responseHeaders.Values(key)
 }
 
 // Scheme returns the scheme of the request (http or https)
 func (r *RequestContext) Scheme() string {
-	return r.scheme
+	return r.requestHeaders.Get(":scheme")
 }
 
 // Authority returns the authority of the request
 func (r *RequestContext) Authority() string {
-	return r.authority
+	return r.requestHeaders.Get(":authority")
+}
+
+// MatchAuthority reports whether the authority is one of the authorities, which all match when empty. Like the domains
+// of Envoy, they are compared case insensitively, with or without the port and the trailing dot of the authority,
+// so clients cannot avoid a configuration scoped to an authority by changing the form of the host header.
+func MatchAuthority(authorities []string, authority string) bool {
+	if len(authorities) == 0 {
+		return true
+	}
+	host := authority
+	if h, _, err := net.SplitHostPort(authority); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(host, ".")
+	for _, a := range authorities {
+		if strings.EqualFold(a, authority) || strings.EqualFold(a, host) {
+			return true
+		}
+	}
+	return false
 }
 
 // Method returns the method of the request (GET, POST, PUT, etc)
 func (r *RequestContext) Method() string {
-	return r.method
+	return r.requestHeaders.Get(":method")
 }
 
-// URL returns the URL of the request
+// URL returns the URL of the request, it is never nil.
 func (r *RequestContext) URL() *url.URL {
+	if r.url != nil {
+		return r.url
+	}
+	path := r.requestHeaders.Get(":path")
+	u, err := url.Parse(path)
+	if err != nil {
+		// Clients can send paths Go does not parse (e.g. invalid escapes), keep them as they are.
+		path, query, _ := strings.Cut(path, "?")
+		u = &url.URL{
+			Path:     path,
+			RawQuery: query,
+		}
+	}
+	r.url = u
 	return r.url
 }
 
 // RequestID returns the request ID of the request
 func (r *RequestContext) RequestID() string {
-	return r.requestID
+	return r.requestHeaders.Get("x-request-id")
 }
 
 // Status returns the status of the response
 func (r *RequestContext) Status() int {
-	return r.status
+	status, _ := strconv.Atoi(r.responseHeaders.Get(":status"))
+	return status
 }
 
 // Cookies returns the cookies of the request
 func (r *RequestContext) Cookies() []http.Cookie {
+	if !r.cookiesParsed {
+		r.cookiesParsed = true
+		if values := r.requestHeaders.Values("cookie"); len(values) > 0 {
+			httpreq := http.Request{Header: http.Header{"Cookie": values}}
+			for _, cookie := range httpreq.Cookies() {
+				r.cookies = append(r.cookies, *cookie)
+			}
+		}
+	}
 	return r.cookies
 }
 
 // SetCookies returns the set cookies of the response
 func (r *RequestContext) SetCookies() []http.Cookie {
+	if !r.setCookiesParsed {
+		r.setCookiesParsed = true
+		if values := r.responseHeaders.Values("set-cookie"); len(values) > 0 {
+			httpresp := http.Response{Header: http.Header{"Set-Cookie": values}}
+			for _, cookie := range httpresp.Cookies() {
+				r.setCookies = append(r.setCookies, *cookie)
+			}
+		}
+	}
 	return r.setCookies
 }
 
-// Metadata returns the metadata of the request, it can be used to excange information between the different processors
-func (r *RequestContext) Metadata() map[string]any {
-	return r.metadata
-}
-
-// Process processes the given message and updates the request object accordingly
-// It should be called on every message received from Envoy
-func (r *RequestContext) Process(message any) {
-	if r.requestHeaders == nil {
-		r.requestHeaders = make(http.Header)
-	}
-	if r.responseHeaders == nil {
-		r.responseHeaders = make(http.Header)
-	}
-	if r.metadata == nil {
-		r.metadata = make(map[string]any)
+// Attribute returns the value of an attribute Envoy sent with the request headers, e.g. source.address when it is
+// listed in the request_attributes of the ext_proc filter.
+func (r *RequestContext) Attribute(name string) (*structpb.Value, bool) {
+	for _, attributes := range r.attributes {
+		if value, ok := attributes.GetFields()[name]; ok {
+			return value, true
+		}
 	}
+	return nil, false
+}
 
-	switch msg := any(message).(type) {
-	case *extproc.ProcessingRequest_RequestHeaders:
-		for _, header := range msg.RequestHeaders.GetHeaders().GetHeaders() {
-			headerValue := cmp.Or(string(header.GetRawValue()), header.GetValue())
-			r.requestHeaders.Add(header.Key, headerValue)
+// ClientIP returns the address of the client. Without trusted hops, it is the address of the downstream connection
+// from the source.address attribute, and false when Envoy does not send it: the x-forwarded-for header is then set by
+// the client.
+// Otherwise it is read from the x-forwarded-for header like Envoy with xff_num_trusted_hops: the addresses appended by
+// the trusted proxies in front of Envoy, trustedHops from the right, are skipped. Envoy appends the address of the
+// downstream connection itself when use_remote_address is enabled.
+// It returns false when the header has less addresses or the address is invalid.
+func (r *RequestContext) ClientIP(trustedHops int) (netip.Addr, bool) {
+	if trustedHops == 0 {
+		source, ok := r.Attribute("source.address")
+		if !ok {
+			return netip.Addr{}, false
 		}
-	case *extproc.ProcessingRequest_ResponseHeaders:
-		for _, header := range msg.ResponseHeaders.GetHeaders().GetHeaders() {
-			headerValue := cmp.Or(string(header.GetRawValue()), header.GetValue())
-			r.responseHeaders.Add(header.Key, headerValue)
+		if addrPort, err := netip.ParseAddrPort(source.GetStringValue()); err == nil {
+			return addrPort.Addr().Unmap(), true
 		}
+		if addr, err := netip.ParseAddr(source.GetStringValue()); err == nil {
+			return addr.Unmap(), true
+		}
+		return netip.Addr{}, false
 	}
-
-	var err error
-	if r.scheme == "" {
-		r.scheme = r.GetRequestHeader(":scheme")
-	}
-	if r.authority == "" {
-		r.authority = r.GetRequestHeader(":authority")
+	values := r.requestHeaders.Values("x-forwarded-for")
+	var addrs []string
+	for _, value := range values {
+		for _, addr := range strings.Split(value, ",") {
+			addrs = append(addrs, strings.TrimSpace(addr))
+		}
 	}
-	if r.method == "" {
-		r.method = r.GetRequestHeader(":method")
+	i := len(addrs) - 1 - trustedHops
+	if trustedHops < 0 || i < 0 {
+		return netip.Addr{}, false
 	}
-	if r.requestID == "" {
-		r.requestID = r.GetRequestHeader("x-request-id")
+	addr, err := netip.ParseAddr(addrs[i])
+	if err != nil {
+		return netip.Addr{}, false
 	}
-	if r.url == nil {
-		r.url, err = url.Parse(r.GetRequestHeader(":path"))
-		if err != nil {
-			r.url = &url.URL{
-				Path:     strings.Split(r.GetRequestHeader(":path"), "?")[0],
-				RawPath:  r.GetRequestHeader(":path"),
-				RawQuery: strings.Split(r.GetRequestHeader(":path"), "?")[1],
-			}
-		}
+	return addr.Unmap(), true
+}
+
+// ParsePrefix parses a CIDR or a single address, e.g. to match the ClientIP against lists of clients.
+func ParsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		return netip.ParsePrefix(s)
 	}
-	if r.status == 0 {
-		status, _ := strconv.Atoi(r.GetResponseHeader(":status"))
-		r.status = status
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
 	}
-	if r.cookies == nil && r.requestHeaders.Get("cookie") != "" {
-		httpreq := http.Request{Header: r.requestHeaders}
-		for _, cookie := range httpreq.Cookies() {
-			r.cookies = append(r.cookies, *cookie)
-		}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// ResponseEndOfStream reports whether the response headers ended the stream, so the response has neither a body nor
+// trailers and the ResponseBody phase does not run.
+func (r *RequestContext) ResponseEndOfStream() bool {
+	return r.responseEnded
+}
+
+// Metadata returns the metadata of the request, it can be used to excange information between the different processors
+func (r *RequestContext) Metadata() map[string]any {
+	if r.metadata == nil {
+		r.metadata = make(map[string]any)
 	}
-	if r.setCookies == nil && r.responseHeaders.Get("set-cookie") != "" {
-		httpresp := http.Response{Header: r.responseHeaders}
-		for _, cookie := range httpresp.Cookies() {
-			r.setCookies = append(r.setCookies, *cookie)
+	return r.metadata
+}
+
+// IsolateMetadata replaces the metadata with a copy until the returned function is called, the keys written or deleted
+// in the meantime are then discarded. It lets processors in shadow mode run without affecting the others.
+func (r *RequestContext) IsolateMetadata() (restore func()) {
+	original := r.metadata
+	r.metadata = maps.Clone(original)
+	return func() { r.metadata = original }
+}
+
+// Process processes the given message and updates the request object accordingly
+// It should be called on every message received from Envoy
+func (r *RequestContext) Process(message any) {
+	switch msg := any(message).(type) {
+	case *extproc.ProcessingRequest_RequestHeaders:
+		r.requestHeaders.add(msg.RequestHeaders.GetHeaders().GetHeaders())
+		if attributes := msg.RequestHeaders.GetAttributes(); len(attributes) > 0 {
+			r.attributes = attributes
 		}
+		// The values parsed from previous headers are stale.
+		r.url = nil
+		r.cookies, r.cookiesParsed = r.cookies[:0], false
+	case *extproc.ProcessingRequest_ResponseHeaders:
+		r.responseHeaders.add(msg.ResponseHeaders.GetHeaders().GetHeaders())
+		r.responseEnded = msg.ResponseHeaders.GetEndOfStream()
+		r.setCookies, r.setCookiesParsed = r.setCookies[:0], false
 	}
 }
@@ -0,0 +1,95 @@
+package processor
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	extproc "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+)
+
+func requestHeaders(headers ...*corev3.HeaderValue) *extproc.ProcessingRequest_RequestHeaders {
+	return &extproc.ProcessingRequest_RequestHeaders{
+		RequestHeaders: &extproc.HttpHeaders{Headers: &corev3.HeaderMap{Headers: headers}},
+	}
+}
+
+func responseHeaders(headers ...*corev3.HeaderValue) *extproc.ProcessingRequest_ResponseHeaders {
+	return &extproc.ProcessingRequest_ResponseHeaders{
+		ResponseHeaders: &extproc.HttpHeaders{Headers: &corev3.HeaderMap{Headers: headers}},
+	}
+}
+
+// headerValue encodes the value in raw_value or value like the two Envoy encodings.
+func headerValue(key, value string, raw bool) *corev3.HeaderValue {
+	if raw {
+		return &corev3.HeaderValue{Key: key, RawValue: []byte(value)}
+	}
+	return &corev3.HeaderValue{Key: key, Value: value}
+}
+
+func FuzzProcessPath(f *testing.F) {
+	for _, seed := range []string{
+		"/",
+		"/path?query=1",
+		"/%zz",
+		"/%zz?a=b",
+		"%",
+		"?",
+		"/a?b?c",
+		"//host/path",
+		"http://[::1",
+		"/\x00",
+		"",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, path string) {
+		r := &RequestContext{}
+		r.Process(requestHeaders(headerValue(":path", path, true)))
+		if r.URL() == nil {
+			t.Fatalf("URL() is nil for :path %q", path)
+		}
+		wantPath, wantQuery, _ := strings.Cut(path, "?")
+		if _, err := url.Parse(path); err != nil && (r.URL().Path != wantPath || r.URL().RawQuery != wantQuery) {
+			t.Fatalf("URL() = path %q query %q for unparsable :path %q", r.URL().Path, r.URL().RawQuery, path)
+		}
+	})
+}
+
+func FuzzProcessHeaders(f *testing.F) {
+	f.Add("x-custom", "value", true, "session=abc; theme=dark", "id=1; Path=/; HttpOnly", "200", "/path?query=1")
+	f.Add("Cookie", "a=b", false, "=;;=", "=", "not-a-status", "%zz")
+	f.Add(":authority", "", true, "\"quoted\"=\"value\"", "a=b; Expires=garbage; Max-Age=-1", "99999999999999999999", "?")
+	f.Add("", "\x00\r\n", false, "", "; ;", "-1", "")
+	f.Fuzz(func(t *testing.T, key, value string, raw bool, cookie, setCookie, status, path string) {
+		r := &RequestContext{}
+		r.Process(requestHeaders(
+			headerValue(":path", path, raw),
+			headerValue("cookie", cookie, raw),
+			headerValue(key, value, raw),
+		))
+		r.Process(&extproc.ProcessingRequest_RequestBody{RequestBody: &extproc.HttpBody{Body: []byte(value)}})
+		r.Process(responseHeaders(
+			headerValue(":status", status, raw),
+			headerValue("set-cookie", setCookie, raw),
+			headerValue(key, value, raw),
+		))
+		r.Process(nil)
+
+		// The accessors processors rely on must be usable whatever the input.
+		_ = r.URL().String()
+		_ = r.GetRequestHeader(key)
+		_ = r.RequestHeaderValues(key)
+		_ = r.GetResponseHeader(key)
+		_ = r.ResponseHeaderValues(key)
+		for _, c := range r.Cookies() {
+			_ = c.String()
+		}
+		for _, c := range r.SetCookies() {
+			_ = c.String()
+		}
+		r.Metadata()["key"] = value
+	})
+}
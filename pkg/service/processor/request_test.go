@@ -0,0 +1,209 @@
+package processor
+
+import (
+	"testing"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	extproc "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// benchmarkRequestHeaders are the request headers of a typical browser request as sent by Envoy.
+func benchmarkRequestHeaders() *extproc.ProcessingRequest_RequestHeaders {
+	return requestHeaders(
+		headerValue(":authority", "127.0.0.1:10000", true),
+		headerValue(":path", "/headers?show_env=1&page=2", true),
+		headerValue(":method", "GET", true),
+		headerValue(":scheme", "http", true),
+		headerValue("user-agent", "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0 Safari/537.36", true),
+		headerValue("accept", "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", true),
+		headerValue("accept-language", "en-US,en;q=0.9", true),
+		headerValue("accept-encoding", "gzip, deflate, br", true),
+		headerValue("cookie", "session=3b2f1c9a; theme=dark; _ga=GA1.1.123456789.1700000000", true),
+		headerValue("x-forwarded-proto", "http", true),
+		headerValue("x-request-id", "ec55e255-f363-9706-95b6-16ba7d08df10", true),
+	)
+}
+
+func benchmarkResponseHeaders() *extproc.ProcessingRequest_ResponseHeaders {
+	return responseHeaders(
+		headerValue(":status", "200", true),
+		headerValue("content-type", "application/json", true),
+		headerValue("content-length", "187", true),
+		headerValue("set-cookie", "session=3b2f1c9a; Path=/; Max-Age=3600", true),
+		headerValue("set-cookie", "theme=dark; Path=/", true),
+		headerValue("x-envoy-upstream-service-time", "2", true),
+	)
+}
+
+func BenchmarkRequestContextProcess(b *testing.B) {
+	reqHeaders := benchmarkRequestHeaders()
+	respHeaders := benchmarkResponseHeaders()
+	body := &extproc.ProcessingRequest_RequestBody{RequestBody: &extproc.HttpBody{Body: []byte("{}"), EndOfStream: true}}
+
+	// stream processes the messages of a stream and reads the values processors commonly use.
+	stream := func(r *RequestContext) {
+		r.Process(reqHeaders)
+		_ = r.URL()
+		_ = r.Cookies()
+		r.Process(body)
+		r.Process(respHeaders)
+		_ = r.Status()
+		_ = r.SetCookies()
+	}
+
+	b.Run("RequestHeaders", func(b *testing.B) {
+		b.ReportAllocs()
+		for range b.N {
+			r := &RequestContext{}
+			r.Process(reqHeaders)
+		}
+	})
+	b.Run("Stream", func(b *testing.B) {
+		b.ReportAllocs()
+		for range b.N {
+			stream(&RequestContext{})
+		}
+	})
+	b.Run("StreamPooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for range b.N {
+			r := NewRequestContext()
+			stream(r)
+			r.Release()
+		}
+	})
+}
+
+func BenchmarkRequestContextLookup(b *testing.B) {
+	r := &RequestContext{}
+	r.Process(benchmarkRequestHeaders())
+	r.Process(benchmarkResponseHeaders())
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		_ = r.GetRequestHeader("user-agent")
+		_ = r.GetRequestHeader("x-missing")
+		_ = r.GetResponseHeader("content-type")
+		_ = r.Cookies()
+	}
+}
+
+// A pooled RequestContext must not leak anything from the previous stream.
+func TestRequestContextRelease(t *testing.T) {
+	r := NewRequestContext()
+	r.Process(benchmarkRequestHeaders())
+	ended := benchmarkResponseHeaders()
+	ended.ResponseHeaders.EndOfStream = true
+	r.Process(ended)
+	if !r.ResponseEndOfStream() {
+		t.Errorf("ResponseEndOfStream() = false, want true")
+	}
+	_, _, _ = r.URL(), r.Cookies(), r.SetCookies()
+	r.Metadata()["key"] = "value"
+	r.Release()
+
+	r = NewRequestContext()
+	defer r.Release()
+	r.Process(requestHeaders(headerValue(":path", "/next", true)))
+	if got := r.URL().Path; got != "/next" {
+		t.Errorf("URL().Path = %q, want /next", got)
+	}
+	if got := r.GetRequestHeader("User-Agent"); got != "" {
+		t.Errorf("GetRequestHeader(User-Agent) = %q, want empty", got)
+	}
+	if r.RequestHeaders().Len() != 1 || r.ResponseHeaders().Len() != 0 {
+		t.Errorf("headers = %d request and %d response, want 1 and 0", r.RequestHeaders().Len(), r.ResponseHeaders().Len())
+	}
+	if len(r.Cookies()) != 0 || len(r.SetCookies()) != 0 || len(r.Metadata()) != 0 || r.Status() != 0 || r.ResponseEndOfStream() {
+		t.Errorf("values from the previous stream are still present")
+	}
+}
+
+func TestRequestContextIsolateMetadata(t *testing.T) {
+	r := &RequestContext{}
+	r.Metadata()["key"] = "value"
+
+	restore := r.IsolateMetadata()
+	if got := r.Metadata()["key"]; got != "value" {
+		t.Errorf("isolated Metadata()[key] = %v, want value", got)
+	}
+	r.Metadata()["key"] = "changed"
+	r.Metadata()["added"] = true
+	restore()
+
+	if got := r.Metadata(); len(got) != 1 || got["key"] != "value" {
+		t.Errorf("Metadata() = %v after restore, want the original", got)
+	}
+}
+
+func TestMatchAuthority(t *testing.T) {
+	authorities := []string{"admin.example.com", "api.example.com:8443"}
+	tests := map[string]bool{
+		"admin.example.com":      true,
+		"ADMIN.Example.com":      true,
+		"admin.example.com:443":  true,
+		"admin.example.com.":     true,
+		"admin.example.com.:443": true,
+		"api.example.com:8443":   true,
+		"api.example.com":        false,
+		"www.example.com":        false,
+		"admin.example.com.evil": false,
+		"":                       false,
+	}
+	for authority, want := range tests {
+		if got := MatchAuthority(authorities, authority); got != want {
+			t.Errorf("MatchAuthority(%q) = %v, want %v", authority, got, want)
+		}
+	}
+	if !MatchAuthority(nil, "www.example.com") {
+		t.Errorf("MatchAuthority() without authorities = false, want true")
+	}
+}
+
+func TestParsePrefix(t *testing.T) {
+	tests := map[string]string{
+		"10.0.0.0/8":     "10.0.0.0/8",
+		"203.0.113.7":    "203.0.113.7/32",
+		"2001:db8::/32":  "2001:db8::/32",
+		"2001:db8::1":    "2001:db8::1/128",
+		"not an address": "invalid",
+		"10.0.0.0/33":    "invalid",
+		"2001:db8::/129": "invalid",
+	}
+	for s, want := range tests {
+		prefix, err := ParsePrefix(s)
+		if got := prefix.String(); (err != nil) != (want == "invalid") || (err == nil && got != want) {
+			t.Errorf("ParsePrefix(%q) = %s, %v, want %s", s, got, err, want)
+		}
+	}
+}
+
+func TestRequestContextClientIP(t *testing.T) {
+	r := &RequestContext{}
+	r.Process(requestHeaders(
+		headerValue("x-forwarded-for", "203.0.113.7, 10.0.0.1", true),
+		headerValue("x-forwarded-for", "::ffff:192.0.2.1", true),
+	))
+	// Without trusted hops, the rightmost address is set by the client itself.
+	tests := map[int]string{0: "invalid", 1: "10.0.0.1", 2: "203.0.113.7", 3: "invalid"}
+	for hops, want := range tests {
+		addr, ok := r.ClientIP(hops)
+		if got := addr.String(); ok != (want != "invalid") || (ok && got != want) {
+			t.Errorf("ClientIP(%d) = %s, %v, want %s", hops, got, ok, want)
+		}
+	}
+
+	// The address of the downstream connection is used without trusted hops.
+	source, _ := structpb.NewStruct(map[string]any{"source.address": "198.51.100.4:51234"})
+	r.Process(&extproc.ProcessingRequest_RequestHeaders{RequestHeaders: &extproc.HttpHeaders{
+		Headers:    &corev3.HeaderMap{},
+		Attributes: map[string]*structpb.Struct{"envoy.filters.http.ext_proc": source},
+	}})
+	if addr, _ := r.ClientIP(0); addr.String() != "198.51.100.4" {
+		t.Errorf("ClientIP(0) = %s, want the source.address attribute", addr)
+	}
+	if addr, _ := r.ClientIP(1); addr.String() != "10.0.0.1" {
+		t.Errorf("ClientIP(1) = %s, want the x-forwarded-for address", addr)
+	}
+}
@@ -0,0 +1,33 @@
+package processor
+
+import (
+	"net/http"
+	"testing"
+)
+
+func BenchmarkCommonResponseWriter(b *testing.B) {
+	cookie := (&http.Cookie{Name: "session", Value: "3b2f1c9a", Path: "/", HttpOnly: true, SameSite: http.SameSiteLaxMode}).String()
+
+	b.Run("Headers", func(b *testing.B) {
+		b.ReportAllocs()
+		for range b.N {
+			crw := NewCommonResponseWriter()
+			crw.HeaderSet("x-custom", "value").
+				HeaderAppend("set-cookie", cookie).
+				HeaderAppend("set-cookie", cookie).
+				RemoveHeaders("x-powered-by", "server")
+			_ = crw.CommonResponse()
+		}
+	})
+	b.Run("Validate", func(b *testing.B) {
+		crw := NewCommonResponseWriter()
+		crw.HeaderSet("x-custom", "value").HeaderAppend("set-cookie", cookie).RemoveHeaders("x-powered-by")
+		b.ReportAllocs()
+		b.ResetTimer()
+		for range b.N {
+			if err := crw.CommonResponse().Validate(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
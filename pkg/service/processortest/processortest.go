@@ -0,0 +1,65 @@
+// Package processortest provides utilities to test processors without Envoy.
+// It drives an ExternalProcessorServer through an in-memory stream the same way Envoy would, from plain net/http values,
+// with the Runner and Session of the proxy package. MustRun, WaitFor and the claims processors are helpers shared by
+// the tests of the processors.
+package processortest
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/cainelli/ext-proc/pkg/proxy"
+	extproc "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+)
+
+// Result is the outcome of running an HTTP exchange through the server, see proxy.Result.
+type Result = proxy.Result
+
+// Runner runs HTTP exchanges through a server, see proxy.Runner.
+type Runner = proxy.Runner
+
+// Session is the client side of an in-memory ext_proc stream, see proxy.Session.
+type Session = proxy.Session
+
+// ErrStreamClosed is returned when sending on a session whose server side has already returned.
+var ErrStreamClosed = proxy.ErrStreamClosed
+
+// Run runs the exchange with the default Runner, see proxy.Runner.Run.
+func Run(ctx context.Context, srv extproc.ExternalProcessorServer, req *http.Request, resp *http.Response) (*Result, error) {
+	return proxy.Run(ctx, srv, req, resp)
+}
+
+// NewSession starts srv.Process on a new in-memory stream, see proxy.NewSession.
+func NewSession(ctx context.Context, srv extproc.ExternalProcessorServer) *Session {
+	return proxy.NewSession(ctx, srv)
+}
+
+// RequestHeaders builds the request headers message Envoy sends for the given request.
+func RequestHeaders(req *http.Request, endOfStream bool) *extproc.ProcessingRequest {
+	return proxy.RequestHeaders(req, endOfStream)
+}
+
+// RequestBody builds a request body message.
+func RequestBody(body []byte, endOfStream bool) *extproc.ProcessingRequest {
+	return proxy.RequestBody(body, endOfStream)
+}
+
+// RequestTrailers builds a request trailers message.
+func RequestTrailers(trailers http.Header) *extproc.ProcessingRequest {
+	return proxy.RequestTrailers(trailers)
+}
+
+// ResponseHeaders builds the response headers message Envoy sends for the given response.
+func ResponseHeaders(resp *http.Response, endOfStream bool) *extproc.ProcessingRequest {
+	return proxy.ResponseHeaders(resp, endOfStream)
+}
+
+// ResponseBody builds a response body message.
+func ResponseBody(body []byte, endOfStream bool) *extproc.ProcessingRequest {
+	return proxy.ResponseBody(body, endOfStream)
+}
+
+// ResponseTrailers builds a response trailers message.
+func ResponseTrailers(trailers http.Header) *extproc.ProcessingRequest {
+	return proxy.ResponseTrailers(trailers)
+}
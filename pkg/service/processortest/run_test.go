@@ -0,0 +1,152 @@
+package processortest_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cainelli/ext-proc/pkg/service/processor"
+	"github.com/cainelli/ext-proc/pkg/service/processortest"
+	extproc "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+)
+
+// gateProcessor answers the requests to /blocked and tags the others.
+type gateProcessor struct {
+	processor.NoOpProcessor
+	responses int
+}
+
+func (p *gateProcessor) RequestHeaders(ctx context.Context, crw *processor.CommonResponseWriter, req *processor.RequestContext) (*extproc.ProcessingResponse_ImmediateResponse, error) {
+	if req.URL().Path == "/blocked" {
+		return &extproc.ProcessingResponse_ImmediateResponse{
+			ImmediateResponse: &extproc.ImmediateResponse{
+				Status: &typev3.HttpStatus{Code: typev3.StatusCode_Forbidden},
+				Body:   "blocked",
+			},
+		}, nil
+	}
+	crw.HeaderSet("x-gate", "passed")
+	crw.RemoveHeaders("x-debug")
+	return nil, nil
+}
+
+func (p *gateProcessor) ResponseHeaders(ctx context.Context, crw *processor.CommonResponseWriter, req *processor.RequestContext) (*extproc.ProcessingResponse_ImmediateResponse, error) {
+	p.responses++
+	crw.HeaderSet("x-request-method", req.Method())
+	return nil, nil
+}
+
+func TestRun(t *testing.T) {
+	p := &gateProcessor{}
+	req := httptest.NewRequest(http.MethodPost, "http://www.example.com/orders", strings.NewReader("order"))
+	req.Header.Set("x-debug", "1")
+	resp := &http.Response{StatusCode: http.StatusCreated, Header: http.Header{"Server": {"upstream"}}, Body: io.NopCloser(strings.NewReader("created"))}
+
+	result := processortest.MustRun(t, processortest.Chain(p), req, resp)
+	if result.ImmediateResponse != nil {
+		t.Fatalf("unexpected immediate response %v", result.ImmediateResponse)
+	}
+	if got := result.Request.Header.Get("x-gate"); got != "passed" {
+		t.Errorf("request x-gate = %q, want passed", got)
+	}
+	if result.Request.Header.Get("x-debug") != "" {
+		t.Errorf("request x-debug was not removed")
+	}
+	if req.Header.Get("x-debug") != "1" || req.Header.Get("x-gate") != "" {
+		t.Errorf("the given request was modified: %v", req.Header)
+	}
+	if body, _ := io.ReadAll(result.Request.Body); string(body) != "order" {
+		t.Errorf("request body = %q, want order", body)
+	}
+
+	if result.Response.StatusCode != http.StatusCreated {
+		t.Errorf("status = %d, want 201", result.Response.StatusCode)
+	}
+	if got := result.Response.Header.Get("x-request-method"); got != http.MethodPost {
+		t.Errorf("response x-request-method = %q, want POST", got)
+	}
+	if got := result.Response.Header.Get("server"); got != "upstream" {
+		t.Errorf("response server = %q, want upstream", got)
+	}
+	if body, _ := io.ReadAll(result.Response.Body); string(body) != "created" {
+		t.Errorf("response body = %q, want created", body)
+	}
+	if resp.Header.Get("x-request-method") != "" {
+		t.Errorf("the given response was modified: %v", resp.Header)
+	}
+
+	// Headers and buffered bodies of both directions.
+	if len(result.Responses) != 4 {
+		t.Fatalf("got %d responses, want 4", len(result.Responses))
+	}
+	_, first := result.Responses[0].Response.(*extproc.ProcessingResponse_RequestHeaders)
+	_, last := result.Responses[3].Response.(*extproc.ProcessingResponse_ResponseBody)
+	if !first || !last {
+		t.Errorf("responses out of order: %v", result.Responses)
+	}
+}
+
+func TestRunImmediateResponse(t *testing.T) {
+	p := &gateProcessor{}
+	req := httptest.NewRequest(http.MethodGet, "http://www.example.com/blocked", nil)
+	resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}}
+
+	result := processortest.MustRun(t, processortest.Chain(p), req, resp)
+	if result.ImmediateResponse == nil {
+		t.Fatalf("request was not answered")
+	}
+	if result.Response.StatusCode != http.StatusForbidden {
+		t.Errorf("status = %d, want 403", result.Response.StatusCode)
+	}
+	if body, _ := io.ReadAll(result.Response.Body); string(body) != "blocked" {
+		t.Errorf("body = %q, want blocked", body)
+	}
+	if len(result.Responses) != 1 {
+		t.Errorf("got %d responses, want only the immediate response", len(result.Responses))
+	}
+	if p.responses != 0 {
+		t.Errorf("response phases ran after the immediate response")
+	}
+}
+
+// closingServer returns right away with its error.
+type closingServer struct {
+	extproc.UnimplementedExternalProcessorServer
+	err error
+}
+
+func (s *closingServer) Process(extproc.ExternalProcessor_ProcessServer) error {
+	return s.err
+}
+
+func TestSessionClosedByServer(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	sess := processortest.NewSession(ctx, &closingServer{})
+	<-sess.Done()
+	if err := sess.Send(processortest.RequestHeaders(httptest.NewRequest(http.MethodGet, "/", nil), true)); !errors.Is(err, processortest.ErrStreamClosed) {
+		t.Errorf("Send() = %v, want ErrStreamClosed", err)
+	}
+	if _, err := sess.Recv(); !errors.Is(err, io.EOF) {
+		t.Errorf("Recv() = %v, want io.EOF", err)
+	}
+	if err := sess.Close(); err != nil {
+		t.Errorf("Close() = %v", err)
+	}
+
+	failure := errors.New("failure")
+	sess = processortest.NewSession(ctx, &closingServer{err: failure})
+	if _, err := sess.Recv(); !errors.Is(err, failure) {
+		t.Errorf("Recv() = %v, want the server error", err)
+	}
+	if err := sess.Close(); !errors.Is(err, failure) {
+		t.Errorf("Close() = %v, want the server error", err)
+	}
+}
@@ -0,0 +1,79 @@
+package processortest
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/cainelli/ext-proc/pkg/service"
+	"github.com/cainelli/ext-proc/pkg/service/processor"
+	extproc "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+)
+
+// Timeout bounds the exchanges of MustRun and the conditions of WaitFor.
+const Timeout = 5 * time.Second
+
+// Chain returns a server running the processors in order.
+func Chain(processors ...processor.Processor) *service.ExtProcessor {
+	return &service.ExtProcessor{Processors: processors}
+}
+
+// MustRun runs the exchange with the default Runner within Timeout and fails the test on error.
+func MustRun(t testing.TB, srv extproc.ExternalProcessorServer, req *http.Request, resp *http.Response) *Result {
+	t.Helper()
+	return MustRunWith(t, &Runner{}, srv, req, resp)
+}
+
+// MustRunWith runs the exchange with runner within Timeout and fails the test on error.
+func MustRunWith(t testing.TB, runner *Runner, srv extproc.ExternalProcessorServer, req *http.Request, resp *http.Response) *Result {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), Timeout)
+	defer cancel()
+	result, err := runner.Run(ctx, srv, req, resp)
+	if err != nil {
+		t.Fatalf("Run() = %v", err)
+	}
+	return result
+}
+
+// WaitFor polls condition until it holds and fails the test when it does not within Timeout.
+func WaitFor(t testing.TB, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(Timeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("condition not met in time")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// ClaimsSetter stores claims in the metadata under Key like the processors authenticating requests, to test the
+// processors reading them.
+type ClaimsSetter struct {
+	processor.NoOpProcessor
+	Key string
+	// Claims returns the claims of the request, nothing is stored when it returns nil.
+	Claims func(req *processor.RequestContext) processor.Claims
+}
+
+func (s *ClaimsSetter) RequestHeaders(_ context.Context, _ *processor.CommonResponseWriter, req *processor.RequestContext) (*extproc.ProcessingResponse_ImmediateResponse, error) {
+	if claims := s.Claims(req); claims != nil {
+		req.Metadata()[s.Key] = claims
+	}
+	return nil, nil
+}
+
+// ClaimsRecorder records the claims stored in the metadata under Key by the previous processors.
+type ClaimsRecorder struct {
+	processor.NoOpProcessor
+	Key string
+	// Claims are the claims of the last request, nil when it had none.
+	Claims processor.Claims
+}
+
+func (r *ClaimsRecorder) RequestHeaders(_ context.Context, _ *processor.CommonResponseWriter, req *processor.RequestContext) (*extproc.ProcessingResponse_ImmediateResponse, error) {
+	r.Claims, _ = req.Metadata()[r.Key].(processor.Claims)
+	return nil, nil
+}
@@ -6,26 +6,74 @@ import (
 	"fmt"
 	"io"
 	"log/slog"
+	"sync"
+	"sync/atomic"
 
 	"github.com/cainelli/ext-proc/pkg/service/processor"
 	extproc "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
 
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
+// errProcessingEnded is returned by the message handlers when no more messages are expected on the stream.
+var errProcessingEnded = errors.New("processing ended")
+
 type ExtProcessor struct {
 	Processors []processor.Processor
+	// MaxBodySize is the maximum size in bytes of the request and of the response body, the chunks of STREAMED bodies
+	// are added up. Larger bodies are rejected with a 413 immediate response.
+	// It must be lower than the gRPC max receive message size of the server, otherwise gRPC closes the stream instead. Zero means no limit.
+	MaxBodySize int
+	// ObserverWorkers is the number of goroutines running the processors on messages sent in async mode, as Envoy does
+	// in observability mode. The messages are queued so the stream never waits for the processors. Zero runs them
+	// inline on the stream goroutine instead.
+	ObserverWorkers int
+	// ObserverQueueSize is the number of messages each observer worker buffers, DefaultObserverQueueSize when zero.
+	// Streams are dropped and counted when the queue of their worker is full.
+	ObserverQueueSize int
+
+	ready        atomic.Bool
+	states       []*processorState
+	statesOnce   sync.Once
+	obs          *observer
+	observerOnce sync.Once
 }
 
 var _ extproc.ExternalProcessorServer = &ExtProcessor{}
 
+// Init initializes every processor implementing processor.Initializer in order.
+// The ExtProcessor is reported as ready only once all of them succeed.
+func (svc *ExtProcessor) Init(ctx context.Context) error {
+	for _, p := range svc.Processors {
+		initializer, ok := p.(processor.Initializer)
+		if !ok {
+			continue
+		}
+		if err := initializer.Init(ctx); err != nil {
+			return fmt.Errorf("failed initializing processor %T: %w", p, err)
+		}
+	}
+	svc.ready.Store(true)
+	return nil
+}
+
+// Ready reports whether all the processors have been initialized.
+func (svc *ExtProcessor) Ready() bool {
+	return svc.ready.Load()
+}
+
 // Process is the main entry point for the ExternalProcessor service.
 // The protocol itself is based on a bidirectional gRPC stream. Envoy will send the server ProcessingRequest messages, and the server must reply with ProcessingResponse.
 // https://www.envoyproxy.io/docs/envoy/latest/api-v3/extensions/filters/http/ext_proc/v3/ext_proc.proto#envoy-v3-api-msg-extensions-filters-http-ext-proc-v3-externalprocessor
 func (svc *ExtProcessor) Process(procsrv extproc.ExternalProcessor_ProcessServer) error {
 	ctx := procsrv.Context()
-	req := &processor.RequestContext{}
+	req := processor.NewRequestContext()
+	defer req.Release()
+	// observe queues the async mode messages of the stream when the processors run on the observer workers.
+	var observe func(*extproc.ProcessingRequest)
+	var bodies bodySizes
 	for {
 		select {
 		case <-ctx.Done():
@@ -37,56 +85,88 @@ func (svc *ExtProcessor) Process(procsrv extproc.ExternalProcessor_ProcessServer
 		switch {
 		case errors.Is(err, io.EOF), errors.Is(err, status.Error(codes.Canceled, context.Canceled.Error())):
 			return nil
+		case status.Code(err) == codes.ResourceExhausted:
+			slog.Error("message exceeds the gRPC maximum receive size, the stream is closed", "error", err)
+			return status.Errorf(codes.ResourceExhausted, "processing request is larger than the server accepts, raise the server max receive message size above MaxBodySize: %v", err)
 		case err != nil:
 			slog.Error("an error occured while processing the requets", "error", err)
 			return status.Errorf(codes.Unknown, "cannot receive stream request: %v", err)
 		}
-		req.Process(procreq.Request)
-
-		switch msg := procreq.Request.(type) {
-		case *extproc.ProcessingRequest_RequestHeaders:
-			if err := svc.requestHeadersMessage(ctx, req, procsrv); err != nil {
-				return err
-			}
-		case *extproc.ProcessingRequest_RequestBody:
-			if err := svc.requestBodyMessage(ctx, req, procsrv); err != nil {
-				return err
-			}
-		case *extproc.ProcessingRequest_RequestTrailers:
-			if err := svc.requestTrailersMessage(ctx, req, procsrv); err != nil {
-				return err
-			}
-		case *extproc.ProcessingRequest_ResponseHeaders:
-			if err := svc.responseHeadersMessage(ctx, req, procsrv); err != nil {
-				return err
-			}
-		case *extproc.ProcessingRequest_ResponseBody:
-			if err := svc.responseBodyMessage(ctx, req, procsrv); err != nil {
-				return err
+		// In async mode Envoy does not wait for responses: the processors still run but nothing is sent back.
+		sender := procsrv
+		if procreq.GetAsyncMode() {
+			sender = discardResponses{procsrv}
+		}
+		if svc.bodyTooLarge(&bodies, procreq) {
+			slog.Warn("body exceeds the maximum size, rejecting request", "max-body-size", svc.MaxBodySize)
+			if err := sender.Send(payloadTooLarge()); err != nil {
+				return fmt.Errorf("failed sending payload too large response: %w", err)
 			}
-		case *extproc.ProcessingRequest_ResponseTrailers:
-			if err := svc.responseTrailersMessage(ctx, req, procsrv); err != nil {
-				return err
+			return nil
+		}
+		if obs := svc.observer(); obs != nil && procreq.GetAsyncMode() {
+			if observe == nil {
+				observe = obs.observeStream(ctx)
+				defer observe(nil)
 			}
-		default:
-			slog.Warn("unhandled message type", "type", fmt.Sprintf("%T", msg))
+			observe(procreq)
+			continue
+		}
+		req.Process(procreq.Request)
+
+		err = svc.handleMessage(ctx, req, procreq, sender)
+		switch {
+		case errors.Is(err, errProcessingEnded):
 			return nil
+		case err != nil:
+			return err
 		}
 	}
 }
 
+// handleMessage runs the processors for the message and sends the response.
+func (svc *ExtProcessor) handleMessage(ctx context.Context, req *processor.RequestContext, procreq *extproc.ProcessingRequest, sender extproc.ExternalProcessor_ProcessServer) error {
+	switch msg := procreq.Request.(type) {
+	case *extproc.ProcessingRequest_RequestHeaders:
+		return svc.requestHeadersMessage(ctx, req, sender)
+	case *extproc.ProcessingRequest_RequestBody:
+		return svc.requestBodyMessage(ctx, req, msg.RequestBody, sender)
+	case *extproc.ProcessingRequest_RequestTrailers:
+		return svc.requestTrailersMessage(ctx, req, sender)
+	case *extproc.ProcessingRequest_ResponseHeaders:
+		return svc.responseHeadersMessage(ctx, req, sender)
+	case *extproc.ProcessingRequest_ResponseBody:
+		return svc.responseBodyMessage(ctx, req, msg.ResponseBody, sender)
+	case *extproc.ProcessingRequest_ResponseTrailers:
+		return svc.responseTrailersMessage(ctx, req, sender)
+	default:
+		// Envoy may add message types in the future, keep the stream alive and wait for the next message.
+		slog.Warn("unhandled message type", "type", fmt.Sprintf("%T", msg))
+		return nil
+	}
+}
+
 // Step 1. Request headers: Contains the headers from the original HTTP request.
 func (svc *ExtProcessor) requestHeadersMessage(ctx context.Context, req *processor.RequestContext, procsrv extproc.ExternalProcessor_ProcessServer) error {
 	crw := processor.NewCommonResponseWriter()
-	for _, p := range svc.Processors {
+	for i, p := range svc.Processors {
+		state := svc.processorState(i)
+		if state.disabled.Load() {
+			continue
+		}
+		state.requestHeaders.Add(1)
+		if state.shadow.Load() {
+			svc.shadow(ctx, "RequestHeaders", i, req, p.RequestHeaders)
+			continue
+		}
 		immediateResponse, err := p.RequestHeaders(ctx, crw, req)
 		if err != nil {
+			state.errors.Add(1)
 			return fmt.Errorf("RequestHeaders: failed running processor %T: %w", p, err)
 		}
 		if immediateResponse != nil {
-			return procsrv.Send(&extproc.ProcessingResponse{
-				Response: immediateResponse,
-			})
+			state.immediateResponses.Add(1)
+			return sendImmediateResponse(procsrv, immediateResponse)
 		}
 		if err := crw.CommonResponse().Validate(); err != nil {
 			return fmt.Errorf("RequestHeaders: failed validating response in processor %T: %w", p, err)
@@ -110,11 +190,51 @@ func (svc *ExtProcessor) requestHeadersMessage(ctx context.Context, req *process
 	return nil
 }
 
-// Step 2. (Not implemented) Request body: Delivered if they are present and sent in a single message if the BUFFERED or BUFFERED_PARTIAL mode is chosen, in multiple messages if the STREAMED mode is chosen, and not at all otherwise.
-func (svc *ExtProcessor) requestBodyMessage(_ context.Context, _ *processor.RequestContext, procsrv extproc.ExternalProcessor_ProcessServer) error {
+// Step 2. Request body: Delivered if they are present and sent in a single message if the BUFFERED or BUFFERED_PARTIAL mode is chosen, in multiple messages if the STREAMED mode is chosen, and not at all otherwise.
+// Only the processors implementing processor.RequestBodyProcessor are called.
+func (svc *ExtProcessor) requestBodyMessage(ctx context.Context, req *processor.RequestContext, body *extproc.HttpBody, procsrv extproc.ExternalProcessor_ProcessServer) error {
+	crw := processor.NewCommonResponseWriter()
+	ran := false
+	for i, p := range svc.Processors {
+		bp, ok := p.(processor.RequestBodyProcessor)
+		state := svc.processorState(i)
+		if !ok || state.disabled.Load() {
+			continue
+		}
+		ran = true
+		state.requestBody.Add(1)
+		if state.shadow.Load() {
+			svc.shadow(ctx, "RequestBody", i, req, bodyPhase(bp.RequestBody, body))
+			continue
+		}
+		immediateResponse, err := bp.RequestBody(ctx, crw, req, body)
+		if err != nil {
+			state.errors.Add(1)
+			return fmt.Errorf("RequestBody: failed running processor %T: %w", p, err)
+		}
+		if immediateResponse != nil {
+			state.immediateResponses.Add(1)
+			return sendImmediateResponse(procsrv, immediateResponse)
+		}
+		if err := crw.CommonResponse().Validate(); err != nil {
+			return fmt.Errorf("RequestBody: failed validating response in processor %T: %w", p, err)
+		}
+		body = mutatedBody(body, crw)
+	}
+	// Without body processors the body is acknowledged without any CommonResponse.
 	r := &extproc.ProcessingResponse{
 		Response: &extproc.ProcessingResponse_RequestBody{},
 	}
+	if ran {
+		r.Response = &extproc.ProcessingResponse_RequestBody{
+			RequestBody: &extproc.BodyResponse{
+				Response: crw.CommonResponse(),
+			},
+		}
+	}
+	if err := r.ValidateAll(); err != nil {
+		return fmt.Errorf("RequestBody: failed validating response: %w", err)
+	}
 	if err := procsrv.Send(r); err != nil {
 		return fmt.Errorf("RequestBody: failed sending response: %w", err)
 	}
@@ -135,15 +255,24 @@ func (svc *ExtProcessor) requestTrailersMessage(_ context.Context, _ *processor.
 // Step 4. Response headers: Contains the headers from the HTTP response. Keep in mind that if the upstream system sends them before processing the request body that this message may arrive before the complete body.
 func (svc *ExtProcessor) responseHeadersMessage(ctx context.Context, req *processor.RequestContext, procsrv extproc.ExternalProcessor_ProcessServer) error {
 	crw := processor.NewCommonResponseWriter()
-	for _, p := range svc.Processors {
+	for i, p := range svc.Processors {
+		state := svc.processorState(i)
+		if state.disabled.Load() {
+			continue
+		}
+		state.responseHeaders.Add(1)
+		if state.shadow.Load() {
+			svc.shadow(ctx, "ResponseHeaders", i, req, p.ResponseHeaders)
+			continue
+		}
 		immediateResponse, err := p.ResponseHeaders(ctx, crw, req)
 		if err != nil {
+			state.errors.Add(1)
 			return fmt.Errorf("ResponseHeaders: failed running processor %T: %w", p, err)
 		}
 		if immediateResponse != nil {
-			return procsrv.Send(&extproc.ProcessingResponse{
-				Response: immediateResponse,
-			})
+			state.immediateResponses.Add(1)
+			return sendImmediateResponse(procsrv, immediateResponse)
 		}
 		if err := crw.CommonResponse().Validate(); err != nil {
 			return fmt.Errorf("ResponseHeaders: failed validating response in processor %T: %w", p, err)
@@ -165,11 +294,51 @@ func (svc *ExtProcessor) responseHeadersMessage(ctx context.Context, req *proces
 	return nil
 }
 
-// Step 5. (Not implemented) Response body: Sent according to the processing mode like the request body.
-func (svc *ExtProcessor) responseBodyMessage(_ context.Context, _ *processor.RequestContext, procsrv extproc.ExternalProcessor_ProcessServer) error {
+// Step 5. Response body: Sent according to the processing mode like the request body.
+// Only the processors implementing processor.ResponseBodyProcessor are called.
+func (svc *ExtProcessor) responseBodyMessage(ctx context.Context, req *processor.RequestContext, body *extproc.HttpBody, procsrv extproc.ExternalProcessor_ProcessServer) error {
+	crw := processor.NewCommonResponseWriter()
+	ran := false
+	for i, p := range svc.Processors {
+		bp, ok := p.(processor.ResponseBodyProcessor)
+		state := svc.processorState(i)
+		if !ok || state.disabled.Load() {
+			continue
+		}
+		ran = true
+		state.responseBody.Add(1)
+		if state.shadow.Load() {
+			svc.shadow(ctx, "ResponseBody", i, req, bodyPhase(bp.ResponseBody, body))
+			continue
+		}
+		immediateResponse, err := bp.ResponseBody(ctx, crw, req, body)
+		if err != nil {
+			state.errors.Add(1)
+			return fmt.Errorf("ResponseBody: failed running processor %T: %w", p, err)
+		}
+		if immediateResponse != nil {
+			state.immediateResponses.Add(1)
+			return sendImmediateResponse(procsrv, immediateResponse)
+		}
+		if err := crw.CommonResponse().Validate(); err != nil {
+			return fmt.Errorf("ResponseBody: failed validating response in processor %T: %w", p, err)
+		}
+		body = mutatedBody(body, crw)
+	}
+	// Without body processors the body is acknowledged without any CommonResponse.
 	r := &extproc.ProcessingResponse{
 		Response: &extproc.ProcessingResponse_ResponseBody{},
 	}
+	if ran {
+		r.Response = &extproc.ProcessingResponse_ResponseBody{
+			ResponseBody: &extproc.BodyResponse{
+				Response: crw.CommonResponse(),
+			},
+		}
+	}
+	if err := r.ValidateAll(); err != nil {
+		return fmt.Errorf("ResponseBody: failed validating response: %w", err)
+	}
 	if err := procsrv.Send(r); err != nil {
 		return fmt.Errorf("ResponseBody: failed sending response: %w", err)
 	}
@@ -186,3 +355,67 @@ func (svc *ExtProcessor) responseTrailersMessage(_ context.Context, _ *processor
 	}
 	return nil
 }
+
+// sendImmediateResponse sends the immediate response which ends the processing of the stream: Envoy replies to the
+// client without sending further messages.
+func sendImmediateResponse(procsrv extproc.ExternalProcessor_ProcessServer, immediateResponse *extproc.ProcessingResponse_ImmediateResponse) error {
+	if err := procsrv.Send(&extproc.ProcessingResponse{Response: immediateResponse}); err != nil {
+		return fmt.Errorf("failed sending immediate response: %w", err)
+	}
+	return errProcessingEnded
+}
+
+// mutatedBody returns the body the next processor sees once the body mutation of the writer is applied.
+func mutatedBody(body *extproc.HttpBody, crw *processor.CommonResponseWriter) *extproc.HttpBody {
+	switch m := crw.CommonResponse().GetBodyMutation().GetMutation().(type) {
+	case *extproc.BodyMutation_Body:
+		return &extproc.HttpBody{Body: m.Body, EndOfStream: body.GetEndOfStream()}
+	case *extproc.BodyMutation_ClearBody:
+		if m.ClearBody {
+			return &extproc.HttpBody{EndOfStream: body.GetEndOfStream()}
+		}
+	}
+	return body
+}
+
+// discardResponses is used for messages sent in async mode, which must not be replied.
+type discardResponses struct {
+	extproc.ExternalProcessor_ProcessServer
+}
+
+func (discardResponses) Send(*extproc.ProcessingResponse) error {
+	return nil
+}
+
+// bodySizes are the sizes of the request and response bodies received so far on a stream.
+type bodySizes struct {
+	request, response int
+}
+
+// bodyTooLarge adds the body of the message to the sizes of the stream and reports whether it exceeds MaxBodySize.
+func (svc *ExtProcessor) bodyTooLarge(sizes *bodySizes, procreq *extproc.ProcessingRequest) bool {
+	if svc.MaxBodySize <= 0 {
+		return false
+	}
+	if body := procreq.GetRequestBody(); body != nil {
+		sizes.request += len(body.GetBody())
+		return sizes.request > svc.MaxBodySize
+	}
+	if body := procreq.GetResponseBody(); body != nil {
+		sizes.response += len(body.GetBody())
+		return sizes.response > svc.MaxBodySize
+	}
+	return false
+}
+
+// payloadTooLarge builds the immediate response sent to Envoy when a body exceeds MaxBodySize.
+func payloadTooLarge() *extproc.ProcessingResponse {
+	return &extproc.ProcessingResponse{
+		Response: &extproc.ProcessingResponse_ImmediateResponse{
+			ImmediateResponse: &extproc.ImmediateResponse{
+				Status:  &typev3.HttpStatus{Code: typev3.StatusCode_PayloadTooLarge},
+				Details: "ext_proc_message_too_large",
+			},
+		},
+	}
+}
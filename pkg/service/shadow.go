@@ -0,0 +1,78 @@
+package service
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/cainelli/ext-proc/pkg/service/processor"
+	extproc "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+)
+
+// phaseFunc is a phase method of a processor, such as Processor.RequestHeaders.
+type phaseFunc func(ctx context.Context, crw *processor.CommonResponseWriter, req *processor.RequestContext) (*extproc.ProcessingResponse_ImmediateResponse, error)
+
+// bodyPhase binds the body to a body phase method so it runs like the header phases.
+func bodyPhase(run func(context.Context, *processor.CommonResponseWriter, *processor.RequestContext, *extproc.HttpBody) (*extproc.ProcessingResponse_ImmediateResponse, error), body *extproc.HttpBody) phaseFunc {
+	return func(ctx context.Context, crw *processor.CommonResponseWriter, req *processor.RequestContext) (*extproc.ProcessingResponse_ImmediateResponse, error) {
+		return run(ctx, crw, req, body)
+	}
+}
+
+// shadow runs a processor in shadow mode: it gets its own CommonResponseWriter which is never sent and a copy of the
+// metadata which is discarded, its mutations and immediate responses are only logged and counted and its errors do not
+// fail the stream. Only the keys of the headers it would set are logged, their values may hold credentials.
+func (svc *ExtProcessor) shadow(ctx context.Context, phase string, index int, req *processor.RequestContext, run phaseFunc) {
+	state := svc.processorState(index)
+	name := processor.Name(svc.Processors[index])
+	crw := processor.NewCommonResponseWriter()
+	restore := req.IsolateMetadata()
+	immediateResponse, err := run(ctx, crw, req)
+	restore()
+	if err != nil {
+		state.errors.Add(1)
+		slog.Warn("shadow processor failed", "processor", name, "phase", phase, "request-id", req.RequestID(), "error", err)
+		return
+	}
+	if immediateResponse != nil {
+		state.shadowImmediateResponses.Add(1)
+		immediate := immediateResponse.ImmediateResponse
+		slog.Info("shadow processor would reply",
+			"processor", name,
+			"phase", phase,
+			"request-id", req.RequestID(),
+			"status", immediate.GetStatus().GetCode().String(),
+			"details", immediate.GetDetails(),
+		)
+		return
+	}
+	common := crw.CommonResponse()
+	if !hasMutations(common) {
+		return
+	}
+	state.shadowMutations.Add(1)
+	mutation := common.GetHeaderMutation()
+	setHeaders := make([]string, 0, len(mutation.GetSetHeaders()))
+	for _, option := range mutation.GetSetHeaders() {
+		setHeaders = append(setHeaders, option.GetHeader().GetKey())
+	}
+	slog.Info("shadow processor would mutate",
+		"processor", name,
+		"phase", phase,
+		"request-id", req.RequestID(),
+		"set-headers", setHeaders,
+		"remove-headers", mutation.GetRemoveHeaders(),
+		"status", common.GetStatus().String(),
+		"body-mutation", common.GetBodyMutation().GetMutation() != nil,
+		"clear-route-cache", common.GetClearRouteCache(),
+	)
+}
+
+// hasMutations reports whether the response changes anything in the request or response.
+func hasMutations(common *extproc.CommonResponse) bool {
+	return len(common.GetHeaderMutation().GetSetHeaders()) > 0 ||
+		len(common.GetHeaderMutation().GetRemoveHeaders()) > 0 ||
+		common.GetStatus() != extproc.CommonResponse_CONTINUE ||
+		common.GetBodyMutation().GetMutation() != nil ||
+		len(common.GetTrailers().GetHeaders()) > 0 ||
+		common.GetClearRouteCache()
+}
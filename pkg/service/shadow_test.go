@@ -0,0 +1,120 @@
+package service_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/cainelli/ext-proc/pkg/service"
+	"github.com/cainelli/ext-proc/pkg/service/processor"
+	"github.com/cainelli/ext-proc/pkg/service/processortest"
+	extproc "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+)
+
+func TestShadow(t *testing.T) {
+	svc := &service.ExtProcessor{Processors: []processor.Processor{
+		&scriptedProcessor{
+			requestHeaders: immediate(typev3.StatusCode_Forbidden),
+			responseHeaders: func(crw *processor.CommonResponseWriter, _ *processor.RequestContext) (*extproc.ProcessingResponse_ImmediateResponse, error) {
+				crw.HeaderSet("x-shadow", "1")
+				return nil, errors.New("ignored in shadow mode")
+			},
+		},
+		&scriptedProcessor{
+			responseHeaders: func(crw *processor.CommonResponseWriter, _ *processor.RequestContext) (*extproc.ProcessingResponse_ImmediateResponse, error) {
+				crw.HeaderSet("x-shadow", "1")
+				return nil, nil
+			},
+		},
+		&scriptedProcessor{
+			responseHeaders: func(crw *processor.CommonResponseWriter, _ *processor.RequestContext) (*extproc.ProcessingResponse_ImmediateResponse, error) {
+				crw.HeaderSet("x-enforced", "1")
+				return nil, nil
+			},
+		},
+	}}
+	for _, index := range []int{0, 1} {
+		if err := svc.SetProcessorShadow(index, true); err != nil {
+			t.Fatalf("SetProcessorShadow(%d) = %v", index, err)
+		}
+	}
+
+	result := processortest.MustRun(t, svc, testRequest, testResponse)
+	if result.ImmediateResponse != nil {
+		t.Fatalf("the immediate response of a shadow processor was sent: %v", result.ImmediateResponse)
+	}
+	if got := result.Response.Header.Get("x-shadow"); got != "" {
+		t.Errorf("the mutation of a shadow processor was sent: x-shadow = %q", got)
+	}
+	if got := result.Response.Header.Get("x-enforced"); got != "1" {
+		t.Errorf("x-enforced = %q, want the mutation of the enforced processor", got)
+	}
+
+	infos := svc.ProcessorsInfo()
+	if got := infos[0].Counters; got.ShadowImmediateResponses != 1 || got.Errors != 1 || got.ImmediateResponses != 0 {
+		t.Errorf("shadow processor counters = %+v", got)
+	}
+	if got := infos[1].Counters; got.ShadowMutations != 1 {
+		t.Errorf("shadow processor counters = %+v", got)
+	}
+	if !infos[0].Shadow || !infos[1].Shadow || infos[2].Shadow {
+		t.Errorf("shadow flags = %v, %v, %v", infos[0].Shadow, infos[1].Shadow, infos[2].Shadow)
+	}
+}
+
+func TestShadowIsolation(t *testing.T) {
+	var logs bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+
+	var seen any
+	svc := &service.ExtProcessor{Processors: []processor.Processor{
+		&scriptedProcessor{
+			requestHeaders: func(_ *processor.CommonResponseWriter, req *processor.RequestContext) (*extproc.ProcessingResponse_ImmediateResponse, error) {
+				req.Metadata()["user"] = "alice"
+				return nil, nil
+			},
+		},
+		&scriptedProcessor{
+			requestHeaders: func(crw *processor.CommonResponseWriter, req *processor.RequestContext) (*extproc.ProcessingResponse_ImmediateResponse, error) {
+				seen = req.Metadata()["user"]
+				req.Metadata()["user"] = "mallory"
+				req.Metadata()["shadow"] = true
+				crw.HeaderSet("authorization", "Bearer s3cr3t")
+				return nil, nil
+			},
+		},
+		&scriptedProcessor{
+			responseHeaders: func(crw *processor.CommonResponseWriter, req *processor.RequestContext) (*extproc.ProcessingResponse_ImmediateResponse, error) {
+				crw.HeaderSet("x-user", fmt.Sprint(req.Metadata()["user"]))
+				crw.HeaderSet("x-shadow", fmt.Sprint(req.Metadata()["shadow"]))
+				return nil, nil
+			},
+		},
+	}}
+	if err := svc.SetProcessorShadow(1, true); err != nil {
+		t.Fatalf("SetProcessorShadow(1) = %v", err)
+	}
+
+	result := processortest.MustRun(t, svc, testRequest, testResponse)
+	if seen != "alice" {
+		t.Errorf("shadow processor saw user %v, want the metadata of the previous processors", seen)
+	}
+	if got := result.Response.Header.Get("x-user"); got != "alice" {
+		t.Errorf("x-user = %q, want the metadata written by the shadow processor discarded", got)
+	}
+	if got := result.Response.Header.Get("x-shadow"); got != "<nil>" {
+		t.Errorf("x-shadow = %q, want the metadata written by the shadow processor discarded", got)
+	}
+
+	if !strings.Contains(logs.String(), "authorization") {
+		t.Errorf("the shadow mutation was not logged: %s", logs.String())
+	}
+	if strings.Contains(logs.String(), "s3cr3t") {
+		t.Errorf("the shadow mutation values were logged: %s", logs.String())
+	}
+}
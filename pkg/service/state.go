@@ -0,0 +1,135 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/cainelli/ext-proc/pkg/service/processor"
+)
+
+// processorState holds the runtime state of a processor in the chain.
+type processorState struct {
+	disabled                 atomic.Bool
+	shadow                   atomic.Bool
+	requestHeaders           atomic.Uint64
+	responseHeaders          atomic.Uint64
+	requestBody              atomic.Uint64
+	responseBody             atomic.Uint64
+	immediateResponses       atomic.Uint64
+	errors                   atomic.Uint64
+	shadowMutations          atomic.Uint64
+	shadowImmediateResponses atomic.Uint64
+}
+
+// ProcessorInfo describes a processor of the chain and its runtime state.
+type ProcessorInfo struct {
+	Index    int               `json:"index"`
+	Name     string            `json:"name"`
+	Type     string            `json:"type"`
+	Enabled  bool              `json:"enabled"`
+	Shadow   bool              `json:"shadow"`
+	Options  any               `json:"options,omitempty"`
+	Counters ProcessorCounters `json:"counters"`
+}
+
+// ProcessorCounters counts the calls made to a processor since the server started.
+type ProcessorCounters struct {
+	RequestHeaders     uint64 `json:"request_headers"`
+	ResponseHeaders    uint64 `json:"response_headers"`
+	RequestBody        uint64 `json:"request_body"`
+	ResponseBody       uint64 `json:"response_body"`
+	ImmediateResponses uint64 `json:"immediate_responses"`
+	Errors             uint64 `json:"errors"`
+	// ShadowMutations and ShadowImmediateResponses count the responses a processor in shadow mode would have sent.
+	ShadowMutations          uint64 `json:"shadow_mutations"`
+	ShadowImmediateResponses uint64 `json:"shadow_immediate_responses"`
+}
+
+// ProcessorsInfo returns the processors in the order they run with their options and counters.
+func (svc *ExtProcessor) ProcessorsInfo() []ProcessorInfo {
+	infos := make([]ProcessorInfo, 0, len(svc.Processors))
+	for i, p := range svc.Processors {
+		state := svc.processorState(i)
+		info := ProcessorInfo{
+			Index:   i,
+			Name:    processor.Name(p),
+			Type:    fmt.Sprintf("%T", p),
+			Enabled: !state.disabled.Load(),
+			Shadow:  state.shadow.Load(),
+			Counters: ProcessorCounters{
+				RequestHeaders:           state.requestHeaders.Load(),
+				ResponseHeaders:          state.responseHeaders.Load(),
+				RequestBody:              state.requestBody.Load(),
+				ResponseBody:             state.responseBody.Load(),
+				ImmediateResponses:       state.immediateResponses.Load(),
+				Errors:                   state.errors.Load(),
+				ShadowMutations:          state.shadowMutations.Load(),
+				ShadowImmediateResponses: state.shadowImmediateResponses.Load(),
+			},
+		}
+		if describer, ok := p.(processor.Describer); ok {
+			info.Options = describer.Describe()
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+// SetProcessorEnabled enables or disables the processor at the given index at runtime.
+// Disabled processors are skipped for every new message until they are enabled again.
+func (svc *ExtProcessor) SetProcessorEnabled(index int, enabled bool) error {
+	if index < 0 || index >= len(svc.Processors) {
+		return fmt.Errorf("processor index %d out of range [0, %d)", index, len(svc.Processors))
+	}
+	svc.processorState(index).disabled.Store(!enabled)
+	return nil
+}
+
+// SetProcessorShadow puts the processor at the given index in shadow mode or back to enforcing at runtime.
+// In shadow mode the processor still runs but its mutations and immediate responses are only logged and counted,
+// nothing it does reaches Envoy.
+func (svc *ExtProcessor) SetProcessorShadow(index int, shadow bool) error {
+	if index < 0 || index >= len(svc.Processors) {
+		return fmt.Errorf("processor index %d out of range [0, %d)", index, len(svc.Processors))
+	}
+	svc.processorState(index).shadow.Store(shadow)
+	return nil
+}
+
+// ProcessorAction runs an action of the processor at the given index, see processor.Actioner.
+func (svc *ExtProcessor) ProcessorAction(ctx context.Context, index int, action string) (any, error) {
+	if index < 0 || index >= len(svc.Processors) {
+		return nil, fmt.Errorf("processor index %d out of range [0, %d)", index, len(svc.Processors))
+	}
+	actioner, ok := svc.Processors[index].(processor.Actioner)
+	if !ok {
+		return nil, fmt.Errorf("processor %s has no actions", processor.Name(svc.Processors[index]))
+	}
+	return actioner.Action(ctx, action)
+}
+
+// ProcessorIndex resolves the id of a processor, which is either its index in the chain or its case insensitive name.
+func (svc *ExtProcessor) ProcessorIndex(id string) (int, bool) {
+	if index, err := strconv.Atoi(id); err == nil {
+		return index, index >= 0 && index < len(svc.Processors)
+	}
+	for i, p := range svc.Processors {
+		if strings.EqualFold(processor.Name(p), id) {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+func (svc *ExtProcessor) processorState(index int) *processorState {
+	svc.statesOnce.Do(func() {
+		svc.states = make([]*processorState, len(svc.Processors))
+		for i := range svc.states {
+			svc.states[i] = &processorState{}
+		}
+	})
+	return svc.states[index]
+}